@@ -0,0 +1,397 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultCacheListLimit = 100
+	maxCacheListLimit     = 1000
+)
+
+// cacheListItem describes one cached entry in admin listings.
+type cacheListItem struct {
+	URL       string    `json:"url"`
+	File      string    `json:"file"`
+	SizeBytes int64     `json:"size_bytes"`
+	BodyBytes int       `json:"body_bytes"`
+	Status    int       `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Expired   bool      `json:"expired"`
+}
+
+type cacheListFilter struct {
+	// Prefix matches the start of the entry URL path, or of the full URL when absolute.
+	Prefix      string
+	ExpiredOnly bool
+	// Scope limits entries to the hosts of some tenants.
+	Scope *tenantScope
+}
+
+type cacheListPage struct {
+	Total   int             `json:"total"`
+	Offset  int             `json:"offset"`
+	Limit   int             `json:"limit"`
+	Entries []cacheListItem `json:"entries"`
+}
+
+// listCacheEntries returns the indexed cache entries matching f, sorted by URL.
+func listCacheEntries(cacheDir string, f cacheListFilter) []cacheListItem {
+	ix := cacheIndexFor(cacheDir)
+	entries := ix.snapshot()
+	now := time.Now().Unix()
+	out := make([]cacheListItem, 0, len(entries))
+	for _, e := range entries {
+		expired := now >= e.ExpiresAt
+		if f.ExpiredOnly && !expired {
+			continue
+		}
+		if f.Prefix != "" && !cacheURLHasPrefix(e.URL, f.Prefix) {
+			continue
+		}
+		if !f.Scope.allowsURL(e.URL) {
+			continue
+		}
+		out = append(out, cacheListItem{
+			URL:       e.URL,
+			File:      ix.path(e),
+			SizeBytes: e.SizeBytes,
+			BodyBytes: e.BodyBytes,
+			Status:    e.Status,
+			CreatedAt: time.Unix(e.CreatedAt, 0).UTC(),
+			ExpiresAt: time.Unix(e.ExpiresAt, 0).UTC(),
+			Expired:   expired,
+		})
+	}
+	return out
+}
+
+func cacheURLHasPrefix(rawURL, prefix string) bool {
+	if strings.Contains(prefix, "://") {
+		return strings.HasPrefix(rawURL, prefix)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return strings.HasPrefix(u.RequestURI(), prefix)
+}
+
+// paginateCacheEntries slices items by offset/limit, clamping limit to maxCacheListLimit.
+func paginateCacheEntries(items []cacheListItem, offset, limit int) cacheListPage {
+	if limit <= 0 {
+		limit = defaultCacheListLimit
+	}
+	if limit > maxCacheListLimit {
+		limit = maxCacheListLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	page := cacheListPage{Total: len(items), Offset: offset, Limit: limit, Entries: []cacheListItem{}}
+	if offset >= len(items) {
+		return page
+	}
+	end := offset + limit
+	if end > len(items) {
+		end = len(items)
+	}
+	page.Entries = items[offset:end]
+	return page
+}
+
+// handleAdminCacheList serves GET /admin/cache/list?prefix=/blog/&expired=1&offset=0&limit=100.
+func handleAdminCacheList(cfg *Config, w http.ResponseWriter, r *http.Request, sc *tenantScope) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	f := cacheListFilter{
+		Prefix:      q.Get("prefix"),
+		ExpiredOnly: q.Get("expired") == "1" || strings.ToLower(q.Get("expired")) == "true",
+		Scope:       sc,
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	page := paginateCacheEntries(listCacheEntries(cfg.CacheDir, f), offset, limit)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// cacheEntryDetail is the admin view of a single cache entry.
+type cacheEntryDetail struct {
+	URL                  string            `json:"url"`
+	File                 string            `json:"file"`
+	Status               int               `json:"status"`
+	Header               map[string]string `json:"header"`
+	CreatedAt            time.Time         `json:"created_at"`
+	ExpiresAt            time.Time         `json:"expires_at"`
+	Expired              bool              `json:"expired"`
+	TTLRemainingSeconds  int64             `json:"ttl_remaining_seconds"`
+	BodyBytes            int               `json:"body_bytes"`
+	UpstreamETag         string            `json:"upstream_etag,omitempty"`
+	UpstreamLastModified string            `json:"upstream_last_modified,omitempty"`
+	Body                 *string           `json:"body,omitempty"`
+	BodyBase64           []byte            `json:"body_base64,omitempty"`
+}
+
+// cacheQueryFileRe matches the cache files of query-string variants:
+// index.<hash8>.json and their vary variants index.<hash8>@<variant>.json.
+var cacheQueryFileRe = regexp.MustCompile(`^index\.[0-9a-f]{8}(@[a-z0-9-]+)?\.json$`)
+
+// cacheQueryVariants lists the query-string variants cached beside p, the
+// default cache file of a URL without a query, and their URLs. With query
+// set, only those whose query string matches it (see queryMatches) are
+// listed.
+func cacheQueryVariants(p, query string) (files, urls []string) {
+	dir := filepath.Dir(p)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil
+	}
+	for _, e := range entries {
+		if e.IsDir() || !cacheQueryFileRe.MatchString(e.Name()) {
+			continue
+		}
+		f := filepath.Join(dir, e.Name())
+		ce, err := readCacheMeta(f)
+		if err != nil {
+			continue
+		}
+		if query != "" {
+			u, err := url.Parse(ce.URL)
+			if err != nil || !queryMatches(query, u.RawQuery) {
+				continue
+			}
+		}
+		files = append(files, f)
+		urls = append(urls, ce.URL)
+	}
+	return files, urls
+}
+
+// queryMatches reports whether the glob pattern matches the raw query string
+// or one of its key=value parameters, so "color=*" selects every variant with
+// a color parameter.
+func queryMatches(pattern, rawQuery string) bool {
+	if ok, _ := path.Match(pattern, rawQuery); ok {
+		return true
+	}
+	for _, kv := range strings.Split(rawQuery, "&") {
+		if ok, _ := path.Match(pattern, kv); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBTarget maps a path to an absolute URL on the B site; absolute URLs are returned as-is.
+func resolveBTarget(cfg *Config, q string) string {
+	if u, err := url.Parse(q); err == nil && u.Scheme != "" {
+		return q
+	}
+	if !strings.HasPrefix(q, "/") {
+		q = "/" + q
+	}
+	return strings.TrimRight(cfg.BBaseURL, "/") + q
+}
+
+// handleAdminCacheEntry serves GET /admin/cache/entry?url=...&body=1[&variant=mobile-de].
+func handleAdminCacheEntry(cfg *Config, w http.ResponseWriter, r *http.Request, sc *tenantScope) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query().Get("url")
+	if q == "" {
+		http.Error(w, "missing url", http.StatusBadRequest)
+		return
+	}
+	target := resolveBTarget(cfg, q)
+	if !sc.allowsURL(target) {
+		errOutsideTenants(w)
+		return
+	}
+	variant := r.URL.Query().Get("variant")
+	p, err := cacheFilePathForVariant(cfg.CacheDir, target, variant)
+	if err != nil {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	ce, err := readStaleCacheVariant(cfg.CacheDir, target, variant)
+	if err != nil {
+		http.Error(w, "not cached", http.StatusNotFound)
+		return
+	}
+	now := time.Now().Unix()
+	d := cacheEntryDetail{
+		URL:                  ce.URL,
+		File:                 p,
+		Status:               ce.Status,
+		Header:               ce.Header,
+		CreatedAt:            time.Unix(ce.CreatedAt, 0).UTC(),
+		ExpiresAt:            time.Unix(ce.ExpiresAt, 0).UTC(),
+		Expired:              now >= ce.ExpiresAt,
+		BodyBytes:            len(ce.Body),
+		UpstreamETag:         ce.UpstreamETag,
+		UpstreamLastModified: ce.UpstreamLastModified,
+	}
+	if !d.Expired {
+		d.TTLRemainingSeconds = ce.ExpiresAt - now
+	}
+	if v := r.URL.Query().Get("body"); v == "1" || strings.ToLower(v) == "true" {
+		if utf8.Valid(ce.Body) {
+			body := string(ce.Body)
+			d.Body = &body
+		} else {
+			d.BodyBase64 = ce.Body
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d)
+}
+
+// bulkPurgeFilter selects cache entries for a bulk purge. Patterns use the same
+// glob syntax as CACHE_PATTERNS and match the entry URL path, so every query
+// variant of a page is included. Tags match entries carrying any of them (see
+// cacheTagsFor). URIRegex matches the entry's request URI (path and query).
+// All filters that are set must match. Scope limits the purge to the hosts
+// of some tenants.
+type bulkPurgeFilter struct {
+	Patterns  []string
+	OlderThan time.Duration
+	Tags      []string
+	URIRegex  *regexp.Regexp
+	Scope     *tenantScope
+}
+
+// describe renders f for the purge log, e.g. "pattern=/blog/* older_than=24h0m0s".
+func (f bulkPurgeFilter) describe() string {
+	var parts []string
+	for _, p := range f.Patterns {
+		parts = append(parts, "pattern="+p)
+	}
+	for _, t := range f.Tags {
+		parts = append(parts, "tag="+t)
+	}
+	if f.OlderThan > 0 {
+		parts = append(parts, "older_than="+f.OlderThan.String())
+	}
+	if f.URIRegex != nil {
+		parts = append(parts, "regex="+f.URIRegex.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// doBulkPurge removes cache entries matching f. Each deleted entry is counted
+// under the first pattern and the first tag it matched.
+func doBulkPurge(cfg *Config, f bulkPurgeFilter) purgeResult {
+	res := purgeResult{Files: []string{}}
+	if len(f.Patterns) > 0 {
+		res.ByPattern = make(map[string]int, len(f.Patterns))
+		for _, p := range f.Patterns {
+			res.ByPattern[p] = 0
+		}
+	}
+	if len(f.Tags) > 0 {
+		res.ByTag = make(map[string]int, len(f.Tags))
+		for _, t := range f.Tags {
+			res.ByTag[t] = 0
+		}
+	}
+	ix := cacheIndexFor(cfg.CacheDir)
+	cutoff := time.Now().Add(-f.OlderThan).Unix()
+	for _, e := range ix.snapshot() {
+		matched, tag, ok := f.match(e.URL, e.Tags, e.CreatedAt, cutoff)
+		if !ok {
+			continue
+		}
+		p := ix.path(e)
+		if err := removeCacheFile(cfg.CacheDir, p); err != nil {
+			continue
+		}
+		res.Deleted++
+		res.Files = append(res.Files, p)
+		res.urls = append(res.urls, e.URL)
+		if matched != "" {
+			res.ByPattern[matched]++
+		}
+		if tag != "" {
+			res.ByTag[tag]++
+		}
+	}
+	if rc := remoteCacheFor(cfg.CacheDir); rc != nil {
+		rc.purgeMatching("", func(ce *cacheEntry) bool {
+			_, _, ok := f.match(ce.URL, ce.Tags, ce.CreatedAt, cutoff)
+			return ok
+		})
+	}
+	return res
+}
+
+// match reports whether the entry of rawURL with tags, created at createdAt,
+// is selected by f, with the pattern and tag it matched first. Entries must be
+// created at cutoff or earlier when f.OlderThan is set.
+func (f bulkPurgeFilter) match(rawURL string, tags []string, createdAt, cutoff int64) (pattern, tag string, ok bool) {
+	if f.OlderThan > 0 && createdAt > cutoff {
+		return "", "", false
+	}
+	if !f.Scope.allowsURL(rawURL) {
+		return "", "", false
+	}
+	if len(f.Tags) > 0 {
+		if tag = firstSharedTag(f.Tags, tags); tag == "" {
+			return "", "", false
+		}
+	}
+	if f.URIRegex == nil && len(f.Patterns) == 0 {
+		return "", tag, true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (f.URIRegex != nil && !f.URIRegex.MatchString(u.RequestURI())) {
+		return "", "", false
+	}
+	if len(f.Patterns) == 0 {
+		return "", tag, true
+	}
+	for _, pat := range f.Patterns {
+		if patternsMatch([]string{pat}, u.EscapedPath()) {
+			return pat, tag, true
+		}
+	}
+	return "", "", false
+}
+
+// parseAgeDuration parses a Go duration, additionally accepting a whole-day
+// suffix such as "7d".
+func parseAgeDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
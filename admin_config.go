@@ -0,0 +1,386 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// redactedValue replaces secrets in config dumps.
+const redactedValue = "***"
+
+// hotConfigFields are the config.json keys /admin/config may change at
+// runtime, with how each is copied from a decoded patch. Everything else
+// (listen address, cache dir, timeouts, logging) needs a restart.
+var hotConfigFields = map[string]func(dst, src *Config){
+	"cache_ttl_seconds":              func(dst, src *Config) { dst.CacheTTLSeconds = src.CacheTTLSeconds },
+	"cache_ttl_rules":                func(dst, src *Config) { dst.CacheTTLRules = src.CacheTTLRules },
+	"cache_all":                      func(dst, src *Config) { dst.CacheAll = src.CacheAll },
+	"cache_assets":                   func(dst, src *Config) { dst.CacheAssets = src.CacheAssets },
+	"cache_patterns":                 func(dst, src *Config) { dst.CachePatterns = src.CachePatterns },
+	"cache_tag_rules":                func(dst, src *Config) { dst.CacheTagRules = src.CacheTagRules },
+	"redirect_status":                func(dst, src *Config) { dst.RedirectStatus = src.RedirectStatus },
+	"header_rules":                   func(dst, src *Config) { dst.HeaderRules = src.HeaderRules },
+	"maintenance_mode":               func(dst, src *Config) { dst.MaintenanceMode = src.MaintenanceMode },
+	"maintenance_retry_after":        func(dst, src *Config) { dst.MaintenanceRetryAfter = src.MaintenanceRetryAfter },
+	"bot_stats_retention_hours":      func(dst, src *Config) { dst.BotStatsRetentionHours = src.BotStatsRetentionHours },
+	"readyz_checks":                  func(dst, src *Config) { dst.ReadyzChecks = src.ReadyzChecks },
+	"readyz_upstream_path":           func(dst, src *Config) { dst.ReadyzUpstreamPath = src.ReadyzUpstreamPath },
+	"error_pages":                    func(dst, src *Config) { dst.ErrorPages = src.ErrorPages },
+	"redirect_rules":                 func(dst, src *Config) { dst.RedirectRules = src.RedirectRules },
+	"human_mode":                     func(dst, src *Config) { dst.HumanMode = src.HumanMode },
+	"human_rules":                    func(dst, src *Config) { dst.HumanRules = src.HumanRules },
+	"block_rules":                    func(dst, src *Config) { dst.BlockRules = src.BlockRules },
+	"serve_stale_on_error":           func(dst, src *Config) { dst.ServeStaleOnError = src.ServeStaleOnError },
+	"inject_canonical":               func(dst, src *Config) { dst.InjectCanonical = src.InjectCanonical },
+	"strip_selectors":                func(dst, src *Config) { dst.StripSelectors = src.StripSelectors },
+	"minify_responses":               func(dst, src *Config) { dst.MinifyResponses = src.MinifyResponses },
+	"transformers":                   func(dst, src *Config) { dst.Transformers = src.Transformers },
+	"transform_hook_timeout_seconds": func(dst, src *Config) { dst.TransformHookTimeoutSeconds = src.TransformHookTimeoutSeconds },
+	"structured_data":                func(dst, src *Config) { dst.StructuredData = src.StructuredData },
+	"robots_policies":                func(dst, src *Config) { dst.RobotsPolicies = src.RobotsPolicies },
+	"header_policies":                func(dst, src *Config) { dst.HeaderPolicies = src.HeaderPolicies },
+	"prefetch_subresources":          func(dst, src *Config) { dst.PrefetchSubresources = src.PrefetchSubresources },
+	"prefetch_subresources_max":      func(dst, src *Config) { dst.PrefetchSubresourcesMax = src.PrefetchSubresourcesMax },
+	"upstream_ua_mode":               func(dst, src *Config) { dst.UpstreamUAMode = src.UpstreamUAMode },
+	"upstream_ua_families":           func(dst, src *Config) { dst.UpstreamUAFamilies = src.UpstreamUAFamilies },
+	"render_service_url":             func(dst, src *Config) { dst.RenderServiceURL = src.RenderServiceURL },
+	"render_patterns":                func(dst, src *Config) { dst.RenderPatterns = src.RenderPatterns },
+	"render_timeout_seconds":         func(dst, src *Config) { dst.RenderTimeoutSeconds = src.RenderTimeoutSeconds },
+	"bot_ua_include":                 func(dst, src *Config) { dst.BotUAInclude = src.BotUAInclude },
+	"bot_ua_exclude":                 func(dst, src *Config) { dst.BotUAExclude = src.BotUAExclude },
+	"bad_bot_ua":                     func(dst, src *Config) { dst.BadBotUA = src.BadBotUA },
+	"bad_bot_action":                 func(dst, src *Config) { dst.BadBotAction = src.BadBotAction },
+	"bad_bot_tarpit_seconds":         func(dst, src *Config) { dst.BadBotTarpitSeconds = src.BadBotTarpitSeconds },
+	"challenge_mode":                 func(dst, src *Config) { dst.ChallengeMode = src.ChallengeMode },
+	"challenge_pass_minutes":         func(dst, src *Config) { dst.ChallengePassMinutes = src.ChallengePassMinutes },
+	"geo_rules":                      func(dst, src *Config) { dst.GeoRules = src.GeoRules },
+	"redirect_targets":               func(dst, src *Config) { dst.RedirectTargets = src.RedirectTargets },
+	"bot_allow_cidrs":                func(dst, src *Config) { dst.BotAllowCIDRs = src.BotAllowCIDRs },
+	"bot_deny_cidrs":                 func(dst, src *Config) { dst.BotDenyCIDRs = src.BotDenyCIDRs },
+	"trusted_proxies":                func(dst, src *Config) { dst.TrustedProxies = src.TrustedProxies },
+}
+
+func hotConfigFieldNames() []string {
+	out := make([]string, 0, len(hotConfigFields))
+	for k := range hotConfigFields {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// redactedConfig returns a copy of cfg safe to show in the admin API.
+func redactedConfig(cfg *Config) Config {
+	out := *cfg
+	for _, s := range []*string{&out.AdminToken, &out.AdminBasicAuthPassword, &out.WebhookSecret, &out.AdminUIPath, &out.RenderServiceToken, &out.CacheS3SecretAccessKey, &out.ChallengeSecret} {
+		if *s != "" {
+			*s = redactedValue
+		}
+	}
+	for _, s := range []*string{&out.BBaseURL, &out.ABaseURL, &out.StaticRedirectURL, &out.CacheS3URL, &out.LogHTTPURL, &out.LogLokiURL, &out.TracingEndpoint, &out.RenderServiceURL, &out.UpstreamProxyURL} {
+		*s = redactedURL(*s)
+	}
+	out.CacheS3AccessKeyID = maskedValue(cfg.CacheS3AccessKeyID)
+	if len(cfg.AdminTokens) != 0 {
+		out.AdminTokens = make([]AdminCredential, len(cfg.AdminTokens))
+		for i, c := range cfg.AdminTokens {
+			c.Token = redactedValue
+			out.AdminTokens[i] = c
+		}
+	}
+	out.UpstreamAuth = cfg.UpstreamAuth.redacted()
+	out.TracingHeaders = redactedHeaders(cfg.TracingHeaders)
+	out.LogShipHeaders = redactedHeaders(cfg.LogShipHeaders)
+	if len(cfg.Upstreams) != 0 {
+		out.Upstreams = make([]UpstreamMapping, len(cfg.Upstreams))
+		for i, m := range cfg.Upstreams {
+			m.Auth = m.Auth.redacted()
+			m.BBaseURL, m.ABaseURL = redactedURL(m.BBaseURL), redactedURL(m.ABaseURL)
+			out.Upstreams[i] = m
+		}
+	}
+	return out
+}
+
+// redactedURL hides the user:pass@ part of a URL setting. A value that does
+// not parse is hidden as a whole.
+func redactedURL(s string) string {
+	if s == "" {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User == nil {
+		return s
+	}
+	// url.User would percent-encode the placeholder
+	u.User = nil
+	return strings.Replace(u.String(), "//", "//"+redactedValue+"@", 1)
+}
+
+// maskedValue hides an identifier but its last four characters, enough to
+// tell which key is configured.
+func maskedValue(s string) string {
+	if len(s) <= 8 {
+		if s == "" {
+			return s
+		}
+		return redactedValue
+	}
+	return redactedValue + s[len(s)-4:]
+}
+
+// redactedHeaders keeps the names of h and hides the values.
+func redactedHeaders(h map[string]string) map[string]string {
+	if len(h) == 0 {
+		return h
+	}
+	out := make(map[string]string, len(h))
+	for k := range h {
+		out[k] = redactedValue
+	}
+	return out
+}
+
+// validateHotConfig checks the hot-reloadable fields of cfg.
+func validateHotConfig(cfg *Config) error {
+	if cfg.CacheTTLSeconds <= 0 {
+		return fmt.Errorf("cache_ttl_seconds must be positive")
+	}
+	if cfg.RedirectStatus < 300 || cfg.RedirectStatus >= 400 {
+		return fmt.Errorf("redirect_status must be 3xx")
+	}
+	if cfg.HumanMode != "" && !validHumanMode(cfg.HumanMode) {
+		return fmt.Errorf("human_mode must be redirect, proxy, cache or block")
+	}
+	for _, rule := range cfg.HumanRules {
+		if err := validateHumanRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, rule := range cfg.BlockRules {
+		if err := validateBlockRule(rule); err != nil {
+			return err
+		}
+	}
+	if cfg.BadBotAction != "" && !validBadBotAction(cfg.BadBotAction) {
+		return fmt.Errorf("bad_bot_action must be block, tarpit, fake or off")
+	}
+	if cfg.BadBotTarpitSeconds < 0 {
+		return fmt.Errorf("bad_bot_tarpit_seconds must not be negative")
+	}
+	if cfg.ChallengeMode != "" && !validChallengeMode(cfg.ChallengeMode) {
+		return fmt.Errorf("challenge_mode must be off, js or cookie")
+	}
+	if err := validateGeoRules(cfg.GeoRules); err != nil {
+		return err
+	}
+	if err := validateRedirectTargets(cfg.RedirectTargets); err != nil {
+		return fmt.Errorf("redirect_targets: %w", err)
+	}
+	if !validSubresourceMode(cfg.PrefetchSubresources) {
+		return fmt.Errorf("prefetch_subresources must be off, assets or all")
+	}
+	if err := validateRenderService(cfg); err != nil {
+		return err
+	}
+	for _, rule := range cfg.CacheTTLRules {
+		if rule.Regex != "" {
+			if _, err := compileTTLRegex(rule.Regex); err != nil {
+				return fmt.Errorf("invalid cache ttl rule regex %q: %w", rule.Regex, err)
+			}
+		}
+	}
+	for _, r := range cfg.CacheTagRules {
+		if r.Pattern == "" || len(r.Tags) == 0 {
+			return fmt.Errorf("cache tag rules need a pattern and tags")
+		}
+	}
+	for _, p := range cfg.RobotsPolicies {
+		if err := validateRobotsPolicy(p); err != nil {
+			return err
+		}
+	}
+	for _, r := range cfg.StructuredData {
+		if err := validateStructuredDataRule(r); err != nil {
+			return err
+		}
+	}
+	for _, sel := range cfg.StripSelectors {
+		if _, ok := parseHTMLSelector(sel); !ok {
+			return fmt.Errorf("invalid strip selector %q", sel)
+		}
+	}
+	if err := validateTransformers(cfg.Transformers); err != nil {
+		return err
+	}
+	if !validUpstreamUAMode(cfg.UpstreamUAMode) {
+		return fmt.Errorf("upstream_ua_mode must be fixed, passthrough or family")
+	}
+	if err := validateUAFamilies(cfg.UpstreamUAFamilies); err != nil {
+		return err
+	}
+	if cfg.MaintenanceRetryAfter < 0 {
+		return fmt.Errorf("maintenance_retry_after must not be negative")
+	}
+	if cfg.BotStatsRetentionHours < 0 {
+		return fmt.Errorf("bot_stats_retention_hours must not be negative")
+	}
+	if err := validateErrorPages(cfg.ErrorPages); err != nil {
+		return err
+	}
+	if err := validateReadyChecks(cfg.ReadyzChecks); err != nil {
+		return err
+	}
+	for _, rule := range cfg.HeaderRules {
+		if err := validateHeaderRule(rule); err != nil {
+			return err
+		}
+	}
+	for _, rule := range cfg.RedirectRules {
+		if err := validateRedirectRule(rule); err != nil {
+			return err
+		}
+	}
+	if err := validateHeaderPolicies(cfg.HeaderPolicies); err != nil {
+		return fmt.Errorf("invalid header_policies: %w", err)
+	}
+	if _, err := parseCIDRList(cfg.BotAllowCIDRs); err != nil {
+		return fmt.Errorf("invalid bot_allow_cidrs: %w", err)
+	}
+	if _, err := parseCIDRList(cfg.BotDenyCIDRs); err != nil {
+		return fmt.Errorf("invalid bot_deny_cidrs: %w", err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid trusted_proxies: %w", err)
+	}
+	return nil
+}
+
+// patchConfig returns a copy of cur with the hot fields in patch applied.
+// Unknown or restart-only keys are rejected.
+func patchConfig(cur *Config, patch map[string]json.RawMessage) (*Config, error) {
+	next := *cur
+	for k, raw := range patch {
+		set, ok := hotConfigFields[k]
+		if !ok {
+			return nil, fmt.Errorf("%s cannot be changed at runtime", k)
+		}
+		var src Config
+		if err := json.Unmarshal([]byte(fmt.Sprintf("{%q:%s}", k, raw)), &src); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", k, err)
+		}
+		set(&next, &src)
+	}
+	// Checked first: validating a plugin entry opens it
+	if err := validateTransformerPatch(cur.Transformers, next.Transformers); err != nil {
+		return nil, err
+	}
+	if err := validateHotConfig(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// persistConfigOverrides writes the patched keys into the config file at path,
+// keeping every other key (and the file mode) as it was.
+func persistConfigOverrides(path string, patch map[string]json.RawMessage) error {
+	doc := map[string]json.RawMessage{}
+	mode := os.FileMode(0o600)
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &doc); err != nil {
+			return fmt.Errorf("parse %s: %w", path, err)
+		}
+		if st, err := os.Stat(path); err == nil {
+			mode = st.Mode().Perm()
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for k, v := range patch {
+		doc[k] = v
+	}
+	b, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// handleAdminConfig serves /admin/config: GET returns the effective config
+// with secrets redacted; PATCH changes hot-reloadable fields, applies them
+// without a restart and persists them to the config file.
+func (a *appHandler) handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := a.config()
+	if !adminAuthorized(cfg, w, r) {
+		return
+	}
+	persisted := false
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, "read error", http.StatusBadRequest)
+			return
+		}
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal(body, &patch); err != nil || len(patch) == 0 {
+			http.Error(w, "expected a JSON object of config fields", http.StatusBadRequest)
+			return
+		}
+		a.reloadMu.Lock()
+		next, err := patchConfig(a.config(), patch)
+		if err != nil {
+			a.reloadMu.Unlock()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if next.configPath != "" {
+			if err := persistConfigOverrides(next.configPath, patch); err != nil {
+				a.reloadMu.Unlock()
+				logger.Errorw("admin_config_persist_error", map[string]interface{}{"req_id": getRequestID(r.Context()), "err": err.Error(), "file": next.configPath})
+				http.Error(w, "persist config: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			persisted = true
+		}
+		a.applyConfig(next)
+		a.reloadMu.Unlock()
+		keys := make([]string, 0, len(patch))
+		for k := range patch {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		logger.Infow("admin_config_updated", map[string]interface{}{"req_id": getRequestID(r.Context()), "fields": keys, "persisted": persisted})
+		changes := make(map[string]interface{}, len(patch))
+		for k, v := range patch {
+			changes[k] = v
+		}
+		auditNote(r, changes, map[string]interface{}{"persisted": persisted})
+		cfg = next
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"config":         redactedConfig(cfg),
+		"hot_reloadable": hotConfigFieldNames(),
+		"persisted":      persisted,
+	})
+}
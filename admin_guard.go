@@ -0,0 +1,149 @@
+package rerouter
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// authLockout counts failed admin authentications per client IP and locks a
+// client out once it reaches the threshold within the lockout window. The
+// state lives on appHandler so it survives config reloads.
+type authLockout struct {
+	mu      sync.Mutex
+	clients map[string]*authFailures
+}
+
+type authFailures struct {
+	count       int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+func newAuthLockout() *authLockout {
+	return &authLockout{clients: map[string]*authFailures{}}
+}
+
+// lockedFor returns how long ip stays locked out, or 0.
+func (l *authLockout) lockedFor(ip string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.clients[ip]; ok && now.Before(f.lockedUntil) {
+		return f.lockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// fail records a failed attempt by ip and reports whether it is now locked out.
+// Failures older than window are forgotten.
+func (l *authLockout) fail(ip string, threshold int, window time.Duration, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.clients) > 10000 {
+		for k, f := range l.clients {
+			if now.Sub(f.first) > window && now.After(f.lockedUntil) {
+				delete(l.clients, k)
+			}
+		}
+	}
+	f, ok := l.clients[ip]
+	if !ok {
+		f = &authFailures{}
+		l.clients[ip] = f
+	}
+	if now.Sub(f.first) > window {
+		f.count, f.first = 0, now
+	}
+	f.count++
+	if f.count < threshold {
+		return false
+	}
+	f.lockedUntil = now.Add(window)
+	f.count = 0
+	return true
+}
+
+// adminGuard applies the admin access controls in front of the admin routes:
+// client IP allowlist, optional HTTP basic auth (on top of the admin token) and
+// lockout after repeated authentication failures. Failures are the guard's own
+// basic auth rejections plus any 401/403 returned by the routes, such as a bad token.
+// A request with an admin UI session cookie and no X-Admin-Token header is
+// authenticated by the session, and must carry its CSRF token unless it is a
+// safe method. Requests that reach the routes with any other method, and
+// plugin purge requests, are written to the audit log.
+func adminGuard(cfg *Config, lock *authLockout, sessions *adminSessions, audit *auditLog, next http.Handler) http.Handler {
+	allow, _ := parseCIDRList(cfg.AdminAllowCIDRs) // validated in LoadConfig
+	window := time.Duration(cfg.AdminLockoutSeconds) * time.Second
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(cfg, r)
+		if len(allow) > 0 {
+			parsed := net.ParseIP(ip)
+			allowed := false
+			for _, n := range allow {
+				if parsed != nil && n.Contains(parsed) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				logger.Warnw("admin_ip_denied", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip, "path": r.URL.Path})
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		lockout := cfg.AdminLockoutThreshold > 0 && window > 0
+		if lockout {
+			if d := lock.lockedFor(ip, time.Now()); d > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(d.Seconds())+1))
+				http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+				return
+			}
+		}
+		failed := func(reason string) {
+			logger.Warnw("admin_auth_failed", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip, "path": r.URL.Path, "reason": reason})
+			if lockout && lock.fail(ip, cfg.AdminLockoutThreshold, window, time.Now()) {
+				logger.Warnw("admin_lockout", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip, "seconds": cfg.AdminLockoutSeconds})
+			}
+		}
+		if cfg.AdminBasicAuthUser != "" {
+			user, pass, ok := r.BasicAuth()
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(cfg.AdminBasicAuthUser)) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(cfg.AdminBasicAuthPassword)) == 1
+			if !ok || !userOK || !passOK {
+				failed("basic_auth")
+				w.Header().Set("WWW-Authenticate", `Basic realm="rerouter admin", charset="UTF-8"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Header.Get("X-Admin-Token") == "" {
+			if sess := sessions.lookup(cfg, r); sess != nil {
+				if !sess.csrfOK(r) {
+					logger.Warnw("admin_csrf_rejected", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip, "path": r.URL.Path})
+					http.Error(w, "invalid csrf token", http.StatusForbidden)
+					return
+				}
+				r = r.WithContext(withAdminSession(r.Context(), sess))
+			}
+		}
+		var entry *auditEntry
+		if auditedMethod(r.Method) || purgeProtocolRequest(r) {
+			entry = newAuditEntry(cfg, r, ip)
+			r = r.WithContext(withAudit(r.Context(), entry))
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if entry != nil {
+			entry.finish(cfg, r, sw.status)
+			audit.write(cfg.AuditLogFile, entry)
+		}
+		if sw.status == http.StatusUnauthorized || sw.status == http.StatusForbidden {
+			failed("token")
+		}
+	})
+}
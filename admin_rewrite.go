@@ -0,0 +1,157 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"rerouter/logger"
+)
+
+const (
+	// maxRewriteTestBytes bounds the request and the page /admin/rewrite-test
+	// works on.
+	maxRewriteTestBytes = 8 << 20
+	// rewriteTestContext is the number of unchanged lines around each change
+	// in the diff.
+	rewriteTestContext = 3
+)
+
+// rewriteTestRequest is the JSON body of POST /admin/rewrite-test.
+type rewriteTestRequest struct {
+	// A path or URL fetched from B, or else the body to rewrite.
+	URL  string `json:"url"`
+	HTML string `json:"html"`
+	// Content type and request path of HTML (default text/html and /).
+	ContentType string `json:"content_type"`
+	Path        string `json:"path"`
+	// Host mapping rules to try instead of the configured ones.
+	RewriteHosts  []RewriteHostMapping `json:"rewrite_hosts"`
+	HreflangHosts map[string]string    `json:"hreflang_hosts"`
+	// Run the whole transformer chain (strip, canonical, minify, hooks, ...)
+	// rather than the URL rewrite only.
+	Chain bool `json:"chain"`
+}
+
+// rewriteTestResult is the answer of POST /admin/rewrite-test.
+type rewriteTestResult struct {
+	URL          string            `json:"url,omitempty"`
+	Status       int               `json:"status,omitempty"`
+	ContentType  string            `json:"content_type"`
+	Changed      bool              `json:"changed"`
+	Diff         string            `json:"diff"`
+	Replacements []diffReplacement `json:"replacements"`
+}
+
+// handleAdminRewriteTest serves POST /admin/rewrite-test: it rewrites a page
+// fetched from B ({"url": "/products/1"}) or given inline ({"html": "..."}) as
+// for a bot, optionally with candidate rewrite_hosts / hreflang_hosts, and
+// returns a unified diff of the original and rewritten body plus the
+// replacements made. Nothing is cached.
+func (a *appHandler) handleAdminRewriteTest(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req rewriteTestRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxRewriteTestBytes)).Decode(&req); err != nil {
+		http.Error(w, "invalid json body", http.StatusBadRequest)
+		return
+	}
+	if (req.URL == "") == (req.HTML == "") {
+		http.Error(w, "set one of url or html", http.StatusBadRequest)
+		return
+	}
+	tcfg := *cfg
+	if req.RewriteHosts != nil {
+		tcfg.RewriteHosts = req.RewriteHosts
+	}
+	if req.HreflangHosts != nil {
+		tcfg.HreflangHosts = req.HreflangHosts
+	}
+	for _, m := range append(append([]RewriteHostMapping(nil), tcfg.RewriteHosts...), hreflangMappings(tcfg.HreflangHosts)...) {
+		if err := validateRewriteTestMapping(m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !req.Chain {
+		tcfg.Transformers = []string{transformRewrite}
+		tcfg.transformers = nil
+	}
+
+	res := rewriteTestResult{ContentType: req.ContentType}
+	body, reqPath := []byte(req.HTML), req.Path
+	if req.URL != "" {
+		target := resolveBTarget(cfg, req.URL)
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		ureq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		if err != nil {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		ureq.Header.Set("User-Agent", upstreamUserAgent(cfg, nil))
+		resp, err := doUpstream(cfg, a.client, ureq, u.Path)
+		if err != nil {
+			logger.Warnw("rewrite_test_fetch_error", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "err": err.Error()})
+			http.Error(w, "fetch failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxRewriteTestBytes))
+		resp.Body.Close()
+		if err != nil {
+			http.Error(w, "fetch failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		res.URL, res.Status, reqPath = target, resp.StatusCode, u.Path
+		if res.ContentType == "" {
+			res.ContentType = resp.Header.Get("Content-Type")
+		}
+	}
+	if res.ContentType == "" {
+		res.ContentType = "text/html; charset=utf-8"
+	}
+	if reqPath == "" {
+		reqPath = "/"
+	}
+
+	bURL, _ := url.Parse(cfg.BBaseURL)
+	out, changed := rewriteBodyForBots(&tcfg, reqPath, body, res.ContentType, deriveABaseURL(cfg, r), bURL)
+	res.Changed = changed && string(out) != string(body)
+	res.Replacements = []diffReplacement{}
+	if res.Changed {
+		res.Diff = unifiedDiff("original", "rewritten", string(body), string(out), rewriteTestContext)
+		res.Replacements = diffReplacements(string(body), string(out))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// hreflangMappings turns HreflangHosts into mappings for validation.
+func hreflangMappings(m map[string]string) []RewriteHostMapping {
+	out := make([]RewriteHostMapping, 0, len(m))
+	for lang, host := range m {
+		out = append(out, RewriteHostMapping{From: lang, To: host})
+	}
+	return out
+}
+
+// validateRewriteTestMapping rejects candidate mappings the rewriter would
+// silently skip.
+func validateRewriteTestMapping(m RewriteHostMapping) error {
+	to := m.To
+	if !strings.Contains(to, "://") {
+		to = "https://" + to
+	}
+	if u, err := url.Parse(to); strings.TrimSpace(m.From) == "" || err != nil || u.Host == "" {
+		return fmt.Errorf("invalid rewrite host mapping %q=%q", m.From, m.To)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package rerouter
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Admin scopes a credential may grant. Full covers every admin route,
+// including config changes; the others only what they name.
+const (
+	adminScopeRead  = "read"
+	adminScopePurge = "purge"
+	adminScopeWarm  = "warm"
+	adminScopeFull  = "full"
+)
+
+// adminScopeHeader names the scope a request lacked on a 403.
+const adminScopeHeader = "X-Admin-Scope-Required"
+
+// AdminCredential is an admin token and the scopes it grants.
+type AdminCredential struct {
+	// Name identifies the holder in logs and the audit log, e.g. "content-team".
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// read, purge, warm and/or full.
+	Scopes []string `json:"scopes"`
+	// Tenants (Config.Tenants) the token is limited to; empty means all.
+	// Such a token only reaches the cache entries, stats and warm jobs of
+	// those tenants' B hosts.
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+// allows reports whether c grants scope.
+func (c *AdminCredential) allows(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == adminScopeFull || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAdminCredentials parses "name:token=scope|scope[@tenant|tenant]"
+// entries separated by commas, e.g.
+// "content:s3cret=purge|read,seo:t0ken=warm,shop:k3y=purge|read@shop".
+func parseAdminCredentials(v string) ([]AdminCredential, error) {
+	out := []AdminCredential{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(p, ":")
+		i := strings.LastIndex(rest, "=")
+		if !ok || i <= 0 {
+			return nil, fmt.Errorf("invalid admin credential %q (want name:token=scope|scope)", p)
+		}
+		c := AdminCredential{Name: strings.TrimSpace(name), Token: rest[:i]}
+		scopes, tenants, limited := strings.Cut(rest[i+1:], "@")
+		c.Scopes = strings.Split(scopes, "|")
+		if limited {
+			c.Tenants = strings.Split(tenants, "|")
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// validateAdminCredentials rejects unnamed, empty, duplicate or unscoped
+// tokens, unknown scopes and tenants missing from tenants.
+func validateAdminCredentials(creds []AdminCredential, adminToken string, tenants map[string][]string) error {
+	seen := map[string]bool{adminToken: adminToken != ""}
+	for _, c := range creds {
+		if c.Name == "" || c.Token == "" {
+			return fmt.Errorf("every admin credential needs a name and a token")
+		}
+		if seen[c.Token] {
+			return fmt.Errorf("admin credential %s reuses a token", c.Name)
+		}
+		seen[c.Token] = true
+		if len(c.Scopes) == 0 {
+			return fmt.Errorf("admin credential %s has no scopes", c.Name)
+		}
+		for _, s := range c.Scopes {
+			switch s {
+			case adminScopeRead, adminScopePurge, adminScopeWarm, adminScopeFull:
+			default:
+				return fmt.Errorf("admin credential %s: unknown scope %q (want read, purge, warm or full)", c.Name, s)
+			}
+		}
+		for _, t := range c.Tenants {
+			if _, ok := tenants[t]; !ok {
+				return fmt.Errorf("admin credential %s: unknown tenant %q", c.Name, t)
+			}
+		}
+	}
+	return nil
+}
+
+// adminEnabled reports whether any admin credential is configured.
+func (cfg *Config) adminEnabled() bool {
+	return cfg.AdminToken != "" || len(cfg.AdminTokens) > 0
+}
+
+// adminCredentials returns ADMIN_TOKEN, as the full-scope credential "admin",
+// followed by ADMIN_TOKENS.
+func (cfg *Config) adminCredentials() []AdminCredential {
+	if cfg.AdminToken == "" {
+		return cfg.AdminTokens
+	}
+	return append([]AdminCredential{{Name: "admin", Token: cfg.AdminToken, Scopes: []string{adminScopeFull}}}, cfg.AdminTokens...)
+}
+
+// adminCredentialFor returns the credential whose token is token, comparing
+// each in constant time, or nil.
+func adminCredentialFor(cfg *Config, token string) *AdminCredential {
+	if token == "" {
+		return nil
+	}
+	var found *AdminCredential
+	creds := cfg.adminCredentials()
+	for i := range creds {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(creds[i].Token)) == 1 {
+			found = &creds[i]
+		}
+	}
+	return found
+}
+
+// adminCredentialBySum returns the credential whose token hashes to sum, as
+// kept by admin UI sessions, or nil.
+func adminCredentialBySum(cfg *Config, sum [32]byte) *AdminCredential {
+	creds := cfg.adminCredentials()
+	for i := range creds {
+		if sha256.Sum256([]byte(creds[i].Token)) == sum {
+			return &creds[i]
+		}
+	}
+	return nil
+}
+
+// adminScopeFor returns the scope admin request r needs: purge and warm for
+// starting those (API or admin UI form), read for other GETs except the audit
+// log and for rewrite dry runs, full for everything else. The admin UI page, login and logout only
+// need a valid credential.
+func adminScopeFor(cfg *Config, r *http.Request) string {
+	path := r.URL.Path
+	ui := cfg.AdminUIPath != "" && path == cfg.AdminUIPath
+	switch {
+	case path == "/admin/purge":
+		return adminScopePurge
+	case path == "/admin/sitemap-cache", path == "/admin/warm":
+		return adminScopeWarm
+	case ui && r.Method == http.MethodPost:
+		switch r.FormValue("form") {
+		case "purge":
+			return adminScopePurge
+		case "sitemap", "crawl":
+			return adminScopeWarm
+		}
+		return adminScopeFull
+	case ui, cfg.AdminUIPath != "" && strings.HasPrefix(path, cfg.AdminUIPath+"/"):
+		return ""
+	case path == "/admin/audit":
+		return adminScopeFull
+	case path == "/admin/rewrite-test":
+		// A dry run: it changes nothing
+		return adminScopeRead
+	case !auditedMethod(r.Method):
+		return adminScopeRead
+	}
+	return adminScopeFull
+}
+
+// checkAdmin reports whether r's admin UI session, or else token, grants the
+// scope r needs. Otherwise it writes a 403, naming the missing scope in
+// X-Admin-Scope-Required when the credential is valid but not allowed.
+// Credentials limited to tenants only reach the routes that honor them.
+func checkAdmin(cfg *Config, w http.ResponseWriter, r *http.Request, token string) bool {
+	cred := adminRequestCredential(cfg, r, token)
+	if cred == nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	if scope := adminScopeFor(cfg, r); scope != "" && !cred.allows(scope) {
+		w.Header().Set(adminScopeHeader, scope)
+		http.Error(w, "forbidden: token lacks the "+scope+" scope", http.StatusForbidden)
+		return false
+	}
+	if len(cred.Tenants) > 0 && !adminTenantRoute(r) {
+		http.Error(w, "forbidden: tenant-scoped token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// adminRequestCredential returns the credential of r's admin UI session, or
+// else the one token belongs to.
+func adminRequestCredential(cfg *Config, r *http.Request, token string) *AdminCredential {
+	if sess := adminSessionFrom(r.Context()); sess != nil {
+		return adminCredentialBySum(cfg, sess.tokenSum)
+	}
+	return adminCredentialFor(cfg, token)
+}
+
+// adminRequestToken returns the admin token of r's X-Admin-Token header or
+// ?token= parameter.
+func adminRequestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Admin-Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
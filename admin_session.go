@@ -0,0 +1,193 @@
+package rerouter
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+const (
+	// adminSessionCookie holds the session of an admin UI login.
+	adminSessionCookie = "rerouter_admin_session"
+	// adminCSRFHeader (or the csrf_token form field) must carry the session's
+	// CSRF token on every state-changing request authenticated by the cookie.
+	adminCSRFHeader = "X-CSRF-Token"
+	adminCSRFField  = "csrf_token"
+	// adminSessionKey is the context key of the session the guard checked.
+	adminSessionKey ctxKey = "admin_session"
+	// A login lasts 12 hours unless AdminSessionTTLSeconds says otherwise.
+	defaultAdminSessionTTLSeconds = 43200
+)
+
+// adminSession is a logged-in admin UI browser.
+type adminSession struct {
+	id      string
+	csrf    string
+	expires time.Time
+	// Hash of the admin token logged in with: removing or changing that token
+	// ends the session, changing its scopes applies right away.
+	tokenSum [32]byte
+}
+
+// adminSessions holds the admin UI sessions in memory. It lives on
+// appHandler so sessions survive config reloads; a restart logs everyone out.
+type adminSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*adminSession
+}
+
+func newAdminSessions() *adminSessions {
+	return &adminSessions{sessions: map[string]*adminSession{}}
+}
+
+// randomToken returns 32 random bytes, hex-encoded.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create starts a session for a login with cred, valid for
+// cfg.AdminSessionTTLSeconds.
+func (s *adminSessions) create(cfg *Config, cred *AdminCredential) (*adminSession, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	sess := &adminSession{id: id, csrf: csrf, expires: now.Add(secondsOr(cfg.AdminSessionTTLSeconds, defaultAdminSessionTTLSeconds*time.Second)), tokenSum: sha256.Sum256([]byte(cred.Token))}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, old := range s.sessions {
+		if now.After(old.expires) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessions[id] = sess
+	return sess, nil
+}
+
+// lookup returns the live session of r's cookie, if any.
+func (s *adminSessions) lookup(cfg *Config, r *http.Request) *adminSession {
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil || !cfg.adminEnabled() {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.sessions[c.Value]
+	if sess == nil {
+		return nil
+	}
+	if time.Now().After(sess.expires) || adminCredentialBySum(cfg, sess.tokenSum) == nil {
+		delete(s.sessions, c.Value)
+		return nil
+	}
+	return sess
+}
+
+func (s *adminSessions) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// csrfOK reports whether r carries sess's CSRF token. Safe methods need none.
+func (sess *adminSession) csrfOK(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	token := r.Header.Get(adminCSRFHeader)
+	if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		token = r.PostFormValue(adminCSRFField)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(sess.csrf)) == 1
+}
+
+func withAdminSession(ctx context.Context, sess *adminSession) context.Context {
+	return context.WithValue(ctx, adminSessionKey, sess)
+}
+
+// adminSessionFrom returns the session adminGuard authenticated r with.
+func adminSessionFrom(ctx context.Context) *adminSession {
+	sess, _ := ctx.Value(adminSessionKey).(*adminSession)
+	return sess
+}
+
+// setAdminSessionCookie sends the session cookie for sess, or clears it when
+// sess is nil. It is sent for every path so the dashboard's calls to the
+// /admin/ endpoints carry it.
+func setAdminSessionCookie(cfg *Config, w http.ResponseWriter, r *http.Request, sess *adminSession) {
+	c := &http.Cookie{
+		Name:     adminSessionCookie,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   clientForwardFor(cfg, r).Proto == "https",
+		SameSite: http.SameSiteStrictMode,
+	}
+	if sess != nil {
+		c.Value = sess.id
+		c.Expires = sess.expires
+	} else {
+		c.MaxAge = -1
+	}
+	http.SetCookie(w, c)
+}
+
+// handleAdminLogin serves POST <AdminUIPath>/login: a form with the admin
+// token starts a session and returns to the dashboard.
+func (a *appHandler) handleAdminLogin(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cred := adminCredentialFor(cfg, r.PostFormValue("token"))
+	if cred == nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	// The dashboard spans every tenant
+	if len(cred.Tenants) > 0 {
+		http.Error(w, "forbidden: tenant-scoped token", http.StatusForbidden)
+		return
+	}
+	sess, err := a.adminSessions.create(cfg, cred)
+	if err != nil {
+		logger.Errorw("admin_session_error", map[string]interface{}{"req_id": getRequestID(r.Context()), "err": err.Error()})
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setAdminSessionCookie(cfg, w, r, sess)
+	logger.Infow("admin_login", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": clientIP(cfg, r), "credential": cred.Name})
+	http.Redirect(w, r, cfg.AdminUIPath, http.StatusSeeOther)
+}
+
+// handleAdminLogout serves POST <AdminUIPath>/logout (CSRF-checked by
+// adminGuard): it ends the session and returns to the login form.
+func (a *appHandler) handleAdminLogout(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if sess := adminSessionFrom(r.Context()); sess != nil {
+		a.adminSessions.remove(sess.id)
+		logger.Infow("admin_logout", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": clientIP(cfg, r)})
+	}
+	setAdminSessionCookie(cfg, w, r, nil)
+	http.Redirect(w, r, cfg.AdminUIPath, http.StatusSeeOther)
+}
@@ -0,0 +1,356 @@
+package rerouter
+
+import "encoding/json"
+
+// adminUIHTML is the admin dashboard served at uiPath to a logged-in session.
+// It is a single self-contained page: its script reads the JSON admin
+// endpoints with the session cookie, sending csrf on changes, and follows
+// running warm jobs over their SSE streams. The form posts handled by the UI
+// path remain for scripts written against the old page.
+func adminUIHTML(uiPath, csrf string) string {
+	csrfJSON, _ := json.Marshal(csrf)
+	return `<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rerouter Admin</title>
+  <style>
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Cantarell,Noto Sans,sans-serif;margin:0;line-height:1.5;color:#222;background:#f7f7f7}
+    header{display:flex;flex-wrap:wrap;gap:1rem;align-items:center;padding:.75rem 2rem;background:#fff;border-bottom:1px solid #ddd}
+    header h1{font-size:1.2rem;margin:0;flex:1}
+    nav{display:flex;gap:.25rem;padding:0 2rem;background:#fff;border-bottom:1px solid #ddd}
+    nav button{margin:0;border-radius:0;background:none;color:#555;border-bottom:3px solid transparent}
+    nav button:hover{background:#f0f0f0}
+    nav button.active{color:#0a4;border-bottom-color:#0b5}
+    main{padding:1rem 2rem}
+    section[data-tab]{display:none}
+    section.active{display:block}
+    .cards{display:flex;flex-wrap:wrap;gap:1rem}
+    .card{flex:1 1 12rem;padding:1rem;border:1px solid #ddd;border-radius:8px;background:#fff}
+    .card b{display:block;font-size:1.4rem}
+    .card span{color:#666;font-size:.9rem}
+    table{width:100%;border-collapse:collapse;margin-top:1rem;background:#fff;font-size:.92rem}
+    th,td{padding:.35rem .6rem;border-bottom:1px solid #eee;text-align:left;vertical-align:top}
+    td.num,th.num{text-align:right}
+    form{max-width:640px;padding:1rem;margin-top:1rem;border:1px solid #ddd;border-radius:8px;background:#fff}
+    label{display:block;margin:.5rem 0 .25rem;font-weight:600;color:#333}
+    input[type=text],input[type=password],input[type=number],textarea{width:100%;box-sizing:border-box;padding:.3rem;border:1px solid #bbb;border-radius:6px;font:inherit}
+    button{margin-top:1rem;padding:.5rem 1rem;border:0;border-radius:6px;background:#0b5;color:#fff;cursor:pointer;font-weight:600;font:inherit}
+    button:hover{background:#0a4}
+    header form.logout{margin:0;padding:0;border:0;background:none}
+    header button{margin:0}
+    progress{width:10rem}
+    pre{padding:1rem;background:#fff;border:1px solid #ddd;border-radius:8px;overflow:auto;font-size:.85rem}
+    .hint,small{color:#666}
+    .msg{margin-top:.5rem;color:#555}
+    .err{color:#b00}
+  </style>
+</head>
+<body>
+  <header>
+    <h1>Rerouter Admin <small id="build"></small></h1>
+    <form method="post" action="` + htmlEscape(uiPath) + `/logout" class="logout">
+      <input type="hidden" name="` + adminCSRFField + `" value="` + htmlEscape(csrf) + `">
+      <button type="submit">Log out</button>
+    </form>
+  </header>
+  <nav>
+    <button data-tab="overview" class="active">Overview</button>
+    <button data-tab="cache">Cache</button>
+    <button data-tab="jobs">Warm jobs</button>
+    <button data-tab="bots">Bots</button>
+    <button data-tab="config">Config</button>
+  </nav>
+  <main>
+    <p id="error" class="err"></p>
+
+    <section data-tab="overview" class="active">
+      <div class="cards" id="overview-cards"></div>
+      <h2>Active warm jobs</h2>
+      <table><thead><tr><th>Job</th><th>Source</th><th>State</th><th class="num">Progress</th></tr></thead><tbody id="overview-jobs"></tbody></table>
+    </section>
+
+    <section data-tab="cache">
+      <div class="cards" id="cache-cards"></div>
+      <form id="purge-form">
+        <label for="purge-url">Purge URL or path</label>
+        <input type="text" id="purge-url" placeholder="/blog/post or https://b.site/blog/post" required>
+        <label for="purge-query">Query variants (a path also purges its cached ?query variants; optionally only those matching, e.g. color=*)</label>
+        <input type="text" id="purge-query" placeholder="color=*">
+        <label><input type="checkbox" id="purge-partial"> Partial (every cached URL containing the value)</label>
+        <label><input type="checkbox" id="purge-rewarm"> Rewarm purged URLs</label>
+        <button type="submit">Purge</button>
+        <div class="msg" id="purge-msg"></div>
+      </form>
+      <h2>Recent purges</h2>
+      <table><thead><tr><th>Time</th><th>Source</th><th>Query</th><th class="num">Deleted</th><th class="num">Rewarm</th></tr></thead><tbody id="purges"></tbody></table>
+      <h2>Most requested URLs</h2>
+      <table><thead><tr><th>URL</th><th class="num">Requests</th><th class="num">Hits</th><th class="num">Stale</th><th class="num">Misses</th><th class="num">Hit rate</th></tr></thead><tbody id="top-urls"></tbody></table>
+    </section>
+
+    <section data-tab="jobs">
+      <form id="warm-form">
+        <label for="warm-mode">Source</label>
+        <select id="warm-mode"><option value="">Sitemap or feed</option><option value="crawl">Crawl from a page</option><option value="list">URL list</option></select>
+        <label for="warm-url">Sitemap, feed or start URL</label>
+        <input type="text" id="warm-url" placeholder="https://b.site/sitemap.xml (crawls start at the B homepage when empty)">
+        <label for="warm-list">URLs (URL list only; one URL or path per line)</label>
+        <textarea id="warm-list" rows="5" placeholder="/products/shoe&#10;https://b.site/landing/summer"></textarea>
+        <label for="warm-max">Max URLs (optional)</label>
+        <input type="number" id="warm-max" min="0" placeholder="Defaults to ` + fmtInt(defaultSitemapURLLimit) + ` for sitemaps, CRAWL_WARM_MAX_URLS for crawls">
+        <label for="warm-depth">Max crawl depth (optional)</label>
+        <input type="number" id="warm-depth" min="0" placeholder="Defaults to CRAWL_WARM_MAX_DEPTH">
+        <button type="submit">Start warming</button>
+        <div class="msg" id="warm-msg"></div>
+      </form>
+      <table><thead><tr><th>Job</th><th>Mode</th><th>Source</th><th>State</th><th class="num">Progress</th><th class="num">Cached</th><th class="num">Skipped</th><th>Submitted</th></tr></thead><tbody id="jobs"></tbody></table>
+    </section>
+
+    <section data-tab="bots">
+      <p class="hint">Bot traffic over the last 24 hours, by family.</p>
+      <table><thead><tr><th>Family</th><th class="num">Requests</th><th class="num">Cache hit rate</th><th>Statuses</th><th>Top paths</th></tr></thead><tbody id="bots"></tbody></table>
+    </section>
+
+    <section data-tab="config">
+      <p class="hint">Effective configuration, secrets redacted. Change hot settings with PATCH /admin/config.</p>
+      <pre id="config"></pre>
+    </section>
+  </main>
+  <script>
+  (function () {
+    var $ = function (id) { return document.getElementById(id); };
+    var tab = "overview", streams = {}, jobRows = {}, csrf = ` + string(csrfJSON) + `;
+
+    function api(path, opts) {
+      opts = opts || {};
+      opts.headers = Object.assign({"` + adminCSRFHeader + `": csrf}, opts.headers || {});
+      opts.credentials = "same-origin";
+      return fetch(path, opts).then(function (r) {
+        // The session expired or was logged out elsewhere; a 403 naming a
+        // scope only means this login may not do that.
+        if (r.status === 403 && !r.headers.get("X-Admin-Scope-Required")) { location.reload(); }
+        if (!r.ok) { throw new Error(path + ": " + r.status + " " + r.statusText); }
+        $("error").textContent = "";
+        return r.status === 204 ? null : r.json();
+      }).catch(function (e) { $("error").textContent = e.message; throw e; });
+    }
+    function el(tag, text, cls) {
+      var e = document.createElement(tag);
+      if (text !== undefined && text !== null) { e.textContent = text; }
+      if (cls) { e.className = cls; }
+      return e;
+    }
+    function row(cells) {
+      var tr = el("tr");
+      cells.forEach(function (c) {
+        if (c instanceof Node) { var td = el("td"); td.appendChild(c); tr.appendChild(td); }
+        else if (typeof c === "number") { tr.appendChild(el("td", c.toLocaleString(), "num")); }
+        else { tr.appendChild(el("td", c)); }
+      });
+      return tr;
+    }
+    function fill(id, rows, empty, cols) {
+      var body = $(id);
+      body.textContent = "";
+      if (!rows.length) { var tr = el("tr"), td = el("td", empty, "hint"); td.colSpan = cols; tr.appendChild(td); body.appendChild(tr); return; }
+      rows.forEach(function (r) { body.appendChild(r); });
+    }
+    function cards(id, items) {
+      var box = $(id);
+      box.textContent = "";
+      items.forEach(function (it) {
+        var c = el("div", null, "card");
+        c.appendChild(el("b", it[1]));
+        c.appendChild(el("span", it[0]));
+        box.appendChild(c);
+      });
+    }
+    function bytes(n) {
+      var u = ["B", "KiB", "MiB", "GiB", "TiB"], i = 0;
+      while (n >= 1024 && i < u.length - 1) { n /= 1024; i++; }
+      return (i ? n.toFixed(1) : n) + " " + u[i];
+    }
+    function pct(f) { return (100 * (f || 0)).toFixed(1) + "%"; }
+    function when(t) { return t && t.indexOf("0001-") !== 0 ? new Date(t).toLocaleString() : ""; }
+    function duration(s) {
+      var d = Math.floor(s / 86400), h = Math.floor(s % 86400 / 3600), m = Math.floor(s % 3600 / 60);
+      return (d ? d + "d " : "") + h + "h " + m + "m";
+    }
+    function progress(d) {
+      var p = el("progress");
+      p.max = d.total_urls || 1;
+      p.value = d.processed_urls || 0;
+      var span = el("span");
+      span.appendChild(p);
+      span.appendChild(document.createTextNode(" " + (d.processed_urls || 0) + "/" + (d.total_urls || 0)));
+      return span;
+    }
+    function finished(state) { return state === "completed" || state === "error" || state === "interrupted"; }
+
+    function loadOverview() {
+      return api("/admin/status").then(function (s) {
+        $("build").textContent = s.version + (s.commit ? " (" + s.commit.slice(0, 12) + ")" : "");
+        var c = s.cache, q = s.prefetch_queue || {};
+        cards("overview-cards", [
+          ["Uptime", duration(s.uptime_seconds)],
+          ["Cached entries", c.entries.toLocaleString()],
+          ["Cache size", bytes(c.bytes)],
+          ["Disk free", c.disk_error ? c.disk_error : bytes(c.disk_free_bytes) + " of " + bytes(c.disk_size_bytes)],
+          ["Prefetch queue", (q.depth || 0) + " / " + (q.capacity || 0) + ((q.dropped_low || q.dropped_high) ? " (" + ((q.dropped_low || 0) + (q.dropped_high || 0)).toLocaleString() + " dropped)" : "")],
+          ["Config hash", s.config_hash]
+        ]);
+        fill("overview-jobs", (s.active_warm_jobs || []).map(function (j) {
+          return row([j.job_id, j.sitemap_url, j.state, progress(j)]);
+        }), "No warm job queued or running.", 4);
+      });
+    }
+
+    function loadCache() {
+      return Promise.all([api("/admin/stats/cache?top=20"), api("/admin/purges")]).then(function (res) {
+        var s = res[0];
+        cards("cache-cards", [
+          ["Requests since " + when(s.since), s.requests.toLocaleString()],
+          ["Hit rate (stale included)", pct(s.hit_rate)],
+          ["Hits / stale / misses", s.hits + " / " + s.stale + " / " + s.misses],
+          ["Served from cache", bytes(s.bytes_from_cache) + " of " + bytes(s.bytes_served)]
+        ]);
+        fill("top-urls", (s.top_urls || []).map(function (u) {
+          return row([u.url, u.requests, u.hits, u.stale, u.misses, pct(u.hit_rate)]);
+        }), "No cached responses served yet.", 6);
+        fill("purges", res[1].purges.map(function (p) {
+          return row([when(p.time), p.source, p.query, p.deleted, p.rewarm_queued || 0]);
+        }), "No purges since start.", 5);
+      });
+    }
+
+    function jobCells(d) {
+      return [d.job_id, d.mode || "sitemap", d.sitemap_url || "(URL list)", d.state + (d.error ? ": " + d.error : ""), progress(d), d.cached_urls || 0, d.skipped_urls || 0, when(d.submitted_at)];
+    }
+    function follow(d) {
+      if (finished(d.state) || streams[d.job_id]) { return; }
+      var es = new EventSource("/admin/sitemap-cache/stream?job=" + encodeURIComponent(d.job_id));
+      streams[d.job_id] = es;
+      var update = function (e) {
+        var u = JSON.parse(e.data), cur = jobRows[d.job_id];
+        if (!cur) { return; }
+        // "url" events carry the error of that URL, not of the job
+        var keys = ["processed_urls", "total_urls", "cached_urls", "skipped_urls"];
+        if (e.type === "state") { keys.push("state", "error"); }
+        keys.forEach(function (k) { cur.data[k] = u[k]; });
+        var next = row(jobCells(cur.data));
+        cur.tr.replaceWith(next);
+        cur.tr = next;
+        if (finished(cur.data.state)) { es.close(); delete streams[d.job_id]; }
+      };
+      es.addEventListener("state", update);
+      es.addEventListener("url", update);
+      es.onerror = function () { es.close(); delete streams[d.job_id]; };
+    }
+    function loadJobs() {
+      return api("/admin/sitemap-cache/status").then(function (res) {
+        var jobs = res.jobs || [];
+        jobs.sort(function (a, b) { return a.submitted_at < b.submitted_at ? 1 : -1; });
+        jobRows = {};
+        fill("jobs", jobs.map(function (d) {
+          delete d.url_statuses;
+          var tr = row(jobCells(d));
+          jobRows[d.job_id] = {tr: tr, data: d};
+          return tr;
+        }), "No warm jobs.", 8);
+        jobs.forEach(follow);
+      });
+    }
+
+    function loadBots() {
+      return api("/admin/stats/bots?from=24h&top=5").then(function (res) {
+        fill("bots", (res.families || []).map(function (f) {
+          var statuses = Object.keys(f.statuses || {}).sort().map(function (k) { return k + ": " + f.statuses[k]; }).join(", ");
+          var paths = (f.top_paths || []).map(function (p) { return p.path + " (" + p.requests + ")"; }).join(", ");
+          return row([f.family, f.requests, pct(f.cache_hit_rate), statuses, paths]);
+        }), "No bot traffic in the last 24 hours.", 5);
+      });
+    }
+
+    function loadConfig() {
+      return api("/admin/config").then(function (c) { $("config").textContent = JSON.stringify(c, null, 2); });
+    }
+
+    var loaders = {overview: loadOverview, cache: loadCache, jobs: loadJobs, bots: loadBots, config: loadConfig};
+    function refresh() {
+      loaders[tab]().catch(function () {});
+    }
+    document.querySelectorAll("nav button").forEach(function (b) {
+      b.addEventListener("click", function () {
+        tab = b.dataset.tab;
+        document.querySelectorAll("nav button, section[data-tab]").forEach(function (e) {
+          e.classList.toggle("active", e.dataset.tab === tab);
+        });
+        refresh();
+      });
+    });
+
+    $("purge-form").addEventListener("submit", function (e) {
+      e.preventDefault();
+      api("/admin/purge", {
+        method: "POST",
+        headers: {"Content-Type": "application/json"},
+        body: JSON.stringify({url: $("purge-url").value, query: $("purge-query").value, partial: $("purge-partial").checked, rewarm: $("purge-rewarm").checked})
+      }).then(function (res) {
+        $("purge-msg").textContent = "Deleted " + res.deleted + " entries" + (res.rewarm_queued ? ", " + res.rewarm_queued + " queued for rewarming." : ".");
+        loadCache();
+      }).catch(function () {});
+    });
+
+    $("warm-form").addEventListener("submit", function (e) {
+      e.preventDefault();
+      var mode = $("warm-mode").value, u = $("warm-url").value.trim();
+      var body = {mode: mode, max_urls: parseInt($("warm-max").value, 10) || 0, max_depth: parseInt($("warm-depth").value, 10) || 0};
+      var path = "/admin/sitemap-cache";
+      if (mode === "list") {
+        path = "/admin/warm";
+        body = {urls: $("warm-list").value.split("\n"), max_urls: body.max_urls};
+      } else if (mode === "crawl") { body.start_url = u; } else { body.sitemap_url = u; }
+      api(path, {method: "POST", headers: {"Content-Type": "application/json"}, body: JSON.stringify(body)}).then(function (res) {
+        $("warm-msg").textContent = "Queued job " + res.job_id + ".";
+        loadJobs();
+      }).catch(function () {});
+    });
+
+    refresh();
+    setInterval(function () {
+      // Running jobs update live over their streams
+      if (tab !== "config" && tab !== "jobs") { refresh(); }
+    }, 5000);
+  })();
+  </script>
+</body>
+</html>`
+}
+
+// adminLoginHTML is the form served at uiPath without a session: the admin
+// token is posted once to <uiPath>/login, which sets the session cookie.
+func adminLoginHTML(uiPath string) string {
+	return `<!doctype html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>Rerouter Admin Login</title>
+  <style>
+    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Cantarell,Noto Sans,sans-serif;margin:2rem;line-height:1.5;color:#222;background:#f7f7f7}
+    form{max-width:360px;margin:4rem auto;padding:1.5rem;border:1px solid #ddd;border-radius:8px;background:#fff}
+    h1{font-size:1.2rem;margin-top:0}
+    input{width:100%;box-sizing:border-box;padding:.4rem;border:1px solid #bbb;border-radius:6px;font:inherit}
+    button{margin-top:1rem;padding:.5rem 1rem;border:0;border-radius:6px;background:#0b5;color:#fff;cursor:pointer;font-weight:600;font:inherit}
+  </style>
+</head>
+<body>
+  <form method="post" action="` + htmlEscape(uiPath) + `/login">
+    <h1>Rerouter Admin</h1>
+    <input type="password" name="token" placeholder="Admin token" autocomplete="current-password" required autofocus>
+    <button type="submit">Log in</button>
+  </form>
+</body>
+</html>`
+}
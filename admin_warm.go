@@ -0,0 +1,143 @@
+package rerouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// maxWarmListBytes bounds a URL list posted to /admin/warm.
+const maxWarmListBytes = 10 << 20
+
+// warmListRequest is a URL list warm job as posted to /admin/warm.
+type warmListRequest struct {
+	URLs     []string `json:"urls"`
+	MaxURLs  int      `json:"max_urls"`
+	ABaseURL string   `json:"a_base_url"`
+}
+
+// parseWarmListRequest reads the URLs to warm from r: a JSON body (an array,
+// or an object with urls, max_urls and a_base_url), a multipart upload of a
+// text file in the "file" field, or a plain text body. Text lists hold one
+// URL per line; blank lines and lines starting with '#' are ignored. Outside
+// JSON, max_urls and a_base_url are query or form parameters.
+func parseWarmListRequest(r *http.Request) (warmListRequest, error) {
+	var req warmListRequest
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch ct {
+	case "application/json":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return req, err
+		}
+		data = bytes.TrimSpace(data)
+		if bytes.HasPrefix(data, []byte("[")) {
+			err = json.Unmarshal(data, &req.URLs)
+		} else {
+			err = json.Unmarshal(data, &req)
+		}
+		if err != nil {
+			return req, fmt.Errorf("invalid json")
+		}
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(maxWarmListBytes); err != nil {
+			return req, fmt.Errorf("invalid upload: %w", err)
+		}
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return req, fmt.Errorf("missing file")
+		}
+		defer f.Close()
+		if req.URLs, err = readWarmList(f); err != nil {
+			return req, err
+		}
+	default:
+		var err error
+		if req.URLs, err = readWarmList(r.Body); err != nil {
+			return req, err
+		}
+	}
+	if ct != "application/json" {
+		req.ABaseURL = r.FormValue("a_base_url")
+		if v := r.FormValue("max_urls"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return req, fmt.Errorf("invalid max_urls")
+			}
+			req.MaxURLs = n
+		}
+	}
+	urls := req.URLs[:0]
+	for _, u := range req.URLs {
+		if u = strings.TrimSpace(u); u == "" {
+			continue
+		}
+		if p, err := url.Parse(u); err != nil || p.Host == "" && !strings.HasPrefix(u, "/") || p.Host != "" && p.Scheme != "http" && p.Scheme != "https" {
+			return req, fmt.Errorf("invalid url %q (want an absolute http(s) URL or a path)", u)
+		}
+		urls = append(urls, u)
+	}
+	req.URLs = urls
+	return req, nil
+}
+
+// readWarmList reads one URL per line, skipping blank and '#' lines.
+func readWarmList(r io.Reader) ([]string, error) {
+	var out []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		out = append(out, line)
+	}
+	return out, sc.Err()
+}
+
+// handleAdminWarm serves POST /admin/warm: it starts a warm job for a list of
+// URLs, tracked like sitemap jobs under /admin/sitemap-cache/status.
+func handleAdminWarm(cfg *Config, warmMgr *sitemapWarmManager, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxWarmListBytes)
+	req, err := parseWarmListRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.URLs) > 0 && !adminTenantScope(cfg, r, adminRequestToken(r)).allowsHost(warmJobBHost(cfg, req.URLs[0])) {
+		errOutsideTenants(w)
+		return
+	}
+	job, err := warmMgr.StartListJob(req.URLs, req.MaxURLs, req.ABaseURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	total := len(job.URLs)
+	auditNote(r, map[string]interface{}{"mode": warmModeList, "urls": len(req.URLs), "max_urls": req.MaxURLs, "a_base_url": req.ABaseURL}, map[string]interface{}{"job_id": job.ID})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	resp := map[string]interface{}{
+		"job_id":     job.ID,
+		"state":      job.snapshot().State,
+		"mode":       warmModeList,
+		"total_urls": total,
+		"status_url": "/admin/sitemap-cache/status?job=" + url.QueryEscape(job.ID),
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Errorw("admin_warm_write_error", map[string]interface{}{"err": err.Error()})
+	}
+}
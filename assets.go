@@ -0,0 +1,28 @@
+package rerouter
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// staticAssetExts are the file extensions CACHE_ASSETS caches for bots.
+var staticAssetExts = map[string]bool{
+	".css": true, ".js": true, ".mjs": true, ".map": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true, ".svg": true, ".ico": true, ".bmp": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".otf": true, ".eot": true,
+	".mp4": true, ".webm": true, ".mp3": true, ".ogg": true,
+	".pdf": true,
+}
+
+// isStaticAssetPath reports whether reqPath names a stylesheet, script, image,
+// font or media file by its extension.
+func isStaticAssetPath(reqPath string) bool {
+	return staticAssetExts[strings.ToLower(path.Ext(reqPath))]
+}
+
+// guessContentType fills in a Content-Type from the extension of reqPath for
+// responses B sent without one, so cached assets are not served as sniffed text.
+func guessContentType(reqPath string) string {
+	return mime.TypeByExtension(strings.ToLower(path.Ext(reqPath)))
+}
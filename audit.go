@@ -0,0 +1,290 @@
+package rerouter
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+const (
+	auditKey ctxKey = "audit"
+	// defaultAuditLimit is how many records GET /admin/audit returns by default.
+	defaultAuditLimit = 100
+	// maxAuditLineBytes bounds one record when reading the audit log back.
+	maxAuditLineBytes = 1 << 20
+)
+
+// auditSecretParams are request parameters never written to the audit log.
+var auditSecretParams = map[string]bool{"token": true, "password": true, adminCSRFField: true}
+
+// auditEntry is one admin action in the audit log: who (client IP, token
+// fingerprint, basic auth user), what (action, parameters) and the outcome.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"req_id,omitempty"`
+	Action    string    `json:"action"`
+	IP        string    `json:"ip"`
+	// First 12 hex digits of the SHA-256 of the admin token presented, or of
+	// the token the session logged in with.
+	Token   string `json:"token_fingerprint,omitempty"`
+	Session bool   `json:"session,omitempty"`
+	// Name of the admin credential (ADMIN_TOKENS) the token belongs to.
+	Credential string                 `json:"credential,omitempty"`
+	User       string                 `json:"user,omitempty"`
+	Method     string                 `json:"method"`
+	Path       string                 `json:"path"`
+	Params     map[string]interface{} `json:"params,omitempty"`
+	Status     int                    `json:"status"`
+	Result     map[string]interface{} `json:"result,omitempty"`
+}
+
+// tokenFingerprint identifies an admin token in the audit log without
+// revealing it.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:6])
+}
+
+// auditLog appends admin actions to cfg.AuditLogFile, one JSON object per
+// line. The file is opened for each record, so moving it away (or changing
+// AUDIT_LOG_FILE on reload) starts a new one; rerouter never rotates or
+// truncates it.
+type auditLog struct {
+	mu sync.Mutex
+}
+
+func (l *auditLog) write(path string, e *auditEntry) {
+	if path == "" {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		logger.Errorw("audit_log_error", map[string]interface{}{"err": err.Error(), "file": path})
+		return
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		logger.Errorw("audit_log_error", map[string]interface{}{"err": err.Error(), "file": path})
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logger.Errorw("audit_log_error", map[string]interface{}{"err": err.Error(), "file": path})
+	}
+}
+
+// auditFilter selects records for GET /admin/audit.
+type auditFilter struct {
+	from, to     time.Time
+	action, ip   string
+	token, query string
+}
+
+func (f auditFilter) match(e *auditEntry) bool {
+	if e.Time.Before(f.from) || e.Time.After(f.to) {
+		return false
+	}
+	if f.action != "" && e.Action != f.action || f.ip != "" && e.IP != f.ip || f.token != "" && e.Token != f.token {
+		return false
+	}
+	if f.query != "" {
+		b, _ := json.Marshal(e.Params)
+		return strings.Contains(string(b), f.query)
+	}
+	return true
+}
+
+// read returns the newest limit records of the audit log at path matching f,
+// newest first.
+func (l *auditLog) read(path string, f auditFilter, limit int) ([]auditEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []auditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var out []auditEntry
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 64*1024), maxAuditLineBytes)
+	for sc.Scan() {
+		var e auditEntry
+		if json.Unmarshal(sc.Bytes(), &e) != nil || !f.match(&e) {
+			continue
+		}
+		out = append(out, e)
+		if len(out) > 2*limit {
+			out = append(out[:0], out[len(out)-limit:]...)
+		}
+	}
+	if len(out) > limit {
+		out = out[len(out)-limit:]
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	if out == nil {
+		out = []auditEntry{}
+	}
+	return out, sc.Err()
+}
+
+// handleAdminAudit serves GET /admin/audit?from=7d&to=...&action=purge&ip=...&token_fingerprint=...&q=/products&limit=100;
+// q matches a substring of the parameters.
+func (l *auditLog) handleAdminAudit(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	f := auditFilter{to: now, action: q.Get("action"), ip: q.Get("ip"), token: q.Get("token_fingerprint"), query: q.Get("q")}
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{{"from", &f.from}, {"to", &f.to}} {
+		if v := q.Get(p.key); v != "" {
+			t, err := parseStatsTime(v, now)
+			if err != nil {
+				http.Error(w, p.key+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*p.dst = t
+		}
+	}
+	limit := defaultAuditLimit
+	if n, err := strconv.Atoi(q.Get("limit")); err == nil && n > 0 {
+		limit = n
+	}
+	entries, err := l.read(cfg.AuditLogFile, f, limit)
+	if err != nil {
+		logger.Errorw("audit_log_read_error", map[string]interface{}{"req_id": getRequestID(r.Context()), "err": err.Error(), "file": cfg.AuditLogFile})
+		http.Error(w, "read audit log failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"entries": entries})
+}
+
+// auditedMethod reports whether requests with method change something and
+// are audited. Reads are not.
+func auditedMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// auditAction names the admin action of path: the route below /admin/ with
+// "/" as "_" (e.g. cache_reindex), ui, ui_login and ui_logout for the admin
+// UI, or purge_protocol for plugin purges outside /admin/. The UI path itself
+// is a secret and is logged as ADMIN_UI_PATH.
+func auditAction(cfg *Config, path string) (action, logged string) {
+	if cfg.AdminUIPath != "" && (path == cfg.AdminUIPath || strings.HasPrefix(path, cfg.AdminUIPath+"/")) {
+		rest := strings.TrimPrefix(path, cfg.AdminUIPath)
+		return "ui" + strings.ReplaceAll(rest, "/", "_"), "ADMIN_UI_PATH" + rest
+	}
+	if !strings.HasPrefix(path, "/admin/") {
+		return "purge_protocol", path
+	}
+	return strings.ReplaceAll(strings.Trim(strings.TrimPrefix(path, "/admin/"), "/"), "/", "_"), path
+}
+
+// newAuditEntry starts the audit record of admin request r.
+func newAuditEntry(cfg *Config, r *http.Request, ip string) *auditEntry {
+	action, path := auditAction(cfg, r.URL.Path)
+	user, _, _ := r.BasicAuth()
+	return &auditEntry{Time: time.Now().UTC(), RequestID: getRequestID(r.Context()), Action: action, IP: ip, User: user, Method: r.Method, Path: path}
+}
+
+// finish fills in who made request r, its query and form parameters (secrets
+// left out) unless the handler noted them, and the response status.
+func (e *auditEntry) finish(cfg *Config, r *http.Request, status int) {
+	e.Status = status
+	token := ""
+	if sess := adminSessionFrom(r.Context()); sess != nil {
+		e.Session = true
+		e.Token = hex.EncodeToString(sess.tokenSum[:6])
+	} else {
+		token = r.Header.Get("X-Admin-Token")
+		for _, k := range []string{"token", "password"} {
+			if token == "" {
+				token = r.URL.Query().Get(k)
+			}
+			if token == "" && r.PostForm != nil {
+				token = r.PostForm.Get(k)
+			}
+		}
+		if token != "" {
+			e.Token = tokenFingerprint(token)
+		}
+	}
+	if cred := adminRequestCredential(cfg, r, token); cred != nil {
+		e.Credential = cred.Name
+	}
+	add := func(k string, v []string) {
+		if auditSecretParams[k] || len(v) == 0 {
+			return
+		}
+		if e.Params == nil {
+			e.Params = map[string]interface{}{}
+		}
+		if _, noted := e.Params[k]; noted {
+			return
+		}
+		if len(v) == 1 {
+			e.Params[k] = v[0]
+		} else {
+			e.Params[k] = v
+		}
+	}
+	for k, v := range r.URL.Query() {
+		add(k, v)
+	}
+	for k, v := range r.PostForm {
+		add(k, v)
+	}
+}
+
+func withAudit(ctx context.Context, e *auditEntry) context.Context {
+	return context.WithValue(ctx, auditKey, e)
+}
+
+// auditNote adds parameters (e.g. those of a JSON body) and results to the
+// audit record of admin request r. It does nothing for requests not audited.
+func auditNote(r *http.Request, params, result map[string]interface{}) {
+	e, _ := r.Context().Value(auditKey).(*auditEntry)
+	if e == nil {
+		return
+	}
+	for k, v := range params {
+		if e.Params == nil {
+			e.Params = map[string]interface{}{}
+		}
+		e.Params[k] = v
+	}
+	for k, v := range result {
+		if e.Result == nil {
+			e.Result = map[string]interface{}{}
+		}
+		e.Result[k] = v
+	}
+}
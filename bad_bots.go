@@ -0,0 +1,166 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Actions accepted in cfg.BadBotAction.
+const (
+	// Answer 403 (the default).
+	badBotActionBlock = "block"
+	// Hold the connection for BadBotTarpitSeconds, then answer 403.
+	badBotActionTarpit = "tarpit"
+	// Answer 200 with an empty page, so scanners record nothing useful.
+	badBotActionFake = "fake"
+	// Let them through like any other client.
+	badBotActionOff = "off"
+)
+
+// maxTarpitted bounds the connections held at once; beyond it bad bots are
+// answered 403 right away so a flood cannot pile up goroutines.
+const maxTarpitted = 256
+
+// badBotStatsPrefix prefixes the signature to form the bot stats family
+// bad-bot requests are counted under, e.g. "bad:sqlmap".
+const badBotStatsPrefix = "bad:"
+
+// builtinBadBotUASubstrings lists security scanners, exploit kits and
+// credential stuffing tools by lowercased UA substring. SEO crawlers such as
+// AhrefsBot are good bots and do not belong here.
+var builtinBadBotUASubstrings = []string{
+	// Vulnerability and injection scanners
+	"sqlmap", "nikto", "nessus", "openvas", "acunetix", "netsparker",
+	"appscan", "webinspect", "arachni", "w3af", "nuclei", "wpscan",
+	"joomscan", "whatweb", "skipfish", "havij", "jorgee", "zmeu",
+	// Port and mass scanners
+	"nmap", "masscan", "zgrab", "l9explore", "l9tcpid",
+	// Content discovery and fuzzers
+	"dirbuster", "gobuster", "feroxbuster", "ffuf", "wfuzz", "dirb/",
+	// Brute forcers and credential stuffers
+	"hydra", "openbullet", "silverbullet", "blackbullet", "sentry mba",
+}
+
+// badBotHeaders are request headers only security scanners send.
+var badBotHeaders = []string{"Acunetix-Aspect", "Acunetix-Product", "X-Scanner", "X-Wipp", "X-Scan-Memo"}
+
+func validBadBotAction(a string) bool {
+	switch a {
+	case badBotActionBlock, badBotActionTarpit, badBotActionFake, badBotActionOff:
+		return true
+	}
+	return false
+}
+
+// badBotSignature returns what marks r as a scanner or bad bot: the matching
+// UA substring or the lowercased scanner header, or "" for other clients.
+func badBotSignature(cfg *Config, r *http.Request) string {
+	if cfg.BadBotAction == badBotActionOff {
+		return ""
+	}
+	ua := strings.ToLower(r.UserAgent())
+	if ua != "" {
+		for _, k := range cfg.BadBotUA {
+			if k = strings.ToLower(strings.TrimSpace(k)); k != "" && strings.Contains(ua, k) {
+				return k
+			}
+		}
+		for _, k := range builtinBadBotUASubstrings {
+			if strings.Contains(ua, k) {
+				return k
+			}
+		}
+	}
+	for _, h := range badBotHeaders {
+		if r.Header.Get(h) != "" {
+			return strings.ToLower(h)
+		}
+	}
+	return ""
+}
+
+// badBotCounter counts bad-bot requests per action for the system_metrics
+// log line; per-signature counts go to the bot stats.
+type badBotCounter struct {
+	mu        sync.Mutex
+	actions   map[string]int64
+	tarpitted int32
+}
+
+func newBadBotCounter() *badBotCounter {
+	return &badBotCounter{actions: map[string]int64{}}
+}
+
+func (c *badBotCounter) add(action string) {
+	c.mu.Lock()
+	c.actions[action]++
+	c.mu.Unlock()
+}
+
+func (c *badBotCounter) metrics() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total int64
+	for _, n := range c.actions {
+		total += n
+	}
+	return map[string]interface{}{
+		"bad_bot_requests":  total,
+		"bad_bot_blocked":   c.actions[badBotActionBlock],
+		"bad_bot_tarpitted": c.actions[badBotActionTarpit],
+		"bad_bot_faked":     c.actions[badBotActionFake],
+		"bad_bot_holding":   atomic.LoadInt32(&c.tarpitted),
+	}
+}
+
+// serveBadBot answers r per cfg.BadBotAction when it comes from a scanner or
+// bad bot, and reports whether it did.
+func (a *appHandler) serveBadBot(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	sig := badBotSignature(cfg, r)
+	if sig == "" {
+		return false
+	}
+	action := cfg.BadBotAction
+	if action == "" {
+		action = badBotActionBlock
+	}
+	status := http.StatusForbidden
+	if action == badBotActionTarpit {
+		if n := atomic.AddInt32(&a.badBots.tarpitted, 1); n > maxTarpitted {
+			action = badBotActionBlock
+		} else {
+			select {
+			case <-time.After(time.Duration(cfg.BadBotTarpitSeconds) * time.Second):
+			case <-r.Context().Done():
+			}
+		}
+		atomic.AddInt32(&a.badBots.tarpitted, -1)
+	}
+	a.badBots.add(action)
+	if action == badBotActionFake {
+		status = http.StatusOK
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		fmt.Fprint(w, "<!DOCTYPE html><html><head><title></title></head><body></body></html>")
+	} else {
+		http.Error(w, http.StatusText(status), status)
+	}
+	if cfg.BotStatsRetentionHours > 0 {
+		retention := time.Duration(cfg.BotStatsRetentionHours) * time.Hour
+		a.botStats.record(retention, badBotStatsPrefix+sig, r.URL.Path, status, "", time.Now())
+	}
+	logger.Debugw("bad_bot", map[string]interface{}{
+		"req_id":    getRequestID(r.Context()),
+		"signature": sig,
+		"action":    action,
+		"path":      r.URL.Path,
+		"client_ip": clientIP(cfg, r),
+	})
+	return true
+}
@@ -0,0 +1,97 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// BlockRule answers requests for paths matching Pattern with Status right
+// away, before they are redirected or proxied to the B site.
+type BlockRule struct {
+	Pattern string `json:"pattern"`
+	// 4xx status to answer with; 0 means 404.
+	Status int `json:"status,omitempty"`
+}
+
+// parseBlockRules parses "pattern[=status]" entries separated by semicolons,
+// e.g. "/wp-admin/*;/xmlrpc.php=410;.env=451".
+func parseBlockRules(v string) ([]BlockRule, error) {
+	out := []BlockRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pat, status, hasStatus := strings.Cut(p, "=")
+		rule := BlockRule{Pattern: strings.TrimSpace(pat)}
+		if hasStatus {
+			n, err := strconv.Atoi(strings.TrimSpace(status))
+			if err != nil {
+				return nil, fmt.Errorf("invalid block rule %q", p)
+			}
+			rule.Status = n
+		}
+		if err := validateBlockRule(rule); err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func validateBlockRule(r BlockRule) error {
+	if r.Pattern == "" {
+		return fmt.Errorf("block rule needs a pattern")
+	}
+	if r.Status != 0 && (r.Status < 400 || r.Status > 499) {
+		return fmt.Errorf("block rule %q: status %d is not 4xx", r.Pattern, r.Status)
+	}
+	return nil
+}
+
+// matches reports whether reqPath is blocked by r. Patterns with a slash use
+// the CACHE_PATTERNS syntax; patterns without one match the last path
+// segment, so ".env" or "*.sql" catch probes at any depth.
+func (r BlockRule) matches(reqPath string) bool {
+	if !strings.Contains(r.Pattern, "/") {
+		ok, err := path.Match(r.Pattern, path.Base(reqPath))
+		return err == nil && ok
+	}
+	return patternsMatch([]string{r.Pattern}, reqPath)
+}
+
+// blockRuleFor returns the first rule of cfg.BlockRules matching reqPath.
+func blockRuleFor(cfg *Config, reqPath string) (BlockRule, bool) {
+	for _, r := range cfg.BlockRules {
+		if r.matches(reqPath) {
+			return r, true
+		}
+	}
+	return BlockRule{}, false
+}
+
+// serveBlocked answers r when its path is on the block list and reports
+// whether it did.
+func serveBlocked(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	rule, ok := blockRuleFor(cfg, r.URL.Path)
+	if !ok {
+		return false
+	}
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusNotFound
+	}
+	logger.Debugw("request_blocked", map[string]interface{}{
+		"req_id":  getRequestID(r.Context()),
+		"path":    r.URL.Path,
+		"pattern": rule.Pattern,
+		"status":  status,
+	})
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
@@ -1,4 +1,4 @@
-package main
+package rerouter
 
 import (
 	"net/http"
@@ -6,7 +6,8 @@ import (
 	"strings"
 )
 
-func isBot(r *http.Request) bool {
+// isBot matches the UA against the built-in crawler list and cfg's bot lists.
+func isBot(cfg *Config, r *http.Request) bool {
 	// Allow forcing detection for testing
 	if r.Header.Get("X-Bot") == "true" {
 		return true
@@ -15,68 +16,75 @@ func isBot(r *http.Request) bool {
 	if ua == "" {
 		return false
 	}
+	// Configured exclusions win over every match below (e.g. internal monitoring agents)
+	if cfg.botUA.excluded(ua) {
+		return false
+	}
 	// Known crawler identifiers (lowercased substrings). Keep generic "bot" last.
 	// Hybrid detection:
 	// 1) Generic keywords catch most crawlers quickly
 	if strings.Contains(ua, "bot") || strings.Contains(ua, "crawl") || strings.Contains(ua, "spider") {
 		return true
 	}
-	// 2) Comprehensive curated substrings for known crawlers and preview fetchers
-	// Note: Keep items lowercased; we already lowercased UA above.
-	known := []string{
-		// Google family
-		"googlebot", "adsbot-google", "mediapartners-google", "apis-google",
-		"feedfetcher-google", "google-inspectiontool", "googleother",
-		"duplexweb-google", "googleweblight", "google-proxy", "google favicon",
-		"google-read-aloud", "google-extended",
-		// Microsoft/Bing
-		"bingbot", "msnbot", "bingpreview", "adidxbot", "msnbot-media",
-		"bingurlpreview",
-		// Yahoo
-		"slurp",
-		// DuckDuckGo
-		"duckduckbot", "duckduckgo-favicons-bot",
-		// Baidu
-		"baiduspider",
-		// Yandex
-		"yandexbot", "yandeximages", "yandexmobilebot", "yandexnews",
-		"yandexvideo",
-		// Sogou / Exalead / Seznam / Qwant
-		"sogou", "exabot", "seznambot", "qwantify",
-		// Naver
-		"naverbot", "naver-yeti", "yeti",
-		// Apple / Huawei
-		"applebot", "applenewsbot", "petalbot", "aspiegelbot",
-		// Social previews
-		"facebot", "facebookbot", "facebookexternalhit", "facebookcatalog",
-		"meta-externalagent", "twitterbot", "linkedinbot", "pinterestbot",
-		"discordbot", "slackbot", "slack-imgproxy", "telegrambot",
-		"skypeuripreview", "whatsapp", "vkshare", "odklbot", "redditbot",
-		// SEO crawlers and link explorers
-		"ahrefsbot", "mj12bot", "semrushbot", "dotbot", "blexbot",
-		"seokicks-robot", "spbot", "rogerbot", "linkdexbot", "megaindex",
-		"serpstatbot", "siteexplorer", "barkrowler", "seobilitybot",
-		"sistrix", "mauibot", "ezooms", "linkpadbot", "dataforseobot",
-		"zoominfobot",
-		// Other engines / archives
-		"ia_archiver", "mail.ru_bot", "mail.ru bot", "coccocbot", "bytespider",
-		"toutiaospider", "ccbot", "heritrix", "nutch", "diffbot", "twingly",
-		"sosospider", "youdaobot",
-		// Performance tools and auditors
-		"lighthouse", "pagespeed", "ptst", "gtmetrix", "speedcurve", "pingdom",
-		"siteimprove", "w3c_validator", "validator",
-		// Headless browsers commonly used for crawling
-		"headlesschrome", "phantomjs", "puppeteer", "rendertron", "prerender", "lighthouse",
-		// AI crawlers
-		"gptbot", "oai-searchbot", "perplexitybot", "claudebot", "claude-web",
-		"amazonbot",
-	}
-	for _, k := range known {
+	// 2) Comprehensive curated substrings for known crawlers and preview fetchers,
+	// plus any configured additions
+	for _, k := range builtinBotUASubstrings {
 		if strings.Contains(ua, k) {
 			return true
 		}
 	}
-	return false
+	return cfg.botUA.included(ua)
+}
+
+// builtinBotUASubstrings lists known crawler identifiers (lowercased substrings).
+// Note: Keep items lowercased; isBot lowercases the UA before matching.
+var builtinBotUASubstrings = []string{
+	// Google family
+	"googlebot", "adsbot-google", "mediapartners-google", "apis-google",
+	"feedfetcher-google", "google-inspectiontool", "googleother",
+	"duplexweb-google", "googleweblight", "google-proxy", "google favicon",
+	"google-read-aloud", "google-extended",
+	// Microsoft/Bing
+	"bingbot", "msnbot", "bingpreview", "adidxbot", "msnbot-media",
+	"bingurlpreview",
+	// Yahoo
+	"slurp",
+	// DuckDuckGo
+	"duckduckbot", "duckduckgo-favicons-bot",
+	// Baidu
+	"baiduspider",
+	// Yandex
+	"yandexbot", "yandeximages", "yandexmobilebot", "yandexnews",
+	"yandexvideo",
+	// Sogou / Exalead / Seznam / Qwant
+	"sogou", "exabot", "seznambot", "qwantify",
+	// Naver
+	"naverbot", "naver-yeti", "yeti",
+	// Apple / Huawei
+	"applebot", "applenewsbot", "petalbot", "aspiegelbot",
+	// Social previews
+	"facebot", "facebookbot", "facebookexternalhit", "facebookcatalog",
+	"meta-externalagent", "twitterbot", "linkedinbot", "pinterestbot",
+	"discordbot", "slackbot", "slack-imgproxy", "telegrambot",
+	"skypeuripreview", "whatsapp", "vkshare", "odklbot", "redditbot",
+	// SEO crawlers and link explorers
+	"ahrefsbot", "mj12bot", "semrushbot", "dotbot", "blexbot",
+	"seokicks-robot", "spbot", "rogerbot", "linkdexbot", "megaindex",
+	"serpstatbot", "siteexplorer", "barkrowler", "seobilitybot",
+	"sistrix", "mauibot", "ezooms", "linkpadbot", "dataforseobot",
+	"zoominfobot",
+	// Other engines / archives
+	"ia_archiver", "mail.ru_bot", "mail.ru bot", "coccocbot", "bytespider",
+	"toutiaospider", "ccbot", "heritrix", "nutch", "diffbot", "twingly",
+	"sosospider", "youdaobot",
+	// Performance tools and auditors
+	"lighthouse", "pagespeed", "ptst", "gtmetrix", "speedcurve", "pingdom",
+	"siteimprove", "w3c_validator", "validator",
+	// Headless browsers commonly used for crawling
+	"headlesschrome", "phantomjs", "puppeteer", "rendertron", "prerender", "lighthouse",
+	// AI crawlers
+	"gptbot", "oai-searchbot", "perplexitybot", "claudebot", "claude-web",
+	"amazonbot",
 }
 
 func patternsMatch(patterns []string, reqPath string) bool {
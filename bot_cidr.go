@@ -0,0 +1,176 @@
+package rerouter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// botCIDRLists holds client IP ranges that override UA-based bot detection.
+type botCIDRLists struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (l *botCIDRLists) set(allow, deny []*net.IPNet) {
+	l.mu.Lock()
+	l.allow = allow
+	l.deny = deny
+	l.mu.Unlock()
+}
+
+func (l *botCIDRLists) counts() (allow, deny int) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.allow), len(l.deny)
+}
+
+// match reports whether ip is in the deny list (denied) or the allow list (allowed).
+func (l *botCIDRLists) match(ip net.IP) (allowed, denied bool) {
+	if l == nil || ip == nil {
+		return false, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, n := range l.deny {
+		if n.Contains(ip) {
+			return false, true
+		}
+	}
+	for _, n := range l.allow {
+		if n.Contains(ip) {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// reloadBotCIDRs parses cfg CIDR lists plus cfg.BotAllowCIDRFile into cfg's
+// lists, creating them if cfg has none. On error the previous lists are kept.
+func reloadBotCIDRs(cfg *Config) error {
+	allow, err := parseCIDRList(cfg.BotAllowCIDRs)
+	if err != nil {
+		return err
+	}
+	deny, err := parseCIDRList(cfg.BotDenyCIDRs)
+	if err != nil {
+		return err
+	}
+	if cfg.BotAllowCIDRFile != "" {
+		b, err := os.ReadFile(cfg.BotAllowCIDRFile)
+		if err != nil {
+			return err
+		}
+		fromFile, err := parseCIDRFile(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cfg.BotAllowCIDRFile, err)
+		}
+		allow = append(allow, fromFile...)
+	}
+	if cfg.botCIDRs == nil {
+		cfg.botCIDRs = &botCIDRLists{}
+	}
+	cfg.botCIDRs.set(allow, deny)
+	return nil
+}
+
+func parseCIDRList(items []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(items))
+	for _, s := range items {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := parseCIDROrIP(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// parseCIDRFile accepts either one CIDR/IP per line ("#" comments allowed) or the
+// JSON format published for Googlebot/Bingbot: {"prefixes":[{"ipv4Prefix":"..."},{"ipv6Prefix":"..."}]}.
+func parseCIDRFile(b []byte) ([]*net.IPNet, error) {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var doc struct {
+			Prefixes []struct {
+				IPv4 string `json:"ipv4Prefix"`
+				IPv6 string `json:"ipv6Prefix"`
+			} `json:"prefixes"`
+		}
+		if err := json.Unmarshal(trimmed, &doc); err != nil {
+			return nil, err
+		}
+		items := make([]string, 0, len(doc.Prefixes))
+		for _, p := range doc.Prefixes {
+			items = append(items, p.IPv4+p.IPv6)
+		}
+		return parseCIDRList(items)
+	}
+	items := []string{}
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items = append(items, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return parseCIDRList(items)
+}
+
+// parseCIDROrIP parses a CIDR, treating a bare IP as a single-address network.
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q", s)
+	}
+	return n, nil
+}
+
+// clientIP returns the client IP. With cfg.TrustedProxies it is the address
+// behind the trusted proxies; otherwise, with cfg.TrustXForwardedFor, the
+// last X-Forwarded-For entry (the one appended by the fronting proxy).
+func clientIP(cfg *Config, r *http.Request) string {
+	if cfg != nil && len(cfg.trustedProxyNets) != 0 {
+		return trustedClientIP(cfg, r)
+	}
+	if cfg != nil && cfg.TrustXForwardedFor {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			parts := strings.Split(xff, ",")
+			if ip := strings.TrimSpace(parts[len(parts)-1]); net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,268 @@
+package rerouter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+const (
+	botStatsFile = "bot-stats.json"
+	// botStatsBucket is the resolution of the rolling store.
+	botStatsBucket = time.Hour
+	// botStatsMaxPaths caps distinct paths kept per family and bucket; the rest
+	// are counted under botStatsOtherPaths.
+	botStatsMaxPaths   = 500
+	botStatsOtherPaths = "(other)"
+	defaultBotStatsTop = 20
+)
+
+// botFamilyCounts are the counters of one bot family in one bucket.
+type botFamilyCounts struct {
+	Requests int64            `json:"requests"`
+	Hits     int64            `json:"hits"`
+	Misses   int64            `json:"misses"`
+	Stale    int64            `json:"stale"`
+	Statuses map[string]int64 `json:"statuses"`
+	Paths    map[string]int64 `json:"paths"`
+}
+
+type botStatsHour struct {
+	Start    int64                       `json:"start"`
+	Families map[string]*botFamilyCounts `json:"families"`
+}
+
+// botStats is the rolling store of bot traffic: hourly buckets per bot
+// family, kept for BotStatsRetentionHours and saved in the cache dir on
+// shutdown.
+type botStats struct {
+	mu    sync.Mutex
+	hours []*botStatsHour // oldest first
+}
+
+func loadBotStats(cacheDir string) *botStats {
+	s := &botStats{}
+	b, err := os.ReadFile(filepath.Join(cacheDir, botStatsFile))
+	if err != nil {
+		return s
+	}
+	if err := json.Unmarshal(b, &s.hours); err != nil {
+		logger.Warnw("bot_stats_load_error", map[string]interface{}{"err": err.Error()})
+		s.hours = nil
+	}
+	return s
+}
+
+func (s *botStats) save(cacheDir string) error {
+	s.mu.Lock()
+	b, err := json.Marshal(s.hours)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(cacheDir, botStatsFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(cacheDir, botStatsFile))
+}
+
+// record counts one bot request. xCache is the X-Cache header it was served with.
+func (s *botStats) record(retention time.Duration, family, path string, status int, xCache string, now time.Time) {
+	start := now.Truncate(botStatsBucket).Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.hours); n == 0 || s.hours[n-1].Start < start {
+		s.hours = append(s.hours, &botStatsHour{Start: start, Families: map[string]*botFamilyCounts{}})
+	}
+	cutoff := now.Add(-retention).Unix()
+	drop := 0
+	for drop < len(s.hours)-1 && s.hours[drop].Start+int64(botStatsBucket/time.Second) <= cutoff {
+		drop++
+	}
+	s.hours = s.hours[drop:]
+
+	h := s.hours[len(s.hours)-1]
+	c := h.Families[family]
+	if c == nil {
+		c = &botFamilyCounts{Statuses: map[string]int64{}, Paths: map[string]int64{}}
+		h.Families[family] = c
+	}
+	c.Requests++
+	switch xCache {
+	case "HIT":
+		c.Hits++
+	case "MISS":
+		c.Misses++
+	case "STALE":
+		c.Stale++
+	}
+	c.Statuses[strconv.Itoa(status)]++
+	if _, ok := c.Paths[path]; !ok && len(c.Paths) >= botStatsMaxPaths {
+		path = botStatsOtherPaths
+	}
+	c.Paths[path]++
+}
+
+// botPathCount is one row of a top-paths list.
+type botPathCount struct {
+	Path     string `json:"path"`
+	Requests int64  `json:"requests"`
+}
+
+// botFamilyReport sums a family's counters over a time range.
+type botFamilyReport struct {
+	Family   string           `json:"family"`
+	Requests int64            `json:"requests"`
+	Hits     int64            `json:"cache_hits"`
+	Misses   int64            `json:"cache_misses"`
+	Stale    int64            `json:"cache_stale"`
+	HitRate  float64          `json:"cache_hit_rate"`
+	Statuses map[string]int64 `json:"statuses"`
+	TopPaths []botPathCount   `json:"top_paths"`
+}
+
+// report sums the buckets overlapping [from, to) per family (or only family
+// when set), busiest family first, with its top paths.
+func (s *botStats) report(from, to time.Time, family string, top int) []botFamilyReport {
+	sums := map[string]*botFamilyCounts{}
+	s.mu.Lock()
+	for _, h := range s.hours {
+		if h.Start+int64(botStatsBucket/time.Second) <= from.Unix() || h.Start >= to.Unix() {
+			continue
+		}
+		for fam, c := range h.Families {
+			if family != "" && fam != family {
+				continue
+			}
+			sum := sums[fam]
+			if sum == nil {
+				sum = &botFamilyCounts{Statuses: map[string]int64{}, Paths: map[string]int64{}}
+				sums[fam] = sum
+			}
+			sum.Requests += c.Requests
+			sum.Hits += c.Hits
+			sum.Misses += c.Misses
+			sum.Stale += c.Stale
+			for k, v := range c.Statuses {
+				sum.Statuses[k] += v
+			}
+			for k, v := range c.Paths {
+				sum.Paths[k] += v
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	out := make([]botFamilyReport, 0, len(sums))
+	for fam, c := range sums {
+		r := botFamilyReport{Family: fam, Requests: c.Requests, Hits: c.Hits, Misses: c.Misses, Stale: c.Stale, Statuses: c.Statuses, TopPaths: []botPathCount{}}
+		if served := c.Hits + c.Misses + c.Stale; served > 0 {
+			r.HitRate = float64(c.Hits+c.Stale) / float64(served)
+		}
+		for p, n := range c.Paths {
+			r.TopPaths = append(r.TopPaths, botPathCount{Path: p, Requests: n})
+		}
+		sort.Slice(r.TopPaths, func(i, j int) bool {
+			if r.TopPaths[i].Requests != r.TopPaths[j].Requests {
+				return r.TopPaths[i].Requests > r.TopPaths[j].Requests
+			}
+			return r.TopPaths[i].Path < r.TopPaths[j].Path
+		})
+		if len(r.TopPaths) > top {
+			r.TopPaths = r.TopPaths[:top]
+		}
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Requests != out[j].Requests {
+			return out[i].Requests > out[j].Requests
+		}
+		return out[i].Family < out[j].Family
+	})
+	return out
+}
+
+// parseStatsTime accepts RFC 3339, unix seconds, or a duration back from now ("24h").
+func parseStatsTime(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (want RFC 3339, unix seconds or a duration like 24h)", v)
+}
+
+// handleAdminBotStats serves GET /admin/stats/bots?from=24h&to=...&family=google&top=20&format=csv[&view=paths].
+func (s *botStats) handleAdminBotStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	now := time.Now()
+	from, to := now.Add(-24*time.Hour), now
+	for _, p := range []struct {
+		key string
+		dst *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		if v := q.Get(p.key); v != "" {
+			t, err := parseStatsTime(v, now)
+			if err != nil {
+				http.Error(w, p.key+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*p.dst = t
+		}
+	}
+	top := defaultBotStatsTop
+	if n, err := strconv.Atoi(q.Get("top")); err == nil && n > 0 {
+		top = n
+	}
+	families := s.report(from, to, strings.ToLower(q.Get("family")), top)
+
+	if q.Get("format") != "csv" {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"from": from.UTC(), "to": to.UTC(), "families": families})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="bot-stats.csv"`)
+	cw := csv.NewWriter(w)
+	if q.Get("view") == "paths" {
+		_ = cw.Write([]string{"family", "path", "requests"})
+		for _, f := range families {
+			for _, p := range f.TopPaths {
+				_ = cw.Write([]string{f.Family, p.Path, strconv.FormatInt(p.Requests, 10)})
+			}
+		}
+	} else {
+		_ = cw.Write([]string{"family", "requests", "cache_hits", "cache_misses", "cache_stale", "cache_hit_rate", "status_2xx", "status_3xx", "status_4xx", "status_5xx"})
+		for _, f := range families {
+			var classes [4]int64
+			for code, n := range f.Statuses {
+				if c := code[0] - '2'; len(code) == 3 && c < 4 {
+					classes[c] += n
+				}
+			}
+			_ = cw.Write([]string{f.Family, strconv.FormatInt(f.Requests, 10), strconv.FormatInt(f.Hits, 10), strconv.FormatInt(f.Misses, 10),
+				strconv.FormatInt(f.Stale, 10), strconv.FormatFloat(f.HitRate, 'f', 4, 64),
+				strconv.FormatInt(classes[0], 10), strconv.FormatInt(classes[1], 10), strconv.FormatInt(classes[2], 10), strconv.FormatInt(classes[3], 10)})
+		}
+	}
+	cw.Flush()
+}
@@ -1,7 +1,11 @@
-package main
+package rerouter
 
 import (
+    "context"
+    "errors"
     "net/http/httptest"
+    "os"
+    "path/filepath"
     "testing"
 )
 
@@ -22,7 +26,7 @@ func TestIsBot_GoogleVariants(t *testing.T) {
     for _, ua := range cases {
         r := httptest.NewRequest("GET", "/", nil)
         r.Header.Set("User-Agent", ua)
-        if !isBot(r) {
+        if !isBot(&Config{}, r) {
             t.Fatalf("expected isBot true for UA: %q", ua)
         }
     }
@@ -37,7 +41,7 @@ func TestIsBot_NonBots(t *testing.T) {
     for _, ua := range cases {
         r := httptest.NewRequest("GET", "/", nil)
         r.Header.Set("User-Agent", ua)
-        if isBot(r) {
+        if isBot(&Config{}, r) {
             t.Fatalf("expected isBot false for UA: %q", ua)
         }
     }
@@ -65,8 +69,161 @@ func TestIsBot_NonGenericKnowns(t *testing.T) {
     for _, ua := range cases {
         r := httptest.NewRequest("GET", "/", nil)
         r.Header.Set("User-Agent", ua)
-        if !isBot(r) {
+        if !isBot(&Config{}, r) {
             t.Fatalf("expected isBot true for UA: %q", ua)
         }
     }
 }
+
+func TestIsBot_ConfiguredIncludeExclude(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "bots.txt")
+    if err := os.WriteFile(file, []byte("# custom\nNewAICrawler\n!UptimeBot\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    cfg := &Config{BotUAInclude: []string{"ExtraFetcher"}, BotUAFile: file}
+    if _, _, err := reloadBotUA(cfg); err != nil {
+        t.Fatal(err)
+    }
+
+    cases := map[string]bool{
+        "ExtraFetcher/1.0":   true,
+        "NewAICrawler/2.0":   true,
+        "UptimeBot/1.0":      false,
+        "Googlebot/2.1":      true,
+        "Mozilla/5.0 Safari": false,
+    }
+    for ua, want := range cases {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.Header.Set("User-Agent", ua)
+        if got := isBot(cfg, r); got != want {
+            t.Fatalf("isBot(%q) = %v, want %v", ua, got, want)
+        }
+    }
+
+    // Reload picks up file edits
+    if err := os.WriteFile(file, []byte("!googlebot\n"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, err := reloadBotUA(cfg); err != nil {
+        t.Fatal(err)
+    }
+    r := httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("User-Agent", "Googlebot/2.1")
+    if isBot(cfg, r) {
+        t.Fatalf("expected googlebot excluded after reload")
+    }
+}
+
+func TestDetectBot_VerifiesClaimedCrawler(t *testing.T) {
+    origAddr, origHost := lookupAddr, lookupHost
+    defer func() { lookupAddr, lookupHost = origAddr, origHost }()
+    lookupAddr = func(ctx context.Context, ip string) ([]string, error) {
+        switch ip {
+        case "66.249.66.1":
+            return []string{"crawl-66-249-66-1.googlebot.com."}, nil
+        case "10.0.0.9":
+            return []string{"crawl-fake.googlebot.com.evil.net."}, nil
+        }
+        return nil, errors.New("no ptr")
+    }
+    lookupHost = func(ctx context.Context, host string) ([]string, error) {
+        if host == "crawl-66-249-66-1.googlebot.com" {
+            return []string{"66.249.66.1"}, nil
+        }
+        return nil, errors.New("nxdomain")
+    }
+
+    cfg := &Config{VerifyBots: true}
+    cases := []struct {
+        remote, ua string
+        want       bool
+    }{
+        {"66.249.66.1:1234", "Googlebot/2.1", true},
+        {"10.0.0.9:1234", "Googlebot/2.1", false},
+        {"10.0.0.10:1234", "Googlebot/2.1", false},
+        // Crawlers without a verifiable identity keep UA-only detection
+        {"10.0.0.10:1234", "AhrefsBot/7.0", true},
+    }
+    for _, c := range cases {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.RemoteAddr = c.remote
+        r.Header.Set("User-Agent", c.ua)
+        if got := detectBot(cfg, r); got != c.want {
+            t.Fatalf("detectBot(%s, %q) = %v, want %v", c.remote, c.ua, got, c.want)
+        }
+    }
+
+    // Verification disabled: UA alone decides
+    r := httptest.NewRequest("GET", "/", nil)
+    r.RemoteAddr = "10.0.0.9:1234"
+    r.Header.Set("User-Agent", "Googlebot/2.1")
+    if !detectBot(&Config{}, r) {
+        t.Fatalf("expected UA-only detection when verification disabled")
+    }
+}
+
+func TestDetectBot_CIDRAllowDeny(t *testing.T) {
+    dir := t.TempDir()
+    file := filepath.Join(dir, "googlebot.json")
+    published := `{"creationTime":"2024-01-01","prefixes":[{"ipv4Prefix":"66.249.64.0/27"},{"ipv6Prefix":"2001:4860:4801:10::/64"}]}`
+    if err := os.WriteFile(file, []byte(published), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    cfg := &Config{
+        BotAllowCIDRs:      []string{"192.0.2.0/24"},
+        BotDenyCIDRs:       []string{"198.51.100.7"},
+        BotAllowCIDRFile:   file,
+        TrustXForwardedFor: true,
+    }
+    if err := reloadBotCIDRs(cfg); err != nil {
+        t.Fatal(err)
+    }
+
+    cases := []struct {
+        remote, xff, ua string
+        want            bool
+    }{
+        {"192.0.2.10:1000", "", "", true},
+        {"66.249.64.5:1000", "", "Mozilla/5.0", true},
+        {"[2001:4860:4801:10::1]:1000", "", "", true},
+        {"198.51.100.7:1000", "", "Googlebot/2.1", false},
+        {"10.0.0.1:1000", "1.2.3.4, 192.0.2.44", "", true},
+        {"10.0.0.1:1000", "192.0.2.44, 198.51.100.7", "Googlebot/2.1", false},
+        {"10.0.0.1:1000", "", "Mozilla/5.0", false},
+    }
+    for _, c := range cases {
+        r := httptest.NewRequest("GET", "/", nil)
+        r.RemoteAddr = c.remote
+        if c.xff != "" {
+            r.Header.Set("X-Forwarded-For", c.xff)
+        }
+        r.Header.Set("User-Agent", c.ua)
+        if got := detectBot(cfg, r); got != c.want {
+            t.Fatalf("detectBot(%s, xff=%q, ua=%q) = %v, want %v", c.remote, c.xff, c.ua, got, c.want)
+        }
+    }
+
+    if err := reloadBotCIDRs(&Config{BotAllowCIDRs: []string{"not-a-cidr"}}); err == nil {
+        t.Fatalf("expected error for invalid cidr")
+    }
+}
+
+func TestBotListsPerHandler(t *testing.T) {
+    cfgA := newTestCfg(t, "http://b.example")
+    cfgA.BotUAInclude = []string{"FetcherA"}
+    cfgA.BotAllowCIDRs = []string{"192.0.2.0/24"}
+    a := buildHandler(cfgA)
+    b := buildHandler(newTestCfg(t, "http://b.example"))
+
+    r := httptest.NewRequest("GET", "/", nil)
+    r.Header.Set("User-Agent", "FetcherA/1.0")
+    if !detectBot(a.config(), r) || detectBot(b.config(), r) {
+        t.Fatalf("UA list leaked between handlers")
+    }
+    r = httptest.NewRequest("GET", "/", nil)
+    r.RemoteAddr = "192.0.2.10:1000"
+    if !detectBot(a.config(), r) || detectBot(b.config(), r) {
+        t.Fatalf("CIDR list leaked between handlers")
+    }
+}
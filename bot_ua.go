@@ -0,0 +1,118 @@
+package rerouter
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+// botUAMatcher holds configurable UA substrings layered on top of the built-in list.
+// Lists are replaced as a whole under the lock on reload.
+type botUAMatcher struct {
+	mu      sync.RWMutex
+	include []string
+	exclude []string
+}
+
+func (m *botUAMatcher) set(include, exclude []string) {
+	m.mu.Lock()
+	m.include = include
+	m.exclude = exclude
+	m.mu.Unlock()
+}
+
+func (m *botUAMatcher) lists() (include, exclude []string) {
+	if m == nil {
+		return nil, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]string(nil), m.include...), append([]string(nil), m.exclude...)
+}
+
+// included reports whether the lowercased ua contains a configured include substring.
+func (m *botUAMatcher) included(ua string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.include {
+		if strings.Contains(ua, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// excluded reports whether the lowercased ua contains a configured exclude substring.
+func (m *botUAMatcher) excluded(ua string) bool {
+	if m == nil {
+		return false
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, k := range m.exclude {
+		if strings.Contains(ua, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadBotUA rebuilds cfg's matcher, creating it if cfg has none, from cfg
+// lists and cfg.BotUAFile. On a file read error the previous lists are kept.
+func reloadBotUA(cfg *Config) (include, exclude []string, err error) {
+	include = normalizeUASubstrings(cfg.BotUAInclude)
+	exclude = normalizeUASubstrings(cfg.BotUAExclude)
+	if cfg.BotUAFile != "" {
+		fi, fe, ferr := readBotUAFile(cfg.BotUAFile)
+		if ferr != nil {
+			return nil, nil, ferr
+		}
+		include = append(include, fi...)
+		exclude = append(exclude, fe...)
+	}
+	if cfg.botUA == nil {
+		cfg.botUA = &botUAMatcher{}
+	}
+	cfg.botUA.set(include, exclude)
+	return include, exclude, nil
+}
+
+// readBotUAFile parses one UA substring per line. Lines starting with "!" are
+// exclusions; blank lines and "#" comments are ignored.
+func readBotUAFile(path string) (include, exclude []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "!") {
+			if v := strings.ToLower(strings.TrimSpace(line[1:])); v != "" {
+				exclude = append(exclude, v)
+			}
+			continue
+		}
+		include = append(include, strings.ToLower(line))
+	}
+	return include, exclude, s.Err()
+}
+
+func normalizeUASubstrings(in []string) []string {
+	out := make([]string, 0, len(in))
+	for _, v := range in {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
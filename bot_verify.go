@@ -0,0 +1,160 @@
+package rerouter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// verifiableCrawler maps a UA substring to the reverse-DNS domains its operator publishes.
+type verifiableCrawler struct {
+	family  string
+	ua      []string
+	domains []string
+}
+
+var verifiableCrawlers = []verifiableCrawler{
+	{family: "google", ua: []string{"googlebot", "adsbot-google", "mediapartners-google", "apis-google", "feedfetcher-google", "google-inspectiontool", "googleother"}, domains: []string{".googlebot.com", ".google.com", ".googleusercontent.com"}},
+	{family: "bing", ua: []string{"bingbot", "msnbot", "bingpreview", "adidxbot"}, domains: []string{".search.msn.com"}},
+	{family: "baidu", ua: []string{"baiduspider"}, domains: []string{".baidu.com", ".baidu.jp"}},
+	{family: "yandex", ua: []string{"yandex"}, domains: []string{".yandex.ru", ".yandex.net", ".yandex.com"}},
+	{family: "apple", ua: []string{"applebot"}, domains: []string{".applebot.apple.com"}},
+	{family: "petal", ua: []string{"petalbot"}, domains: []string{".petalsearch.com"}},
+}
+
+const botVerifyCacheTTL = time.Hour
+const botVerifyLookupTimeout = 2 * time.Second
+
+// DNS lookups; replaced in tests.
+var (
+	lookupAddr = net.DefaultResolver.LookupAddr
+	lookupHost = net.DefaultResolver.LookupHost
+)
+
+type botVerifyResult struct {
+	ok  bool
+	exp time.Time
+}
+
+// botVerifyCache memoizes verification results per family and client IP.
+var botVerifyCache = struct {
+	mu sync.Mutex
+	m  map[string]botVerifyResult
+}{m: make(map[string]botVerifyResult)}
+
+// claimedCrawler returns the verifiable crawler the lowercased UA claims to be, if any.
+func claimedCrawler(ua string) (verifiableCrawler, bool) {
+	for _, c := range verifiableCrawlers {
+		for _, k := range c.ua {
+			if strings.Contains(ua, k) {
+				return c, true
+			}
+		}
+	}
+	return verifiableCrawler{}, false
+}
+
+// detectBot applies isBot and, when cfg.VerifyBots is set, confirms crawlers that
+// claim a verifiable identity via reverse DNS plus forward confirmation.
+// Spoofed claims are treated as humans.
+//
+// Client IP lists take precedence: denied ranges are never bots and allowed
+// ranges are bots even without a crawler UA.
+func detectBot(cfg *Config, r *http.Request) bool {
+	ip := clientIP(cfg, r)
+	if allowed, denied := cfg.botCIDRs.match(net.ParseIP(ip)); denied {
+		return false
+	} else if allowed {
+		return true
+	}
+	if !isBot(cfg, r) {
+		return false
+	}
+	if !cfg.VerifyBots || r.Header.Get("X-Bot") == "true" {
+		return true
+	}
+	c, ok := claimedCrawler(strings.ToLower(r.UserAgent()))
+	if !ok {
+		return true
+	}
+	if verifyCrawlerIP(r.Context(), c, ip) {
+		return true
+	}
+	logger.Infow("bot_verify_failed", map[string]interface{}{
+		"req_id": getRequestID(r.Context()),
+		"family": c.family,
+		"ip":     ip,
+		"ua":     r.UserAgent(),
+	})
+	return false
+}
+
+// verifyCrawlerIP performs reverse DNS on ip, checks the hostname against the
+// crawler's domains, then resolves the hostname forward to confirm it maps back to ip.
+func verifyCrawlerIP(ctx context.Context, c verifiableCrawler, ip string) bool {
+	if ip == "" {
+		return false
+	}
+	key := c.family + "|" + ip
+	now := time.Now()
+	botVerifyCache.mu.Lock()
+	if res, ok := botVerifyCache.m[key]; ok && now.Before(res.exp) {
+		botVerifyCache.mu.Unlock()
+		return res.ok
+	}
+	botVerifyCache.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, botVerifyLookupTimeout)
+	defer cancel()
+	ok := false
+	names, err := lookupAddr(ctx, ip)
+	if err == nil {
+	names:
+		for _, name := range names {
+			host := strings.ToLower(strings.TrimSuffix(name, "."))
+			if !hasAnySuffix(host, c.domains) {
+				continue
+			}
+			addrs, err := lookupHost(ctx, host)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				if net.ParseIP(a).Equal(net.ParseIP(ip)) {
+					ok = true
+					break names
+				}
+			}
+		}
+	}
+	// Do not cache transient resolver failures (e.g. timeouts) as negative results
+	if err != nil && ctx.Err() != nil {
+		return false
+	}
+
+	botVerifyCache.mu.Lock()
+	if len(botVerifyCache.m) > 10000 {
+		for k, v := range botVerifyCache.m {
+			if now.After(v.exp) {
+				delete(botVerifyCache.m, k)
+			}
+		}
+	}
+	botVerifyCache.m[key] = botVerifyResult{ok: ok, exp: now.Add(botVerifyCacheTTL)}
+	botVerifyCache.mu.Unlock()
+	return ok
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suf := range suffixes {
+		if strings.HasSuffix(s, suf) {
+			return true
+		}
+	}
+	return false
+}
@@ -1,24 +1,74 @@
-package main
+package rerouter
 
 import (
+    "bytes"
+    "compress/gzip"
     "crypto/sha1"
     "encoding/hex"
     "encoding/json"
     "errors"
+    "io"
     "net/url"
     "os"
     "path/filepath"
+    "runtime"
     "strings"
     "time"
 )
 
+// cacheFormatV2 entries keep only metadata in the JSON file; the body lives in
+// a raw blob beside it (see cacheBodyPath). Entries without Format are v1 and
+// carry the body inline as base64.
+const cacheFormatV2 = 2
+
 type cacheEntry struct {
+    Format    int               `json:"format,omitempty"`
     URL       string            `json:"url"`
     CreatedAt int64             `json:"created_at"`
     ExpiresAt int64             `json:"expires_at"`
     Status    int               `json:"status"`
     Header    map[string]string `json:"header"`
-    Body      []byte            `json:"body"`
+    // Inline only in v1 files; v2 stores it in the body blob.
+    Body []byte `json:"body,omitempty"`
+    // Uncompressed body length, used to list entries and detect torn writes.
+    BodySize int `json:"body_size"`
+    // Storage encoding of the body blob: "" (raw) or "gzip". Bodies in memory are always decoded.
+    BodyEncoding string `json:"body_encoding,omitempty"`
+    // Upstream validators kept for conditional revalidation, even when the
+    // served headers drop them after rewriting.
+    UpstreamETag         string `json:"upstream_etag,omitempty"`
+    UpstreamLastModified string `json:"upstream_last_modified,omitempty"`
+    // Vary key of the stored representation (see cacheVariant); empty for the default.
+    Variant string `json:"variant,omitempty"`
+    // Purge tags from CACHE_TAG_RULES and upstream Surrogate-Key/Cache-Tag headers.
+    Tags []string `json:"tags,omitempty"`
+}
+
+// cacheBodyEncoding returns the blob encoding for a newly written entry of the
+// given content type. Already compressed media is stored raw.
+func cacheBodyEncoding(cfg *Config, contentType string) string {
+    if cfg.CacheCompress && !isCompressedMediaType(contentType) {
+        return "gzip"
+    }
+    return ""
+}
+
+// isCompressedMediaType reports whether gzip would gain nothing on contentType
+// (raster images, audio/video, woff fonts, archives). SVG stays compressible.
+func isCompressedMediaType(contentType string) bool {
+    ct := strings.ToLower(contentType)
+    switch {
+    case strings.HasPrefix(ct, "image/"):
+        return !strings.Contains(ct, "svg") && !strings.Contains(ct, "x-icon") && !strings.Contains(ct, "bmp")
+    case strings.HasPrefix(ct, "video/"), strings.HasPrefix(ct, "audio/"), strings.HasPrefix(ct, "font/woff"):
+        return true
+    }
+    for _, t := range []string{"application/zip", "application/gzip", "application/x-gzip", "application/pdf", "application/font-woff"} {
+        if strings.HasPrefix(ct, t) {
+            return true
+        }
+    }
+    return false
 }
 
 // cacheFilePathForURL returns the absolute path for the cache JSON file for a given absolute URL.
@@ -26,6 +76,12 @@ type cacheEntry struct {
 // - Root path -> .../<host>/index.json
 // - Query string -> append short hash suffix to avoid collisions: index.<hash8>.json
 func cacheFilePathForURL(cacheDir, rawURL string) (string, error) {
+    return cacheFilePathForVariant(cacheDir, rawURL, "")
+}
+
+// cacheFilePathForVariant is cacheFilePathForURL for a vary variant, stored
+// next to the default file as index[.<hash8>]@<variant>.json.
+func cacheFilePathForVariant(cacheDir, rawURL, variant string) (string, error) {
     u, err := url.Parse(rawURL)
     if err != nil {
         return "", err
@@ -34,12 +90,12 @@ func cacheFilePathForURL(cacheDir, rawURL string) (string, error) {
     // Normalize path
     p := strings.Trim(u.EscapedPath(), "/")
     // Build directory: host + path segments
-    dir := filepath.Join(cacheDir, host)
+    dir := filepath.Join(cacheDir, cacheSegmentName(host))
     if p != "" {
         // Split on '/'; filepath.Join will handle platform separators
         for _, seg := range strings.Split(p, "/") {
             if seg == "" { continue }
-            dir = filepath.Join(dir, seg)
+            dir = filepath.Join(dir, cacheSegmentName(seg))
         }
     }
     // File name
@@ -49,14 +105,122 @@ func cacheFilePathForURL(cacheDir, rawURL string) (string, error) {
         h := sha1.Sum([]byte(u.RequestURI()))
         name = "index." + hex.EncodeToString(h[:4]) + ".json" // 8 hex chars
     }
+    if variant != "" {
+        if strings.Trim(variant, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+            return "", errors.New("invalid cache variant")
+        }
+        name = strings.TrimSuffix(name, ".json") + "@" + variant + ".json"
+    }
     return filepath.Join(dir, name), nil
 }
 
+// maxCacheSegmentBytes bounds one directory name of the cache layout; most
+// filesystems refuse names over 255 bytes (ENAMETOOLONG).
+const maxCacheSegmentBytes = 200
+
+// cacheSegmentName returns URL path segment (or host) seg as a directory
+// name: seg itself when it is safe, otherwise a readable prefix, "#" and a
+// hash of seg. "#" never appears in an escaped path, so hashed names cannot
+// collide with literal segments.
+func cacheSegmentName(seg string) string {
+    if !unsafeCacheSegment(seg) {
+        return seg
+    }
+    prefix := strings.Map(func(r rune) rune {
+        if r > 0x7e || strings.ContainsRune(`.:*`, r) {
+            return '_'
+        }
+        return r
+    }, seg)
+    if len(prefix) > 64 {
+        prefix = prefix[:64]
+    }
+    h := sha1.Sum([]byte(seg))
+    return prefix + "#" + hex.EncodeToString(h[:8])
+}
+
+// unsafeCacheSegment reports whether seg cannot be used as a directory name
+// as is: "." and "..", which would climb out of the host directory, names
+// over maxCacheSegmentBytes, and on Windows names with ":" or "*", a trailing
+// dot or a reserved device name.
+func unsafeCacheSegment(seg string) bool {
+    if seg == "." || seg == ".." || len(seg) > maxCacheSegmentBytes {
+        return true
+    }
+    if runtime.GOOS != "windows" {
+        return false
+    }
+    if strings.ContainsAny(seg, ":*") || strings.HasSuffix(seg, ".") {
+        return true
+    }
+    base, _, _ := strings.Cut(strings.ToUpper(seg), ".")
+    switch base {
+    case "CON", "PRN", "AUX", "NUL":
+        return true
+    }
+    return len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) && base[3] >= '1' && base[3] <= '9'
+}
+
+// cacheVariantFiles lists the vary variant files stored beside the default cache file p.
+func cacheVariantFiles(p string) []string {
+    prefix := strings.TrimSuffix(filepath.Base(p), ".json") + "@"
+    entries, err := os.ReadDir(filepath.Dir(p))
+    if err != nil {
+        return nil
+    }
+    var out []string
+    for _, e := range entries {
+        if !e.IsDir() && strings.HasPrefix(e.Name(), prefix) && strings.HasSuffix(e.Name(), ".json") {
+            out = append(out, filepath.Join(filepath.Dir(p), e.Name()))
+        }
+    }
+    return out
+}
+
 func readCacheByURL(cacheDir, rawURL string) (*cacheEntry, error) {
-    p, err := cacheFilePathForURL(cacheDir, rawURL)
+    return readCacheVariant(cacheDir, rawURL, "")
+}
+
+// readCacheVariant reads the fresh entry stored for a vary variant of rawURL.
+func readCacheVariant(cacheDir, rawURL, variant string) (*cacheEntry, error) {
+    ce, err := readStaleCacheVariant(cacheDir, rawURL, variant)
     if err != nil {
         return nil, err
     }
+    if time.Now().Unix() >= ce.ExpiresAt {
+        return nil, errors.New("cache expired")
+    }
+    return ce, nil
+}
+
+// readStaleCacheByURL reads a cache entry without checking its expiry.
+func readStaleCacheByURL(cacheDir, rawURL string) (*cacheEntry, error) {
+    return readStaleCacheVariant(cacheDir, rawURL, "")
+}
+
+// readStaleCacheVariant reads a variant entry without checking its expiry.
+func readStaleCacheVariant(cacheDir, rawURL, variant string) (*cacheEntry, error) {
+    p, err := cacheFilePathForVariant(cacheDir, rawURL, variant)
+    if err != nil {
+        return nil, err
+    }
+    ce, err := readCacheFile(p)
+    if err != nil && os.IsNotExist(err) {
+        // Local miss: read through from the bucket mirror, if any
+        if rc := remoteCacheFor(cacheDir); rc != nil && rc.fetch(p) == nil {
+            return readCacheFile(p)
+        }
+    }
+    return ce, err
+}
+
+// cacheBodyPath returns the body blob path for the metadata file p.
+func cacheBodyPath(p string) string {
+    return strings.TrimSuffix(p, ".json") + ".body"
+}
+
+// readCacheMeta reads the metadata file p without loading a v2 body blob.
+func readCacheMeta(p string) (*cacheEntry, error) {
     b, err := os.ReadFile(p)
     if err != nil {
         return nil, err
@@ -65,37 +229,138 @@ func readCacheByURL(cacheDir, rawURL string) (*cacheEntry, error) {
     if err := json.Unmarshal(b, &ce); err != nil {
         return nil, err
     }
-    if time.Now().Unix() >= ce.ExpiresAt {
-        return nil, errors.New("cache expired")
+    if ce.Format < cacheFormatV2 {
+        ce.BodySize = len(ce.Body)
     }
     return &ce, nil
 }
 
+// readCacheFile reads the entry at metadata path p together with its body.
+func readCacheFile(p string) (*cacheEntry, error) {
+    ce, err := readCacheMeta(p)
+    if err != nil || ce.Format < cacheFormatV2 {
+        return ce, err
+    }
+    b, err := os.ReadFile(cacheBodyPath(p))
+    if err != nil {
+        return nil, err
+    }
+    if ce.BodyEncoding == "gzip" {
+        zr, err := gzip.NewReader(bytes.NewReader(b))
+        if err != nil {
+            return nil, err
+        }
+        if b, err = io.ReadAll(zr); err != nil {
+            return nil, err
+        }
+    }
+    if len(b) != ce.BodySize {
+        // Metadata and blob from different writes; treat as a miss
+        return nil, errors.New("cache body size mismatch")
+    }
+    ce.Body = b
+    return ce, nil
+}
+
+// writeCacheByURL stores ce under rawURL, in the file for ce.Variant.
 func writeCacheByURL(cacheDir, rawURL string, ce *cacheEntry) error {
-    p, err := cacheFilePathForURL(cacheDir, rawURL)
+    p, err := cacheFilePathForVariant(cacheDir, rawURL, ce.Variant)
     if err != nil {
         return err
     }
     if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
         return err
     }
-    tmp := p + ".tmp"
-    b, err := json.Marshal(ce)
+    // Body blob first, so the metadata never points at a missing body
+    body := ce.Body
+    if ce.BodyEncoding == "gzip" {
+        var buf bytes.Buffer
+        zw := gzip.NewWriter(&buf)
+        if _, err := zw.Write(body); err != nil {
+            return err
+        }
+        if err := zw.Close(); err != nil {
+            return err
+        }
+        body = buf.Bytes()
+    }
+    if err := writeFileAtomic(cacheBodyPath(p), body); err != nil {
+        return err
+    }
+    return writeCacheMeta(cacheDir, p, ce)
+}
+
+// writeCacheMeta rewrites only the v2 metadata file p, e.g. to extend expiry,
+// and records it in the cache index.
+func writeCacheMeta(cacheDir, p string, ce *cacheEntry) error {
+    meta := *ce
+    meta.Format = cacheFormatV2
+    meta.Body = nil
+    meta.BodySize = len(ce.Body)
+    b, err := json.Marshal(&meta)
     if err != nil {
         return err
     }
+    if err := writeFileAtomic(p, b); err != nil {
+        return err
+    }
+    cacheIndexFor(cacheDir).put(p, &meta)
+    if rc := remoteCacheFor(cacheDir); rc != nil {
+        rc.upload(p)
+    }
+    return nil
+}
+
+func writeFileAtomic(p string, b []byte) error {
+    tmp := p + ".tmp"
     if err := os.WriteFile(tmp, b, 0o644); err != nil {
         return err
     }
     return os.Rename(tmp, p)
 }
 
-// walkCacheJSONFiles lists all .json files recursively under cacheDir.
+// removeCacheFile deletes the metadata file p and its body blob, if any, and
+// drops it from the cache index and the bucket mirror.
+func removeCacheFile(cacheDir, p string) error {
+    if rc := remoteCacheFor(cacheDir); rc != nil {
+        // Even when missing locally: another instance may have uploaded it
+        rc.remove(p)
+    }
+    err := os.Remove(p)
+    if err == nil || os.IsNotExist(err) {
+        cacheIndexFor(cacheDir).remove(p)
+    }
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(cacheBodyPath(p)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+// cacheFileSize returns the on-disk size of the entry at p, metadata plus body blob.
+func cacheFileSize(p string) int64 {
+    var n int64
+    for _, f := range []string{p, cacheBodyPath(p)} {
+        if st, err := os.Stat(f); err == nil {
+            n += st.Size()
+        }
+    }
+    return n
+}
+
+// walkCacheJSONFiles lists all .json files recursively under cacheDir,
+// skipping the sitemap warm job snapshots in <cacheDir>/jobs.
 func walkCacheJSONFiles(cacheDir string) ([]string, error) {
     paths := []string{}
+    jobsDir := sitemapWarmJobsDir(cacheDir)
     _ = filepath.WalkDir(cacheDir, func(p string, d os.DirEntry, err error) error {
         if err != nil { return nil }
-        if d.IsDir() { return nil }
+        if d.IsDir() {
+            if p == jobsDir { return filepath.SkipDir }
+            return nil
+        }
         if strings.HasSuffix(strings.ToLower(d.Name()), ".json") {
             paths = append(paths, p)
         }
@@ -0,0 +1,83 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Upstream response markers accepted in cfg.CacheBypassResponse.
+const (
+	cacheBypassHeader    = "header"
+	cacheBypassPrivate   = "private"
+	cacheBypassSetCookie = "set-cookie"
+	cacheBypassNone      = "none"
+)
+
+// noCacheHeader is the response header B sets to keep a page out of the cache.
+// It is not passed on to clients.
+const noCacheHeader = "X-Rerouter-No-Cache"
+
+// normalizeCacheBypassResponse lowercases the markers in list and rejects
+// unknown ones.
+func normalizeCacheBypassResponse(list []string) error {
+	for i, m := range list {
+		m = strings.ToLower(strings.TrimSpace(m))
+		list[i] = m
+		switch m {
+		case cacheBypassHeader, cacheBypassPrivate, cacheBypassSetCookie:
+		case cacheBypassNone:
+			if len(list) > 1 {
+				return fmt.Errorf("%q cannot be combined with other markers", m)
+			}
+		default:
+			return fmt.Errorf("unknown marker %q (want header, private, set-cookie or none)", m)
+		}
+	}
+	return nil
+}
+
+// responseBypassReason returns the configured marker that keeps an upstream
+// response with headers h out of the cache, or "" when it may be cached.
+func responseBypassReason(cfg *Config, h http.Header) string {
+	if h == nil {
+		return ""
+	}
+	for _, m := range cfg.CacheBypassResponse {
+		switch m {
+		case cacheBypassHeader:
+			if h.Get(noCacheHeader) != "" {
+				return m
+			}
+		case cacheBypassPrivate:
+			if cacheControlNoStore(h) {
+				return m
+			}
+		case cacheBypassSetCookie:
+			if len(h.Values("Set-Cookie")) > 0 {
+				return m
+			}
+		}
+	}
+	return ""
+}
+
+// requestBypassCookie returns the name of the first cookie on r matching
+// cfg.CacheBypassCookies, or "" when r may be served from the cache.
+func requestBypassCookie(cfg *Config, r *http.Request) string {
+	if len(cfg.CacheBypassCookies) == 0 || r.Header.Get("Cookie") == "" {
+		return ""
+	}
+	for _, c := range r.Cookies() {
+		for _, want := range cfg.CacheBypassCookies {
+			if prefix, ok := strings.CutSuffix(want, "*"); ok {
+				if strings.HasPrefix(c.Name, prefix) {
+					return c.Name
+				}
+			} else if c.Name == want {
+				return c.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package rerouter
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"rerouter/logger"
+)
+
+// cacheIndexFileName is the journal of index changes kept in the cache root.
+const cacheIndexFileName = "cache-index.jsonl"
+
+// cacheIndexEntry is the indexed metadata of one cache file, enough to list
+// and purge entries without opening them.
+type cacheIndexEntry struct {
+	URL       string   `json:"url"`
+	File      string   `json:"file"`
+	Variant   string   `json:"variant,omitempty"`
+	Status    int      `json:"status"`
+	CreatedAt int64    `json:"created_at"`
+	ExpiresAt int64    `json:"expires_at"`
+	SizeBytes int64    `json:"size_bytes"`
+	BodyBytes int      `json:"body_bytes"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// cacheIndexOp is one journal line: a put of Entry or a delete of File.
+type cacheIndexOp struct {
+	Op    string           `json:"op"`
+	File  string           `json:"file,omitempty"`
+	Entry *cacheIndexEntry `json:"entry,omitempty"`
+}
+
+// cacheIndex maps cache files (relative to the cache root) to their metadata.
+// It is loaded from an append-only journal, rebuilt by walking the cache when
+// the journal is missing or has a damaged line, and compacted once stale lines
+// outnumber live ones. A JSONL journal rather than SQLite or bbolt keeps the
+// module free of dependencies; the whole index lives in memory anyway.
+type cacheIndex struct {
+	dir  string
+	once sync.Once
+
+	mu      sync.RWMutex
+	entries map[string]cacheIndexEntry
+	journal *os.File
+	lines   int
+}
+
+var cacheIndexes sync.Map // cleaned cache dir -> *cacheIndex
+
+// cacheIndexFor returns the index of cacheDir, loading it on first use.
+func cacheIndexFor(cacheDir string) *cacheIndex {
+	dir := filepath.Clean(cacheDir)
+	v, _ := cacheIndexes.LoadOrStore(dir, &cacheIndex{dir: dir})
+	ix := v.(*cacheIndex)
+	ix.once.Do(ix.load)
+	return ix
+}
+
+func (ix *cacheIndex) journalPath() string {
+	return filepath.Join(ix.dir, cacheIndexFileName)
+}
+
+func (ix *cacheIndex) load() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.entries = map[string]cacheIndexEntry{}
+	f, err := os.Open(ix.journalPath())
+	if err != nil {
+		ix.rebuildLocked()
+		return
+	}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	corrupt := false
+	for sc.Scan() {
+		var op cacheIndexOp
+		if json.Unmarshal(sc.Bytes(), &op) != nil {
+			corrupt = true
+			continue
+		}
+		ix.lines++
+		switch {
+		case op.Op == "put" && op.Entry != nil:
+			ix.entries[op.Entry.File] = *op.Entry
+		case op.Op == "del":
+			delete(ix.entries, op.File)
+		}
+	}
+	f.Close()
+	if corrupt || sc.Err() != nil {
+		// A write torn by a crash loses the entry it was journaling; the cache
+		// files are the source of truth
+		logger.Warnw("cache_index_corrupt", map[string]interface{}{"dir": ix.dir})
+		ix.rebuildLocked()
+		return
+	}
+	ix.compactLocked()
+}
+
+// rebuildLocked re-reads every cache file's metadata and rewrites the journal.
+func (ix *cacheIndex) rebuildLocked() {
+	ix.entries = map[string]cacheIndexEntry{}
+	files, _ := walkCacheJSONFiles(ix.dir)
+	for _, p := range files {
+		ce, err := readCacheMeta(p)
+		if err != nil || ce.URL == "" {
+			continue
+		}
+		e := ix.entryFor(p, ce)
+		ix.entries[e.File] = e
+	}
+	ix.compactLocked()
+}
+
+// rebuild discards the index and rebuilds it from the cache files, e.g. after
+// files were changed outside rerouter. It returns the number of entries.
+func (ix *cacheIndex) rebuild() int {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.rebuildLocked()
+	return len(ix.entries)
+}
+
+// compactLocked rewrites the journal as one put per live entry and reopens it
+// for appending. Without a writable journal the index stays memory-only.
+func (ix *cacheIndex) compactLocked() {
+	if ix.journal != nil {
+		ix.journal.Close()
+		ix.journal = nil
+	}
+	if err := ix.writeJournalLocked(); err != nil {
+		logger.Warnw("cache_index_write_error", map[string]interface{}{"err": err.Error(), "dir": ix.dir})
+		return
+	}
+	ix.lines = len(ix.entries)
+	f, err := os.OpenFile(ix.journalPath(), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		logger.Warnw("cache_index_write_error", map[string]interface{}{"err": err.Error(), "dir": ix.dir})
+		return
+	}
+	ix.journal = f
+}
+
+func (ix *cacheIndex) writeJournalLocked() error {
+	if err := os.MkdirAll(ix.dir, 0o755); err != nil {
+		return err
+	}
+	tmp := ix.journalPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range ix.entries {
+		e := e
+		if err := enc.Encode(cacheIndexOp{Op: "put", Entry: &e}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ix.journalPath())
+}
+
+// appendLocked journals op, compacting when most lines are superseded.
+func (ix *cacheIndex) appendLocked(op cacheIndexOp) {
+	if ix.journal == nil {
+		return
+	}
+	b, _ := json.Marshal(op)
+	if _, err := ix.journal.Write(append(b, '\n')); err != nil {
+		logger.Warnw("cache_index_write_error", map[string]interface{}{"err": err.Error(), "dir": ix.dir})
+		return
+	}
+	ix.lines++
+	if ix.lines > 2*len(ix.entries)+1000 {
+		ix.compactLocked()
+	}
+}
+
+func (ix *cacheIndex) rel(p string) string {
+	if r, err := filepath.Rel(ix.dir, p); err == nil {
+		return filepath.ToSlash(r)
+	}
+	return filepath.ToSlash(p)
+}
+
+func (ix *cacheIndex) entryFor(p string, ce *cacheEntry) cacheIndexEntry {
+	return cacheIndexEntry{
+		URL:       ce.URL,
+		File:      ix.rel(p),
+		Variant:   ce.Variant,
+		Status:    ce.Status,
+		CreatedAt: ce.CreatedAt,
+		ExpiresAt: ce.ExpiresAt,
+		SizeBytes: cacheFileSize(p),
+		BodyBytes: ce.BodySize,
+		Tags:      ce.Tags,
+	}
+}
+
+// put records the entry just written to metadata file p.
+func (ix *cacheIndex) put(p string, ce *cacheEntry) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	e := ix.entryFor(p, ce)
+	ix.entries[e.File] = e
+	ix.appendLocked(cacheIndexOp{Op: "put", Entry: &e})
+}
+
+// remove drops metadata file p from the index.
+func (ix *cacheIndex) remove(p string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	f := ix.rel(p)
+	if _, ok := ix.entries[f]; !ok {
+		return
+	}
+	delete(ix.entries, f)
+	ix.appendLocked(cacheIndexOp{Op: "del", File: f})
+}
+
+// path returns the metadata file path of an indexed entry.
+func (ix *cacheIndex) path(e cacheIndexEntry) string {
+	return filepath.Join(ix.dir, filepath.FromSlash(e.File))
+}
+
+// totals returns the number of indexed entries and their summed size.
+func (ix *cacheIndex) totals() (entries int, bytes int64) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	for _, e := range ix.entries {
+		bytes += e.SizeBytes
+	}
+	return len(ix.entries), bytes
+}
+
+// snapshot returns the indexed entries sorted by URL, then file.
+func (ix *cacheIndex) snapshot() []cacheIndexEntry {
+	ix.mu.RLock()
+	out := make([]cacheIndexEntry, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		out = append(out, e)
+	}
+	ix.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].URL != out[j].URL {
+			return out[i].URL < out[j].URL
+		}
+		return out[i].File < out[j].File
+	})
+	return out
+}
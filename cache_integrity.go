@@ -0,0 +1,311 @@
+package rerouter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// cacheCheckGrace is how old a file must be before the integrity scan
+// touches it, so writes still in progress are left alone.
+const cacheCheckGrace = 10 * time.Minute
+
+// cacheCheckResult counts what one integrity scan found and did.
+type cacheCheckResult struct {
+	Scanned int `json:"scanned"`
+	// Corrupt metadata files did not parse (crashed or truncated writes).
+	Corrupt int `json:"corrupt"`
+	// Truncated entries had a missing or short body blob.
+	Truncated int `json:"truncated"`
+	// Misplaced entries were stored under a path their URL does not map to.
+	Misplaced int `json:"misplaced"`
+	// Repaired entries were moved to their path or fetched again from the
+	// bucket mirror; the other bad ones were deleted.
+	Repaired   int `json:"repaired"`
+	Deleted    int `json:"deleted"`
+	TmpRemoved int `json:"tmp_removed"`
+	// Orphans are body blobs without metadata.
+	Orphans int `json:"orphans"`
+	// IndexStale counts index entries whose file was gone.
+	IndexStale int `json:"index_stale"`
+}
+
+func (r *cacheCheckResult) add(o cacheCheckResult) {
+	r.Scanned += o.Scanned
+	r.Corrupt += o.Corrupt
+	r.Truncated += o.Truncated
+	r.Misplaced += o.Misplaced
+	r.Repaired += o.Repaired
+	r.Deleted += o.Deleted
+	r.TmpRemoved += o.TmpRemoved
+	r.Orphans += o.Orphans
+	r.IndexStale += o.IndexStale
+}
+
+// cacheChecker runs the periodic integrity scans of one appHandler and
+// keeps their totals for the system_metrics log line.
+type cacheChecker struct {
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu     sync.Mutex
+	runs   int
+	totals cacheCheckResult
+}
+
+func newCacheChecker() *cacheChecker {
+	return &cacheChecker{stop: make(chan struct{})}
+}
+
+// run scans the cache dir every CacheCheckIntervalMinutes of the current
+// config until close; with the interval at 0 it only watches for it to be set.
+func (c *cacheChecker) run(cfg func() *Config) {
+	for {
+		minutes := cfg().CacheCheckIntervalMinutes
+		wait := time.Duration(minutes) * time.Minute
+		if minutes <= 0 {
+			wait = time.Minute
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(wait):
+		}
+		if cur := cfg(); cur.CacheCheckIntervalMinutes > 0 {
+			c.check(cur.CacheDir)
+		}
+	}
+}
+
+func (c *cacheChecker) close() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// check runs one scan of cacheDir, logs what it found and adds it to the totals.
+func (c *cacheChecker) check(cacheDir string) cacheCheckResult {
+	start := time.Now()
+	res := checkCacheDir(cacheDir, start.Add(-cacheCheckGrace))
+	c.mu.Lock()
+	c.runs++
+	c.totals.add(res)
+	c.mu.Unlock()
+	fields := map[string]interface{}{
+		"scanned": res.Scanned, "corrupt": res.Corrupt, "truncated": res.Truncated, "misplaced": res.Misplaced,
+		"repaired": res.Repaired, "deleted": res.Deleted, "tmp_removed": res.TmpRemoved, "orphans": res.Orphans,
+		"index_stale": res.IndexStale, "duration_ms": time.Since(start).Milliseconds(),
+	}
+	if res.Corrupt+res.Truncated+res.Misplaced+res.TmpRemoved+res.Orphans+res.IndexStale > 0 {
+		logger.Warnw("cache_check", fields)
+	} else {
+		logger.Infow("cache_check", fields)
+	}
+	return res
+}
+
+// metrics reports the scan totals since start.
+func (c *cacheChecker) metrics() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := c.totals
+	return map[string]interface{}{
+		"cache_check_runs":      c.runs,
+		"cache_check_corrupt":   t.Corrupt,
+		"cache_check_truncated": t.Truncated,
+		"cache_check_misplaced": t.Misplaced,
+		"cache_check_repaired":  t.Repaired,
+		"cache_check_deleted":   t.Deleted,
+		"cache_check_tmp":       t.TmpRemoved,
+		"cache_check_orphans":   t.Orphans,
+	}
+}
+
+// checkCacheDir scans the entries under cacheDir, leaving files modified
+// after cutoff alone. Root files (index journal, bot stats) and the warm job
+// snapshots are not cache entries and are skipped.
+func checkCacheDir(cacheDir string, cutoff time.Time) cacheCheckResult {
+	var res cacheCheckResult
+	cacheDir = filepath.Clean(cacheDir)
+	jobsDir := sitemapWarmJobsDir(cacheDir)
+	var metas, bodies []string
+	_ = filepath.WalkDir(cacheDir, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if p == jobsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(p) == cacheDir {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		switch {
+		case strings.HasSuffix(p, ".tmp"):
+			// Left by a write that crashed before its rename
+			if os.Remove(p) == nil {
+				res.TmpRemoved++
+			}
+		case strings.HasSuffix(p, ".json"):
+			metas = append(metas, p)
+		case strings.HasSuffix(p, ".body"):
+			bodies = append(bodies, p)
+		}
+		return nil
+	})
+	for _, p := range metas {
+		res.Scanned++
+		checkCacheEntry(cacheDir, p, cutoff, &res)
+	}
+	for _, b := range bodies {
+		meta := strings.TrimSuffix(b, ".body") + ".json"
+		if _, err := os.Stat(meta); os.IsNotExist(err) && os.Remove(b) == nil {
+			res.Orphans++
+		}
+	}
+	ix := cacheIndexFor(cacheDir)
+	for _, e := range ix.snapshot() {
+		p := ix.path(e)
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			ix.remove(p)
+			res.IndexStale++
+		}
+	}
+	return res
+}
+
+// checkCacheEntry checks the entry at metadata path p and repairs or
+// deletes it when it is unreadable or misplaced.
+func checkCacheEntry(cacheDir, p string, cutoff time.Time, res *cacheCheckResult) {
+	if st, err := os.Stat(cacheBodyPath(p)); err == nil && st.ModTime().After(cutoff) {
+		return // being rewritten
+	}
+	ce, err := readCacheMeta(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		res.Corrupt++
+		repairCacheEntry(cacheDir, p, res)
+		return
+	}
+	if _, err := readCacheFile(p); err != nil {
+		res.Truncated++
+		repairCacheEntry(cacheDir, p, res)
+		return
+	}
+	want, err := cacheFilePathForVariant(cacheDir, ce.URL, ce.Variant)
+	if err == nil && (ce.URL == "" || want == p) {
+		return
+	}
+	res.Misplaced++
+	if err == nil && ce.URL != "" {
+		moved, err := relocateCacheEntry(cacheDir, p, want, ce)
+		if moved {
+			res.Repaired++
+		} else if err == nil {
+			res.Deleted++
+		}
+		return
+	}
+	if removeCacheFile(cacheDir, p) == nil {
+		res.Deleted++
+	}
+}
+
+// relocateCacheEntry moves the entry at p to want, the path its URL maps
+// to, or deletes it when want already holds an entry. moved reports which.
+func relocateCacheEntry(cacheDir, p, want string, ce *cacheEntry) (moved bool, err error) {
+	if _, err := os.Stat(want); err == nil {
+		return false, removeCacheFile(cacheDir, p)
+	}
+	if err := moveCacheEntry(cacheDir, p, want, ce); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// MigrateCache moves the entries of cacheDir stored under an older cache
+// layout, e.g. before long or unsafe path segments were hashed, to the path
+// their URL maps to now. An entry whose new path is already taken is
+// deleted. It returns how many entries it moved and deleted; the scans run
+// by CacheCheckIntervalMinutes do the same for a running instance.
+func MigrateCache(cacheDir string) (moved, deleted int, err error) {
+	cacheDir = filepath.Clean(cacheDir)
+	files, err := walkCacheJSONFiles(cacheDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, p := range files {
+		if filepath.Dir(p) == cacheDir {
+			continue // index, bot stats and other root files
+		}
+		ce, rerr := readCacheMeta(p)
+		if rerr != nil || ce.URL == "" {
+			continue
+		}
+		want, werr := cacheFilePathForVariant(cacheDir, ce.URL, ce.Variant)
+		if werr != nil || want == p {
+			continue
+		}
+		ok, merr := relocateCacheEntry(cacheDir, p, want, ce)
+		switch {
+		case ok:
+			moved++
+		case merr == nil:
+			deleted++
+		case err == nil:
+			err = merr
+		}
+	}
+	return moved, deleted, err
+}
+
+// repairCacheEntry replaces the broken entry at p with the bucket mirror's
+// copy when there is one, and deletes it otherwise.
+func repairCacheEntry(cacheDir, p string, res *cacheCheckResult) {
+	if rc := remoteCacheFor(cacheDir); rc != nil {
+		os.Remove(p)
+		os.Remove(cacheBodyPath(p))
+		cacheIndexFor(cacheDir).remove(p)
+		if rc.fetch(p) == nil {
+			if _, err := readCacheFile(p); err == nil {
+				res.Repaired++
+				return
+			}
+		}
+	}
+	if err := removeCacheFile(cacheDir, p); err == nil || os.IsNotExist(err) {
+		res.Deleted++
+	}
+}
+
+// moveCacheEntry moves the entry at p, body blob first, to the path its URL
+// maps to.
+func moveCacheEntry(cacheDir, p, want string, ce *cacheEntry) error {
+	if err := os.MkdirAll(filepath.Dir(want), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(cacheBodyPath(p), cacheBodyPath(want)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(p, want); err != nil {
+		return err
+	}
+	ix := cacheIndexFor(cacheDir)
+	ix.remove(p)
+	ix.put(want, ce)
+	if rc := remoteCacheFor(cacheDir); rc != nil {
+		rc.remove(p)
+		rc.upload(want)
+	}
+	return nil
+}
@@ -0,0 +1,656 @@
+package rerouter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rerouter/logger"
+)
+
+const (
+	// remoteCacheQueueSize bounds the uploads and deletes waiting for the bucket;
+	// past it new ones are dropped and the entry stays local only.
+	remoteCacheQueueSize = 1024
+	// remoteCacheMissTTL is how long a key found missing in the bucket is not
+	// asked for again, so uncached URLs cost one lookup rather than one per request.
+	remoteCacheMissTTL   = 30 * time.Second
+	remoteCacheMaxMisses = 10000
+	// remoteCacheHydrateWorkers download entries in parallel when refilling CacheDir.
+	remoteCacheHydrateWorkers = 4
+	remoteCacheTimeout        = 30 * time.Second
+)
+
+// s3Store talks to one S3-compatible bucket with SigV4-signed requests.
+type s3Store struct {
+	base   *url.URL // bucket URL, path-style or virtual-hosted
+	prefix string   // key prefix, without leading or trailing slash
+	region string
+	keyID  string
+	secret string
+	client *http.Client
+}
+
+func newS3Store(cfg *Config) (*s3Store, error) {
+	u, err := url.Parse(cfg.CacheS3URL)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{
+		base:   u,
+		prefix: strings.Trim(cfg.CacheS3Prefix, "/"),
+		region: cfg.CacheS3Region,
+		keyID:  cfg.CacheS3AccessKeyID,
+		secret: cfg.CacheS3SecretAccessKey,
+		client: &http.Client{Timeout: remoteCacheTimeout},
+	}, nil
+}
+
+// errRemoteNotFound is returned for keys missing from the bucket.
+var errRemoteNotFound = errors.New("not found in bucket")
+
+// objectKey returns the bucket key of cache-relative key k.
+func (s *s3Store) objectKey(k string) string {
+	if s.prefix == "" {
+		return k
+	}
+	return s.prefix + "/" + k
+}
+
+// do sends a signed request for objectKey (or the bucket itself when empty)
+// and returns the response of a 2xx status.
+func (s *s3Store) do(ctx context.Context, method, objectKey string, query url.Values, body []byte) (*http.Response, error) {
+	u := *s.base
+	p := strings.TrimRight(s.base.EscapedPath(), "/") + "/" + awsURIEscape(objectKey, false)
+	u.Path, _ = url.PathUnescape(p)
+	u.RawPath = p
+	u.RawQuery = awsCanonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	signS3Request(req, body, s.region, s.keyID, s.secret, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRemoteNotFound
+	}
+	return nil, fmt.Errorf("%s %s: %s: %s", method, objectKey, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func (s *s3Store) get(ctx context.Context, k string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(k), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) put(ctx context.Context, k string, b []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(k), nil, b)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) delete(ctx context.Context, k string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.objectKey(k), nil, nil)
+	if err != nil && err != errRemoteNotFound {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// s3ListResult is the part of a ListObjects (v1) response we use; v1 is the
+// variant every S3-compatible store, GCS included, implements.
+type s3ListResult struct {
+	IsTruncated bool   `xml:"IsTruncated"`
+	NextMarker  string `xml:"NextMarker"`
+	Contents    []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+}
+
+// list returns the cache-relative keys of every object under the prefix
+// and cache-relative key prefix sub.
+func (s *s3Store) list(ctx context.Context, sub string) ([]string, error) {
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	var keys []string
+	marker := ""
+	for {
+		q := url.Values{"prefix": {prefix + sub}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil)
+		if err != nil {
+			return keys, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return keys, err
+		}
+		for _, c := range res.Contents {
+			keys = append(keys, strings.TrimPrefix(c.Key, prefix))
+		}
+		if !res.IsTruncated || len(res.Contents) == 0 {
+			return keys, nil
+		}
+		marker = res.NextMarker
+		if marker == "" {
+			marker = res.Contents[len(res.Contents)-1].Key
+		}
+	}
+}
+
+// signS3Request signs req with AWS Signature Version 4 for the s3 service,
+// covering the host, range and x-amz-* headers.
+func signS3Request(req *http.Request, payload []byte, region, keyID, secret string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	sum := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(sum[:])
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	names := []string{"host"}
+	values := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			names = append(names, lk)
+			values[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, n := range names {
+		headers.WriteString(n + ":" + values[n] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonical := strings.Join([]string{req.Method, uri, awsCanonicalQuery(req.URL.Query()), headers.String(), signed, payloadHash}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	h := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(h[:])
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+keyID+"/"+scope+", SignedHeaders="+signed+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// awsURIEscape percent-encodes s the way SigV4 expects: everything but
+// unreserved characters, plus "/" when escapeSlash is set.
+func awsURIEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// awsCanonicalQuery encodes q sorted by key and value, as SigV4 signs it.
+func awsCanonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsURIEscape(k, true)+"="+awsURIEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// remoteCache mirrors one cache dir to a bucket. Writes and removals are
+// queued and sent by a single worker; reads go to the bucket only when the
+// local layer misses.
+type remoteCache struct {
+	store    *s3Store
+	cacheDir string
+	ops      chan remoteCacheOp
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	flight   flightGroup
+	// scans are the running purgeMatching bucket scans.
+	scans sync.WaitGroup
+
+	mu     sync.Mutex
+	misses map[string]time.Time // keys recently found missing in the bucket
+
+	uploads, deletes, fetches, dropped, failures atomic.Int64
+}
+
+// remoteCacheOp uploads (or, with remove, deletes) the entry at metadata path p.
+type remoteCacheOp struct {
+	p      string
+	remove bool
+}
+
+var remoteCaches sync.Map // cleaned cache dir -> *remoteCache
+
+// remoteCacheFor returns the bucket mirror of cacheDir, or nil when it has none.
+func remoteCacheFor(cacheDir string) *remoteCache {
+	if v, ok := remoteCaches.Load(filepath.Clean(cacheDir)); ok {
+		return v.(*remoteCache)
+	}
+	return nil
+}
+
+// newRemoteCache mirrors cfg.CacheDir to cfg.CacheS3URL and starts the
+// upload worker.
+func newRemoteCache(cfg *Config) (*remoteCache, error) {
+	store, err := newS3Store(cfg)
+	if err != nil {
+		return nil, err
+	}
+	rc := &remoteCache{
+		store:    store,
+		cacheDir: filepath.Clean(cfg.CacheDir),
+		ops:      make(chan remoteCacheOp, remoteCacheQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		misses:   map[string]time.Time{},
+	}
+	remoteCaches.Store(rc.cacheDir, rc)
+	go rc.run()
+	return rc, nil
+}
+
+// key returns the bucket key of metadata or body path p, relative to the cache dir.
+func (rc *remoteCache) key(p string) (string, bool) {
+	rel, err := filepath.Rel(rc.cacheDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// localPath returns the cache dir path of bucket key k, rejecting keys that
+// would land outside it.
+func (rc *remoteCache) localPath(k string) (string, bool) {
+	clean := path.Clean("/" + k)
+	if clean == "/" || clean != "/"+k {
+		return "", false
+	}
+	return filepath.Join(rc.cacheDir, filepath.FromSlash(clean[1:])), true
+}
+
+func (rc *remoteCache) upload(p string) { rc.enqueue(remoteCacheOp{p: p}) }
+
+func (rc *remoteCache) remove(p string) { rc.enqueue(remoteCacheOp{p: p, remove: true}) }
+
+func (rc *remoteCache) enqueue(op remoteCacheOp) {
+	select {
+	case <-rc.stop:
+		return
+	default:
+	}
+	select {
+	case rc.ops <- op:
+	default:
+		rc.dropped.Add(1)
+		logger.Warnw("cache_s3_queue_full", map[string]interface{}{"path": op.p})
+	}
+}
+
+func (rc *remoteCache) run() {
+	defer close(rc.done)
+	for {
+		select {
+		case op := <-rc.ops:
+			rc.apply(op)
+		case <-rc.stop:
+			// Drain what was queued before shutdown
+			for {
+				select {
+				case op := <-rc.ops:
+					rc.apply(op)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// apply sends op to the bucket. Uploads read the files when sent, so an
+// entry rewritten while queued goes up once, in its latest form.
+func (rc *remoteCache) apply(op remoteCacheOp) {
+	k, ok := rc.key(op.p)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCacheTimeout)
+	defer cancel()
+	bodyKey := strings.TrimSuffix(k, ".json") + ".body"
+	var err error
+	if op.remove {
+		if err = rc.store.delete(ctx, k); err == nil {
+			err = rc.store.delete(ctx, bodyKey)
+		}
+		rc.deletes.Add(1)
+	} else {
+		meta, rerr := os.ReadFile(op.p)
+		if rerr != nil {
+			return // removed since; its delete is queued too
+		}
+		// Body first, as on disk, so the metadata never points at a missing body
+		if body, rerr := os.ReadFile(cacheBodyPath(op.p)); rerr == nil {
+			err = rc.store.put(ctx, bodyKey, body)
+		}
+		if err == nil {
+			err = rc.store.put(ctx, k, meta)
+		}
+		rc.uploads.Add(1)
+		rc.mu.Lock()
+		delete(rc.misses, k)
+		rc.mu.Unlock()
+	}
+	if err != nil {
+		rc.failures.Add(1)
+		logger.Warnw("cache_s3_error", map[string]interface{}{"err": err.Error(), "key": k, "remove": op.remove})
+	}
+}
+
+// fetch downloads the entry at metadata path p from the bucket into the
+// local layer. It returns os.ErrNotExist when the bucket has no such entry.
+func (rc *remoteCache) fetch(p string) error {
+	k, ok := rc.key(p)
+	if !ok {
+		return os.ErrNotExist
+	}
+	rc.mu.Lock()
+	until, missed := rc.misses[k]
+	rc.mu.Unlock()
+	if missed && time.Now().Before(until) {
+		return os.ErrNotExist
+	}
+	_, err, _ := rc.flight.Do(k, func() (interface{}, error) {
+		return nil, rc.download(k, p)
+	})
+	if err == errRemoteNotFound {
+		rc.noteMiss(k)
+		return os.ErrNotExist
+	}
+	if err != nil {
+		rc.failures.Add(1)
+		logger.Warnw("cache_s3_error", map[string]interface{}{"err": err.Error(), "key": k})
+	}
+	return err
+}
+
+func (rc *remoteCache) noteMiss(k string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	now := time.Now()
+	if len(rc.misses) >= remoteCacheMaxMisses {
+		for mk, until := range rc.misses {
+			if now.After(until) {
+				delete(rc.misses, mk)
+			}
+		}
+		if len(rc.misses) >= remoteCacheMaxMisses {
+			rc.misses = map[string]time.Time{}
+		}
+	}
+	rc.misses[k] = now.Add(remoteCacheMissTTL)
+}
+
+// download copies bucket key k to metadata path p, body blob first.
+func (rc *remoteCache) download(k, p string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteCacheTimeout)
+	defer cancel()
+	meta, err := rc.store.get(ctx, k)
+	if err != nil {
+		return err
+	}
+	var ce cacheEntry
+	if err := json.Unmarshal(meta, &ce); err != nil {
+		return fmt.Errorf("%s: %w", k, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if ce.Format >= cacheFormatV2 {
+		body, err := rc.store.get(ctx, strings.TrimSuffix(k, ".json")+".body")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(cacheBodyPath(p), body); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(p, meta); err != nil {
+		return err
+	}
+	rc.fetches.Add(1)
+	if ce.Format < cacheFormatV2 {
+		ce.BodySize = len(ce.Body)
+		ce.Body = nil
+	}
+	cacheIndexFor(rc.cacheDir).put(p, &ce)
+	return nil
+}
+
+// hydrate downloads the bucket's entries missing from the local layer, so a
+// fresh container starts with the shared cache instead of filling it one
+// miss at a time. It stops early on shutdown.
+func (rc *remoteCache) hydrate() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rc.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	keys, err := rc.store.list(ctx, "")
+	if err != nil {
+		logger.Warnw("cache_s3_error", map[string]interface{}{"err": err.Error(), "op": "list"})
+	}
+	jobs := make(chan [2]string)
+	var fetched, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < remoteCacheHydrateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if err := rc.download(j[0], j[1]); err != nil {
+					failed.Add(1)
+					continue
+				}
+				fetched.Add(1)
+			}
+		}()
+	}
+	jobsDir := filepath.Base(sitemapWarmJobsDir(rc.cacheDir))
+	for _, k := range keys {
+		if !strings.HasSuffix(k, ".json") || strings.HasPrefix(k, jobsDir+"/") {
+			continue
+		}
+		p, ok := rc.localPath(k)
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			continue
+		}
+		select {
+		case jobs <- [2]string{k, p}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	logger.Infow("cache_s3_hydrated", map[string]interface{}{"listed": len(keys), "fetched": fetched.Load(), "failed": failed.Load()})
+}
+
+// purgeMatching deletes, in the background, the bucket entries under the
+// cache-relative directory dir ("" for all) that match and are missing
+// locally: entries other instances uploaded that this one never read, so the
+// local purge did not see them. Entries created after the call are kept, as
+// they were fetched after the purge.
+func (rc *remoteCache) purgeMatching(dir string, match func(*cacheEntry) bool) {
+	select {
+	case <-rc.stop:
+		return
+	default:
+	}
+	before := time.Now().Unix()
+	sub := ""
+	if dir != "" && dir != "." {
+		sub = strings.Trim(filepath.ToSlash(dir), "/") + "/"
+	}
+	rc.scans.Add(1)
+	go func() {
+		defer rc.scans.Done()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-rc.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		keys, err := rc.store.list(ctx, sub)
+		if err != nil {
+			rc.failures.Add(1)
+			logger.Warnw("cache_s3_error", map[string]interface{}{"err": err.Error(), "op": "purge_list", "prefix": sub})
+		}
+		jobsDir := filepath.Base(sitemapWarmJobsDir(rc.cacheDir))
+		purged := 0
+		for _, k := range keys {
+			if ctx.Err() != nil {
+				break
+			}
+			if !strings.HasSuffix(k, ".json") || strings.HasPrefix(k, jobsDir+"/") || !strings.Contains(k, "/") {
+				continue
+			}
+			p, ok := rc.localPath(k)
+			if !ok {
+				continue
+			}
+			if _, err := os.Stat(p); err == nil {
+				continue // judged by the local purge
+			}
+			meta, err := rc.store.get(ctx, k)
+			if err != nil {
+				continue
+			}
+			var ce cacheEntry
+			if json.Unmarshal(meta, &ce) != nil || ce.CreatedAt > before || !match(&ce) {
+				continue
+			}
+			rc.remove(p)
+			purged++
+		}
+		if purged > 0 {
+			logger.Infow("cache_s3_purged", map[string]interface{}{"prefix": sub, "listed": len(keys), "deleted": purged})
+		}
+	}()
+}
+
+// close waits for running purge scans, stops accepting work and waits for
+// the queued uploads and deletes.
+func (rc *remoteCache) close(ctx context.Context) error {
+	// Let purge scans queue their deletes first; past ctx they are cut short
+	scanned := make(chan struct{})
+	go func() {
+		rc.scans.Wait()
+		close(scanned)
+	}()
+	select {
+	case <-scanned:
+	case <-ctx.Done():
+	}
+	rc.stopOnce.Do(func() { close(rc.stop) })
+	select {
+	case <-rc.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// metrics reports the mirror's counters for the system_metrics log line.
+func (rc *remoteCache) metrics() map[string]interface{} {
+	return map[string]interface{}{
+		"cache_s3_queue":    len(rc.ops),
+		"cache_s3_uploads":  rc.uploads.Load(),
+		"cache_s3_deletes":  rc.deletes.Load(),
+		"cache_s3_fetches":  rc.fetches.Load(),
+		"cache_s3_dropped":  rc.dropped.Load(),
+		"cache_s3_failures": rc.failures.Load(),
+	}
+}
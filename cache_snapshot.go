@@ -0,0 +1,273 @@
+package rerouter
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rerouter/logger"
+)
+
+// maxSnapshotFileBytes bounds one file read from an imported snapshot.
+const maxSnapshotFileBytes = 256 << 20
+
+// CacheSnapshotFilter selects the entries ExportCache writes.
+type CacheSnapshotFilter struct {
+	// Prefix matches the start of the entry URL path, or of the full URL when absolute.
+	Prefix string
+	// IncludeExpired also exports expired entries, still usable as stale copies.
+	IncludeExpired bool
+}
+
+// CacheImportResult counts what ImportCache did with a snapshot's entries.
+type CacheImportResult struct {
+	Imported int `json:"imported"`
+	// Skipped entries already had a copy at least as new locally.
+	Skipped int `json:"skipped"`
+	// Invalid entries had an unsafe path, unreadable metadata or no body.
+	Invalid int `json:"invalid"`
+}
+
+// ExportCache writes the indexed entries of cacheDir matching f to w as a
+// tar.gz snapshot and returns how many it wrote. Files keep their paths
+// relative to the cache dir, each body blob right before its metadata, so
+// entries keep their creation and expiry times on import.
+func ExportCache(w io.Writer, cacheDir string, f CacheSnapshotFilter) (int, error) {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	ix := cacheIndexFor(cacheDir)
+	now := time.Now().Unix()
+	n := 0
+	for _, e := range ix.snapshot() {
+		if !f.IncludeExpired && now >= e.ExpiresAt {
+			continue
+		}
+		if f.Prefix != "" && !cacheURLHasPrefix(e.URL, f.Prefix) {
+			continue
+		}
+		meta, body, ok := readSnapshotFiles(ix.path(e))
+		if !ok {
+			continue // removed or rewritten meanwhile
+		}
+		if body != nil {
+			if err := writeSnapshotFile(tw, strings.TrimSuffix(e.File, ".json")+".body", body); err != nil {
+				return n, err
+			}
+		}
+		if err := writeSnapshotFile(tw, e.File, meta); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := tw.Close(); err != nil {
+		return n, err
+	}
+	return n, zw.Close()
+}
+
+// readSnapshotFiles reads the metadata file p and its body blob, if any,
+// retrying once when the entry is rewritten between the two reads.
+func readSnapshotFiles(p string) (meta, body []byte, ok bool) {
+	for try := 0; try < 2; try++ {
+		m, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, false
+		}
+		b, err := os.ReadFile(cacheBodyPath(p))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, false
+		}
+		if again, err := os.ReadFile(p); err == nil && bytes.Equal(m, again) {
+			return m, b, true
+		}
+	}
+	return nil, nil, false
+}
+
+func writeSnapshotFile(tw *tar.Writer, name string, b []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(b)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+// snapshotEntryPath returns the cache dir path of snapshot file name, a
+// metadata file relative to the cache root, rejecting anything else.
+func snapshotEntryPath(cacheDir, name string) (string, bool) {
+	clean := path.Clean("/" + name)
+	if clean != "/"+name || !strings.HasSuffix(clean, ".json") || clean == "/"+cacheIndexFileName {
+		return "", false
+	}
+	if strings.HasPrefix(clean, "/"+filepath.Base(sitemapWarmJobsDir(cacheDir))+"/") {
+		return "", false
+	}
+	return filepath.Join(cacheDir, filepath.FromSlash(clean[1:])), true
+}
+
+// ImportCache stores the entries of a tar.gz snapshot from r in cacheDir,
+// keeping their creation and expiry times. An entry is skipped when the
+// cache already holds one created at the same time or later, unless
+// overwrite is set.
+func ImportCache(r io.Reader, cacheDir string, overwrite bool) (CacheImportResult, error) {
+	var res CacheImportResult
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return res, err
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return res, fmt.Errorf("not a gzip snapshot: %w", err)
+	}
+	tr := tar.NewReader(zr)
+	var bodyName string
+	var body []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if hdr.Size > maxSnapshotFileBytes {
+			return res, fmt.Errorf("%s: larger than %d bytes", hdr.Name, maxSnapshotFileBytes)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return res, err
+		}
+		if strings.HasSuffix(hdr.Name, ".body") {
+			bodyName, body = hdr.Name, b
+			continue
+		}
+		if !strings.HasSuffix(hdr.Name, ".json") {
+			continue
+		}
+		var entryBody []byte
+		if bodyName == strings.TrimSuffix(hdr.Name, ".json")+".body" {
+			entryBody = body
+		}
+		bodyName, body = "", nil
+		switch err := importCacheEntry(cacheDir, hdr.Name, b, entryBody, overwrite); {
+		case err == nil:
+			res.Imported++
+		case errors.Is(err, errSnapshotEntryCurrent):
+			res.Skipped++
+		default:
+			res.Invalid++
+			logger.Debugw("cache_import_invalid", map[string]interface{}{"file": hdr.Name, "err": err.Error()})
+		}
+	}
+}
+
+var errSnapshotEntryCurrent = errors.New("local entry is as new")
+
+// importCacheEntry writes one snapshot entry, body blob first, and records
+// it in the cache index and the bucket mirror.
+func importCacheEntry(cacheDir, name string, meta, body []byte, overwrite bool) error {
+	p, ok := snapshotEntryPath(cacheDir, name)
+	if !ok {
+		return errors.New("unsafe path")
+	}
+	var ce cacheEntry
+	if err := json.Unmarshal(meta, &ce); err != nil {
+		return err
+	}
+	if ce.Format >= cacheFormatV2 && body == nil {
+		return errors.New("missing body")
+	}
+	if !overwrite {
+		if cur, err := readCacheMeta(p); err == nil && cur.CreatedAt >= ce.CreatedAt {
+			return errSnapshotEntryCurrent
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	if ce.Format >= cacheFormatV2 {
+		if err := writeFileAtomic(cacheBodyPath(p), body); err != nil {
+			return err
+		}
+	} else {
+		ce.BodySize = len(ce.Body)
+		ce.Body = nil
+	}
+	if err := writeFileAtomic(p, meta); err != nil {
+		return err
+	}
+	cacheIndexFor(cacheDir).put(p, &ce)
+	if rc := remoteCacheFor(cacheDir); rc != nil {
+		rc.upload(p)
+	}
+	return nil
+}
+
+// handleAdminCacheExport serves GET /admin/cache/export?prefix=/blog/&expired=1
+// as a tar.gz download.
+func handleAdminCacheExport(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Large snapshots take longer than the server write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	q := r.URL.Query()
+	f := CacheSnapshotFilter{
+		Prefix:         q.Get("prefix"),
+		IncludeExpired: q.Get("expired") == "1" || strings.ToLower(q.Get("expired")) == "true",
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="rerouter-cache-%s.tar.gz"`, time.Now().UTC().Format("20060102-150405")))
+	n, err := ExportCache(w, cfg.CacheDir, f)
+	fields := map[string]interface{}{"req_id": getRequestID(r.Context()), "entries": n, "prefix": f.Prefix}
+	if err != nil {
+		// Headers are sent; the client sees a truncated archive
+		fields["err"] = err.Error()
+		logger.Warnw("cache_export_error", fields)
+		return
+	}
+	logger.Infow("cache_exported", fields)
+}
+
+// handleAdminCacheImport serves POST /admin/cache/import?overwrite=1 with a
+// snapshot from /admin/cache/export as the body.
+func handleAdminCacheImport(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Large uploads take longer than the server read and write timeouts
+	rc := http.NewResponseController(w)
+	_ = rc.SetReadDeadline(time.Time{})
+	_ = rc.SetWriteDeadline(time.Time{})
+	overwrite := r.URL.Query().Get("overwrite") == "1" || strings.ToLower(r.URL.Query().Get("overwrite")) == "true"
+	res, err := ImportCache(r.Body, cfg.CacheDir, overwrite)
+	auditNote(r, map[string]interface{}{"overwrite": overwrite}, map[string]interface{}{"imported": res.Imported, "skipped": res.Skipped, "invalid": res.Invalid})
+	fields := map[string]interface{}{"req_id": getRequestID(r.Context()), "imported": res.Imported, "skipped": res.Skipped, "invalid": res.Invalid}
+	if err != nil {
+		fields["err"] = err.Error()
+		logger.Warnw("cache_import_error", fields)
+		// Entries before the error stay imported; report them with the error
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": err.Error(), "imported": res.Imported, "skipped": res.Skipped, "invalid": res.Invalid})
+		return
+	}
+	logger.Infow("cache_imported", fields)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,268 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// cacheStatsMaxURLs caps distinct URLs counted; the rest are counted under
+	// cacheStatsOtherURLs.
+	cacheStatsMaxURLs    = 10000
+	cacheStatsOtherURLs  = "(other)"
+	defaultCacheStatsTop = 20
+)
+
+// cacheCounts are the counters of responses served with an X-Cache header.
+type cacheCounts struct {
+	Requests int64 `json:"requests"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+	Stale    int64 `json:"stale"`
+	// Body bytes sent, and the part of them served from the cache (HIT or STALE).
+	Bytes          int64 `json:"bytes_served"`
+	BytesFromCache int64 `json:"bytes_from_cache"`
+}
+
+func (c *cacheCounts) add(xCache string, n int64) {
+	c.Requests++
+	c.Bytes += n
+	switch xCache {
+	case "HIT":
+		c.Hits++
+		c.BytesFromCache += n
+	case "STALE":
+		c.Stale++
+		c.BytesFromCache += n
+	default:
+		c.Misses++
+	}
+}
+
+func (c *cacheCounts) merge(o cacheCounts) {
+	c.Requests += o.Requests
+	c.Hits += o.Hits
+	c.Misses += o.Misses
+	c.Stale += o.Stale
+	c.Bytes += o.Bytes
+	c.BytesFromCache += o.BytesFromCache
+}
+
+// hitRate is the share of requests served from the cache, stale included.
+func (c *cacheCounts) hitRate() float64 {
+	if c.Requests == 0 {
+		return 0
+	}
+	return float64(c.Hits+c.Stale) / float64(c.Requests)
+}
+
+// cacheStats counts cache hits, misses, stale serves and bytes since start (or
+// the last reset), overall and per requested URL, and the same per tenant.
+type cacheStats struct {
+	mu      sync.Mutex
+	since   time.Time
+	all     *cacheCounter
+	tenants map[string]*cacheCounter
+}
+
+// cacheCounter is the totals and per-URL counts of one set of responses.
+type cacheCounter struct {
+	total cacheCounts
+	urls  map[string]*cacheCounts
+}
+
+func newCacheCounter() *cacheCounter {
+	return &cacheCounter{urls: map[string]*cacheCounts{}}
+}
+
+func (cc *cacheCounter) add(uri, xCache string, n int64) {
+	cc.total.add(xCache, n)
+	c := cc.urls[uri]
+	if c == nil {
+		if len(cc.urls) >= cacheStatsMaxURLs {
+			uri = cacheStatsOtherURLs
+			c = cc.urls[uri]
+		}
+		if c == nil {
+			c = &cacheCounts{}
+			cc.urls[uri] = c
+		}
+	}
+	c.add(xCache, n)
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{since: time.Now(), all: newCacheCounter(), tenants: map[string]*cacheCounter{}}
+}
+
+// record counts a response for uri of tenant ("" for none) served with
+// xCache and n body bytes.
+func (s *cacheStats) record(tenant, uri, xCache string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.all.add(uri, xCache, n)
+	if tenant == "" {
+		return
+	}
+	cc := s.tenants[tenant]
+	if cc == nil {
+		cc = newCacheCounter()
+		s.tenants[tenant] = cc
+	}
+	cc.add(uri, xCache, n)
+}
+
+func (s *cacheStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.since, s.all, s.tenants = time.Now(), newCacheCounter(), map[string]*cacheCounter{}
+}
+
+// cacheURLStats is one row of the top-URL list.
+type cacheURLStats struct {
+	URL string `json:"url"`
+	cacheCounts
+	HitRate float64 `json:"hit_rate"`
+}
+
+type cacheStatsReport struct {
+	Since time.Time `json:"since"`
+	cacheCounts
+	HitRate float64         `json:"hit_rate"`
+	TopURLs []cacheURLStats `json:"top_urls"`
+}
+
+// report returns the totals and the top most-requested URLs, of every
+// response or, with sc, of its tenants'.
+func (s *cacheStats) report(top int, sc *tenantScope) cacheStatsReport {
+	s.mu.Lock()
+	counters := []*cacheCounter{s.all}
+	if sc != nil {
+		counters = counters[:0]
+		for _, t := range sc.tenants {
+			if cc := s.tenants[t]; cc != nil {
+				counters = append(counters, cc)
+			}
+		}
+	}
+	out := cacheStatsReport{Since: s.since.UTC(), TopURLs: []cacheURLStats{}}
+	urls := map[string]*cacheCounts{}
+	for _, cc := range counters {
+		out.cacheCounts.merge(cc.total)
+		for u, c := range cc.urls {
+			if urls[u] == nil {
+				urls[u] = &cacheCounts{}
+			}
+			urls[u].merge(*c)
+		}
+	}
+	s.mu.Unlock()
+	out.HitRate = out.cacheCounts.hitRate()
+	for u, c := range urls {
+		out.TopURLs = append(out.TopURLs, cacheURLStats{URL: u, cacheCounts: *c, HitRate: c.hitRate()})
+	}
+	sort.Slice(out.TopURLs, func(i, j int) bool {
+		if out.TopURLs[i].Requests != out.TopURLs[j].Requests {
+			return out.TopURLs[i].Requests > out.TopURLs[j].Requests
+		}
+		return out.TopURLs[i].URL < out.TopURLs[j].URL
+	})
+	if len(out.TopURLs) > top {
+		out.TopURLs = out.TopURLs[:top]
+	}
+	return out
+}
+
+// metrics reports the totals for the periodic system_metrics log line.
+func (s *cacheStats) metrics() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.all.total
+	return map[string]interface{}{
+		"cache_hits":             t.Hits,
+		"cache_misses":           t.Misses,
+		"cache_stale":            t.Stale,
+		"cache_hit_rate":         t.hitRate(),
+		"cache_bytes_served":     t.Bytes,
+		"cache_bytes_from_cache": t.BytesFromCache,
+	}
+}
+
+// handleAdminCacheStats serves GET /admin/stats/cache?top=20, limited to the
+// tenants of sc when set; DELETE resets the counters.
+func (s *cacheStats) handleAdminCacheStats(w http.ResponseWriter, r *http.Request, sc *tenantScope) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	top := defaultCacheStatsTop
+	if n, err := strconv.Atoi(r.URL.Query().Get("top")); err == nil && n > 0 {
+		top = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.report(top, sc))
+}
+
+// statsWriter notes the status, X-Cache and body size of a response for the
+// cache and bot stats.
+type statsWriter struct {
+	http.ResponseWriter
+	status int
+	xCache string
+	bytes  int64
+}
+
+func (sw *statsWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status, sw.xCache = code, sw.Header().Get("X-Cache")
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statsWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statsWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// trackStats wraps w so the response to r is counted in the cache stats, and
+// in the bot stats when bot is set; call the returned func when the handler
+// is done. Admin previews are not counted. Wrap after the header rules so X-Cache is seen before a rule
+// removes it.
+func (a *appHandler) trackStats(cfg *Config, w http.ResponseWriter, r *http.Request, bot bool) (http.ResponseWriter, func()) {
+	sw := &statsWriter{ResponseWriter: w}
+	if p := previewFrom(r.Context()); p != nil {
+		return sw, func() { p.xCache = sw.xCache }
+	}
+	return sw, func() {
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if sw.xCache != "" {
+			a.cacheStats.record(tenantForConfig(cfg), r.URL.RequestURI(), sw.xCache, sw.bytes)
+		}
+		if bot && cfg.BotStatsRetentionHours > 0 {
+			retention := time.Duration(cfg.BotStatsRetentionHours) * time.Hour
+			a.botStats.record(retention, uaFamily(r.UserAgent()), r.URL.Path, status, sw.xCache, time.Now())
+		}
+	}
+}
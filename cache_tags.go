@@ -0,0 +1,79 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CacheTagRule tags cache entries whose request path matches Pattern (same
+// glob syntax as CACHE_PATTERNS), so they can be purged together by tag.
+type CacheTagRule struct {
+	Pattern string   `json:"pattern"`
+	Tags    []string `json:"tags"`
+}
+
+// parseCacheTagRules parses "pattern=tag1,tag2;pattern2=tag3".
+func parseCacheTagRules(v string) ([]CacheTagRule, error) {
+	out := []CacheTagRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid cache tag rule %q", p)
+		}
+		tags := splitCommaList(kv[1])
+		if len(tags) == 0 {
+			return nil, fmt.Errorf("cache tag rule %q: no tags", p)
+		}
+		out = append(out, CacheTagRule{Pattern: strings.TrimSpace(kv[0]), Tags: tags})
+	}
+	return out, nil
+}
+
+// cacheTagsFor collects the tags of a response for reqPath: those of every
+// matching rule plus the upstream Surrogate-Key (space-separated) and
+// Cache-Tag (comma-separated) headers. Duplicates are dropped.
+func cacheTagsFor(cfg *Config, reqPath string, h http.Header) []string {
+	var tags []string
+	seen := map[string]bool{}
+	add := func(t string) {
+		if t = strings.TrimSpace(t); t != "" && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	for _, r := range cfg.CacheTagRules {
+		if patternsMatch([]string{r.Pattern}, reqPath) {
+			for _, t := range r.Tags {
+				add(t)
+			}
+		}
+	}
+	for _, v := range h.Values("Surrogate-Key") {
+		for _, t := range strings.Fields(v) {
+			add(t)
+		}
+	}
+	for _, v := range h.Values("Cache-Tag") {
+		for _, t := range strings.Split(v, ",") {
+			add(t)
+		}
+	}
+	return tags
+}
+
+// firstSharedTag returns the first tag of want that tags contains, or "".
+func firstSharedTag(want, tags []string) string {
+	for _, w := range want {
+		for _, t := range tags {
+			if t == w {
+				return w
+			}
+		}
+	}
+	return ""
+}
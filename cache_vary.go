@@ -0,0 +1,137 @@
+package rerouter
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultUpstreamMobileUserAgent = "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Mobile Safari/537.36"
+
+// Cache vary dimensions accepted in cfg.CacheVary.
+const (
+	cacheVaryDevice = "device"
+	cacheVaryLang   = "lang"
+)
+
+// cacheVariant is the cached representation selected for a request by the
+// dimensions in cfg.CacheVary. Zero fields mean the default representation
+// (desktop, no language), which is also what prefetch and sitemap warming store.
+type cacheVariant struct {
+	Mobile bool
+	Lang   string
+}
+
+// requestCacheVariant classifies r along the configured vary dimensions.
+func requestCacheVariant(cfg *Config, r *http.Request) cacheVariant {
+	var v cacheVariant
+	for _, d := range cfg.CacheVary {
+		switch d {
+		case cacheVaryDevice:
+			v.Mobile = isMobileUA(r.Header.Get("User-Agent"))
+		case cacheVaryLang:
+			lang := primaryAcceptLanguage(r.Header.Get("Accept-Language"))
+			if len(cfg.CacheVaryLangs) == 0 || containsString(cfg.CacheVaryLangs, lang) {
+				v.Lang = lang
+			}
+		}
+	}
+	return v
+}
+
+// key names the variant in cache file names ("mobile", "de", "mobile-de");
+// the default variant has an empty key and uses the plain file.
+func (v cacheVariant) key() string {
+	parts := make([]string, 0, 2)
+	if v.Mobile {
+		parts = append(parts, "mobile")
+	}
+	if v.Lang != "" {
+		parts = append(parts, v.Lang)
+	}
+	return strings.Join(parts, "-")
+}
+
+// setUpstreamHeaders makes the B request ask for this variant: a mobile UA for
+// mobile crawlers (unless their own UA is passed through) and the selected
+// Accept-Language.
+func (v cacheVariant) setUpstreamHeaders(cfg *Config, req *http.Request) {
+	if v.Mobile && cfg.UpstreamUAMode != upstreamUAPassthrough {
+		ua := cfg.UpstreamMobileUserAgent
+		if ua == "" {
+			ua = defaultUpstreamMobileUserAgent
+		}
+		req.Header.Set("User-Agent", ua)
+	}
+	if v.Lang != "" {
+		req.Header.Set("Accept-Language", v.Lang)
+	}
+}
+
+// setVaryHeader tells downstream caches which request headers select the variant.
+func setVaryHeader(cfg *Config, w http.ResponseWriter) {
+	for _, d := range cfg.CacheVary {
+		switch d {
+		case cacheVaryDevice:
+			w.Header().Add("Vary", "User-Agent")
+		case cacheVaryLang:
+			w.Header().Add("Vary", "Accept-Language")
+		}
+	}
+}
+
+// isMobileUA reports whether ua belongs to a smartphone browser or crawler
+// (e.g. Googlebot-Smartphone, which sends an Android "Mobile" UA).
+func isMobileUA(ua string) bool {
+	ua = strings.ToLower(ua)
+	return strings.Contains(ua, "mobile") || strings.Contains(ua, "android") || strings.Contains(ua, "iphone")
+}
+
+// primaryAcceptLanguage returns the primary subtag of the highest-weighted
+// language in an Accept-Language header ("de-AT,en;q=0.8" -> "de"), or "" for
+// none, "*" or malformed tags.
+func primaryAcceptLanguage(header string) string {
+	best, bestQ := "", -1.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if n, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = n
+				}
+			}
+		}
+		if i := strings.IndexAny(tag, "-_"); i > 0 {
+			tag = tag[:i]
+		}
+		if !isLangSubtag(tag) || q <= 0 || q <= bestQ {
+			continue
+		}
+		best, bestQ = tag, q
+	}
+	return best
+}
+
+func isLangSubtag(s string) bool {
+	if len(s) < 2 || len(s) > 8 {
+		return false
+	}
+	for _, c := range s {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package rerouter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Challenge modes accepted in cfg.ChallengeMode.
+const (
+	challengeOff = "off"
+	// A script on the challenge page computes the pass cookie.
+	challengeJS = "js"
+	// The challenge page sets the pass cookie; the client only has to send it back.
+	challengeCookie = "cookie"
+)
+
+const (
+	challengeCookieName         = "rerouter_challenge"
+	defaultChallengePassMinutes = 60
+	// maxChallengePasses bounds the IPs remembered as passed; past it a
+	// client is let through by its cookie alone.
+	maxChallengePasses = 100000
+)
+
+func validChallengeMode(m string) bool {
+	switch m {
+	case challengeOff, challengeJS, challengeCookie:
+		return true
+	}
+	return false
+}
+
+// challenger issues and checks the challenges of suspicious clients and
+// remembers the IPs that passed. It lives on appHandler so passes survive
+// config reloads.
+type challenger struct {
+	// secret signs pass cookies when cfg.ChallengeSecret is empty; it changes
+	// on every start.
+	secret []byte
+
+	mu          sync.Mutex
+	passed      map[string]time.Time // client IP -> pass expiry
+	issuedCount int64
+	passedCount int64
+}
+
+func newChallenger() *challenger {
+	tok, _ := randomToken()
+	return &challenger{secret: []byte(tok), passed: map[string]time.Time{}}
+}
+
+func (c *challenger) key(cfg *Config) []byte {
+	if cfg.ChallengeSecret != "" {
+		return []byte(cfg.ChallengeSecret)
+	}
+	return c.secret
+}
+
+// suspiciousClient reports whether r, a client not detected as a bot, lacks
+// what every current browser sends with a page request: a Mozilla UA,
+// Accept-Language and the Sec-Fetch-Mode header.
+func suspiciousClient(r *http.Request) bool {
+	return !strings.HasPrefix(r.UserAgent(), "Mozilla/") || r.Header.Get("Accept-Language") == "" || r.Header.Get("Sec-Fetch-Mode") == ""
+}
+
+// required reports whether r must pass a challenge before it is redirected
+// or proxied: challenges are on, r looks suspicious and its IP has not
+// passed within ChallengePassMinutes.
+func (c *challenger) required(cfg *Config, r *http.Request) bool {
+	if cfg.ChallengeMode == "" || cfg.ChallengeMode == challengeOff || !suspiciousClient(r) {
+		return false
+	}
+	return !c.hasPassed(cfg, r, clientIP(cfg, r))
+}
+
+func challengePassDuration(cfg *Config) time.Duration {
+	if cfg.ChallengePassMinutes > 0 {
+		return time.Duration(cfg.ChallengePassMinutes) * time.Minute
+	}
+	return defaultChallengePassMinutes * time.Minute
+}
+
+// hasPassed reports whether ip passed recently or r carries a valid pass
+// cookie for it, which then counts as a pass for the IP.
+func (c *challenger) hasPassed(cfg *Config, r *http.Request, ip string) bool {
+	now := time.Now()
+	c.mu.Lock()
+	exp, ok := c.passed[ip]
+	c.mu.Unlock()
+	if ok && now.Before(exp) {
+		return true
+	}
+	ck, err := r.Cookie(challengeCookieName)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(ck.Value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	issued := time.Unix(ts, 0)
+	if issued.After(now.Add(time.Minute)) || now.After(issued.Add(challengePassDuration(cfg))) {
+		return false
+	}
+	want := challengeSig(c.key(cfg), ip, parts[0], parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(want)) {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.passedCount++
+	if len(c.passed) >= maxChallengePasses {
+		for k, e := range c.passed {
+			if now.After(e) {
+				delete(c.passed, k)
+			}
+		}
+	}
+	if len(c.passed) < maxChallengePasses {
+		c.passed[ip] = issued.Add(challengePassDuration(cfg))
+	}
+	logger.Debugw("challenge_passed", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip})
+	return true
+}
+
+// challengeSig signs a pass cookie for ip, issued at ts with answer.
+func challengeSig(key []byte, ip, ts, answer string) string {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(ip + "|" + ts + "|" + answer))
+	return hex.EncodeToString(m.Sum(nil))[:32]
+}
+
+// serve answers r with the challenge page of cfg.ChallengeMode. Passing it
+// reloads the page with the pass cookie set.
+func (c *challenger) serve(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(cfg, r)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	maxAge := int(challengePassDuration(cfg) / time.Second)
+	var body string
+	if cfg.ChallengeMode == challengeCookie {
+		http.SetCookie(w, &http.Cookie{Name: challengeCookieName, Value: ts + ".0." + challengeSig(c.key(cfg), ip, ts, "0"),
+			Path: "/", MaxAge: maxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		body = `<meta http-equiv="refresh" content="1">`
+	} else {
+		a, b := rand.IntN(1000), rand.IntN(1000)
+		sig := challengeSig(c.key(cfg), ip, ts, strconv.Itoa(a+b))
+		body = fmt.Sprintf(`<script>document.cookie="%s=%s."+(%d+%d)+".%s; path=/; max-age=%d; SameSite=Lax";location.reload();</script>`+
+			`<noscript><p>Please enable JavaScript to continue.</p></noscript>`, challengeCookieName, ts, a, b, sig, maxAge)
+	}
+	c.mu.Lock()
+	c.issuedCount++
+	c.mu.Unlock()
+	logger.Debugw("challenge_issued", map[string]interface{}{"req_id": getRequestID(r.Context()), "ip": ip, "mode": cfg.ChallengeMode, "ua": r.UserAgent()})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "<!DOCTYPE html><html><head><title>Checking your browser</title></head><body><p>Checking your browser&hellip;</p>%s</body></html>", body)
+}
+
+// metrics reports the challenges issued and passed since start.
+func (c *challenger) metrics() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return map[string]interface{}{
+		"challenge_issued":     c.issuedCount,
+		"challenge_passed":     c.passedCount,
+		"challenge_passed_ips": len(c.passed),
+	}
+}
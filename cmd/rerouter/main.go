@@ -0,0 +1,151 @@
+// Command rerouter runs the rerouter proxy configured from the environment
+// and config.json.
+package main
+
+import (
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "os/signal"
+    "syscall"
+    "time"
+    "rerouter"
+    "rerouter/logger"
+)
+// Auto-load .env from project root if present (minimal, clean)
+import _ "github.com/joho/godotenv/autoload"
+
+func main() {
+    validate := flag.Bool("validate", false, "load and check the configuration, print a report and exit")
+    exportCache := flag.String("export-cache", "", "write the unexpired cache entries to this tar.gz file (- for stdout) and exit")
+    importCache := flag.String("import-cache", "", "load a tar.gz cache snapshot from this file (- for stdin) into CACHE_DIR and exit")
+    overwrite := flag.Bool("overwrite", false, "with -import-cache, replace local entries even when they are newer")
+    migrateCache := flag.Bool("migrate-cache", false, "move CACHE_DIR entries stored under an older cache layout to their current paths and exit")
+    flag.Parse()
+    cfg, err := rerouter.LoadConfig()
+    if *validate {
+        os.Exit(rerouter.Validate(os.Stdout, cfg, err))
+    }
+    if err != nil {
+        // Fallback simple stderr
+        panic(err)
+    }
+    if *exportCache != "" || *importCache != "" {
+        os.Exit(cacheSnapshot(cfg, *exportCache, *importCache, *overwrite))
+    }
+    if *migrateCache {
+        moved, deleted, err := rerouter.MigrateCache(cfg.CacheDir)
+        fmt.Fprintf(os.Stderr, "moved %d entries, deleted %d\n", moved, deleted)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "migration failed:", err)
+            os.Exit(1)
+        }
+        os.Exit(0)
+    }
+    closeLogs := rerouter.SetupLogging(cfg)
+    defer closeLogs()
+
+    srv, err := rerouter.NewServer(cfg)
+    if err != nil {
+        logger.Errorw("failed_create_cache_dir", map[string]interface{}{"err": err.Error(), "dir": cfg.CacheDir})
+        os.Exit(1)
+    }
+    logger.Infow("startup", map[string]interface{}{"listen": cfg.ListenAddr, "b_base_url": cfg.BBaseURL})
+    if cfg.AdminToken != "" && cfg.AdminUIPath != "" {
+        logger.Infow("admin_ui_enabled", map[string]interface{}{"path": cfg.AdminUIPath})
+    }
+    if err := srv.Start(); err != nil {
+        logger.Errorw("listen_error", map[string]interface{}{"err": err.Error()})
+        os.Exit(1)
+    }
+
+    // Reload config (env, config file, bot lists) on SIGHUP
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    go func() {
+        for range hup {
+            _ = srv.Reload("sighup")
+        }
+    }()
+
+    // Hand the listeners to a new binary on SIGUSR2, then drain and exit
+    usr2 := make(chan os.Signal, 1)
+    signal.Notify(usr2, syscall.SIGUSR2)
+    upgraded := make(chan struct{})
+    go func() {
+        for range usr2 {
+            ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.UpgradeTimeoutSeconds)*time.Second)
+            err := srv.Upgrade(ctx)
+            cancel()
+            if err != nil {
+                logger.Errorw("upgrade_failed", map[string]interface{}{"err": err.Error()})
+                continue
+            }
+            close(upgraded)
+            return
+        }
+    }()
+
+    // Drain in-flight requests and background work on SIGINT/SIGTERM
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    select {
+    case err := <-srv.Err():
+        logger.Errorw("server_error", map[string]interface{}{"err": err.Error()})
+        os.Exit(1)
+    case <-ctx.Done():
+    case <-upgraded:
+    }
+    stop()
+    timeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+    logger.Infow("shutdown_started", map[string]interface{}{"timeout_seconds": cfg.ShutdownTimeoutSeconds})
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    _ = srv.Shutdown(shutdownCtx) // errors are logged by Shutdown
+    logger.Infow("shutdown_complete", nil)
+}
+
+// cacheSnapshot exports CACHE_DIR to exportPath or imports importPath into
+// it, without starting the server, and returns the process exit code. To
+// load a snapshot into a running instance use POST /admin/cache/import, so
+// its cache index stays current.
+func cacheSnapshot(cfg *rerouter.Config, exportPath, importPath string, overwrite bool) int {
+    if exportPath != "" {
+        var w io.Writer = os.Stdout
+        if exportPath != "-" {
+            f, err := os.Create(exportPath)
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                return 1
+            }
+            defer f.Close()
+            w = f
+        }
+        n, err := rerouter.ExportCache(w, cfg.CacheDir, rerouter.CacheSnapshotFilter{})
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "export failed:", err)
+            return 1
+        }
+        fmt.Fprintf(os.Stderr, "exported %d entries\n", n)
+        return 0
+    }
+    var r io.Reader = os.Stdin
+    if importPath != "-" {
+        f, err := os.Open(importPath)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+        defer f.Close()
+        r = f
+    }
+    res, err := rerouter.ImportCache(r, cfg.CacheDir, overwrite)
+    fmt.Fprintf(os.Stderr, "imported %d entries, skipped %d, invalid %d\n", res.Imported, res.Skipped, res.Invalid)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "import failed:", err)
+        return 1
+    }
+    return 0
+}
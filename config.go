@@ -1,4 +1,4 @@
-package main
+package rerouter
 
 import (
 	"crypto/sha256"
@@ -6,58 +6,427 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"strings"
+	"text/template"
+
+	"rerouter/logger"
 )
 
 const defaultUpstreamUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36"
 
+// Config is the complete rerouter configuration; see LoadConfig.
 type Config struct {
 	// Base URL for B site, e.g. https://b.example.com
 	BBaseURL string `json:"b_base_url"`
 	// Static HTML URL that performs final hop to B site for human visitors.
 	StaticRedirectURL string `json:"static_redirect_url"`
+	// How human visitors reach B: "redirect" them there, "proxy" B through A
+	// with rewritten pages so the A domain stays in the address bar, serve them
+	// the "cache"d bot copy, or "block" them with a 404.
+	HumanMode string `json:"human_mode"`
+	// Per-path overrides of HumanMode: redirect, proxy, cache or block (first match wins).
+	HumanRules []HumanRule `json:"human_rules"`
+	// Paths answered with a 4xx right away, never redirected or proxied to B,
+	// e.g. scanner probes for /wp-admin/* or .env (first match wins).
+	BlockRules []BlockRule `json:"block_rules"`
 	// Base URL for A site (used for rewriting links in bot-served pages). If empty, derived from request host.
 	ABaseURL string `json:"a_base_url"`
 	// User-Agent header to send when fetching from the B site or other upstreams.
 	UpstreamUserAgent string `json:"upstream_user_agent"`
-	// Address to listen on, e.g. :8080
+	// Which User-Agent goes upstream: "fixed" (UpstreamUserAgent, default),
+	// "passthrough" (the client's own) or "family" (UpstreamUAFamilies by bot
+	// family, falling back to UpstreamUserAgent).
+	UpstreamUAMode string `json:"upstream_ua_mode"`
+	// User-Agent per bot family (google, bing, baidu, yandex, apple, petal),
+	// "other" for remaining clients and "background" for prefetch and sitemap warming.
+	UpstreamUAFamilies map[string]string `json:"upstream_ua_families"`
+	// Addresses to listen on, comma-separated: ":8080", "https://:8443", "unix:/run/rerouter.sock"
 	ListenAddr string `json:"listen_addr"`
+	// Certificate and key for https:// listeners.
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// Separate listener(s) for the admin API and UI (same syntax as ListenAddr), e.g. 127.0.0.1:9090.
+	// When set the admin routes are removed from the ListenAddr listeners.
+	AdminListenAddr string `json:"admin_listen_addr"`
+	// Serve admin endpoints only on unix: listeners; TCP listeners treat /admin paths as ordinary pages.
+	AdminUnixOnly bool `json:"admin_unix_only"`
 	// Cache directory to store files
 	CacheDir string `json:"cache_dir"`
+	// Optional S3-compatible bucket (AWS S3, GCS interoperability, MinIO)
+	// mirroring the cache: its URL, path-style (https://storage.googleapis.com/my-bucket)
+	// or virtual-hosted (https://my-bucket.s3.eu-west-1.amazonaws.com), and a key
+	// prefix. CacheDir stays the local layer: entries are uploaded after being
+	// written, local misses are read through from the bucket, and CacheDir is
+	// refilled from it in the background on start.
+	CacheS3URL             string `json:"cache_s3_url"`
+	CacheS3Prefix          string `json:"cache_s3_prefix"`
+	CacheS3Region          string `json:"cache_s3_region"`
+	CacheS3AccessKeyID     string `json:"cache_s3_access_key_id"`
+	CacheS3SecretAccessKey string `json:"cache_s3_secret_access_key"`
+	// Minutes between background cache integrity scans, which remove or
+	// repair corrupt and truncated entries, stale .tmp files and entries stored
+	// under the wrong path; 0 disables them.
+	CacheCheckIntervalMinutes int `json:"cache_check_interval_minutes"`
 	// Cache TTL in seconds
 	CacheTTLSeconds int `json:"cache_ttl_seconds"`
+	// Take every entry's TTL from the origin's Cache-Control (s-maxage, max-age)
+	// or Expires when it sends one, as rules with respect_cache_control do;
+	// no-store and private responses are never cached. Origin TTLs are bounded
+	// by CacheTTLMinSeconds and CacheTTLMaxSeconds (0 leaves that side open).
+	CacheRespectCacheControl bool `json:"cache_respect_cache_control"`
+	CacheTTLMinSeconds       int  `json:"cache_ttl_min_seconds"`
+	CacheTTLMaxSeconds       int  `json:"cache_ttl_max_seconds"`
+	// Upstream response markers that keep a response out of the cache:
+	// "header" (X-Rerouter-No-Cache), "private" (Cache-Control private or
+	// no-store) and "set-cookie"; "none" caches regardless.
+	CacheBypassResponse []string `json:"cache_bypass_response"`
+	// Request cookie names that make bot requests skip the cache and go to the
+	// B site; a trailing "*" matches by prefix, e.g. "wordpress_logged_in_*".
+	CacheBypassCookies []string `json:"cache_bypass_cookies"`
 	// Cache all URLs for bots when response is 200
 	CacheAll bool `json:"cache_all"`
+	// Also cache stylesheets, scripts, images, fonts and media (by extension) when CacheAll=false.
+	CacheAssets bool `json:"cache_assets"`
 	// Path patterns to cache for bots if CacheAll=false (comma-separated via env). Supports * wildcard.
 	CachePatterns []string `json:"cache_patterns"`
+	// Store cached bodies gzip-compressed on disk.
+	CacheCompress bool `json:"cache_compress"`
+	// Path pattern -> tags attached to cache entries for POST /admin/purge?tag=... (all matching rules apply).
+	CacheTagRules []CacheTagRule `json:"cache_tag_rules"`
+	// Request dimensions cached as separate variants per URL: "device" (mobile vs desktop UA)
+	// and/or "lang" (primary Accept-Language). Empty caches one representation per URL.
+	CacheVary []string `json:"cache_vary"`
+	// Languages kept as separate "lang" variants; others share the default entry. Empty allows any.
+	CacheVaryLangs []string `json:"cache_vary_langs"`
+	// User-Agent sent to the B site when fetching the mobile variant.
+	UpstreamMobileUserAgent string `json:"upstream_mobile_user_agent"`
 	// HTTP status code used to redirect humans (302 or 307 recommended)
 	RedirectStatus int `json:"redirect_status"`
+	// Per-path overrides of RedirectStatus and the B path redirected to (first match wins).
+	RedirectRules []RedirectRule `json:"redirect_rules"`
+	// Response headers set, appended or removed per path, for bots, humans or both.
+	HeaderRules []HeaderRule `json:"header_rules"`
+	// Answer every non-admin request with the 503 maintenance page.
+	MaintenanceMode bool `json:"maintenance_mode"`
+	// Retry-After seconds sent with the maintenance page (0 omits the header).
+	MaintenanceRetryAfter int `json:"maintenance_retry_after"`
+	// HTML templates (html/template files) replacing the built-in 502, 503, 504
+	// and "maintenance" pages, keyed by status code or "maintenance".
+	ErrorPages map[string]string `json:"error_pages"`
 	// Admin token required to call admin endpoints like purge
 	AdminToken string `json:"admin_token"`
+	// Further admin tokens, each limited to some scopes (read, purge, warm,
+	// full), e.g. a purge-only token for the content team.
+	AdminTokens []AdminCredential `json:"admin_tokens"`
+	// Tenant name -> the B hosts it owns, e.g. {"shop": ["b-shop.com"]}. Admin
+	// tokens limited to tenants only see and change those hosts' cache
+	// entries, cache stats and warm jobs.
+	Tenants map[string][]string `json:"tenants"`
+	// Client IP ranges allowed to reach the admin routes (empty allows any).
+	AdminAllowCIDRs []string `json:"admin_allow_cidrs"`
+	// Optional HTTP basic auth required on the admin routes in addition to the token.
+	AdminBasicAuthUser     string `json:"admin_basic_auth_user"`
+	AdminBasicAuthPassword string `json:"admin_basic_auth_password"`
+	// Lock a client IP out of the admin routes for AdminLockoutSeconds after this
+	// many failed authentications within that window (0 disables).
+	AdminLockoutThreshold int `json:"admin_lockout_threshold"`
+	AdminLockoutSeconds   int `json:"admin_lockout_seconds"`
+	// Client IP ranges allowed to send plugin-style PURGE / GET /purge/<path> requests without the admin token.
+	PurgeAllowCIDRs []string `json:"purge_allow_cidrs"`
+	// Shared secret for HMAC-signed POST /webhooks/purge requests. Empty disables the endpoint.
+	WebhookSecret string `json:"webhook_secret"`
+	// Paths purged and rewarmed on every webhook, e.g. listing pages: "/", "/blog/", "/sitemap.xml".
+	WebhookPurgePaths []string `json:"webhook_purge_paths"`
 	// Admin purge UI path (long hashed). If empty, derived from AdminToken.
 	AdminUIPath string `json:"admin_ui_path"`
+	// How long an admin UI login lasts.
+	AdminSessionTTLSeconds int `json:"admin_session_ttl_seconds"`
+	// Append-only JSON-lines log of admin actions, read back by /admin/audit.
+	AuditLogFile string `json:"audit_log_file"`
 	// Log level: debug, info, warn, error
 	LogLevel string `json:"log_level"`
+	// Per-component levels overriding LogLevel, e.g. {"cache": "warn"}, for
+	// the handler, prefetch, sitemap and cache components.
+	LogLevels map[string]string `json:"log_levels"`
+	// Console log output: stdout (default), stderr or none (file only).
+	LogOutput string `json:"log_output"`
+	// Debug sampling: per event and second, log the first LogSampleInitial
+	// entries, then every LogSampleThereafter-th. 0 disables sampling.
+	LogSampleInitial    int `json:"log_sample_initial"`
+	LogSampleThereafter int `json:"log_sample_thereafter"`
+	// Log shipping, alongside console and file: syslog target ("local",
+	// udp://host:514 or tcp://host:514), a generic HTTP endpoint receiving
+	// batches of NDJSON lines, and a Loki push URL with its stream labels.
+	// LogShipHeaders go with the HTTP and Loki requests (auth, tenant).
+	LogSyslog      string            `json:"log_syslog"`
+	LogHTTPURL     string            `json:"log_http_url"`
+	LogLokiURL     string            `json:"log_loki_url"`
+	LogLokiLabels  map[string]string `json:"log_loki_labels"`
+	LogShipHeaders map[string]string `json:"log_ship_headers"`
 	// Log file path. If empty, file logging disabled.
 	LogFile string `json:"log_file"`
 	// Log rotation settings
 	LogMaxSizeMB  int `json:"log_max_size_mb"`
 	LogMaxBackups int `json:"log_max_backups"`
 	LogMaxAgeDays int `json:"log_max_age_days"`
+	// Dedicated access log file; empty keeps access entries in the app log.
+	AccessLogFile string `json:"access_log_file"`
+	// Access log format: json (default), combined or common.
+	AccessLogFormat string `json:"access_log_format"`
+	// Access log rotation settings, independent of the app log's.
+	AccessLogMaxSizeMB  int `json:"access_log_max_size_mb"`
+	AccessLogMaxBackups int `json:"access_log_max_backups"`
+	AccessLogMaxAgeDays int `json:"access_log_max_age_days"`
+	// Hours of per-bot-family traffic kept for /admin/stats/bots (0 disables tracking).
+	BotStatsRetentionHours int `json:"bot_stats_retention_hours"`
+	// OTLP/HTTP traces URL of an OpenTelemetry collector (empty disables tracing),
+	// with extra export headers, the service.name resource and the share of
+	// new traces sampled (0-1; incoming traceparent decisions are kept).
+	TracingEndpoint    string            `json:"tracing_endpoint"`
+	TracingHeaders     map[string]string `json:"tracing_headers"`
+	TracingServiceName string            `json:"tracing_service_name"`
+	TracingSampleRatio float64           `json:"tracing_sample_ratio"`
 	// Interval to log system metrics (seconds). 0 disables.
 	MetricsIntervalSeconds int `json:"metrics_interval_seconds"`
 	// Optional per-path TTL rules (evaluated in order). First match wins.
 	CacheTTLRules []TTLRule `json:"cache_ttl_rules"`
-	// Delay between sitemap warm fetches in seconds.
+	// Minimum gap between sitemap warm fetches to the same host, in seconds (across workers and jobs).
 	SitemapWarmDelaySeconds int `json:"sitemap_warm_delay_seconds"`
+	// Parallel fetches per sitemap warm job; the delay above still spaces requests to each host.
+	SitemapWarmConcurrency int `json:"sitemap_warm_concurrency"`
+	// Warm jobs skip URLs the B site's robots.txt disallows and space fetches
+	// by its Crawl-delay unless WarmIgnoreRobots is set. WarmCrawlDelaySeconds
+	// above 0 replaces the Crawl-delay; -1 ignores it.
+	WarmIgnoreRobots      bool `json:"warm_ignore_robots"`
+	WarmCrawlDelaySeconds int  `json:"warm_crawl_delay_seconds"`
+	// Finished warm jobs kept in memory and under <CacheDir>/jobs; older ones are pruned. 0 keeps all.
+	SitemapWarmJobHistory int `json:"sitemap_warm_job_history"`
+	// Finished warm jobs older than this many days are pruned. 0 keeps them regardless of age.
+	SitemapWarmJobMaxAgeDays int `json:"sitemap_warm_job_max_age_days"`
+	// Per-URL results kept per warm job (most recent); counters still cover every URL. 0 keeps all.
+	SitemapWarmMaxURLStatuses int `json:"sitemap_warm_max_url_statuses"`
+	// After caching an HTML page, prefetch what it references on the same host:
+	// "assets" (stylesheets, scripts, images, icons) or "all" (assets plus <a> links).
+	// Empty or "off" disables it. Prefetched resources are not followed further.
+	PrefetchSubresources string `json:"prefetch_subresources"`
+	// Most resources queued per cached page.
+	PrefetchSubresourcesMax int `json:"prefetch_subresources_max"`
+	// Background prefetch workers and queued jobs; when the queue is full an
+	// admin rewarm evicts the newest human-triggered warm.
+	PrefetchWorkers   int `json:"prefetch_workers"`
+	PrefetchQueueSize int `json:"prefetch_queue_size"`
+	// Attempts per queued prefetch failing with a network error, 429 or 5xx,
+	// re-queued after PrefetchRetryBackoffMs doubled per retry (with jitter).
+	PrefetchMaxAttempts    int `json:"prefetch_max_attempts"`
+	PrefetchRetryBackoffMs int `json:"prefetch_retry_backoff_ms"`
+	// Crawl warm jobs follow links at most this many hops from the start page.
+	CrawlWarmMaxDepth int `json:"crawl_warm_max_depth"`
+	// Default page budget of a crawl warm job.
+	CrawlWarmMaxURLs int `json:"crawl_warm_max_urls"`
+	// Optional rendering service (Rendertron, Prerender or compatible) used for
+	// RenderPatterns paths: the target URL is appended, or substituted for "{url}".
+	RenderServiceURL string `json:"render_service_url"`
+	// Sent to the rendering service as X-Prerender-Token.
+	RenderServiceToken string `json:"render_service_token"`
+	// Paths fetched through the rendering service (same syntax as CachePatterns).
+	RenderPatterns []string `json:"render_patterns"`
+	// Timeout for one rendering request.
+	RenderTimeoutSeconds int `json:"render_timeout_seconds"`
+	// Sitemaps re-warmed automatically on a fixed interval (env: "6h=https://b.com/sitemap.xml,...").
+	SitemapWarmSchedules []SitemapWarmSchedule `json:"sitemap_warm_schedules"`
+	// Optional A host/path prefix -> B site mappings (evaluated in order). First match wins;
+	// requests matching none use BBaseURL.
+	Upstreams []UpstreamMapping `json:"upstreams"`
+	// Additional B host -> A host pairs rewritten in bot-served content (e.g. a separate CDN domain).
+	RewriteHosts []RewriteHostMapping `json:"rewrite_hosts"`
+	// hreflang value -> A host or origin for alternate links, e.g. {"de": "de.a.com", "x-default": "a.com"}.
+	HreflangHosts map[string]string `json:"hreflang_hosts"`
+	// Request path patterns whose responses are served without any rewriting.
+	RewriteExcludePaths []string `json:"rewrite_exclude_paths"`
+	// Simple selectors (tag, #id, .class, tag.class) of HTML elements left untouched, including their content.
+	RewriteExcludeSelectors []string `json:"rewrite_exclude_selectors"`
+	// Simple selectors of HTML elements removed with their content from bot-served pages (admin bars, trackers).
+	StripSelectors []string `json:"strip_selectors"`
+	// Minify bot-served HTML, CSS and JavaScript and drop HTML comments.
+	MinifyResponses bool `json:"minify_responses"`
+	// Ordered body transformer chain: built-in names plus "hook:<url>" and
+	// "plugin:<path>" entries. Empty uses the default built-in order.
+	Transformers []string `json:"transformers"`
+	// Timeout for one hook transformer request (default 5).
+	TransformHookTimeoutSeconds int `json:"transform_hook_timeout_seconds"`
+	// Inject or overwrite <link rel="canonical">, og:url and twitter:url in bot-served HTML with the A URL.
+	InjectCanonical bool `json:"inject_canonical"`
+	// Per-path robots meta/X-Robots-Tag policies for bot-served responses (first match wins).
+	RobotsPolicies []RobotsPolicy `json:"robots_policies"`
+	// JSON-LD blocks injected into bot-served HTML per path (every matching rule applies).
+	StructuredData []StructuredDataRule `json:"structured_data"`
+	// Local robots.txt served instead of proxying B's: a text/template file or inline text.
+	// Variables: {{.AHost}}, {{.ABaseURL}}, {{range .Sitemaps}}...{{end}}.
+	RobotsTxtFile string `json:"robots_txt_file"`
+	RobotsTxt     string `json:"robots_txt"`
+	// Serve a generated "allow all" robots.txt listing RobotsTxtSitemaps when no template is set.
+	RobotsTxtSynthesize bool `json:"robots_txt_synthesize"`
+	// Sitemap paths or URLs exposed to robots.txt templates (default /sitemap.xml).
+	RobotsTxtSitemaps []string `json:"robots_txt_sitemaps"`
+	// Checks run by /readyz: cache_dir, upstream, prefetch_queue (default all).
+	ReadyzChecks []string `json:"readyz_checks"`
+	// Path on the B site probed (HEAD) by the upstream readiness check; default "/".
+	ReadyzUpstreamPath string `json:"readyz_upstream_path"`
+	// Extra UA substrings treated as bots, on top of the built-in list.
+	BotUAInclude []string `json:"bot_ua_include"`
+	// UA substrings never treated as bots (e.g. internal monitoring agents).
+	BotUAExclude []string `json:"bot_ua_exclude"`
+	// Optional file with one UA substring per line ("!" prefix excludes). Re-read on reload.
+	BotUAFile string `json:"bot_ua_file"`
+	// Confirm crawlers claiming Googlebot/Bingbot/etc. via reverse + forward DNS; spoofed UAs are treated as humans.
+	VerifyBots bool `json:"verify_bots"`
+	// Extra UA substrings of scanners and bad bots, on top of the built-in list
+	// (sqlmap, nikto, nuclei, credential stuffers, ...). Good-bot detection is separate.
+	BadBotUA []string `json:"bad_bot_ua"`
+	// What bad bots get: "block" (403, default), "tarpit" (403 after
+	// BadBotTarpitSeconds), "fake" (empty 200 page) or "off".
+	BadBotAction        string `json:"bad_bot_action"`
+	BadBotTarpitSeconds int    `json:"bad_bot_tarpit_seconds"`
+	// Challenge human-path clients that lack the headers of a real browser
+	// before redirecting or proxying them: "off" (default), "js" (a script
+	// computes the pass cookie) or "cookie" (the client must keep a cookie).
+	// A pass holds for the client IP and cookie for ChallengePassMinutes.
+	ChallengeMode        string `json:"challenge_mode"`
+	ChallengePassMinutes int    `json:"challenge_pass_minutes"`
+	// Signs pass cookies; set the same on every instance. Empty uses a random
+	// key per start.
+	ChallengeSecret string `json:"challenge_secret"`
+	// Weighted origins humans are redirected to instead of BBaseURL, e.g. 90% to
+	// B and 10% to B2; each visitor keeps their assignment through a cookie.
+	// Bots, proxying and the cache still use BBaseURL.
+	RedirectTargets []RedirectTarget `json:"redirect_targets"`
+	// MaxMind DB file (GeoLite2/GeoIP2 Country or City) for GeoRules and the
+	// country in access logs; a replaced file is picked up within a minute.
+	GeoIPDatabase string `json:"geoip_database"`
+	// Per-country routing by client IP (first match wins): redirect humans to
+	// a region mirror or block everyone.
+	GeoRules []GeoRule `json:"geo_rules"`
+	// Client IP ranges always treated as bots (e.g. published Googlebot ranges) or never treated as bots.
+	BotAllowCIDRs []string `json:"bot_allow_cidrs"`
+	BotDenyCIDRs  []string `json:"bot_deny_cidrs"`
+	// Optional file of allowed ranges: one CIDR per line or Google/Bing published JSON. Re-read on reload.
+	BotAllowCIDRFile string `json:"bot_allow_cidr_file"`
+	// Use the last X-Forwarded-For entry as client IP (set when running behind a reverse proxy).
+	TrustXForwardedFor bool `json:"trust_x_forwarded_for"`
+	// Peers (CIDRs, IPs, "cloudflare", "private") whose X-Forwarded-For and
+	// X-Forwarded-Proto are believed; the client is the first address left of
+	// them in X-Forwarded-For. Takes precedence over TrustXForwardedFor.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Cap on concurrent outbound fetches to B sites (0 = unlimited).
+	UpstreamMaxConcurrent int `json:"upstream_max_concurrent"`
+	// Cap on outbound fetch rate to B sites in requests per second (0 = unlimited).
+	UpstreamMaxRPS float64 `json:"upstream_max_rps"`
+	// Retries of GET/HEAD fetches failing with a network error or 502/503/504,
+	// after UpstreamRetryBackoffMs doubled per retry (with jitter).
+	UpstreamRetries        int `json:"upstream_retries"`
+	UpstreamRetryBackoffMs int `json:"upstream_retry_backoff_ms"`
+	// Consecutive failed fetches to a B host that open its circuit breaker (0
+	// disables); while open, fetches fail at once for the cooldown and stale
+	// cache or a 503 is served.
+	UpstreamBreakerThreshold       int `json:"upstream_breaker_threshold"`
+	UpstreamBreakerCooldownSeconds int `json:"upstream_breaker_cooldown_seconds"`
+	// Total time allowed per fetch to B (seconds): bot and prefetch fetches
+	// (default 15) and sitemap/crawl fetches (default 30).
+	UpstreamTimeoutSeconds     int `json:"upstream_timeout_seconds"`
+	SitemapFetchTimeoutSeconds int `json:"sitemap_fetch_timeout_seconds"`
+	// Upstream connection settings (seconds): TCP connect (default 30), TLS
+	// handshake (default 10) and wait for response headers (0 = no limit).
+	UpstreamConnectTimeoutSeconds int `json:"upstream_connect_timeout_seconds"`
+	UpstreamTLSTimeoutSeconds     int `json:"upstream_tls_timeout_seconds"`
+	UpstreamHeaderTimeoutSeconds  int `json:"upstream_header_timeout_seconds"`
+	// Idle keep-alive connections kept per B host (0 = Go default of 2).
+	UpstreamMaxIdleConnsPerHost int `json:"upstream_max_idle_conns_per_host"`
+	// Proxy for upstream fetches (http, https or socks5 URL). Empty uses
+	// HTTP_PROXY/HTTPS_PROXY/NO_PROXY from the environment.
+	UpstreamProxyURL string `json:"upstream_proxy_url"`
+	// PEM bundle of extra CAs trusted for B sites, on top of the system pool.
+	UpstreamCAFile string `json:"upstream_ca_file"`
+	// Skip TLS certificate verification for B sites (self-signed staging origins only).
+	UpstreamInsecureSkipVerify bool `json:"upstream_insecure_skip_verify"`
+	// Host header and TLS server name (SNI) sent to the B site instead of those
+	// of BBaseURL, e.g. to fetch by IP while presenting the production hostname.
+	// UPSTREAMS mappings set their own (host_header, tls_server_name).
+	UpstreamHostHeader    string `json:"upstream_host_header"`
+	UpstreamTLSServerName string `json:"upstream_tls_server_name"`
+	// Credentials attached to requests for the B site (bearer token, basic
+	// auth, headers, HMAC signature); UPSTREAMS mappings may set their own.
+	UpstreamAuth *UpstreamAuth `json:"upstream_auth,omitempty"`
+	// What to do with 3xx responses from B: "follow" them server-side (up to
+	// UpstreamMaxRedirects hops) or "rewrite" their Location to A and pass them on.
+	UpstreamRedirects    string `json:"upstream_redirects"`
+	UpstreamMaxRedirects int    `json:"upstream_max_redirects"`
+	// HTTP server timeouts (seconds) and header size limit. 0 disables a timeout.
+	ServerReadTimeoutSeconds       int `json:"server_read_timeout_seconds"`
+	ServerReadHeaderTimeoutSeconds int `json:"server_read_header_timeout_seconds"`
+	ServerWriteTimeoutSeconds      int `json:"server_write_timeout_seconds"`
+	ServerIdleTimeoutSeconds       int `json:"server_idle_timeout_seconds"`
+	ServerMaxHeaderBytes           int `json:"server_max_header_bytes"`
+	// Serve HTTP/2 over cleartext (h2c), e.g. behind a proxy speaking h2 to the backend.
+	EnableH2C bool `json:"enable_h2c"`
+	// Extra request headers forwarded to B on the uncached bot path (see forwardedRequestHeaders).
+	ForwardHeaders []string `json:"forward_headers"`
+	// Forward Cookie to B on the uncached bot path; also passes Set-Cookie back
+	// unless HeaderPolicies sets a set-cookie policy.
+	ForwardCookies bool `json:"forward_cookies"`
+	// What to do with upstream Set-Cookie, CSP, HSTS and CORS headers on bot
+	// responses, per group: strip (default), pass or rewrite B hosts to A.
+	HeaderPolicies map[string]string `json:"header_policies"`
+	// Headers carrying the original client IP on upstream requests:
+	// x-forwarded-for, x-real-ip, forwarded (RFC 7239). Empty sends none.
+	ForwardClientIP []string `json:"forward_client_ip"`
+	// Serve an expired cache entry (X-Cache: STALE) when the upstream fetch fails or returns 5xx.
+	ServeStaleOnError bool `json:"serve_stale_on_error"`
+	// Time allowed for in-flight requests and background work to drain on shutdown (seconds).
+	ShutdownTimeoutSeconds int `json:"shutdown_timeout_seconds"`
+	// Poll the config file and bot list files for changes and reload them (seconds, 0 disables).
+	ConfigWatchIntervalSeconds int `json:"config_watch_interval_seconds"`
+	// File the process ID is written to, kept current across binary upgrades
+	// (SIGUSR2) so a supervisor can follow the new process.
+	PidFile string `json:"pid_file"`
+	// Time a new binary started by SIGUSR2 has to start serving before the
+	// upgrade is abandoned and the old process keeps running (seconds).
+	UpgradeTimeoutSeconds int `json:"upgrade_timeout_seconds"`
+
+	// configPath is the CONFIG_PATH file runtime overrides are persisted to.
+	configPath string
+	// transformers is Transformers resolved once per config load (see
+	// applyConfig); nil until then.
+	transformers []bodyTransformer
+	// trustedProxyNets is TrustedProxies parsed once per config load; every
+	// client IP, scheme and access log decision reads it.
+	trustedProxyNets []*net.IPNet
+	// botUA and botCIDRs are the bot lists of the handler serving this
+	// config (see applyConfig); nil means the built-in UA list only.
+	botUA    *botUAMatcher
+	botCIDRs *botCIDRLists
+}
+
+// RewriteHostMapping rewrites URLs on From (a B host) to To (an A host or origin).
+// Without a scheme To keeps the A site's scheme.
+type RewriteHostMapping struct {
+	From string `json:"from"`
+	To   string `json:"to"`
 }
 
-// TTLRule defines a TTL for matching request paths.
+// TTLRule defines a TTL for matching responses. All non-empty selectors must match.
 type TTLRule struct {
-	Pattern    string `json:"pattern"`
+	// Glob path pattern ("/blog/*", "/blog/") or extension ("*.xml").
+	Pattern string `json:"pattern,omitempty"`
+	// Regular expression matched against the request path.
+	Regex string `json:"regex,omitempty"`
+	// Upstream status codes or classes, e.g. "404,410" or "5xx". Empty means 200 only.
+	Status     string `json:"status,omitempty"`
 	TTLSeconds int    `json:"ttl_seconds"`
+	// Use the upstream Cache-Control s-maxage/max-age when present instead of TTLSeconds.
+	RespectCacheControl bool `json:"respect_cache_control,omitempty"`
 }
 
 func getenv(key, def string) string {
@@ -67,25 +436,115 @@ func getenv(key, def string) string {
 	return def
 }
 
-func loadConfig() (*Config, error) {
+// splitCommaList splits v on commas, trimming spaces and dropping empty items.
+func splitCommaList(v string) []string {
+	out := []string{}
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// setIntFromEnv overwrites *dst with the integer in env key when it is >= min.
+func setIntFromEnv(key string, dst *int, min int) {
+	if v := os.Getenv(key); v != "" {
+		var n int
+		fmt.Sscanf(v, "%d", &n)
+		if n >= min {
+			*dst = n
+		}
+	}
+}
+
+// setBoolFromEnv overwrites *dst when env key holds a recognized boolean.
+func setBoolFromEnv(key string, dst *bool) {
+	switch strings.ToLower(os.Getenv(key)) {
+	case "1", "true", "yes", "on":
+		*dst = true
+	case "0", "false", "no", "off":
+		*dst = false
+	}
+}
+
+// LoadConfig reads the configuration from the environment and the CONFIG_PATH
+// file (default ./config.json), which overrides it, and validates it.
+func LoadConfig() (*Config, error) {
 	cfg := &Config{
-		BBaseURL:                getenv("B_BASE_URL", ""),
-		StaticRedirectURL:       getenv("STATIC_REDIRECT_URL", ""),
-		ABaseURL:                getenv("A_BASE_URL", ""),
-		UpstreamUserAgent:       getenv("UPSTREAM_USER_AGENT", defaultUpstreamUserAgent),
-		ListenAddr:              getenv("LISTEN_ADDR", ":8080"),
-		CacheDir:                getenv("CACHE_DIR", "./cache"),
-		CacheTTLSeconds:         3600,
-		CacheAll:                true,
-		CachePatterns:           []string{"/sitemap.xml", "/blog/*", "/products/*"},
-		RedirectStatus:          302,
-		LogLevel:                getenv("LOG_LEVEL", "info"),
-		LogFile:                 getenv("LOG_FILE", "./logs/a-site.log"),
-		LogMaxSizeMB:            10,
-		LogMaxBackups:           5,
-		LogMaxAgeDays:           7,
-		MetricsIntervalSeconds:  60,
-		SitemapWarmDelaySeconds: 10,
+		BBaseURL:                   getenv("B_BASE_URL", ""),
+		StaticRedirectURL:          getenv("STATIC_REDIRECT_URL", ""),
+		HumanMode:                  strings.ToLower(strings.TrimSpace(getenv("HUMAN_MODE", humanModeRedirect))),
+		ABaseURL:                   getenv("A_BASE_URL", ""),
+		UpstreamUserAgent:          getenv("UPSTREAM_USER_AGENT", defaultUpstreamUserAgent),
+		UpstreamMobileUserAgent:    getenv("UPSTREAM_MOBILE_USER_AGENT", defaultUpstreamMobileUserAgent),
+		ListenAddr:                 getenv("LISTEN_ADDR", ":8080"),
+		AdminListenAddr:            getenv("ADMIN_LISTEN_ADDR", ""),
+		TLSCertFile:                getenv("TLS_CERT_FILE", ""),
+		TLSKeyFile:                 getenv("TLS_KEY_FILE", ""),
+		CacheDir:                   getenv("CACHE_DIR", "./cache"),
+		CacheS3URL:                 getenv("CACHE_S3_URL", ""),
+		CacheS3Prefix:              getenv("CACHE_S3_PREFIX", ""),
+		CacheS3Region:              getenv("CACHE_S3_REGION", "us-east-1"),
+		CacheS3AccessKeyID:         getenv("CACHE_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+		CacheS3SecretAccessKey:     getenv("CACHE_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		CacheTTLSeconds:            3600,
+		CacheCheckIntervalMinutes:  60,
+		CacheBypassResponse:        []string{cacheBypassHeader, cacheBypassPrivate},
+		BadBotAction:               badBotActionBlock,
+		BadBotTarpitSeconds:        10,
+		ChallengeMode:              challengeOff,
+		ChallengePassMinutes:       defaultChallengePassMinutes,
+		CacheAll:                   true,
+		CachePatterns:              []string{"/sitemap.xml", "/blog/*", "/products/*"},
+		RedirectStatus:             302,
+		LogLevel:                   getenv("LOG_LEVEL", "info"),
+		LogFile:                    getenv("LOG_FILE", "./logs/a-site.log"),
+		LogMaxSizeMB:               10,
+		LogMaxBackups:              5,
+		LogMaxAgeDays:              7,
+		AccessLogFile:              getenv("ACCESS_LOG_FILE", ""),
+		AuditLogFile:               getenv("AUDIT_LOG_FILE", "./logs/audit.log"),
+		AccessLogMaxSizeMB:         100,
+		AccessLogMaxBackups:        10,
+		AccessLogMaxAgeDays:        14,
+		BotStatsRetentionHours:     168,
+		TracingSampleRatio:         1,
+		MetricsIntervalSeconds:     60,
+		SitemapWarmDelaySeconds:    10,
+		SitemapWarmConcurrency:     1,
+		SitemapWarmJobHistory:      100,
+		SitemapWarmJobMaxAgeDays:   30,
+		SitemapWarmMaxURLStatuses:  1000,
+		CrawlWarmMaxDepth:          3,
+		PrefetchSubresources:       strings.ToLower(strings.TrimSpace(os.Getenv("PREFETCH_SUBRESOURCES"))),
+		PrefetchSubresourcesMax:    50,
+		PrefetchWorkers:            2,
+		PrefetchQueueSize:          256,
+		PrefetchMaxAttempts:        3,
+		PrefetchRetryBackoffMs:     1000,
+		CrawlWarmMaxURLs:           500,
+		RenderServiceURL:           getenv("RENDER_SERVICE_URL", ""),
+		RenderServiceToken:         getenv("RENDER_SERVICE_TOKEN", ""),
+		RenderTimeoutSeconds:       defaultRenderTimeoutSeconds,
+		ShutdownTimeoutSeconds:     30,
+		AdminLockoutThreshold:      5,
+		UpstreamRedirects:          upstreamRedirectFollow,
+		UpstreamMaxRedirects:       10,
+		UpstreamRetries:            2,
+		UpstreamRetryBackoffMs:     200,
+		UpstreamBreakerThreshold:   5,
+		AdminLockoutSeconds:        900,
+		AdminSessionTTLSeconds:     defaultAdminSessionTTLSeconds,
+		MaintenanceRetryAfter:      3600,
+		ConfigWatchIntervalSeconds: 5,
+		UpgradeTimeoutSeconds:      60,
+
+		ServerReadTimeoutSeconds:       30,
+		ServerReadHeaderTimeoutSeconds: 10,
+		ServerWriteTimeoutSeconds:      60,
+		ServerIdleTimeoutSeconds:       120,
+		ServerMaxHeaderBytes:           1 << 20,
 	}
 
 	if v := os.Getenv("CACHE_TTL_SECONDS"); v != "" {
@@ -95,6 +554,15 @@ func loadConfig() (*Config, error) {
 			cfg.CacheTTLSeconds = n
 		}
 	}
+	setBoolFromEnv("CACHE_RESPECT_CACHE_CONTROL", &cfg.CacheRespectCacheControl)
+	setIntFromEnv("CACHE_TTL_MIN_SECONDS", &cfg.CacheTTLMinSeconds, 0)
+	setIntFromEnv("CACHE_TTL_MAX_SECONDS", &cfg.CacheTTLMaxSeconds, 0)
+	if v := compactEnv("CACHE_BYPASS_RESPONSE"); v != "" {
+		cfg.CacheBypassResponse = splitCommaList(v)
+	}
+	if v := compactEnv("CACHE_BYPASS_COOKIES"); v != "" {
+		cfg.CacheBypassCookies = splitCommaList(v)
+	}
 	if v := strings.ToLower(os.Getenv("CACHE_ALL")); v != "" {
 		if v == "1" || v == "true" || v == "yes" || v == "on" {
 			cfg.CacheAll = true
@@ -102,7 +570,7 @@ func loadConfig() (*Config, error) {
 			cfg.CacheAll = false
 		}
 	}
-	if v := os.Getenv("CACHE_PATTERNS"); v != "" {
+	if v := compactEnv("CACHE_PATTERNS"); v != "" {
 		parts := strings.Split(v, ",")
 		out := make([]string, 0, len(parts))
 		for _, p := range parts {
@@ -118,6 +586,12 @@ func loadConfig() (*Config, error) {
 			cfg.CachePatterns = out
 		}
 	}
+	if v := compactEnv("CACHE_VARY"); v != "" {
+		cfg.CacheVary = splitCommaList(v)
+	}
+	if v := compactEnv("CACHE_VARY_LANGS"); v != "" {
+		cfg.CacheVaryLangs = splitCommaList(v)
+	}
 	if v := os.Getenv("REDIRECT_STATUS"); v != "" {
 		var n int
 		fmt.Sscanf(v, "%d", &n)
@@ -132,6 +606,21 @@ func loadConfig() (*Config, error) {
 			cfg.MetricsIntervalSeconds = n
 		}
 	}
+	setIntFromEnv("SITEMAP_WARM_CONCURRENCY", &cfg.SitemapWarmConcurrency, 1)
+	setBoolFromEnv("WARM_IGNORE_ROBOTS", &cfg.WarmIgnoreRobots)
+	setIntFromEnv("WARM_CRAWL_DELAY_SECONDS", &cfg.WarmCrawlDelaySeconds, -1)
+	setIntFromEnv("SITEMAP_WARM_JOB_HISTORY", &cfg.SitemapWarmJobHistory, 0)
+	setIntFromEnv("SITEMAP_WARM_JOB_MAX_AGE_DAYS", &cfg.SitemapWarmJobMaxAgeDays, 0)
+	setIntFromEnv("SITEMAP_WARM_MAX_URL_STATUSES", &cfg.SitemapWarmMaxURLStatuses, 0)
+	setIntFromEnv("CRAWL_WARM_MAX_DEPTH", &cfg.CrawlWarmMaxDepth, 1)
+	setIntFromEnv("CRAWL_WARM_MAX_URLS", &cfg.CrawlWarmMaxURLs, 1)
+	setIntFromEnv("PREFETCH_SUBRESOURCES_MAX", &cfg.PrefetchSubresourcesMax, 1)
+	setIntFromEnv("PREFETCH_WORKERS", &cfg.PrefetchWorkers, 1)
+	setIntFromEnv("PREFETCH_QUEUE_SIZE", &cfg.PrefetchQueueSize, 1)
+	setIntFromEnv("PREFETCH_MAX_ATTEMPTS", &cfg.PrefetchMaxAttempts, 1)
+	setIntFromEnv("PREFETCH_RETRY_BACKOFF_MS", &cfg.PrefetchRetryBackoffMs, 0)
+	setIntFromEnv("CACHE_CHECK_INTERVAL_MINUTES", &cfg.CacheCheckIntervalMinutes, 0)
+	setIntFromEnv("RENDER_TIMEOUT_SECONDS", &cfg.RenderTimeoutSeconds, 1)
 	if v := os.Getenv("SITEMAP_WARM_DELAY_SECONDS"); v != "" {
 		var n int
 		fmt.Sscanf(v, "%d", &n)
@@ -139,6 +628,113 @@ func loadConfig() (*Config, error) {
 			cfg.SitemapWarmDelaySeconds = n
 		}
 	}
+	if v := os.Getenv("SHUTDOWN_TIMEOUT_SECONDS"); v != "" {
+		var n int
+		fmt.Sscanf(v, "%d", &n)
+		if n > 0 {
+			cfg.ShutdownTimeoutSeconds = n
+		}
+	}
+	setIntFromEnv("CONFIG_WATCH_INTERVAL_SECONDS", &cfg.ConfigWatchIntervalSeconds, 0)
+	cfg.PidFile = strings.TrimSpace(os.Getenv("PID_FILE"))
+	setIntFromEnv("UPGRADE_TIMEOUT_SECONDS", &cfg.UpgradeTimeoutSeconds, 1)
+	setIntFromEnv("UPSTREAM_MAX_CONCURRENT", &cfg.UpstreamMaxConcurrent, 0)
+	if v := os.Getenv("UPSTREAM_REDIRECTS"); v != "" {
+		cfg.UpstreamRedirects = strings.ToLower(strings.TrimSpace(v))
+	}
+	setIntFromEnv("UPSTREAM_MAX_REDIRECTS", &cfg.UpstreamMaxRedirects, 0)
+	setIntFromEnv("UPSTREAM_TIMEOUT_SECONDS", &cfg.UpstreamTimeoutSeconds, 0)
+	setIntFromEnv("SITEMAP_FETCH_TIMEOUT_SECONDS", &cfg.SitemapFetchTimeoutSeconds, 0)
+	setIntFromEnv("UPSTREAM_CONNECT_TIMEOUT_SECONDS", &cfg.UpstreamConnectTimeoutSeconds, 0)
+	setIntFromEnv("UPSTREAM_TLS_TIMEOUT_SECONDS", &cfg.UpstreamTLSTimeoutSeconds, 0)
+	setIntFromEnv("UPSTREAM_HEADER_TIMEOUT_SECONDS", &cfg.UpstreamHeaderTimeoutSeconds, 0)
+	setIntFromEnv("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &cfg.UpstreamMaxIdleConnsPerHost, 0)
+	if v := os.Getenv("UPSTREAM_PROXY_URL"); v != "" {
+		cfg.UpstreamProxyURL = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("UPSTREAM_CA_FILE"); v != "" {
+		cfg.UpstreamCAFile = strings.TrimSpace(v)
+	}
+	setBoolFromEnv("UPSTREAM_INSECURE_SKIP_VERIFY", &cfg.UpstreamInsecureSkipVerify)
+	if v := os.Getenv("UPSTREAM_UA_MODE"); v != "" {
+		cfg.UpstreamUAMode = strings.ToLower(strings.TrimSpace(v))
+	}
+	if v := compactEnv("UPSTREAM_UA_FAMILIES"); v != "" {
+		fams, err := parseUAFamilies(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_UA_FAMILIES: %w", err)
+		}
+		cfg.UpstreamUAFamilies = fams
+	}
+	if v := os.Getenv("UPSTREAM_HOST_HEADER"); v != "" {
+		cfg.UpstreamHostHeader = strings.TrimSpace(v)
+	}
+	if v := os.Getenv("UPSTREAM_TLS_SERVER_NAME"); v != "" {
+		cfg.UpstreamTLSServerName = strings.TrimSpace(v)
+	}
+	auth := &UpstreamAuth{
+		BearerToken:     os.Getenv("UPSTREAM_BEARER_TOKEN"),
+		BasicUser:       os.Getenv("UPSTREAM_BASIC_AUTH_USER"),
+		BasicPassword:   os.Getenv("UPSTREAM_BASIC_AUTH_PASSWORD"),
+		HMACSecret:      os.Getenv("UPSTREAM_HMAC_SECRET"),
+		SignatureHeader: strings.TrimSpace(os.Getenv("UPSTREAM_SIGNATURE_HEADER")),
+	}
+	if v := os.Getenv("UPSTREAM_HEADERS"); v != "" {
+		h, err := parseUpstreamHeaders(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAM_HEADERS: %w", err)
+		}
+		auth.Headers = h
+	}
+	if !auth.empty() {
+		cfg.UpstreamAuth = auth
+	}
+	setIntFromEnv("UPSTREAM_RETRIES", &cfg.UpstreamRetries, 0)
+	setIntFromEnv("UPSTREAM_RETRY_BACKOFF_MS", &cfg.UpstreamRetryBackoffMs, 0)
+	setIntFromEnv("UPSTREAM_BREAKER_THRESHOLD", &cfg.UpstreamBreakerThreshold, 0)
+	setIntFromEnv("UPSTREAM_BREAKER_COOLDOWN_SECONDS", &cfg.UpstreamBreakerCooldownSeconds, 0)
+	if v := os.Getenv("UPSTREAM_MAX_RPS"); v != "" {
+		var f float64
+		fmt.Sscanf(v, "%g", &f)
+		if f >= 0 {
+			cfg.UpstreamMaxRPS = f
+		}
+	}
+	setIntFromEnv("SERVER_READ_TIMEOUT_SECONDS", &cfg.ServerReadTimeoutSeconds, 0)
+	setIntFromEnv("SERVER_READ_HEADER_TIMEOUT_SECONDS", &cfg.ServerReadHeaderTimeoutSeconds, 0)
+	setIntFromEnv("SERVER_WRITE_TIMEOUT_SECONDS", &cfg.ServerWriteTimeoutSeconds, 0)
+	setIntFromEnv("SERVER_IDLE_TIMEOUT_SECONDS", &cfg.ServerIdleTimeoutSeconds, 0)
+	setIntFromEnv("SERVER_MAX_HEADER_BYTES", &cfg.ServerMaxHeaderBytes, 1)
+	setBoolFromEnv("ENABLE_H2C", &cfg.EnableH2C)
+	setBoolFromEnv("SERVE_STALE_ON_ERROR", &cfg.ServeStaleOnError)
+	setBoolFromEnv("CACHE_ASSETS", &cfg.CacheAssets)
+	setBoolFromEnv("ADMIN_UNIX_ONLY", &cfg.AdminUnixOnly)
+	setBoolFromEnv("FORWARD_COOKIES", &cfg.ForwardCookies)
+	if v := compactEnv("HEADER_POLICIES"); v != "" {
+		pols, err := parseHeaderPolicies(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEADER_POLICIES: %w", err)
+		}
+		cfg.HeaderPolicies = pols
+	}
+	if v := compactEnv("FORWARD_CLIENT_IP"); v != "" {
+		cfg.ForwardClientIP = splitCommaList(v)
+	}
+	if v := compactEnv("FORWARD_HEADERS"); v != "" {
+		cfg.ForwardHeaders = splitCommaList(v)
+	}
+	setBoolFromEnv("CACHE_COMPRESS", &cfg.CacheCompress)
+	setBoolFromEnv("INJECT_CANONICAL", &cfg.InjectCanonical)
+	cfg.RobotsTxtFile = getenv("ROBOTS_TXT_FILE", "")
+	cfg.RobotsTxt = os.Getenv("ROBOTS_TXT")
+	setBoolFromEnv("ROBOTS_TXT_SYNTHESIZE", &cfg.RobotsTxtSynthesize)
+	if v := compactEnv("ROBOTS_TXT_SITEMAPS"); v != "" {
+		cfg.RobotsTxtSitemaps = splitCommaList(v)
+	}
+	if v := compactEnv("READYZ_CHECKS"); v != "" {
+		cfg.ReadyzChecks = splitCommaList(strings.ToLower(v))
+	}
+	cfg.ReadyzUpstreamPath = strings.TrimSpace(os.Getenv("READYZ_UPSTREAM_PATH"))
 	if v := os.Getenv("LOG_MAX_SIZE_MB"); v != "" {
 		var n int
 		fmt.Sscanf(v, "%d", &n)
@@ -160,28 +756,98 @@ func loadConfig() (*Config, error) {
 			cfg.LogMaxAgeDays = n
 		}
 	}
-	// Parse TTL rules from env: "/blog/*:600,/products/*:1200,/sitemap.xml:86400"
-	if v := os.Getenv("CACHE_TTL_RULES"); v != "" {
+	if v := compactEnv("LOG_LEVELS"); v != "" {
+		cfg.LogLevels = map[string]string{}
+		for _, p := range splitCommaList(v) {
+			c, lvl, ok := strings.Cut(p, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid LOG_LEVELS entry %q (want component=level)", p)
+			}
+			cfg.LogLevels[strings.TrimSpace(c)] = strings.TrimSpace(lvl)
+		}
+	}
+	if v := os.Getenv("LOG_OUTPUT"); v != "" {
+		cfg.LogOutput = strings.ToLower(strings.TrimSpace(v))
+	}
+	setIntFromEnv("LOG_SAMPLE_INITIAL", &cfg.LogSampleInitial, 0)
+	setIntFromEnv("LOG_SAMPLE_THEREAFTER", &cfg.LogSampleThereafter, 0)
+	cfg.LogSyslog = strings.TrimSpace(os.Getenv("LOG_SYSLOG"))
+	cfg.LogHTTPURL = strings.TrimSpace(os.Getenv("LOG_HTTP_URL"))
+	cfg.LogLokiURL = strings.TrimSpace(os.Getenv("LOG_LOKI_URL"))
+	if v := compactEnv("LOG_LOKI_LABELS"); v != "" {
+		cfg.LogLokiLabels = map[string]string{}
+		for _, p := range splitCommaList(v) {
+			k, val, ok := strings.Cut(p, "=")
+			if !ok || strings.TrimSpace(k) == "" {
+				return nil, fmt.Errorf("invalid LOG_LOKI_LABELS entry %q (want name=value)", p)
+			}
+			cfg.LogLokiLabels[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+	}
+	if v := compactEnv("LOG_SHIP_HEADERS"); v != "" {
+		h, err := parseUpstreamHeaders(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_SHIP_HEADERS: %w", err)
+		}
+		cfg.LogShipHeaders = h
+	}
+	if v := os.Getenv("ACCESS_LOG_FORMAT"); v != "" {
+		cfg.AccessLogFormat = strings.ToLower(strings.TrimSpace(v))
+	}
+	setIntFromEnv("ACCESS_LOG_MAX_SIZE_MB", &cfg.AccessLogMaxSizeMB, 1)
+	setIntFromEnv("ACCESS_LOG_MAX_BACKUPS", &cfg.AccessLogMaxBackups, 0)
+	setIntFromEnv("ACCESS_LOG_MAX_AGE_DAYS", &cfg.AccessLogMaxAgeDays, 0)
+	setIntFromEnv("BOT_STATS_RETENTION_HOURS", &cfg.BotStatsRetentionHours, 0)
+	// Tracing uses the standard OpenTelemetry SDK variables
+	if os.Getenv("OTEL_SDK_DISABLED") != "true" && os.Getenv("OTEL_TRACES_EXPORTER") != "none" {
+		cfg.TracingEndpoint = tracingEndpointURL(strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")), strings.TrimSpace(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")))
+	}
+	if v := compactEnv("OTEL_EXPORTER_OTLP_HEADERS"); v != "" {
+		h, err := parseOTLPHeaders(v)
+		if err != nil {
+			return nil, err
+		}
+		cfg.TracingHeaders = h
+	}
+	cfg.TracingServiceName = strings.TrimSpace(os.Getenv("OTEL_SERVICE_NAME"))
+	if v := os.Getenv("OTEL_TRACES_SAMPLER_ARG"); v != "" {
+		var f float64
+		if _, err := fmt.Sscanf(strings.TrimSpace(v), "%g", &f); err != nil {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q", v)
+		}
+		cfg.TracingSampleRatio = f
+	}
+	// Parse TTL rules from env: "/blog/*:600,/products/*:1200,/sitemap.xml:86400".
+	// "~" prefixes a regex ("~^/p/[0-9]+$:600") and "@status" restricts by upstream
+	// status ("@404:300", "/api/*@5xx:30").
+	if v := compactEnv("CACHE_TTL_RULES"); v != "" {
 		parts := strings.Split(v, ",")
 		rules := make([]TTLRule, 0, len(parts))
 		for _, p := range parts {
 			p = strings.TrimSpace(p)
-			if p == "" {
+			i := strings.LastIndex(p, ":")
+			if i == -1 {
 				continue
 			}
-			kv := strings.SplitN(p, ":", 2)
-			if len(kv) != 2 {
-				continue
-			}
-			pat := strings.TrimSpace(kv[0])
+			pat := strings.TrimSpace(p[:i])
 			var ttl int
-			fmt.Sscanf(strings.TrimSpace(kv[1]), "%d", &ttl)
-			if pat != "" && ttl > 0 {
+			fmt.Sscanf(strings.TrimSpace(p[i+1:]), "%d", &ttl)
+			rule := TTLRule{TTLSeconds: ttl}
+			if j := strings.LastIndex(pat, "@"); j != -1 {
+				rule.Status = strings.TrimSpace(pat[j+1:])
+				pat = strings.TrimSpace(pat[:j])
+			}
+			if strings.HasPrefix(pat, "~") {
+				rule.Regex = pat[1:]
+			} else if pat != "" {
 				// Only prefix "/" for path patterns; allow extension patterns like "*.xml"
 				if !(strings.HasPrefix(pat, "/") || strings.HasPrefix(pat, "*.") || strings.HasPrefix(pat, ".")) {
 					pat = "/" + pat
 				}
-				rules = append(rules, TTLRule{Pattern: pat, TTLSeconds: ttl})
+				rule.Pattern = pat
+			}
+			if (rule.Pattern != "" || rule.Regex != "" || rule.Status != "") && ttl > 0 {
+				rules = append(rules, rule)
 			}
 		}
 		if len(rules) > 0 {
@@ -191,9 +857,200 @@ func loadConfig() (*Config, error) {
 	if v := os.Getenv("ADMIN_TOKEN"); v != "" {
 		cfg.AdminToken = v
 	}
+	// Tenants from env: "shop=b-shop.com|cdn.b-shop.com,blog=b-blog.com"
+	if v := compactEnv("TENANTS"); v != "" {
+		tenants, err := parseTenants(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TENANTS: %w", err)
+		}
+		cfg.Tenants = tenants
+	}
+	// Scoped admin tokens from env: "content:s3cret=purge|read,seo:t0ken=warm"
+	if v := compactEnv("ADMIN_TOKENS"); v != "" {
+		creds, err := parseAdminCredentials(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ADMIN_TOKENS: %w", err)
+		}
+		cfg.AdminTokens = creds
+	}
+	if v := compactEnv("ADMIN_ALLOW_CIDRS"); v != "" {
+		cfg.AdminAllowCIDRs = splitCommaList(v)
+	}
+	cfg.AdminBasicAuthUser = getenv("ADMIN_BASIC_AUTH_USER", "")
+	cfg.AdminBasicAuthPassword = getenv("ADMIN_BASIC_AUTH_PASSWORD", "")
+	setIntFromEnv("ADMIN_LOCKOUT_THRESHOLD", &cfg.AdminLockoutThreshold, 0)
+	setIntFromEnv("ADMIN_LOCKOUT_SECONDS", &cfg.AdminLockoutSeconds, 1)
+	setIntFromEnv("ADMIN_SESSION_TTL_SECONDS", &cfg.AdminSessionTTLSeconds, 60)
+	if v := compactEnv("PURGE_ALLOW_CIDRS"); v != "" {
+		cfg.PurgeAllowCIDRs = splitCommaList(v)
+	}
+	cfg.WebhookSecret = getenv("WEBHOOK_SECRET", "")
+	if v := compactEnv("WEBHOOK_PURGE_PATHS"); v != "" {
+		cfg.WebhookPurgePaths = splitCommaList(v)
+	}
+	if v := compactEnv("BOT_UA_INCLUDE"); v != "" {
+		cfg.BotUAInclude = splitCommaList(v)
+	}
+	if v := compactEnv("BOT_UA_EXCLUDE"); v != "" {
+		cfg.BotUAExclude = splitCommaList(v)
+	}
+	cfg.BotUAFile = getenv("BOT_UA_FILE", "")
+	if v := compactEnv("BAD_BOT_UA"); v != "" {
+		cfg.BadBotUA = splitCommaList(v)
+	}
+	cfg.BadBotAction = strings.ToLower(getenv("BAD_BOT_ACTION", cfg.BadBotAction))
+	setIntFromEnv("BAD_BOT_TARPIT_SECONDS", &cfg.BadBotTarpitSeconds, 1)
+	cfg.ChallengeMode = strings.ToLower(getenv("CHALLENGE_MODE", cfg.ChallengeMode))
+	setIntFromEnv("CHALLENGE_PASS_MINUTES", &cfg.ChallengePassMinutes, 1)
+	cfg.ChallengeSecret = getenv("CHALLENGE_SECRET", "")
+	if v := compactEnv("REDIRECT_TARGETS"); v != "" {
+		targets, err := parseRedirectTargets(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIRECT_TARGETS: %w", err)
+		}
+		cfg.RedirectTargets = targets
+	}
+	cfg.GeoIPDatabase = getenv("GEOIP_DATABASE", "")
+	if v := compactEnv("GEO_RULES"); v != "" {
+		rules, err := parseGeoRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GEO_RULES: %w", err)
+		}
+		cfg.GeoRules = rules
+	}
+	if v := compactEnv("BOT_ALLOW_CIDRS"); v != "" {
+		cfg.BotAllowCIDRs = splitCommaList(v)
+	}
+	if v := compactEnv("BOT_DENY_CIDRS"); v != "" {
+		cfg.BotDenyCIDRs = splitCommaList(v)
+	}
+	cfg.BotAllowCIDRFile = getenv("BOT_ALLOW_CIDR_FILE", "")
+	if v := strings.ToLower(os.Getenv("TRUST_X_FORWARDED_FOR")); v == "1" || v == "true" || v == "yes" || v == "on" {
+		cfg.TrustXForwardedFor = true
+	}
+	if v := compactEnv("TRUSTED_PROXIES"); v != "" {
+		cfg.TrustedProxies = splitCommaList(v)
+	}
+	if v := strings.ToLower(os.Getenv("VERIFY_BOTS")); v == "1" || v == "true" || v == "yes" || v == "on" {
+		cfg.VerifyBots = true
+	}
+	// Parse upstream mappings from env: "a.com=https://b.com,a2.com/shop/=https://b2.com"
+	if v := compactEnv("UPSTREAMS"); v != "" {
+		ups, err := parseUpstreamMappings(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UPSTREAMS: %w", err)
+		}
+		cfg.Upstreams = ups
+	}
+
+	// Extra rewrite hosts from env: "cdn.b.com=cdn.a.com,img.b.com=https://img.a.com"
+	if v := compactEnv("REWRITE_HOSTS"); v != "" {
+		maps, err := parseRewriteHosts(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REWRITE_HOSTS: %w", err)
+		}
+		cfg.RewriteHosts = maps
+	}
+	// Alternate link hosts per language: "en=en.a.com,de=de.a.com,x-default=a.com"
+	if v := compactEnv("HREFLANG_HOSTS"); v != "" {
+		maps, err := parseRewriteHosts(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HREFLANG_HOSTS: %w", err)
+		}
+		cfg.HreflangHosts = map[string]string{}
+		for _, m := range maps {
+			cfg.HreflangHosts[strings.ToLower(m.From)] = m.To
+		}
+	}
+	if v := compactEnv("REWRITE_EXCLUDE_PATHS"); v != "" {
+		cfg.RewriteExcludePaths = splitCommaList(v)
+	}
+	if v := compactEnv("RENDER_PATTERNS"); v != "" {
+		cfg.RenderPatterns = splitCommaList(v)
+	}
+	if v := compactEnv("STRIP_SELECTORS"); v != "" {
+		cfg.StripSelectors = splitCommaList(v)
+	}
+	setBoolFromEnv("MINIFY_RESPONSES", &cfg.MinifyResponses)
+	if v := compactEnv("TRANSFORMERS"); v != "" {
+		cfg.Transformers = splitCommaList(v)
+	}
+	setIntFromEnv("TRANSFORM_HOOK_TIMEOUT_SECONDS", &cfg.TransformHookTimeoutSeconds, 1)
+	if v := compactEnv("REWRITE_EXCLUDE_SELECTORS"); v != "" {
+		cfg.RewriteExcludeSelectors = splitCommaList(v)
+	}
+	if v := compactEnv("HUMAN_RULES"); v != "" {
+		rules, err := parseHumanRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HUMAN_RULES: %w", err)
+		}
+		cfg.HumanRules = rules
+	}
+	if v := compactEnv("BLOCK_RULES"); v != "" {
+		rules, err := parseBlockRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid BLOCK_RULES: %w", err)
+		}
+		cfg.BlockRules = rules
+	}
+	if v := compactEnv("HEADER_RULES"); v != "" {
+		rules, err := parseHeaderRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEADER_RULES: %w", err)
+		}
+		cfg.HeaderRules = rules
+	}
+	setBoolFromEnv("MAINTENANCE_MODE", &cfg.MaintenanceMode)
+	setIntFromEnv("MAINTENANCE_RETRY_AFTER", &cfg.MaintenanceRetryAfter, 0)
+	if v := compactEnv("ERROR_PAGES"); v != "" {
+		pages, err := parseErrorPages(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ERROR_PAGES: %w", err)
+		}
+		cfg.ErrorPages = pages
+	}
+	if v := compactEnv("REDIRECT_RULES"); v != "" {
+		rules, err := parseRedirectRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIRECT_RULES: %w", err)
+		}
+		cfg.RedirectRules = rules
+	}
+	if v := compactEnv("ROBOTS_POLICIES"); v != "" {
+		pols, err := parseRobotsPolicies(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ROBOTS_POLICIES: %w", err)
+		}
+		cfg.RobotsPolicies = pols
+	}
+	// These have no compact form; applyJSONEnv decodes them
+	for _, name := range []string{"STRUCTURED_DATA", "UPSTREAM_AUTH"} {
+		if v := os.Getenv(name); v != "" && !isJSONEnv(v) {
+			return nil, fmt.Errorf("invalid %s (want JSON, as in config.json)", name)
+		}
+	}
+	// Cache tags from env: "/products/*=products,shop;/blog/*=blog"
+	if v := compactEnv("CACHE_TAG_RULES"); v != "" {
+		rules, err := parseCacheTagRules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CACHE_TAG_RULES: %w", err)
+		}
+		cfg.CacheTagRules = rules
+	}
+	if v := compactEnv("SITEMAP_WARM_SCHEDULE"); v != "" {
+		scheds, err := parseSitemapWarmSchedules(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SITEMAP_WARM_SCHEDULE: %w", err)
+		}
+		cfg.SitemapWarmSchedules = scheds
+	}
+	if err := applyJSONEnv(cfg); err != nil {
+		return nil, err
+	}
 
 	// Optional JSON config file path
 	configPath := getenv("CONFIG_PATH", "./config.json")
+	cfg.configPath = configPath
 	if b, err := os.ReadFile(configPath); err == nil {
 		// overlay values from file
 		type confAlias Config
@@ -212,21 +1069,136 @@ func loadConfig() (*Config, error) {
 			cfg.AdminUIPath = "/" + v
 		}
 	}
-	if cfg.AdminUIPath == "" && cfg.AdminToken != "" {
-		sum := sha256.Sum256([]byte(cfg.AdminToken + "::rerouter-admin-ui"))
+	if cfg.AdminUIPath == "" && cfg.adminEnabled() {
+		sum := sha256.Sum256([]byte(cfg.adminCredentials()[0].Token + "::rerouter-admin-ui"))
 		cfg.AdminUIPath = "/admin/" + hex.EncodeToString(sum[:])[:48]
 	}
 
 	if strings.TrimSpace(cfg.UpstreamUserAgent) == "" {
 		cfg.UpstreamUserAgent = defaultUpstreamUserAgent
 	}
+	if strings.TrimSpace(cfg.UpstreamMobileUserAgent) == "" {
+		cfg.UpstreamMobileUserAgent = defaultUpstreamMobileUserAgent
+	}
+	for i, d := range cfg.CacheVary {
+		d = strings.ToLower(strings.TrimSpace(d))
+		cfg.CacheVary[i] = d
+		if d != cacheVaryDevice && d != cacheVaryLang {
+			return nil, fmt.Errorf("invalid CACHE_VARY: unknown dimension %q (want device or lang)", d)
+		}
+	}
+	if cfg.UpstreamRedirects != upstreamRedirectFollow && cfg.UpstreamRedirects != upstreamRedirectRewrite {
+		return nil, fmt.Errorf("invalid UPSTREAM_REDIRECTS %q (want follow or rewrite)", cfg.UpstreamRedirects)
+	}
+	if err := validateHeaderPolicies(cfg.HeaderPolicies); err != nil {
+		return nil, fmt.Errorf("invalid HEADER_POLICIES: %w", err)
+	}
+	for i, h := range cfg.ForwardClientIP {
+		h = strings.ToLower(strings.TrimSpace(h))
+		cfg.ForwardClientIP[i] = h
+		if h != forwardXFF && h != forwardRealIP && h != forwardRFC7239 {
+			return nil, fmt.Errorf("invalid FORWARD_CLIENT_IP: unknown header %q (want x-forwarded-for, x-real-ip or forwarded)", h)
+		}
+	}
+	for i, l := range cfg.CacheVaryLangs {
+		cfg.CacheVaryLangs[i] = strings.ToLower(strings.TrimSpace(l))
+	}
+	if err := normalizeCacheBypassResponse(cfg.CacheBypassResponse); err != nil {
+		return nil, fmt.Errorf("invalid CACHE_BYPASS_RESPONSE: %w", err)
+	}
 
+	if cfg.BBaseURL == "" && len(cfg.Upstreams) > 0 {
+		cfg.BBaseURL = cfg.Upstreams[0].BBaseURL
+	}
 	if cfg.BBaseURL == "" {
 		return nil, errors.New("B_BASE_URL is required (env or config.json)")
 	}
 	if _, err := url.Parse(cfg.BBaseURL); err != nil {
 		return nil, fmt.Errorf("invalid B_BASE_URL: %w", err)
 	}
+	if _, err := configuredListeners(cfg); err != nil {
+		return nil, fmt.Errorf("invalid listeners: %w", err)
+	}
+	if !validHumanMode(cfg.HumanMode) {
+		return nil, fmt.Errorf("invalid HUMAN_MODE %q (want redirect, proxy, cache or block)", cfg.HumanMode)
+	}
+	if !validSubresourceMode(cfg.PrefetchSubresources) {
+		return nil, fmt.Errorf("invalid PREFETCH_SUBRESOURCES %q (want off, assets or all)", cfg.PrefetchSubresources)
+	}
+	if err := validateRenderService(cfg); err != nil {
+		return nil, fmt.Errorf("invalid RENDER_SERVICE_URL: %w", err)
+	}
+	if _, err := newUpstreamTransport(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateTracing(cfg); err != nil {
+		return nil, err
+	}
+	if _, err := logger.ParseModuleLevels(cfg.LogLevels); err != nil {
+		return nil, fmt.Errorf("invalid LOG_LEVELS: %w", err)
+	}
+	if cfg.LogSyslog != "" {
+		if err := logger.ValidateSyslogTarget(cfg.LogSyslog); err != nil {
+			return nil, fmt.Errorf("invalid LOG_SYSLOG: %w", err)
+		}
+	}
+	for _, u := range []string{cfg.LogHTTPURL, cfg.LogLokiURL} {
+		if u == "" {
+			continue
+		}
+		if err := logger.ValidateSinkURL(u); err != nil {
+			return nil, err
+		}
+	}
+	if !logger.ValidOutput(cfg.LogOutput) {
+		return nil, fmt.Errorf("invalid LOG_OUTPUT %q (want stdout, stderr or none)", cfg.LogOutput)
+	}
+	if !logger.ValidAccessFormat(cfg.AccessLogFormat) {
+		return nil, fmt.Errorf("invalid ACCESS_LOG_FORMAT %q (want json, combined or common)", cfg.AccessLogFormat)
+	}
+	if !validUpstreamUAMode(cfg.UpstreamUAMode) {
+		return nil, fmt.Errorf("invalid UPSTREAM_UA_MODE %q (want fixed, passthrough or family)", cfg.UpstreamUAMode)
+	}
+	if err := validateUAFamilies(cfg.UpstreamUAFamilies); err != nil {
+		return nil, err
+	}
+	for _, v := range []string{cfg.UpstreamHostHeader, cfg.UpstreamTLSServerName} {
+		if err := validateUpstreamHostOverride(v); err != nil {
+			return nil, err
+		}
+	}
+	for _, m := range cfg.Upstreams {
+		for _, v := range []string{m.HostHeader, m.TLSServerName} {
+			if err := validateUpstreamHostOverride(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, rule := range cfg.HumanRules {
+		if err := validateHumanRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range cfg.BlockRules {
+		if err := validateBlockRule(rule); err != nil {
+			return nil, fmt.Errorf("invalid BLOCK_RULES: %w", err)
+		}
+	}
+	if !validBadBotAction(cfg.BadBotAction) {
+		return nil, fmt.Errorf("invalid BAD_BOT_ACTION %q (want block, tarpit, fake or off)", cfg.BadBotAction)
+	}
+	if !validChallengeMode(cfg.ChallengeMode) {
+		return nil, fmt.Errorf("invalid CHALLENGE_MODE %q (want off, js or cookie)", cfg.ChallengeMode)
+	}
+	if err := validateGeoRules(cfg.GeoRules); err != nil {
+		return nil, fmt.Errorf("invalid GEO_RULES: %w", err)
+	}
+	if err := validateRedirectTargets(cfg.RedirectTargets); err != nil {
+		return nil, fmt.Errorf("invalid REDIRECT_TARGETS: %w", err)
+	}
+	if len(cfg.GeoRules) != 0 && cfg.GeoIPDatabase == "" {
+		return nil, fmt.Errorf("GEO_RULES needs GEOIP_DATABASE")
+	}
 	if cfg.StaticRedirectURL != "" {
 		if _, err := url.Parse(cfg.StaticRedirectURL); err != nil {
 			return nil, fmt.Errorf("invalid STATIC_REDIRECT_URL: %w", err)
@@ -237,6 +1209,107 @@ func loadConfig() (*Config, error) {
 			return nil, fmt.Errorf("invalid A_BASE_URL: %w", err)
 		}
 	}
+	if _, err := parseCIDRList(cfg.AdminAllowCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_ALLOW_CIDRS: %w", err)
+	}
+	if err := validateTenants(cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid TENANTS: %w", err)
+	}
+	if err := validateAdminCredentials(cfg.AdminTokens, cfg.AdminToken, cfg.Tenants); err != nil {
+		return nil, fmt.Errorf("invalid ADMIN_TOKENS: %w", err)
+	}
+	if cfg.CacheTTLMinSeconds < 0 || cfg.CacheTTLMaxSeconds < 0 || (cfg.CacheTTLMaxSeconds > 0 && cfg.CacheTTLMinSeconds > cfg.CacheTTLMaxSeconds) {
+		return nil, fmt.Errorf("invalid CACHE_TTL_MIN_SECONDS/CACHE_TTL_MAX_SECONDS %d/%d (want 0 <= min <= max)", cfg.CacheTTLMinSeconds, cfg.CacheTTLMaxSeconds)
+	}
+	if cfg.CacheS3URL != "" {
+		if u, err := url.Parse(cfg.CacheS3URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid CACHE_S3_URL %q (want an http(s) bucket URL)", cfg.CacheS3URL)
+		}
+		if cfg.CacheS3AccessKeyID == "" || cfg.CacheS3SecretAccessKey == "" {
+			return nil, errors.New("CACHE_S3_URL requires CACHE_S3_ACCESS_KEY_ID and CACHE_S3_SECRET_ACCESS_KEY")
+		}
+	}
+	if cfg.AdminBasicAuthUser != "" && cfg.AdminBasicAuthPassword == "" {
+		return nil, errors.New("ADMIN_BASIC_AUTH_USER requires ADMIN_BASIC_AUTH_PASSWORD")
+	}
+	if _, err := parseCIDRList(cfg.PurgeAllowCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid PURGE_ALLOW_CIDRS: %w", err)
+	}
+	if _, err := parseCIDRList(cfg.BotAllowCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid BOT_ALLOW_CIDRS: %w", err)
+	}
+	if _, err := parseCIDRList(cfg.BotDenyCIDRs); err != nil {
+		return nil, fmt.Errorf("invalid BOT_DENY_CIDRS: %w", err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	for _, m := range cfg.Upstreams {
+		if u, err := url.Parse(m.BBaseURL); err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream b_base_url %q", m.BBaseURL)
+		}
+		if m.ABaseURL != "" {
+			if _, err := url.Parse(m.ABaseURL); err != nil {
+				return nil, fmt.Errorf("invalid upstream a_base_url: %w", err)
+			}
+		}
+	}
+	for _, sel := range cfg.RewriteExcludeSelectors {
+		if _, ok := parseHTMLSelector(sel); !ok {
+			return nil, fmt.Errorf("invalid rewrite exclude selector %q", sel)
+		}
+	}
+	for _, sel := range cfg.StripSelectors {
+		if _, ok := parseHTMLSelector(sel); !ok {
+			return nil, fmt.Errorf("invalid strip selector %q", sel)
+		}
+	}
+	if err := validateTransformers(cfg.Transformers); err != nil {
+		return nil, fmt.Errorf("invalid TRANSFORMERS: %w", err)
+	}
+	for _, p := range cfg.RobotsPolicies {
+		if err := validateRobotsPolicy(p); err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range cfg.StructuredData {
+		if err := validateStructuredDataRule(r); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range cfg.HeaderRules {
+		if err := validateHeaderRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range cfg.RedirectRules {
+		if err := validateRedirectRule(rule); err != nil {
+			return nil, err
+		}
+	}
+	if err := validateErrorPages(cfg.ErrorPages); err != nil {
+		return nil, err
+	}
+	if err := validateReadyChecks(cfg.ReadyzChecks); err != nil {
+		return nil, err
+	}
+	if cfg.RobotsTxt != "" {
+		if _, err := template.New("robots.txt").Parse(cfg.RobotsTxt); err != nil {
+			return nil, fmt.Errorf("invalid robots_txt template: %w", err)
+		}
+	}
+	for _, rule := range cfg.CacheTTLRules {
+		if rule.Regex != "" {
+			if _, err := compileTTLRegex(rule.Regex); err != nil {
+				return nil, fmt.Errorf("invalid cache ttl rule regex %q: %w", rule.Regex, err)
+			}
+		}
+	}
+	for _, sch := range cfg.SitemapWarmSchedules {
+		if err := validateSitemapWarmSchedule(sch); err != nil {
+			return nil, fmt.Errorf("invalid sitemap warm schedule: %w", err)
+		}
+	}
 	return cfg, nil
 }
 
@@ -247,6 +1320,15 @@ func mergeConfig(dst, src *Config) {
 	if src.StaticRedirectURL != "" {
 		dst.StaticRedirectURL = src.StaticRedirectURL
 	}
+	if src.HumanMode != "" {
+		dst.HumanMode = strings.ToLower(src.HumanMode)
+	}
+	if len(src.HumanRules) != 0 {
+		dst.HumanRules = src.HumanRules
+	}
+	if len(src.BlockRules) != 0 {
+		dst.BlockRules = src.BlockRules
+	}
 	if src.ListenAddr != "" {
 		dst.ListenAddr = src.ListenAddr
 	}
@@ -256,12 +1338,42 @@ func mergeConfig(dst, src *Config) {
 	if src.UpstreamUserAgent != "" {
 		dst.UpstreamUserAgent = src.UpstreamUserAgent
 	}
+	if src.UpstreamUAMode != "" {
+		dst.UpstreamUAMode = src.UpstreamUAMode
+	}
+	if len(src.UpstreamUAFamilies) != 0 {
+		dst.UpstreamUAFamilies = src.UpstreamUAFamilies
+	}
 	if src.CacheDir != "" {
 		dst.CacheDir = src.CacheDir
 	}
+	if src.CacheS3URL != "" {
+		dst.CacheS3URL = src.CacheS3URL
+	}
+	if src.CacheS3Prefix != "" {
+		dst.CacheS3Prefix = src.CacheS3Prefix
+	}
+	if src.CacheS3Region != "" {
+		dst.CacheS3Region = src.CacheS3Region
+	}
+	if src.CacheS3AccessKeyID != "" {
+		dst.CacheS3AccessKeyID = src.CacheS3AccessKeyID
+	}
+	if src.CacheS3SecretAccessKey != "" {
+		dst.CacheS3SecretAccessKey = src.CacheS3SecretAccessKey
+	}
 	if src.CacheTTLSeconds != 0 {
 		dst.CacheTTLSeconds = src.CacheTTLSeconds
 	}
+	if src.CacheRespectCacheControl {
+		dst.CacheRespectCacheControl = true
+	}
+	if src.CacheTTLMinSeconds != 0 {
+		dst.CacheTTLMinSeconds = src.CacheTTLMinSeconds
+	}
+	if src.CacheTTLMaxSeconds != 0 {
+		dst.CacheTTLMaxSeconds = src.CacheTTLMaxSeconds
+	}
 	// If provided in file, allow overriding CacheAll
 	if src.CacheAll {
 		dst.CacheAll = true
@@ -271,12 +1383,78 @@ func mergeConfig(dst, src *Config) {
 	if len(src.CachePatterns) != 0 {
 		dst.CachePatterns = src.CachePatterns
 	}
+	if src.CacheAssets {
+		dst.CacheAssets = true
+	}
+	if len(src.CacheTagRules) != 0 {
+		dst.CacheTagRules = src.CacheTagRules
+	}
+	if src.CacheCompress {
+		dst.CacheCompress = true
+	}
+	if len(src.CacheVary) != 0 {
+		dst.CacheVary = src.CacheVary
+	}
+	if len(src.CacheVaryLangs) != 0 {
+		dst.CacheVaryLangs = src.CacheVaryLangs
+	}
+	if len(src.CacheBypassResponse) != 0 {
+		dst.CacheBypassResponse = src.CacheBypassResponse
+	}
+	if len(src.CacheBypassCookies) != 0 {
+		dst.CacheBypassCookies = src.CacheBypassCookies
+	}
+	if src.UpstreamMobileUserAgent != "" {
+		dst.UpstreamMobileUserAgent = src.UpstreamMobileUserAgent
+	}
 	if src.RedirectStatus != 0 {
 		dst.RedirectStatus = src.RedirectStatus
 	}
+	if len(src.RedirectRules) != 0 {
+		dst.RedirectRules = src.RedirectRules
+	}
+	if len(src.HeaderRules) != 0 {
+		dst.HeaderRules = src.HeaderRules
+	}
+	if src.MaintenanceMode {
+		dst.MaintenanceMode = true
+	}
+	if src.MaintenanceRetryAfter != 0 {
+		dst.MaintenanceRetryAfter = src.MaintenanceRetryAfter
+	}
+	if len(src.ErrorPages) != 0 {
+		dst.ErrorPages = src.ErrorPages
+	}
 	if src.LogLevel != "" {
 		dst.LogLevel = src.LogLevel
 	}
+	if len(src.LogLevels) != 0 {
+		dst.LogLevels = src.LogLevels
+	}
+	if src.LogOutput != "" {
+		dst.LogOutput = src.LogOutput
+	}
+	if src.LogSampleInitial != 0 {
+		dst.LogSampleInitial = src.LogSampleInitial
+	}
+	if src.LogSampleThereafter != 0 {
+		dst.LogSampleThereafter = src.LogSampleThereafter
+	}
+	if src.LogSyslog != "" {
+		dst.LogSyslog = src.LogSyslog
+	}
+	if src.LogHTTPURL != "" {
+		dst.LogHTTPURL = src.LogHTTPURL
+	}
+	if src.LogLokiURL != "" {
+		dst.LogLokiURL = src.LogLokiURL
+	}
+	if len(src.LogLokiLabels) != 0 {
+		dst.LogLokiLabels = src.LogLokiLabels
+	}
+	if len(src.LogShipHeaders) != 0 {
+		dst.LogShipHeaders = src.LogShipHeaders
+	}
 	if src.LogFile != "" {
 		dst.LogFile = src.LogFile
 	}
@@ -289,16 +1467,370 @@ func mergeConfig(dst, src *Config) {
 	if src.LogMaxAgeDays != 0 {
 		dst.LogMaxAgeDays = src.LogMaxAgeDays
 	}
+	if src.AccessLogFile != "" {
+		dst.AccessLogFile = src.AccessLogFile
+	}
+	if src.AuditLogFile != "" {
+		dst.AuditLogFile = src.AuditLogFile
+	}
+	if src.AccessLogFormat != "" {
+		dst.AccessLogFormat = src.AccessLogFormat
+	}
+	if src.AccessLogMaxSizeMB != 0 {
+		dst.AccessLogMaxSizeMB = src.AccessLogMaxSizeMB
+	}
+	if src.AccessLogMaxBackups != 0 {
+		dst.AccessLogMaxBackups = src.AccessLogMaxBackups
+	}
+	if src.AccessLogMaxAgeDays != 0 {
+		dst.AccessLogMaxAgeDays = src.AccessLogMaxAgeDays
+	}
+	if src.BotStatsRetentionHours != 0 {
+		dst.BotStatsRetentionHours = src.BotStatsRetentionHours
+	}
+	if src.TracingEndpoint != "" {
+		dst.TracingEndpoint = src.TracingEndpoint
+	}
+	if len(src.TracingHeaders) != 0 {
+		dst.TracingHeaders = src.TracingHeaders
+	}
+	if src.TracingServiceName != "" {
+		dst.TracingServiceName = src.TracingServiceName
+	}
+	if src.TracingSampleRatio != 0 {
+		dst.TracingSampleRatio = src.TracingSampleRatio
+	}
 	if src.MetricsIntervalSeconds != 0 {
 		dst.MetricsIntervalSeconds = src.MetricsIntervalSeconds
 	}
 	if src.SitemapWarmDelaySeconds != 0 {
 		dst.SitemapWarmDelaySeconds = src.SitemapWarmDelaySeconds
 	}
+	if src.SitemapWarmConcurrency > 0 {
+		dst.SitemapWarmConcurrency = src.SitemapWarmConcurrency
+	}
+	if src.WarmIgnoreRobots {
+		dst.WarmIgnoreRobots = true
+	}
+	if src.WarmCrawlDelaySeconds != 0 {
+		dst.WarmCrawlDelaySeconds = src.WarmCrawlDelaySeconds
+	}
+	if src.SitemapWarmJobHistory != 0 {
+		dst.SitemapWarmJobHistory = src.SitemapWarmJobHistory
+	}
+	if src.SitemapWarmJobMaxAgeDays != 0 {
+		dst.SitemapWarmJobMaxAgeDays = src.SitemapWarmJobMaxAgeDays
+	}
+	if src.SitemapWarmMaxURLStatuses != 0 {
+		dst.SitemapWarmMaxURLStatuses = src.SitemapWarmMaxURLStatuses
+	}
+	if src.PrefetchSubresources != "" {
+		dst.PrefetchSubresources = strings.ToLower(src.PrefetchSubresources)
+	}
+	if src.PrefetchSubresourcesMax > 0 {
+		dst.PrefetchSubresourcesMax = src.PrefetchSubresourcesMax
+	}
+	if src.PrefetchWorkers > 0 {
+		dst.PrefetchWorkers = src.PrefetchWorkers
+	}
+	if src.PrefetchQueueSize > 0 {
+		dst.PrefetchQueueSize = src.PrefetchQueueSize
+	}
+	if src.PrefetchMaxAttempts > 0 {
+		dst.PrefetchMaxAttempts = src.PrefetchMaxAttempts
+	}
+	if src.PrefetchRetryBackoffMs != 0 {
+		dst.PrefetchRetryBackoffMs = src.PrefetchRetryBackoffMs
+	}
+	if src.CacheCheckIntervalMinutes != 0 {
+		dst.CacheCheckIntervalMinutes = src.CacheCheckIntervalMinutes
+	}
+	if src.CrawlWarmMaxDepth > 0 {
+		dst.CrawlWarmMaxDepth = src.CrawlWarmMaxDepth
+	}
+	if src.CrawlWarmMaxURLs > 0 {
+		dst.CrawlWarmMaxURLs = src.CrawlWarmMaxURLs
+	}
+	if src.RenderServiceURL != "" {
+		dst.RenderServiceURL = src.RenderServiceURL
+	}
+	if src.RenderServiceToken != "" {
+		dst.RenderServiceToken = src.RenderServiceToken
+	}
+	if len(src.RenderPatterns) != 0 {
+		dst.RenderPatterns = src.RenderPatterns
+	}
+	if src.RenderTimeoutSeconds > 0 {
+		dst.RenderTimeoutSeconds = src.RenderTimeoutSeconds
+	}
+	if src.UpstreamMaxConcurrent != 0 {
+		dst.UpstreamMaxConcurrent = src.UpstreamMaxConcurrent
+	}
+	if src.UpstreamMaxRPS != 0 {
+		dst.UpstreamMaxRPS = src.UpstreamMaxRPS
+	}
+	if src.UpstreamTimeoutSeconds != 0 {
+		dst.UpstreamTimeoutSeconds = src.UpstreamTimeoutSeconds
+	}
+	if src.SitemapFetchTimeoutSeconds != 0 {
+		dst.SitemapFetchTimeoutSeconds = src.SitemapFetchTimeoutSeconds
+	}
+	if src.UpstreamConnectTimeoutSeconds != 0 {
+		dst.UpstreamConnectTimeoutSeconds = src.UpstreamConnectTimeoutSeconds
+	}
+	if src.UpstreamTLSTimeoutSeconds != 0 {
+		dst.UpstreamTLSTimeoutSeconds = src.UpstreamTLSTimeoutSeconds
+	}
+	if src.UpstreamHeaderTimeoutSeconds != 0 {
+		dst.UpstreamHeaderTimeoutSeconds = src.UpstreamHeaderTimeoutSeconds
+	}
+	if src.UpstreamMaxIdleConnsPerHost != 0 {
+		dst.UpstreamMaxIdleConnsPerHost = src.UpstreamMaxIdleConnsPerHost
+	}
+	if src.UpstreamProxyURL != "" {
+		dst.UpstreamProxyURL = src.UpstreamProxyURL
+	}
+	if src.UpstreamCAFile != "" {
+		dst.UpstreamCAFile = src.UpstreamCAFile
+	}
+	if src.UpstreamInsecureSkipVerify {
+		dst.UpstreamInsecureSkipVerify = true
+	}
+	if src.UpstreamHostHeader != "" {
+		dst.UpstreamHostHeader = src.UpstreamHostHeader
+	}
+	if src.UpstreamTLSServerName != "" {
+		dst.UpstreamTLSServerName = src.UpstreamTLSServerName
+	}
+	if !src.UpstreamAuth.empty() {
+		dst.UpstreamAuth = src.UpstreamAuth
+	}
+	if src.UpstreamRetries != 0 {
+		dst.UpstreamRetries = src.UpstreamRetries
+	}
+	if src.UpstreamRetryBackoffMs != 0 {
+		dst.UpstreamRetryBackoffMs = src.UpstreamRetryBackoffMs
+	}
+	if src.UpstreamBreakerThreshold != 0 {
+		dst.UpstreamBreakerThreshold = src.UpstreamBreakerThreshold
+	}
+	if src.UpstreamBreakerCooldownSeconds != 0 {
+		dst.UpstreamBreakerCooldownSeconds = src.UpstreamBreakerCooldownSeconds
+	}
+	if src.UpstreamRedirects != "" {
+		dst.UpstreamRedirects = strings.ToLower(src.UpstreamRedirects)
+	}
+	if src.UpstreamMaxRedirects != 0 {
+		dst.UpstreamMaxRedirects = src.UpstreamMaxRedirects
+	}
+	if src.ServerReadTimeoutSeconds != 0 {
+		dst.ServerReadTimeoutSeconds = src.ServerReadTimeoutSeconds
+	}
+	if src.ServerReadHeaderTimeoutSeconds != 0 {
+		dst.ServerReadHeaderTimeoutSeconds = src.ServerReadHeaderTimeoutSeconds
+	}
+	if src.ServerWriteTimeoutSeconds != 0 {
+		dst.ServerWriteTimeoutSeconds = src.ServerWriteTimeoutSeconds
+	}
+	if src.ServerIdleTimeoutSeconds != 0 {
+		dst.ServerIdleTimeoutSeconds = src.ServerIdleTimeoutSeconds
+	}
+	if src.ServerMaxHeaderBytes != 0 {
+		dst.ServerMaxHeaderBytes = src.ServerMaxHeaderBytes
+	}
+	if src.EnableH2C {
+		dst.EnableH2C = true
+	}
+	if src.AdminListenAddr != "" {
+		dst.AdminListenAddr = src.AdminListenAddr
+	}
+	if src.TLSCertFile != "" {
+		dst.TLSCertFile = src.TLSCertFile
+	}
+	if src.TLSKeyFile != "" {
+		dst.TLSKeyFile = src.TLSKeyFile
+	}
+	if src.AdminUnixOnly {
+		dst.AdminUnixOnly = true
+	}
+	if len(src.ForwardClientIP) != 0 {
+		dst.ForwardClientIP = src.ForwardClientIP
+	}
+	if len(src.ForwardHeaders) != 0 {
+		dst.ForwardHeaders = src.ForwardHeaders
+	}
+	if src.ForwardCookies {
+		dst.ForwardCookies = true
+	}
+	for g, a := range src.HeaderPolicies {
+		if dst.HeaderPolicies == nil {
+			dst.HeaderPolicies = map[string]string{}
+		}
+		dst.HeaderPolicies[strings.ToLower(g)] = strings.ToLower(a)
+	}
+	if src.ServeStaleOnError {
+		dst.ServeStaleOnError = true
+	}
+	if src.InjectCanonical {
+		dst.InjectCanonical = true
+	}
+	if src.RobotsTxtFile != "" {
+		dst.RobotsTxtFile = src.RobotsTxtFile
+	}
+	if src.RobotsTxt != "" {
+		dst.RobotsTxt = src.RobotsTxt
+	}
+	if src.RobotsTxtSynthesize {
+		dst.RobotsTxtSynthesize = true
+	}
+	if len(src.RobotsTxtSitemaps) != 0 {
+		dst.RobotsTxtSitemaps = src.RobotsTxtSitemaps
+	}
+	if len(src.ReadyzChecks) != 0 {
+		dst.ReadyzChecks = src.ReadyzChecks
+	}
+	if src.ReadyzUpstreamPath != "" {
+		dst.ReadyzUpstreamPath = src.ReadyzUpstreamPath
+	}
+	if src.ShutdownTimeoutSeconds != 0 {
+		dst.ShutdownTimeoutSeconds = src.ShutdownTimeoutSeconds
+	}
+	if src.ConfigWatchIntervalSeconds != 0 {
+		dst.ConfigWatchIntervalSeconds = src.ConfigWatchIntervalSeconds
+	}
+	if src.PidFile != "" {
+		dst.PidFile = src.PidFile
+	}
+	if src.UpgradeTimeoutSeconds != 0 {
+		dst.UpgradeTimeoutSeconds = src.UpgradeTimeoutSeconds
+	}
 	if src.AdminUIPath != "" {
 		dst.AdminUIPath = src.AdminUIPath
 	}
+	if len(src.AdminTokens) != 0 {
+		dst.AdminTokens = src.AdminTokens
+	}
+	if len(src.Tenants) != 0 {
+		dst.Tenants = src.Tenants
+	}
+	if len(src.AdminAllowCIDRs) != 0 {
+		dst.AdminAllowCIDRs = src.AdminAllowCIDRs
+	}
+	if src.AdminBasicAuthUser != "" {
+		dst.AdminBasicAuthUser = src.AdminBasicAuthUser
+	}
+	if src.AdminBasicAuthPassword != "" {
+		dst.AdminBasicAuthPassword = src.AdminBasicAuthPassword
+	}
+	if src.AdminLockoutThreshold != 0 {
+		dst.AdminLockoutThreshold = src.AdminLockoutThreshold
+	}
+	if src.AdminLockoutSeconds != 0 {
+		dst.AdminLockoutSeconds = src.AdminLockoutSeconds
+	}
+	if src.AdminSessionTTLSeconds != 0 {
+		dst.AdminSessionTTLSeconds = src.AdminSessionTTLSeconds
+	}
+	if len(src.PurgeAllowCIDRs) != 0 {
+		dst.PurgeAllowCIDRs = src.PurgeAllowCIDRs
+	}
+	if src.WebhookSecret != "" {
+		dst.WebhookSecret = src.WebhookSecret
+	}
+	if len(src.WebhookPurgePaths) != 0 {
+		dst.WebhookPurgePaths = src.WebhookPurgePaths
+	}
 	if len(src.CacheTTLRules) != 0 {
 		dst.CacheTTLRules = src.CacheTTLRules
 	}
+	if len(src.Upstreams) != 0 {
+		dst.Upstreams = src.Upstreams
+	}
+	if len(src.RewriteHosts) != 0 {
+		dst.RewriteHosts = src.RewriteHosts
+	}
+	if len(src.HreflangHosts) != 0 {
+		dst.HreflangHosts = src.HreflangHosts
+	}
+	if len(src.RewriteExcludePaths) != 0 {
+		dst.RewriteExcludePaths = src.RewriteExcludePaths
+	}
+	if len(src.RewriteExcludeSelectors) != 0 {
+		dst.RewriteExcludeSelectors = src.RewriteExcludeSelectors
+	}
+	if len(src.StripSelectors) != 0 {
+		dst.StripSelectors = src.StripSelectors
+	}
+	if src.MinifyResponses {
+		dst.MinifyResponses = true
+	}
+	if len(src.Transformers) != 0 {
+		dst.Transformers = src.Transformers
+	}
+	if src.TransformHookTimeoutSeconds > 0 {
+		dst.TransformHookTimeoutSeconds = src.TransformHookTimeoutSeconds
+	}
+	if len(src.RobotsPolicies) != 0 {
+		dst.RobotsPolicies = src.RobotsPolicies
+	}
+	if len(src.StructuredData) != 0 {
+		dst.StructuredData = src.StructuredData
+	}
+	if len(src.SitemapWarmSchedules) != 0 {
+		dst.SitemapWarmSchedules = src.SitemapWarmSchedules
+	}
+	if len(src.BotUAInclude) != 0 {
+		dst.BotUAInclude = src.BotUAInclude
+	}
+	if len(src.BotUAExclude) != 0 {
+		dst.BotUAExclude = src.BotUAExclude
+	}
+	if len(src.BadBotUA) != 0 {
+		dst.BadBotUA = src.BadBotUA
+	}
+	if src.BadBotAction != "" {
+		dst.BadBotAction = strings.ToLower(src.BadBotAction)
+	}
+	if src.BadBotTarpitSeconds > 0 {
+		dst.BadBotTarpitSeconds = src.BadBotTarpitSeconds
+	}
+	if src.ChallengeMode != "" {
+		dst.ChallengeMode = strings.ToLower(src.ChallengeMode)
+	}
+	if src.ChallengePassMinutes > 0 {
+		dst.ChallengePassMinutes = src.ChallengePassMinutes
+	}
+	if src.ChallengeSecret != "" {
+		dst.ChallengeSecret = src.ChallengeSecret
+	}
+	if len(src.RedirectTargets) != 0 {
+		dst.RedirectTargets = src.RedirectTargets
+	}
+	if src.GeoIPDatabase != "" {
+		dst.GeoIPDatabase = src.GeoIPDatabase
+	}
+	if len(src.GeoRules) != 0 {
+		dst.GeoRules = src.GeoRules
+	}
+	if src.BotUAFile != "" {
+		dst.BotUAFile = src.BotUAFile
+	}
+	if src.VerifyBots {
+		dst.VerifyBots = true
+	}
+	if len(src.BotAllowCIDRs) != 0 {
+		dst.BotAllowCIDRs = src.BotAllowCIDRs
+	}
+	if len(src.BotDenyCIDRs) != 0 {
+		dst.BotDenyCIDRs = src.BotDenyCIDRs
+	}
+	if src.BotAllowCIDRFile != "" {
+		dst.BotAllowCIDRFile = src.BotAllowCIDRFile
+	}
+	if src.TrustXForwardedFor {
+		dst.TrustXForwardedFor = true
+	}
+	if len(src.TrustedProxies) != 0 {
+		dst.TrustedProxies = src.TrustedProxies
+	}
 }
@@ -0,0 +1,74 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// configEnvAliases names the environment variables of config.json keys whose
+// variable is not simply the key upper-cased.
+var configEnvAliases = map[string]string{
+	"sitemap_warm_schedules": "SITEMAP_WARM_SCHEDULE",
+	"tracing_endpoint":       "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"tracing_headers":        "OTEL_EXPORTER_OTLP_HEADERS",
+	"tracing_service_name":   "OTEL_SERVICE_NAME",
+	"tracing_sample_ratio":   "OTEL_TRACES_SAMPLER_ARG",
+}
+
+// configEnvName returns the environment variable setting config.json key.
+func configEnvName(key string) string {
+	if name, ok := configEnvAliases[key]; ok {
+		return name
+	}
+	return strings.ToUpper(key)
+}
+
+// isJSONEnv reports whether v holds a JSON array or object.
+func isJSONEnv(v string) bool {
+	v = strings.TrimSpace(v)
+	return strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{")
+}
+
+// compactEnv returns env variable key for its compact ("a=b,c=d") parser, or
+// "" when it holds JSON, which applyJSONEnv decodes instead.
+func compactEnv(key string) string {
+	if v := os.Getenv(key); !isJSONEnv(v) {
+		return v
+	}
+	return ""
+}
+
+// applyJSONEnv sets the list, map and object settings whose environment
+// variable holds their config.json form, e.g.
+// CACHE_TTL_RULES='[{"pattern":"/blog/*","ttl_seconds":600}]'. An empty
+// array or object clears a default.
+func applyJSONEnv(cfg *Config) error {
+	rv := reflect.ValueOf(cfg).Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || key == "" {
+			continue
+		}
+		switch f.Type.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Pointer:
+		default:
+			continue
+		}
+		name := configEnvName(key)
+		v := os.Getenv(name)
+		if !isJSONEnv(v) {
+			continue
+		}
+		p := reflect.New(f.Type)
+		if err := json.Unmarshal([]byte(v), p.Interface()); err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		rv.Field(i).Set(p.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package rerouter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+
+	"rerouter/logger"
+)
+
+// restartOnlyConfigFields are settings consumed once at startup (listeners,
+// logging, the shared upstream limiter and transport, schedules). A reload keeps their
+// running values and logs that a restart is needed to change them.
+var restartOnlyConfigFields = map[string]func(dst, src *Config){
+	"listen_addr":                        func(dst, src *Config) { dst.ListenAddr = src.ListenAddr },
+	"admin_listen_addr":                  func(dst, src *Config) { dst.AdminListenAddr = src.AdminListenAddr },
+	"tls_cert_file":                      func(dst, src *Config) { dst.TLSCertFile = src.TLSCertFile },
+	"tls_key_file":                       func(dst, src *Config) { dst.TLSKeyFile = src.TLSKeyFile },
+	"admin_unix_only":                    func(dst, src *Config) { dst.AdminUnixOnly = src.AdminUnixOnly },
+	"cache_dir":                          func(dst, src *Config) { dst.CacheDir = src.CacheDir },
+	"cache_s3_url":                       func(dst, src *Config) { dst.CacheS3URL = src.CacheS3URL },
+	"cache_s3_prefix":                    func(dst, src *Config) { dst.CacheS3Prefix = src.CacheS3Prefix },
+	"cache_s3_region":                    func(dst, src *Config) { dst.CacheS3Region = src.CacheS3Region },
+	"cache_s3_access_key_id":             func(dst, src *Config) { dst.CacheS3AccessKeyID = src.CacheS3AccessKeyID },
+	"cache_s3_secret_access_key":         func(dst, src *Config) { dst.CacheS3SecretAccessKey = src.CacheS3SecretAccessKey },
+	"log_level":                          func(dst, src *Config) { dst.LogLevel = src.LogLevel },
+	"log_levels":                         func(dst, src *Config) { dst.LogLevels = src.LogLevels },
+	"log_output":                         func(dst, src *Config) { dst.LogOutput = src.LogOutput },
+	"log_sample_initial":                 func(dst, src *Config) { dst.LogSampleInitial = src.LogSampleInitial },
+	"log_sample_thereafter":              func(dst, src *Config) { dst.LogSampleThereafter = src.LogSampleThereafter },
+	"log_syslog":                         func(dst, src *Config) { dst.LogSyslog = src.LogSyslog },
+	"log_http_url":                       func(dst, src *Config) { dst.LogHTTPURL = src.LogHTTPURL },
+	"log_loki_url":                       func(dst, src *Config) { dst.LogLokiURL = src.LogLokiURL },
+	"log_loki_labels":                    func(dst, src *Config) { dst.LogLokiLabels = src.LogLokiLabels },
+	"log_ship_headers":                   func(dst, src *Config) { dst.LogShipHeaders = src.LogShipHeaders },
+	"log_file":                           func(dst, src *Config) { dst.LogFile = src.LogFile },
+	"log_max_size_mb":                    func(dst, src *Config) { dst.LogMaxSizeMB = src.LogMaxSizeMB },
+	"log_max_backups":                    func(dst, src *Config) { dst.LogMaxBackups = src.LogMaxBackups },
+	"log_max_age_days":                   func(dst, src *Config) { dst.LogMaxAgeDays = src.LogMaxAgeDays },
+	"access_log_file":                    func(dst, src *Config) { dst.AccessLogFile = src.AccessLogFile },
+	"access_log_format":                  func(dst, src *Config) { dst.AccessLogFormat = src.AccessLogFormat },
+	"access_log_max_size_mb":             func(dst, src *Config) { dst.AccessLogMaxSizeMB = src.AccessLogMaxSizeMB },
+	"access_log_max_backups":             func(dst, src *Config) { dst.AccessLogMaxBackups = src.AccessLogMaxBackups },
+	"access_log_max_age_days":            func(dst, src *Config) { dst.AccessLogMaxAgeDays = src.AccessLogMaxAgeDays },
+	"tracing_endpoint":                   func(dst, src *Config) { dst.TracingEndpoint = src.TracingEndpoint },
+	"tracing_headers":                    func(dst, src *Config) { dst.TracingHeaders = src.TracingHeaders },
+	"tracing_service_name":               func(dst, src *Config) { dst.TracingServiceName = src.TracingServiceName },
+	"tracing_sample_ratio":               func(dst, src *Config) { dst.TracingSampleRatio = src.TracingSampleRatio },
+	"metrics_interval_seconds":           func(dst, src *Config) { dst.MetricsIntervalSeconds = src.MetricsIntervalSeconds },
+	"sitemap_warm_schedules":             func(dst, src *Config) { dst.SitemapWarmSchedules = src.SitemapWarmSchedules },
+	"prefetch_workers":                   func(dst, src *Config) { dst.PrefetchWorkers = src.PrefetchWorkers },
+	"prefetch_queue_size":                func(dst, src *Config) { dst.PrefetchQueueSize = src.PrefetchQueueSize },
+	"upstream_max_concurrent":            func(dst, src *Config) { dst.UpstreamMaxConcurrent = src.UpstreamMaxConcurrent },
+	"upstream_max_rps":                   func(dst, src *Config) { dst.UpstreamMaxRPS = src.UpstreamMaxRPS },
+	"upstream_timeout_seconds":           func(dst, src *Config) { dst.UpstreamTimeoutSeconds = src.UpstreamTimeoutSeconds },
+	"sitemap_fetch_timeout_seconds":      func(dst, src *Config) { dst.SitemapFetchTimeoutSeconds = src.SitemapFetchTimeoutSeconds },
+	"upstream_connect_timeout_seconds":   func(dst, src *Config) { dst.UpstreamConnectTimeoutSeconds = src.UpstreamConnectTimeoutSeconds },
+	"upstream_tls_timeout_seconds":       func(dst, src *Config) { dst.UpstreamTLSTimeoutSeconds = src.UpstreamTLSTimeoutSeconds },
+	"upstream_header_timeout_seconds":    func(dst, src *Config) { dst.UpstreamHeaderTimeoutSeconds = src.UpstreamHeaderTimeoutSeconds },
+	"upstream_max_idle_conns_per_host":   func(dst, src *Config) { dst.UpstreamMaxIdleConnsPerHost = src.UpstreamMaxIdleConnsPerHost },
+	"upstream_proxy_url":                 func(dst, src *Config) { dst.UpstreamProxyURL = src.UpstreamProxyURL },
+	"upstream_ca_file":                   func(dst, src *Config) { dst.UpstreamCAFile = src.UpstreamCAFile },
+	"upstream_insecure_skip_verify":      func(dst, src *Config) { dst.UpstreamInsecureSkipVerify = src.UpstreamInsecureSkipVerify },
+	"server_read_timeout_seconds":        func(dst, src *Config) { dst.ServerReadTimeoutSeconds = src.ServerReadTimeoutSeconds },
+	"server_read_header_timeout_seconds": func(dst, src *Config) { dst.ServerReadHeaderTimeoutSeconds = src.ServerReadHeaderTimeoutSeconds },
+	"server_write_timeout_seconds":       func(dst, src *Config) { dst.ServerWriteTimeoutSeconds = src.ServerWriteTimeoutSeconds },
+	"server_idle_timeout_seconds":        func(dst, src *Config) { dst.ServerIdleTimeoutSeconds = src.ServerIdleTimeoutSeconds },
+	"server_max_header_bytes":            func(dst, src *Config) { dst.ServerMaxHeaderBytes = src.ServerMaxHeaderBytes },
+	"enable_h2c":                         func(dst, src *Config) { dst.EnableH2C = src.EnableH2C },
+	"shutdown_timeout_seconds":           func(dst, src *Config) { dst.ShutdownTimeoutSeconds = src.ShutdownTimeoutSeconds },
+	"config_watch_interval_seconds":      func(dst, src *Config) { dst.ConfigWatchIntervalSeconds = src.ConfigWatchIntervalSeconds },
+	"pid_file":                           func(dst, src *Config) { dst.PidFile = src.PidFile },
+	"upgrade_timeout_seconds":            func(dst, src *Config) { dst.UpgradeTimeoutSeconds = src.UpgradeTimeoutSeconds },
+}
+
+// keepRestartOnly resets the restart-only fields of next to their values in
+// cur and returns the keys that differed.
+func keepRestartOnly(next, cur *Config) []string {
+	var changed []string
+	for k, set := range restartOnlyConfigFields {
+		kept := *next
+		set(&kept, cur)
+		if !reflect.DeepEqual(kept, *next) {
+			changed = append(changed, k)
+			*next = kept
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// checkConfigFiles reads the bot list files cfg points to, so a reload with an
+// unreadable or malformed file is rejected instead of half-applied.
+func checkConfigFiles(cfg *Config) error {
+	if cfg.BotUAFile != "" {
+		if _, _, err := readBotUAFile(cfg.BotUAFile); err != nil {
+			return fmt.Errorf("bot_ua_file: %w", err)
+		}
+	}
+	if cfg.BotAllowCIDRFile != "" {
+		b, err := os.ReadFile(cfg.BotAllowCIDRFile)
+		if err != nil {
+			return fmt.Errorf("bot_allow_cidr_file: %w", err)
+		}
+		if _, err := parseCIDRFile(b); err != nil {
+			return fmt.Errorf("bot_allow_cidr_file: %w", err)
+		}
+	}
+	return nil
+}
+
+// reloadConfig re-reads the environment and config file and applies the result
+// in place: the prefetch queue and sitemap warm jobs keep running. An invalid
+// config is rejected and the current one stays in effect.
+func (a *appHandler) reloadConfig(source string) error {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+	next, err := LoadConfig()
+	if err == nil {
+		err = checkConfigFiles(next)
+	}
+	if err != nil {
+		logger.Warnw("config_reload_rejected", map[string]interface{}{"err": err.Error(), "source": source})
+		return err
+	}
+	if changed := keepRestartOnly(next, a.config()); len(changed) > 0 {
+		logger.Warnw("config_reload_restart_required", map[string]interface{}{"fields": changed, "source": source})
+	}
+	a.applyConfig(next)
+	logger.Infow("config_reloaded", map[string]interface{}{"source": source, "file": next.configPath})
+	return nil
+}
+
+// configWatchFiles are the files whose changes trigger a reload: the config
+// file and the bot list files it or the environment points to.
+func configWatchFiles(cfg *Config) []string {
+	var out []string
+	for _, p := range []string{cfg.configPath, cfg.BotUAFile, cfg.BotAllowCIDRFile} {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// fileStamp identifies a file version; a missing file has the zero stamp.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFileStamp(p string) fileStamp {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// watchConfig polls the watched files every interval and reloads when one of
+// them changes, until ctx is done.
+func (a *appHandler) watchConfig(ctx context.Context, interval time.Duration) {
+	stamps := map[string]fileStamp{}
+	for _, p := range configWatchFiles(a.config()) {
+		stamps[p] = statFileStamp(p)
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed := false
+		for _, p := range configWatchFiles(a.config()) {
+			if statFileStamp(p) != stamps[p] {
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		_ = a.reloadConfig("watch")
+		// Re-stat after the reload, which may have changed the file list
+		stamps = map[string]fileStamp{}
+		for _, p := range configWatchFiles(a.config()) {
+			stamps[p] = statFileStamp(p)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package rerouter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+
+	"rerouter/logger"
+)
+
+// Warm job modes: a sitemap (or feed) lists the URLs, a crawl discovers them,
+// or they are submitted as a plain list.
+const (
+	warmModeSitemap = "sitemap"
+	warmModeCrawl   = "crawl"
+	warmModeList    = "list"
+)
+
+// crawlRobotsAgent is the robots.txt user-agent group warm jobs obey, besides "*".
+const crawlRobotsAgent = "rerouter"
+
+// maxRobotsCrawlDelay caps the Crawl-delay taken from robots.txt, so a typo
+// there cannot stall warm jobs; WarmCrawlDelaySeconds may still set more.
+const maxRobotsCrawlDelay = time.Minute
+
+func (job *sitemapWarmJob) mode() string {
+	if job.Mode == "" {
+		return warmModeSitemap
+	}
+	return job.Mode
+}
+
+// crawl warms job.SitemapURL and the same-host pages it links to, breadth
+// first, up to job.MaxDepth links away and job.MaxURLs pages. Links are read
+// from the cached copy of each page, so every page is fetched only once.
+// Pages already handled before a restart are not fetched again, but their
+// links are still followed.
+func (m *sitemapWarmManager) crawl(ctx context.Context, job *sitemapWarmJob, cfg *Config, bURL *url.URL, aBase string, robots robotsRules) {
+	start, err := url.Parse(job.SitemapURL)
+	if err != nil {
+		return
+	}
+	start.Fragment = ""
+	if !strings.EqualFold(start.Host, bURL.Host) {
+		job.incrementProcessed()
+		job.incrementSkipped()
+		job.addURLStatus(sitemapWarmURLStatus{RawURL: job.SitemapURL, URL: start.String(), Status: "skipped", Reason: "host_mismatch", ExpectedHost: bURL.Host, ActualHost: start.Host})
+		return
+	}
+	aHost := ""
+	if u, err := url.Parse(aBase); err == nil {
+		aHost = u.Host
+	}
+	done := job.processedRawURLs()
+	seen := map[string]struct{}{start.String(): {}}
+	level := []string{start.String()}
+	for depth := 0; len(level) > 0 && ctx.Err() == nil; depth++ {
+		job.updateTotal(len(seen))
+		work, wait := m.startWarmWorkers(ctx, job, aBase, robots)
+	levelLoop:
+		for _, target := range level {
+			if _, ok := done[target]; ok {
+				continue
+			}
+			u, _ := url.Parse(target)
+			if !robots.allowed(u.RequestURI()) {
+				job.skipRobotsDisallowed(target, target)
+				continue
+			}
+			select {
+			case work <- sitemapWarmTarget{rawURL: target, target: target, host: u.Host}:
+			case <-ctx.Done():
+				job.setInterrupted()
+				break levelLoop
+			}
+		}
+		close(work)
+		wait()
+		m.persist(job)
+		if depth >= job.MaxDepth || ctx.Err() != nil {
+			break
+		}
+		var next []string
+	nextLoop:
+		for _, target := range level {
+			for _, link := range crawlLinks(cfg.CacheDir, target, aHost, bURL) {
+				if len(seen) >= job.MaxURLs {
+					break nextLoop
+				}
+				if _, ok := seen[link]; ok {
+					continue
+				}
+				seen[link] = struct{}{}
+				next = append(next, link)
+			}
+		}
+		level = next
+	}
+	job.updateTotal(len(seen))
+}
+
+// crawlLinks returns the same-site links of the cached HTML page target as B
+// URLs. The cached body may already be rewritten to A, so links to aHost are
+// mapped back to B.
+func crawlLinks(cacheDir, target, aHost string, bURL *url.URL) []string {
+	ce, err := readCacheByURL(cacheDir, target)
+	if err != nil || ce.Status != http.StatusOK || !strings.Contains(strings.ToLower(ce.Header["Content-Type"]), "text/html") {
+		return nil
+	}
+	page, err := url.Parse(target)
+	if err != nil {
+		return nil
+	}
+	return sameSiteTargets(extractPageLinks(ce.Body), page, aHost, bURL)
+}
+
+// extractPageLinks returns the href of every <a> in an HTML document that is
+// not marked rel="nofollow", in document order.
+func extractPageLinks(body []byte) []string {
+	var out []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return out
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "a" || !hasAttr {
+				continue
+			}
+			var href string
+			nofollow := false
+			for {
+				k, v, more := z.TagAttr()
+				switch strings.ToLower(string(k)) {
+				case "href":
+					href = strings.TrimSpace(string(v))
+				case "rel":
+					nofollow = strings.Contains(" "+strings.ToLower(string(v))+" ", " nofollow ")
+				}
+				if !more {
+					break
+				}
+			}
+			if href != "" && !nofollow && !strings.HasPrefix(href, "#") {
+				out = append(out, href)
+			}
+		}
+	}
+}
+
+// robotsRules are the Allow/Disallow lines and Crawl-delay of the robots.txt
+// group that applies to the crawler.
+type robotsRules struct {
+	allow      []string
+	disallow   []string
+	crawlDelay time.Duration
+}
+
+// skipRobotsDisallowed records a URL of job that robots.txt disallows.
+func (job *sitemapWarmJob) skipRobotsDisallowed(rawURL, target string) {
+	job.incrementProcessed()
+	job.incrementSkipped()
+	job.addURLStatus(sitemapWarmURLStatus{RawURL: rawURL, URL: target, Status: "skipped", Reason: "robots_disallowed"})
+	logger.Infow("sitemap_cache_job_url_skipped", map[string]interface{}{
+		"job_id":  job.ID,
+		"sitemap": job.SitemapURL,
+		"target":  target,
+		"reason":  "robots_disallowed",
+	})
+}
+
+// warmRobotsRules returns the robots.txt rules warm jobs on bURL obey, or
+// none when WarmIgnoreRobots is set.
+func warmRobotsRules(ctx context.Context, cfg *Config, client *http.Client, bURL *url.URL) robotsRules {
+	if cfg.WarmIgnoreRobots {
+		return robotsRules{}
+	}
+	return fetchRobotsRules(ctx, client, bURL)
+}
+
+// warmDelay returns the gap between warm fetches to one host:
+// SitemapWarmDelaySeconds, or the Crawl-delay (robots.txt, or
+// WarmCrawlDelaySeconds when set) when that is longer.
+func warmDelay(cfg *Config, robots robotsRules) time.Duration {
+	delay := time.Duration(cfg.SitemapWarmDelaySeconds) * time.Second
+	crawl := robots.crawlDelay
+	if crawl > maxRobotsCrawlDelay {
+		crawl = maxRobotsCrawlDelay
+	}
+	switch {
+	case cfg.WarmCrawlDelaySeconds > 0:
+		crawl = time.Duration(cfg.WarmCrawlDelaySeconds) * time.Second
+	case cfg.WarmCrawlDelaySeconds < 0:
+		crawl = 0
+	}
+	if crawl > delay {
+		return crawl
+	}
+	return delay
+}
+
+// fetchRobotsRules loads robots.txt for the origin of start. A missing or
+// unreadable file allows everything.
+func fetchRobotsRules(ctx context.Context, client *http.Client, start *url.URL) robotsRules {
+	u := url.URL{Scheme: start.Scheme, Host: start.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return robotsRules{}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return robotsRules{}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return robotsRules{}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 512<<10))
+	if err != nil {
+		return robotsRules{}
+	}
+	return parseRobotsRules(body, crawlRobotsAgent)
+}
+
+// parseRobotsRules returns the rules of the group naming agent, or of the "*"
+// group when no group names it.
+func parseRobotsRules(body []byte, agent string) robotsRules {
+	var named, wildcard robotsRules
+	var matchNamed, matchWildcard, inAgents, foundNamed bool
+	sc := bufio.NewScanner(bytes.NewReader(body))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch k {
+		case "user-agent":
+			if !inAgents {
+				matchNamed, matchWildcard = false, false
+			}
+			inAgents = true
+			ua := strings.ToLower(v)
+			if ua == "*" {
+				matchWildcard = true
+			} else if ua != "" && strings.Contains(agent, ua) {
+				matchNamed, foundNamed = true, true
+			}
+		case "crawl-delay":
+			inAgents = false
+			secs, err := strconv.ParseFloat(v, 64)
+			if err != nil || secs <= 0 {
+				continue
+			}
+			if matchNamed {
+				named.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+			if matchWildcard {
+				wildcard.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		case "allow", "disallow":
+			inAgents = false
+			if v == "" {
+				continue
+			}
+			for _, r := range []struct {
+				match bool
+				dst   *robotsRules
+			}{{matchNamed, &named}, {matchWildcard, &wildcard}} {
+				if !r.match {
+					continue
+				}
+				if k == "allow" {
+					r.dst.allow = append(r.dst.allow, v)
+				} else {
+					r.dst.disallow = append(r.dst.disallow, v)
+				}
+			}
+		default:
+			inAgents = false
+		}
+	}
+	if foundNamed {
+		return named
+	}
+	return wildcard
+}
+
+// allowed applies the most specific (longest) matching rule to path; Allow
+// wins a tie, and a path no rule matches is allowed.
+func (r robotsRules) allowed(path string) bool {
+	best, allow := -1, true
+	for _, p := range r.allow {
+		if robotsPatternMatch(p, path) && len(p) > best {
+			best, allow = len(p), true
+		}
+	}
+	for _, p := range r.disallow {
+		if robotsPatternMatch(p, path) && len(p) > best {
+			best, allow = len(p), false
+		}
+	}
+	return allow
+}
+
+// robotsPatternMatch matches a robots.txt path pattern, where "*" is any
+// sequence and a trailing "$" anchors the end.
+func robotsPatternMatch(pattern, path string) bool {
+	if !strings.ContainsAny(pattern, "*$") {
+		return strings.HasPrefix(path, pattern)
+	}
+	expr := regexp.QuoteMeta(strings.TrimSuffix(pattern, "$"))
+	expr = "^" + strings.ReplaceAll(expr, `\*`, ".*")
+	if strings.HasSuffix(pattern, "$") {
+		expr += "$"
+	}
+	re, err := compileTTLRegex(expr)
+	if err != nil {
+		return false
+	}
+	return re.MatchString(path)
+}
@@ -0,0 +1,236 @@
+package rerouter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxDiffEdits bounds the work of diffStrings; inputs further apart than
+// this are shown as one block of deletions followed by insertions.
+const maxDiffEdits = 2000
+
+// diffOp is one element of a diff: kept (' '), deleted ('-') or inserted ('+').
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffStrings returns a shortest edit script turning a into b (Myers' O(ND)
+// algorithm), after trimming their common prefix and suffix.
+func diffStrings(a, b []string) []diffOp {
+	var ops []diffOp
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		ops = append(ops, diffOp{' ', a[pre]})
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	ops = append(ops, myersDiff(a[pre:len(a)-suf], b[pre:len(b)-suf])...)
+	for _, s := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', s})
+	}
+	return ops
+}
+
+func myersDiff(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	off := n + m
+	v := make([]int, 2*off+2)
+	// trace[d] holds v[-d..d] as it was before step d
+	var trace [][]int
+	for d := 0; d <= off && d <= maxDiffEdits; d++ {
+		trace = append(trace, append([]int(nil), v[off-d:off+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(trace, a, b)
+			}
+		}
+	}
+	ops := make([]diffOp, 0, n+m)
+	for _, s := range a {
+		ops = append(ops, diffOp{'-', s})
+	}
+	for _, s := range b {
+		ops = append(ops, diffOp{'+', s})
+	}
+	return ops
+}
+
+func myersBacktrack(trace [][]int, a, b []string) []diffOp {
+	var rev []diffOp
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && at(k-1) < at(k+1) {
+			prevK = k + 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			rev = append(rev, diffOp{' ', a[x-1]})
+			x, y = x-1, y-1
+		}
+		if x == prevX {
+			rev = append(rev, diffOp{'+', b[y-1]})
+			y--
+		} else {
+			rev = append(rev, diffOp{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		rev = append(rev, diffOp{' ', a[x-1]})
+		x, y = x-1, y-1
+	}
+	ops := make([]diffOp, len(rev))
+	for i, op := range rev {
+		ops[len(rev)-1-i] = op
+	}
+	return ops
+}
+
+// splitLines splits s into lines without their line breaks.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// unifiedDiff renders the line diff of a and b in unified format with
+// context lines around each change; it is empty when they are equal.
+func unifiedDiff(aName, bName, a, b string, context int) string {
+	ops := diffStrings(splitLines(a), splitLines(b))
+	var out strings.Builder
+	// aLine and bLine are the 0-based line numbers before ops[i]
+	aLine, bLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		aLine[i+1], bLine[i+1] = aLine[i], bLine[i]
+		if op.kind != '+' {
+			aLine[i+1]++
+		}
+		if op.kind != '-' {
+			bLine[i+1]++
+		}
+	}
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// A hunk runs until more than 2*context unchanged lines follow a change
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aLine[start], aLine[stop]), hunkRange(bLine[start], bLine[stop]))
+		for _, op := range ops[start:stop] {
+			out.WriteByte(op.kind)
+			out.WriteString(op.text)
+			out.WriteByte('\n')
+		}
+		i = stop
+	}
+	return out.String()
+}
+
+// hunkRange formats the 0-based line span [from, to) as "start,count".
+func hunkRange(from, to int) string {
+	if to == from {
+		return fmt.Sprintf("%d,0", from)
+	}
+	return fmt.Sprintf("%d,%d", from+1, to-from)
+}
+
+// diffReplacement is a run of text a diff replaced, and how often.
+type diffReplacement struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Count int    `json:"count"`
+}
+
+// diffReplacements lists what changed between a and b at the level of tokens
+// (runs of text between spaces, quotes, brackets and separators), e.g. the
+// URL in an attribute, counting repeats in the order first seen.
+func diffReplacements(a, b string) []diffReplacement {
+	out := []diffReplacement{}
+	seen := map[[2]string]int{}
+	add := func(from, to []string) {
+		if len(from) == 0 && len(to) == 0 {
+			return
+		}
+		key := [2]string{strings.Join(from, ""), strings.Join(to, "")}
+		if i, ok := seen[key]; ok {
+			out[i].Count++
+			return
+		}
+		seen[key] = len(out)
+		out = append(out, diffReplacement{From: key[0], To: key[1], Count: 1})
+	}
+	var from, to []string
+	for _, op := range diffStrings(diffTokens(a), diffTokens(b)) {
+		switch op.kind {
+		case '-':
+			from = append(from, op.text)
+		case '+':
+			to = append(to, op.text)
+		default:
+			add(from, to)
+			from, to = nil, nil
+		}
+	}
+	add(from, to)
+	return out
+}
+
+// diffTokens splits s into runs of text and single separator characters.
+func diffTokens(s string) []string {
+	var out []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(" \t\r\n\"'`<>()[]{},;", s[i]) >= 0 {
+			if start < i {
+				out = append(out, s[start:i])
+			}
+			out = append(out, s[i:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(s) {
+		out = append(out, s[start:])
+	}
+	return out
+}
@@ -0,0 +1,164 @@
+package rerouter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// errorPageMaintenance is the ERROR_PAGES key of the maintenance page; the
+// others are status codes.
+const errorPageMaintenance = "maintenance"
+
+// defaultErrorPageTemplate is used for statuses without a configured page.
+const defaultErrorPageTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="robots" content="noindex"><title>{{.Title}}</title>
+<style>body{font-family:sans-serif;color:#333;max-width:36em;margin:15vh auto;padding:0 1em}h1{font-size:1.5em}</style></head>
+<body><h1>{{.Title}}</h1><p>{{.Message}}</p></body></html>
+`
+
+// errorPageVars are the variables available to error page templates.
+type errorPageVars struct {
+	Status     int
+	Title      string
+	Message    string
+	Path       string
+	RequestID  string
+	RetryAfter int // seconds, 0 when unknown
+}
+
+func validErrorPageKey(k string) bool {
+	switch k {
+	case "502", "503", "504", errorPageMaintenance:
+		return true
+	}
+	return false
+}
+
+// parseErrorPages parses "502=/etc/rerouter/502.html,maintenance=/etc/rerouter/maint.html".
+func parseErrorPages(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, item := range splitCommaList(v) {
+		k, p, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want key=file", item)
+		}
+		out[strings.ToLower(strings.TrimSpace(k))] = strings.TrimSpace(p)
+	}
+	return out, nil
+}
+
+func validateErrorPages(m map[string]string) error {
+	for k, p := range m {
+		if !validErrorPageKey(k) {
+			return fmt.Errorf("unknown error page %q (want 502, 503, 504 or maintenance)", k)
+		}
+		if p == "" {
+			return fmt.Errorf("error page %q needs a file", k)
+		}
+	}
+	return nil
+}
+
+// upstreamErrorStatus maps a failed upstream request to 503 while the host's
+// circuit breaker is open, 504 for timeouts and 502 otherwise.
+func upstreamErrorStatus(err error) int {
+	if errors.Is(err, errCircuitOpen) {
+		return http.StatusServiceUnavailable
+	}
+	var ne net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// writeUpstreamError answers a request whose upstream fetch failed with the
+// 502, 503 or 504 error page.
+func writeUpstreamError(cfg *Config, w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errCircuitOpen) {
+		cooldown := cfg.UpstreamBreakerCooldownSeconds
+		if cooldown <= 0 {
+			cooldown = defaultUpstreamBreakerCooldownSeconds
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(cooldown))
+	}
+	writeErrorPage(cfg, w, r, upstreamErrorStatus(err), "")
+}
+
+// serveMaintenance answers with the maintenance page (503) while
+// cfg.MaintenanceMode is on, and reports whether it did.
+func serveMaintenance(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	if !cfg.MaintenanceMode {
+		return false
+	}
+	if cfg.MaintenanceRetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(cfg.MaintenanceRetryAfter))
+	}
+	writeErrorPage(cfg, w, r, http.StatusServiceUnavailable, errorPageMaintenance)
+	return true
+}
+
+// writeErrorPage renders the HTML page for status (or for key, when set)
+// from cfg.ErrorPages, falling back to the built-in page when none is
+// configured or the template fails.
+func writeErrorPage(cfg *Config, w http.ResponseWriter, r *http.Request, status int, key string) {
+	if key == "" {
+		key = strconv.Itoa(status)
+	}
+	vars := errorPageVars{Status: status, Title: http.StatusText(status), Path: r.URL.Path, RequestID: getRequestID(r.Context()), RetryAfter: cfg.MaintenanceRetryAfter}
+	switch {
+	case key == errorPageMaintenance:
+		vars.Title, vars.Message = "Down for maintenance", "We are performing scheduled maintenance and will be back shortly."
+	case status == http.StatusGatewayTimeout:
+		vars.Message = "The site took too long to respond. Please try again in a moment."
+	default:
+		vars.Message = "The site is temporarily unavailable. Please try again in a moment."
+	}
+	if key != errorPageMaintenance {
+		vars.RetryAfter = 0
+	}
+	body, err := renderErrorPage(cfg.ErrorPages[key], vars)
+	if err != nil {
+		logger.Warnw("error_page_template_error", map[string]interface{}{"err": err.Error(), "page": key, "req_id": getRequestID(r.Context())})
+		body, _ = renderErrorPage("", vars)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// renderErrorPage executes the html/template in file, or the built-in page
+// when file is empty.
+func renderErrorPage(file string, vars errorPageVars) ([]byte, error) {
+	src := defaultErrorPageTemplate
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		src = string(b)
+	}
+	t, err := template.New("error").Parse(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,218 @@
+package rerouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// rssDoc covers RSS 2.0 (<rss><channel><item>) and RSS 1.0, whose RDF
+// document keeps the items beside the channel.
+type rssDoc struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []rssItem `xml:"item"`
+	} `xml:"channel"`
+	Items []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	// <link> text; atom:link elements inside items only carry an href.
+	Links []struct {
+		Value string `xml:",chardata"`
+	} `xml:"link"`
+	GUID struct {
+		Value       string `xml:",chardata"`
+		IsPermaLink string `xml:"isPermaLink,attr"`
+	} `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+	DCDate  string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name
+	Entries []struct {
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Updated   string `xml:"updated"`
+		Published string `xml:"published"`
+	} `xml:"entry"`
+}
+
+type jsonFeed struct {
+	Version string `json:"version"`
+	Items   []struct {
+		URL           string `json:"url"`
+		DateModified  string `json:"date_modified"`
+		DatePublished string `json:"date_published"`
+	} `json:"items"`
+}
+
+// feedDateLayouts are the RFC 822 dates used by RSS <pubDate>, which real
+// feeds write with and without a leading zero and with zone names or offsets.
+var feedDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+}
+
+func parseFeedDate(v string) time.Time {
+	v = strings.TrimSpace(v)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return parseSitemapLastMod(v)
+}
+
+// parseFeedItems extracts item links from an RSS, Atom or JSON feed, in
+// document order. Links are returned as written; callers resolve them.
+func parseFeedItems(body []byte) ([]sitemapURL, bool) {
+	if len(body) > 0 && body[0] == '{' {
+		var jf jsonFeed
+		if err := json.Unmarshal(body, &jf); err != nil || !strings.Contains(jf.Version, "jsonfeed.org") {
+			return nil, false
+		}
+		out := make([]sitemapURL, 0, len(jf.Items))
+		for _, it := range jf.Items {
+			if loc := strings.TrimSpace(it.URL); loc != "" {
+				date := it.DateModified
+				if date == "" {
+					date = it.DatePublished
+				}
+				out = append(out, sitemapURL{Loc: loc, LastMod: parseSitemapLastMod(date), Priority: 0.5})
+			}
+		}
+		return out, true
+	}
+
+	var probe struct{ XMLName xml.Name }
+	if err := xml.Unmarshal(body, &probe); err != nil {
+		return nil, false
+	}
+	switch probe.XMLName.Local {
+	case "rss", "RDF":
+		var doc rssDoc
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			return nil, false
+		}
+		items := append(doc.Channel.Items, doc.Items...)
+		out := make([]sitemapURL, 0, len(items))
+		for _, it := range items {
+			loc := ""
+			for _, l := range it.Links {
+				if loc = strings.TrimSpace(l.Value); loc != "" {
+					break
+				}
+			}
+			if loc == "" && !strings.EqualFold(it.GUID.IsPermaLink, "false") {
+				loc = strings.TrimSpace(it.GUID.Value)
+			}
+			if loc == "" {
+				continue
+			}
+			date := it.PubDate
+			if date == "" {
+				date = it.DCDate
+			}
+			out = append(out, sitemapURL{Loc: loc, LastMod: parseFeedDate(date), Priority: 0.5})
+		}
+		return out, true
+	case "feed":
+		var doc atomFeed
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			return nil, false
+		}
+		out := make([]sitemapURL, 0, len(doc.Entries))
+		for _, e := range doc.Entries {
+			loc := ""
+			for _, l := range e.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					loc = strings.TrimSpace(l.Href)
+					break
+				}
+			}
+			if loc == "" {
+				continue
+			}
+			date := e.Updated
+			if date == "" {
+				date = e.Published
+			}
+			out = append(out, sitemapURL{Loc: loc, LastMod: parseSitemapLastMod(date), Priority: 0.5})
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// feedContentTypes are the <link rel="alternate"> types treated as feeds.
+var feedContentTypes = []string{"application/rss+xml", "application/atom+xml", "application/feed+json"}
+
+// discoverFeedLinks returns the hrefs of feeds an HTML page advertises with
+// <link rel="alternate" type="application/rss+xml" href="...">.
+func discoverFeedLinks(body []byte) []string {
+	if !bytes.Contains(bytes.ToLower(body[:min(len(body), 4096)]), []byte("<html")) {
+		return nil
+	}
+	var out []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return out
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "body" {
+				return out
+			}
+			if tok.Data != "link" {
+				continue
+			}
+			var rel, typ, href string
+			for _, a := range tok.Attr {
+				switch strings.ToLower(a.Key) {
+				case "rel":
+					rel = strings.ToLower(a.Val)
+				case "type":
+					typ = strings.ToLower(strings.TrimSpace(a.Val))
+				case "href":
+					href = strings.TrimSpace(a.Val)
+				}
+			}
+			if href == "" || !strings.Contains(" "+rel+" ", " alternate ") {
+				continue
+			}
+			for _, ct := range feedContentTypes {
+				if typ == ct {
+					out = append(out, href)
+					break
+				}
+			}
+		}
+	}
+}
+
+// isFeedPath reports whether p looks like an RSS/Atom feed URL, such as
+// WordPress's /feed/ or a .rss/.atom file.
+func isFeedPath(p string) bool {
+	lp := strings.TrimSuffix(strings.ToLower(p), "/")
+	if strings.HasSuffix(lp, ".rss") || strings.HasSuffix(lp, ".atom") {
+		return true
+	}
+	i := strings.LastIndex(lp, "/")
+	switch lp[i+1:] {
+	case "feed", "rss", "atom", "rss.xml", "atom.xml", "feed.xml", "feed.json", "index.xml":
+		return true
+	}
+	return false
+}
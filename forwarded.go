@@ -0,0 +1,77 @@
+package rerouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Client-IP headers accepted in cfg.ForwardClientIP.
+const (
+	forwardXFF     = "x-forwarded-for"
+	forwardRealIP  = "x-real-ip"
+	forwardRFC7239 = "forwarded"
+)
+
+// clientForward identifies the client an upstream request is made on behalf
+// of. The zero value (background work with no client) adds no headers.
+type clientForward struct {
+	IP string
+	// X-Forwarded-For to send: the received chain (from a trusted proxy) plus the peer.
+	Chain string
+	Proto string
+	Host  string
+}
+
+// clientForwardFor captures the client of r. The client IP follows
+// TRUSTED_PROXIES or TRUST_X_FORWARDED_FOR like bot detection does; an
+// untrusted incoming X-Forwarded-For is dropped rather than passed on.
+func clientForwardFor(cfg *Config, r *http.Request) clientForward {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	f := clientForward{IP: clientIP(cfg, r), Chain: peer, Proto: "http", Host: r.Host}
+	if r.TLS != nil {
+		f.Proto = "https"
+	}
+	if forwardedHeadersTrusted(cfg, r) {
+		if xff := strings.TrimSpace(strings.Join(r.Header.Values("X-Forwarded-For"), ", ")); xff != "" {
+			f.Chain = xff + ", " + peer
+		}
+		if p := forwardedProto(r); p != "" {
+			f.Proto = p
+		}
+	}
+	return f
+}
+
+// apply sets the client-IP headers enabled in cfg.ForwardClientIP on req.
+func (f clientForward) apply(cfg *Config, req *http.Request) {
+	if f.IP == "" {
+		return
+	}
+	for _, h := range cfg.ForwardClientIP {
+		switch h {
+		case forwardXFF:
+			req.Header.Set("X-Forwarded-For", f.Chain)
+		case forwardRealIP:
+			req.Header.Set("X-Real-IP", f.IP)
+		case forwardRFC7239:
+			v := "for=" + forwardedNode(f.IP)
+			if f.Host != "" {
+				v += fmt.Sprintf(";host=%q", f.Host)
+			}
+			req.Header.Set("Forwarded", v+";proto="+f.Proto)
+		}
+	}
+}
+
+// forwardedNode formats ip as an RFC 7239 node: IPv6 addresses are bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
@@ -0,0 +1,470 @@
+package rerouter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Actions accepted in GeoRule.Action.
+const (
+	// Redirect humans to the rule's B base URL instead of BBaseURL.
+	geoActionRedirect = "redirect"
+	// Answer every client with the rule's status (403 by default).
+	geoActionBlock = "block"
+)
+
+// GeoRule routes clients whose GeoIP country is one of Countries.
+type GeoRule struct {
+	// ISO 3166-1 alpha-2 codes, e.g. ["CN", "HK"].
+	Countries []string `json:"countries"`
+	Action    string   `json:"action"`
+	// Region mirror humans are redirected to, e.g. https://b-cn.example.com.
+	BBaseURL string `json:"b_base_url,omitempty"`
+	// 4xx status for block rules; 0 means 403.
+	Status int `json:"status,omitempty"`
+}
+
+// parseGeoRules parses "countries=target" entries separated by semicolons,
+// where target is a B base URL to redirect humans to or "block[:status]",
+// e.g. "CN,HK=https://b-cn.example.com;KP,IR=block:451".
+func parseGeoRules(v string) ([]GeoRule, error) {
+	out := []GeoRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		countries, target, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid geo rule %q (want countries=url or countries=block)", p)
+		}
+		rule := GeoRule{Countries: splitCommaList(countries), Action: geoActionRedirect, BBaseURL: strings.TrimSpace(target)}
+		if action, status, _ := strings.Cut(rule.BBaseURL, ":"); strings.EqualFold(action, geoActionBlock) {
+			rule.Action, rule.BBaseURL = geoActionBlock, ""
+			if status != "" {
+				n, err := strconv.Atoi(status)
+				if err != nil {
+					return nil, fmt.Errorf("invalid geo rule %q", p)
+				}
+				rule.Status = n
+			}
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// validateGeoRules normalizes country codes to upper case and checks each
+// rule's action and target.
+func validateGeoRules(rules []GeoRule) error {
+	for i := range rules {
+		r := &rules[i]
+		if len(r.Countries) == 0 {
+			return fmt.Errorf("geo rule needs at least one country")
+		}
+		for j, c := range r.Countries {
+			c = strings.ToUpper(strings.TrimSpace(c))
+			if len(c) != 2 {
+				return fmt.Errorf("geo rule: %q is not a two-letter country code", c)
+			}
+			r.Countries[j] = c
+		}
+		r.Action = strings.ToLower(r.Action)
+		switch r.Action {
+		case geoActionRedirect:
+			u, err := url.Parse(r.BBaseURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("geo rule %s: invalid b_base_url %q", strings.Join(r.Countries, ","), r.BBaseURL)
+			}
+		case geoActionBlock:
+			if r.Status != 0 && (r.Status < 400 || r.Status > 499) {
+				return fmt.Errorf("geo rule %s: status %d is not 4xx", strings.Join(r.Countries, ","), r.Status)
+			}
+		default:
+			return fmt.Errorf("geo rule %s: unknown action %q (want redirect or block)", strings.Join(r.Countries, ","), r.Action)
+		}
+	}
+	return nil
+}
+
+// geoRuleFor returns the first rule of cfg.GeoRules covering country.
+func geoRuleFor(cfg *Config, country string) (GeoRule, bool) {
+	if country == "" {
+		return GeoRule{}, false
+	}
+	for _, r := range cfg.GeoRules {
+		if containsString(r.Countries, country) {
+			return r, true
+		}
+	}
+	return GeoRule{}, false
+}
+
+// geoRedirectBase returns the region mirror humans from country go to, or
+// "" for BBaseURL.
+func geoRedirectBase(cfg *Config, country string) string {
+	if r, ok := geoRuleFor(cfg, country); ok && r.Action == geoActionRedirect {
+		return r.BBaseURL
+	}
+	return ""
+}
+
+// serveGeoBlocked answers r when a block rule covers country and reports
+// whether it did.
+func serveGeoBlocked(cfg *Config, w http.ResponseWriter, r *http.Request, country string) bool {
+	rule, ok := geoRuleFor(cfg, country)
+	if !ok || rule.Action != geoActionBlock {
+		return false
+	}
+	status := rule.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	logger.Debugw("geo_blocked", map[string]interface{}{"req_id": getRequestID(r.Context()), "country": country, "path": r.URL.Path, "status": status})
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
+
+// geoCountry returns the ISO country code of r's client IP from
+// cfg.GeoIPDatabase, or "" when there is no database or no match. The
+// country is also noted for the access log.
+func geoCountry(cfg *Config, r *http.Request) string {
+	if cfg.GeoIPDatabase == "" {
+		return ""
+	}
+	db := geoDBFor(cfg.GeoIPDatabase)
+	if db == nil {
+		return ""
+	}
+	ip := net.ParseIP(clientIP(cfg, r))
+	if ip == nil {
+		return ""
+	}
+	rec, err := db.lookup(ip)
+	if err != nil {
+		logger.Debugw("geoip_lookup_error", map[string]interface{}{"req_id": getRequestID(r.Context()), "err": err.Error()})
+		return ""
+	}
+	country := mmdbCountry(rec)
+	if n := accessNoteFrom(r.Context()); n != nil {
+		n.country = country
+	}
+	return country
+}
+
+// mmdbCountry reads country.iso_code, or registered_country.iso_code, from
+// a GeoIP2/GeoLite2 Country or City record.
+func mmdbCountry(rec interface{}) string {
+	m, _ := rec.(map[string]interface{})
+	for _, k := range []string{"country", "registered_country"} {
+		if c, ok := m[k].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok && code != "" {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+// geoDBCheckInterval is how often the database file is checked for an update
+// (e.g. by geoipupdate).
+const geoDBCheckInterval = time.Minute
+
+// geoDBCache keeps the open GeoIP database at path, reopening it when the
+// file is replaced.
+type geoDBCache struct {
+	mu      sync.Mutex
+	path    string
+	db      *mmdbReader
+	modTime time.Time
+	checked time.Time
+}
+
+var geoDBs sync.Map // database path -> *geoDBCache
+
+// geoDBFor returns the database at path, or nil when it cannot be read.
+// Servers of one process configured with the same path share it.
+func geoDBFor(path string) *mmdbReader {
+	v, _ := geoDBs.LoadOrStore(path, &geoDBCache{path: path})
+	return v.(*geoDBCache).get()
+}
+
+// get returns the database, or nil when it cannot be read. A file that turns
+// unreadable after loading keeps the loaded copy in use.
+func (c *geoDBCache) get() *mmdbReader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.checked) < geoDBCheckInterval {
+		return c.db
+	}
+	c.checked = now
+	path := c.path
+	st, err := os.Stat(path)
+	if err == nil && c.db != nil && st.ModTime().Equal(c.modTime) {
+		return c.db
+	}
+	var db *mmdbReader
+	if err == nil {
+		var b []byte
+		if b, err = os.ReadFile(path); err == nil {
+			db, err = openMMDB(b)
+		}
+	}
+	if err != nil {
+		logger.Warnw("geoip_load_error", map[string]interface{}{"path": path, "err": err.Error()})
+		return c.db
+	}
+	c.db, c.modTime = db, st.ModTime()
+	logger.Infow("geoip_loaded", map[string]interface{}{"path": path, "type": db.dbType, "nodes": db.nodeCount})
+	return db
+}
+
+// mmdbMetadataMarker starts the metadata section at the end of a MaxMind DB file.
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+var errMMDBCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdbReader looks up IP addresses in a MaxMind DB file held in memory: a
+// binary search tree over the address bits whose leaves point into a data
+// section of typed values.
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+	dbType     string
+}
+
+func openMMDB(b []byte) (*mmdbReader, error) {
+	i := bytes.LastIndex(b, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB: no metadata")
+	}
+	v, _, err := mmdbDecoder{buf: b[i+len(mmdbMetadataMarker):]}.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	meta, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("metadata: %w", errMMDBCorrupt)
+	}
+	r := &mmdbReader{nodeCount: mmdbUint(meta["node_count"]), recordSize: mmdbUint(meta["record_size"]), ipVersion: mmdbUint(meta["ip_version"])}
+	r.dbType, _ = meta["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", r.ipVersion)
+	}
+	treeSize := r.recordSize * 2 / 8 * r.nodeCount
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("search tree: %w", errMMDBCorrupt)
+	}
+	r.tree = b[:treeSize]
+	r.data = mmdbDecoder{buf: b[treeSize+16 : i]}
+	if r.ipVersion == 6 {
+		// IPv4 addresses live under ::/96
+		node := uint(0)
+		for n := 0; n < 96 && node < r.nodeCount; n++ {
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *mmdbReader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// lookup returns the data record for ip, or nil when the database has none.
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	bits, node := ip.To4(), uint(0)
+	if bits != nil {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	} else {
+		bits = ip.To16()
+	}
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+	off := node - r.nodeCount - 16
+	if off >= uint(len(r.data.buf)) {
+		return nil, errMMDBCorrupt
+	}
+	v, _, err := r.data.decode(off, 0)
+	return v, err
+}
+
+// mmdbDecoder decodes values of a MaxMind DB data section; pointers are
+// offsets from the start of buf.
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// maxMMDBDepth bounds nesting and pointer chains in corrupt files.
+const maxMMDBDepth = 32
+
+func (d mmdbDecoder) bytes(off, n uint) ([]byte, error) {
+	if off+n > uint(len(d.buf)) || off+n < off {
+		return nil, errMMDBCorrupt
+	}
+	return d.buf[off : off+n], nil
+}
+
+// decode returns the value at off and the offset after it.
+func (d mmdbDecoder) decode(off uint, depth int) (interface{}, uint, error) {
+	if depth > maxMMDBDepth {
+		return nil, 0, errMMDBCorrupt
+	}
+	b, err := d.bytes(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	off++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		n := uint(ctrl>>3&3) + 1
+		pb, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		p := uint(0)
+		if n < 4 {
+			p = uint(ctrl & 7)
+		}
+		for _, c := range pb {
+			p = p<<8 | uint(c)
+		}
+		p += [...]uint{0, 2048, 526336, 0}[n-1]
+		v, _, err := d.decode(p, depth+1)
+		return v, off + n, err
+	}
+	if typ == 0 {
+		eb, err := d.bytes(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(eb[0])
+		off++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		sb, err := d.bytes(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		v := uint(0)
+		for _, c := range sb {
+			v = v<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + v
+		off += n
+	}
+	switch typ {
+	case 2, 4: // utf8 string, bytes
+		v, err := d.bytes(off, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if typ == 2 {
+			return string(v), off + size, nil
+		}
+		return append([]byte(nil), v...), off + size, nil
+	case 3, 15: // double, float
+		v, err := d.bytes(off, size)
+		if err != nil || (typ == 3 && size != 8) || (typ == 15 && size != 4) {
+			return nil, 0, errMMDBCorrupt
+		}
+		if typ == 3 {
+			return math.Float64frombits(binary.BigEndian.Uint64(v)), off + size, nil
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(v))), off + size, nil
+	case 5, 6, 8, 9, 10: // uint16, uint32, int32, uint64, uint128 (low 64 bits)
+		v, err := d.bytes(off, size)
+		if err != nil || size > 16 {
+			return nil, 0, errMMDBCorrupt
+		}
+		var n uint64
+		for _, c := range v {
+			n = n<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(uint32(n))), off + size, nil
+		}
+		return n, off + size, nil
+	case 7: // map
+		m := map[string]interface{}{}
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], off, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // array
+		var a []interface{}
+		for i := uint(0); i < size; i++ {
+			v, next, err := d.decode(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			off = next
+		}
+		return a, off, nil
+	case 14: // boolean, the value is the size
+		return size != 0, off, nil
+	}
+	return nil, 0, errMMDBCorrupt
+}
+
+func mmdbUint(v interface{}) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
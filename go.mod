@@ -3,3 +3,8 @@ module rerouter
 go 1.22.0
 
 require github.com/joho/godotenv v1.5.1
+
+require (
+	golang.org/x/net v0.25.0
+	golang.org/x/text v0.15.0 // indirect
+)
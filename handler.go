@@ -1,26 +1,39 @@
-package main
+package rerouter
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"path"
 	"path/filepath"
 	"rerouter/logger"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type purgeResult struct {
-	Deleted int      `json:"deleted"`
-	Files   []string `json:"files"`
+	Deleted   int            `json:"deleted"`
+	Files     []string       `json:"files"`
+	ByPattern map[string]int `json:"by_pattern,omitempty"`
+	ByTag     map[string]int `json:"by_tag,omitempty"`
+	// RewarmQueued counts purged URLs handed to the Prefetcher (rewarm=1).
+	RewarmQueued int `json:"rewarm_queued,omitempty"`
+	urls         []string
 }
 
-func doPurge(cfg *Config, q string, partial bool) (purgeResult, error) {
+// doPurge removes the cache entries of q, a path or URL on B: with partial,
+// every URL containing q; otherwise the URL itself with its vary variants and,
+// when q has no query string, its query-string variants (only those matching
+// query, when set). A partial purge only takes entries on the hosts of sc.
+func doPurge(cfg *Config, q string, partial bool, query string, sc *tenantScope) (purgeResult, error) {
 	res := purgeResult{}
 	// If q is a path, convert to absolute on B-site
 	fullURL := q
@@ -37,71 +50,338 @@ func doPurge(cfg *Config, q string, partial bool) (purgeResult, error) {
 		if perr != nil {
 			return res, perr
 		}
-		if _, err := os.Stat(p); err == nil {
-			if err := os.Remove(p); err == nil {
-				res.Deleted = 1
-				res.Files = append(res.Files, filepath.Base(p))
+		// The default entry and every vary variant of the URL
+		for _, f := range append([]string{p}, cacheVariantFiles(p)...) {
+			if err := removeCacheFile(cfg.CacheDir, f); err == nil {
+				res.Deleted++
+				res.Files = append(res.Files, filepath.Base(f))
 			}
 		}
-	} else {
-		files, _ := walkCacheJSONFiles(cfg.CacheDir)
-		for _, p := range files {
-			b, err := os.ReadFile(p)
-			if err != nil {
-				continue
+		if res.Deleted > 0 {
+			res.urls = append(res.urls, fullURL)
+		}
+		// Bots may hold ?color=red variants of the same page
+		if u, err := url.Parse(fullURL); err == nil && u.RawQuery == "" {
+			files, urls := cacheQueryVariants(p, query)
+			seen := map[string]bool{}
+			for i, f := range files {
+				if err := removeCacheFile(cfg.CacheDir, f); err != nil {
+					continue
+				}
+				res.Deleted++
+				res.Files = append(res.Files, filepath.Base(f))
+				if !seen[urls[i]] {
+					seen[urls[i]] = true
+					res.urls = append(res.urls, urls[i])
+				}
 			}
-			var ce cacheEntry
-			if err := json.Unmarshal(b, &ce); err != nil {
-				continue
+		}
+		// Variants other instances uploaded are only in the bucket
+		if rc := remoteCacheFor(cfg.CacheDir); rc != nil {
+			if dir, ok := rc.key(filepath.Dir(p)); ok {
+				rc.purgeMatching(dir, func(ce *cacheEntry) bool { return purgeCoversURL(ce.URL, fullURL, query) })
 			}
-			if strings.Contains(ce.URL, q) || strings.Contains(ce.URL, fullURL) {
-				if err := os.Remove(p); err == nil {
+		}
+	} else {
+		ix := cacheIndexFor(cfg.CacheDir)
+		for _, e := range ix.snapshot() {
+			if (strings.Contains(e.URL, q) || strings.Contains(e.URL, fullURL)) && sc.allowsURL(e.URL) {
+				p := ix.path(e)
+				if err := removeCacheFile(cfg.CacheDir, p); err == nil {
 					res.Deleted++
 					res.Files = append(res.Files, p)
+					res.urls = append(res.urls, e.URL)
 				}
 			}
 		}
+		if rc := remoteCacheFor(cfg.CacheDir); rc != nil {
+			rc.purgeMatching("", func(ce *cacheEntry) bool {
+				return (strings.Contains(ce.URL, q) || strings.Contains(ce.URL, fullURL)) && sc.allowsURL(ce.URL)
+			})
+		}
 	}
 	return res, nil
 }
 
-func buildHandler(cfg *Config) http.Handler {
-	client := &http.Client{Timeout: 15 * time.Second}
+// purgeCoversURL reports whether an exact purge of fullURL (with query
+// filter query) takes the entry of rawURL: the URL itself and, when fullURL
+// has no query string, its query-string variants.
+func purgeCoversURL(rawURL, fullURL, query string) bool {
+	if rawURL == fullURL {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.RawQuery == "" || strings.Contains(fullURL, "?") {
+		return false
+	}
+	rawQuery := u.RawQuery
+	u.RawQuery = ""
+	return u.String() == fullURL && (query == "" || queryMatches(query, rawQuery))
+}
+
+// rewarmPurged enqueues purged URLs for prefetch so the next bot hit is served
+// from cache, ahead of opportunistic warms. a_base_url overrides the A base
+// derived from the admin request. It returns how many URLs were queued; the
+// rest were dropped on a queue full of other rewarms.
+func rewarmPurged(cfg *Config, pf *Prefetcher, r *http.Request, urls []string) int {
+	aBase := strings.TrimSpace(r.FormValue("a_base_url"))
+	if aBase == "" {
+		aBase = deriveABaseURL(cfg, r).String()
+	}
+	queued := 0
+	for _, u := range urls {
+		// Rewarming has no end client to forward
+		if pf.enqueue(prefetchJob{target: u, aBase: aBase, priority: prefetchHigh}) {
+			queued++
+		}
+	}
+	return queued
+}
+
+// appHandler is the root handler plus the background workers it owns. Routes
+// are built from one Config snapshot and swapped atomically when the config
+// changes; the workers, upstream client and miss coalescing outlive swaps.
+type appHandler struct {
+	pf         *Prefetcher
+	remote     *remoteCache // bucket mirror of the cache dir, or nil
+	cacheCheck *cacheChecker
+	warmMgr    *sitemapWarmManager
+	client     *http.Client
+	missFlight flightGroup
+	routes     atomic.Pointer[appRoutes]
+	// Failed admin logins per client IP, kept across config swaps.
+	adminLockout *authLockout
+	// Admin UI login sessions, kept across config swaps.
+	adminSessions *adminSessions
+	// Retries and circuit breakers shared by all upstream clients.
+	upstream *resilientTransport
+	// Bot UA and client IP lists, kept across config swaps so a failed reload
+	// keeps the previous lists.
+	botUA    *botUAMatcher
+	botCIDRs *botCIDRLists
+	// Per-bot-family traffic and cache hit counters, kept across config swaps.
+	botStats   *botStats
+	badBots    *badBotCounter
+	challenge  *challenger
+	cacheStats *cacheStats
+	// Recent purges listed by /admin/purges.
+	purges *purgeLog
+	audit  *auditLog
+	// Upstream probes of /readyz.
+	prober *readyProber
+	// Start time reported by /admin/status.
+	startedAt time.Time
+	// Serializes config changes (read-modify-apply).
+	reloadMu sync.Mutex
+}
+
+// appRoutes pairs a config snapshot with the handlers built from it.
+type appRoutes struct {
+	cfg      *Config
+	handlers map[listenerRole]http.Handler
+}
+
+// ServeHTTP serves public and admin routes alike.
+func (a *appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.serveRole(listenerAll, w, r)
+}
+
+// handlerFor returns the handler of listeners with role; it follows config swaps.
+func (a *appHandler) handlerFor(role listenerRole) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.serveRole(role, w, r)
+	})
+}
+
+// serveRole serves r with the current routes of role and records the client
+// for the access log as their config's trusted proxies resolve it.
+func (a *appHandler) serveRole(role listenerRole, w http.ResponseWriter, r *http.Request) {
+	rt := a.routes.Load()
+	if n := accessNoteFrom(r.Context()); n != nil {
+		n.remote = accessRemote(rt.cfg, r)
+	}
+	rt.handlers[role].ServeHTTP(w, r)
+}
+
+// config returns the effective configuration.
+func (a *appHandler) config() *Config {
+	return a.routes.Load().cfg
+}
+
+// applyConfig makes cfg the effective configuration: the workers and bot lists
+// pick it up and the routes are rebuilt and swapped in. Requests already being
+// served finish with the config they started with.
+func (a *appHandler) applyConfig(cfg *Config) {
+	cfg.transformers = buildTransformChain(cfg)
+	cfg.botUA, cfg.botCIDRs = a.botUA, a.botCIDRs
+	a.pf.setConfig(cfg)
+	a.warmMgr.setConfig(cfg)
+	if _, _, err := reloadBotUA(cfg); err != nil {
+		logger.Warnw("bot_ua_load_error", map[string]interface{}{"err": err.Error(), "file": cfg.BotUAFile})
+	}
+	if err := reloadBotCIDRs(cfg); err != nil {
+		logger.Warnw("bot_cidr_load_error", map[string]interface{}{"err": err.Error(), "file": cfg.BotAllowCIDRFile})
+	}
+	if err := loadTrustedProxies(cfg); err != nil {
+		logger.Warnw("trusted_proxies_error", map[string]interface{}{"err": err.Error()})
+	}
+	a.routes.Store(&appRoutes{cfg: cfg, handlers: a.buildRoutes(cfg)})
+}
+
+// Shutdown stops the cache integrity scans and prefetch workers and
+// interrupts sitemap warm jobs,
+// persisting their progress and the bot stats, then flushes pending bucket
+// uploads. It returns ctx.Err() if draining takes too long.
+func (a *appHandler) Shutdown(ctx context.Context) error {
+	if err := a.botStats.save(a.config().CacheDir); err != nil {
+		logger.Warnw("bot_stats_save_error", map[string]interface{}{"err": err.Error()})
+	}
+	a.cacheCheck.close()
+	errPf := a.pf.Stop(ctx)
+	if err := a.warmMgr.Shutdown(ctx); err != nil {
+		return err
+	}
+	if a.remote != nil {
+		// After the workers, so the entries they wrote are uploaded too
+		if err := a.remote.close(ctx); err != nil {
+			return err
+		}
+	}
+	return errPf
+}
+
+func buildHandler(cfg *Config) *appHandler {
+	a := newAppHandler(cfg)
+	a.resumeWarmJobs()
+	return a
+}
+
+// resumeWarmJobs restarts the warm jobs a previous process left unfinished.
+func (a *appHandler) resumeWarmJobs() {
+	if n := a.warmMgr.ResumePersistedJobs(); n > 0 {
+		logger.Infow("sitemap_cache_jobs_resumed", map[string]interface{}{"count": n})
+	}
+}
+
+// newAppHandler builds the handler chain and starts the background workers,
+// without resuming persisted warm jobs.
+func newAppHandler(cfg *Config) *appHandler {
+	// All upstream traffic (bot fetches, prefetch, sitemap warming) shares one
+	// limiter and one set of circuit breakers; each retry takes a limiter slot
+	a := &appHandler{startedAt: time.Now(), adminLockout: newAuthLockout(), adminSessions: newAdminSessions(), botUA: &botUAMatcher{}, botCIDRs: &botCIDRLists{}, botStats: loadBotStats(cfg.CacheDir), badBots: newBadBotCounter(), challenge: newChallenger(), cacheStats: newCacheStats(), purges: &purgeLog{}, audit: &auditLog{}}
+	base, err := newUpstreamTransport(cfg)
+	if err != nil {
+		// LoadConfig validated these settings; only a CA file changed since can fail
+		logger.Errorw("upstream_transport_error", map[string]interface{}{"err": err.Error()})
+		base = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	liveConfig := func() *Config {
+		if rt := a.routes.Load(); rt != nil {
+			return rt.cfg
+		}
+		return cfg
+	}
+	origin := &authTransport{base: &hostOverrideTransport{base: base, cfg: liveConfig}, cfg: liveConfig}
+	a.upstream = &resilientTransport{
+		base: &limitedTransport{
+			lim:  newUpstreamLimiter(cfg.UpstreamMaxConcurrent, cfg.UpstreamMaxRPS),
+			base: origin,
+		},
+		cfg: liveConfig,
+	}
+	if cfg.CacheS3URL != "" {
+		if a.remote, err = newRemoteCache(cfg); err != nil {
+			logger.Errorw("cache_s3_error", map[string]interface{}{"err": err.Error()})
+		} else {
+			go a.remote.hydrate()
+		}
+	}
+	a.prober = &readyProber{client: &http.Client{Timeout: readyUpstreamTimeout, Transport: origin}}
+	traced := &tracingTransport{base: a.upstream}
+	a.client = &http.Client{Timeout: upstreamTimeout(cfg), Transport: traced}
+	a.client.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
+		return upstreamCheckRedirect(a.config(), via)
+	}
 	// Start background prefetcher for human-triggered warming
-	pf := NewPrefetcher(cfg)
-	pf.Start(2)
-	sitemapClient := newSitemapHTTPClient(30*time.Second, cfg.UpstreamUserAgent)
-	warmMgr := newSitemapWarmManager(cfg, pf, sitemapClient)
+	a.pf = NewPrefetcher(cfg, traced)
+	a.pf.Start(cfg.PrefetchWorkers)
+	sitemapClient := newSitemapHTTPClientWithTransport(sitemapFetchTimeout(cfg), func() string {
+		return upstreamUserAgent(liveConfig(), nil)
+	}, traced)
+	a.warmMgr = newSitemapWarmManager(cfg, a.pf, sitemapClient)
+	a.warmMgr.StartSchedules(cfg.SitemapWarmSchedules)
+	a.applyConfig(cfg)
+	a.cacheCheck = newCacheChecker()
+	go a.cacheCheck.run(a.config)
+	return a
+}
+
+// buildRoutes builds the request handlers for one config snapshot, one per
+// listener role.
+func (a *appHandler) buildRoutes(cfg *Config) map[listenerRole]http.Handler {
+	client, pf, warmMgr, missFlight := a.client, a.pf, a.warmMgr, &a.missFlight
 	mux := http.NewServeMux()
+	// Admin API and UI; listeners without the admin role never reach it
+	adminMux := http.NewServeMux()
 
 	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		cfg := upstreamConfigForRequest(cfg, r)
+		audience := headerAudienceHuman
+		bot := detectBot(cfg, r)
+		if bot {
+			audience = headerAudienceBot
+		}
+		w = withHeaderRules(cfg, w, r, audience)
+		w, done := a.trackStats(cfg, w, r, bot)
+		defer done()
+		if serveLocalRobotsTxt(cfg, w, r) {
+			return
+		}
 		target := strings.TrimRight(cfg.BBaseURL, "/") + "/robots.txt"
-		if ce, err := readCacheByURL(cfg.CacheDir, target); err == nil && ce.Status == http.StatusOK {
+		bypass := requestBypassCookie(cfg, r)
+		if bypass != "" {
+			// Personalized request: neither served from nor stored in the shared cache
+			w.Header().Set("X-Cache", "BYPASS")
+			logger.Debugw("cache_bypass", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "cookie": bypass})
+		} else if ce, err := readCacheByURL(cfg.CacheDir, target); err == nil && ce.Status == http.StatusOK {
 			// Re-rewrite with current A if needed
 			aURL := deriveABaseURL(cfg, r)
 			bURL, _ := url.Parse(cfg.BBaseURL)
 			body := ce.Body
-			if nb, rw := rewriteBToA(body, aURL, bURL); rw {
+			if nb, rw := newURLRewriter(cfg, aURL, bURL).bToA(body); rw {
 				// Drop validators if present
 				w.Header().Set("X-Cache", "HIT")
 				setCacheMetaHeaders(w, ce)
 				w.Header().Set("Content-Type", ce.Header["Content-Type"])
-				w.WriteHeader(ce.Status)
-				_, _ = w.Write(nb)
+				serveBody(w, r, ce.Status, nb)
 				return
 			}
-			serveFromCache(w, ce)
+			serveFromCache(w, r, ce)
 			return
 		}
-		req, _ := http.NewRequest(http.MethodGet, target, nil)
-		req.Header.Set("User-Agent", cfg.UpstreamUserAgent)
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+		req.Header.Set("User-Agent", upstreamUserAgent(cfg, r))
+		clientForwardFor(cfg, r).apply(cfg, req)
+		var stale *cacheEntry
+		if bypass == "" {
+			stale = staleForRevalidation(cfg.CacheDir, target, "")
+		}
+		setConditionalHeaders(req, stale)
 		resp, err := client.Do(req)
 		if err != nil {
 			logger.Errorw("robots_fetch_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
-			http.Error(w, "upstream fetch error", http.StatusBadGateway)
+			writeUpstreamError(cfg, w, r, err)
 			return
 		}
 		defer resp.Body.Close()
+		if stale != nil && resp.StatusCode == http.StatusNotModified {
+			ttl, _ := cacheTTLFor(cfg, "/robots.txt", stale.Status, resp.Header)
+			if err := extendCacheEntry(cfg.CacheDir, target, stale, ttl); err != nil {
+				logger.Warnw("cache_write_error", map[string]interface{}{"err": err.Error(), "url": target, "req_id": getRequestID(r.Context())})
+			}
+			serveFromCache(w, r, stale)
+			return
+		}
 		body, _ := io.ReadAll(resp.Body)
 		ct := resp.Header.Get("Content-Type")
 		if ct == "" {
@@ -109,7 +389,7 @@ func buildHandler(cfg *Config) http.Handler {
 		}
 		aURL := deriveABaseURL(cfg, r)
 		bURL, _ := url.Parse(cfg.BBaseURL)
-		body, rewrote := rewriteBToA(body, aURL, bURL)
+		body, rewrote := newURLRewriter(cfg, aURL, bURL).bToA(body)
 		headers := map[string]string{"Content-Type": ct}
 		if !rewrote {
 			if v := resp.Header.Get("Last-Modified"); v != "" {
@@ -119,44 +399,43 @@ func buildHandler(cfg *Config) http.Handler {
 				headers["ETag"] = v
 			}
 		}
-		if resp.StatusCode == http.StatusOK {
-			ttl := cacheTTLForPath(cfg, "/robots.txt")
-			ce := &cacheEntry{URL: target, CreatedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second).Unix(), Status: resp.StatusCode, Header: headers, Body: body}
+		ttl, cacheable := cacheTTLFor(cfg, "/robots.txt", resp.StatusCode, resp.Header)
+		if resp.StatusCode == http.StatusOK && cacheable && bypass == "" && previewFrom(r.Context()) == nil {
+			ce := &cacheEntry{URL: target, CreatedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second).Unix(), Status: resp.StatusCode, Header: headers, Body: body, BodyEncoding: cacheBodyEncoding(cfg, headers["Content-Type"]), Tags: cacheTagsFor(cfg, "/robots.txt", resp.Header)}
+			setUpstreamValidators(ce, resp.Header)
 			if err := writeCacheByURL(cfg.CacheDir, target, ce); err != nil {
 				logger.Warnw("cache_write_error", map[string]interface{}{"err": err.Error(), "url": target, "req_id": getRequestID(r.Context())})
 			} else {
 				logger.Debugw("cache_store", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "ttl_seconds": ttl})
 			}
 		}
-		w.Header().Set("X-Cache", "MISS")
+		if w.Header().Get("X-Cache") == "" {
+			w.Header().Set("X-Cache", "MISS")
+		}
 		for k, v := range headers {
 			w.Header().Set(k, v)
 		}
-		w.WriteHeader(resp.StatusCode)
-		if len(body) > 0 {
-			_, _ = w.Write(body)
-		}
+		serveBody(w, r, resp.StatusCode, body)
 	})
 
+	// Liveness: the process serves requests
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
 
+	// Readiness: cache dir, B site and prefetch queue are usable
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		a.handleReadyz(cfg, w, r)
+	})
+
 	// Admin purge endpoint: POST/DELETE /admin/purge?url=...&partial=1
-	mux.HandleFunc("/admin/purge", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.AdminToken == "" {
-			http.Error(w, "admin disabled: set ADMIN_TOKEN", http.StatusForbidden)
-			return
-		}
-		token := r.Header.Get("X-Admin-Token")
-		if token == "" {
-			token = r.URL.Query().Get("token")
-		}
-		if token != cfg.AdminToken {
-			http.Error(w, "forbidden", http.StatusForbidden)
+	// or bulk: ?pattern=/blog/*&older_than=24h, ?tag=products
+	adminMux.HandleFunc("/admin/purge", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
 			return
 		}
+		sc := adminTenantScope(cfg, r, adminRequestToken(r))
 
 		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -168,61 +447,271 @@ func buildHandler(cfg *Config) http.Handler {
 			q = r.FormValue("q")
 		}
 		partial := r.FormValue("partial") == "1" || strings.ToLower(r.FormValue("partial")) == "true"
-		// Support JSON body: {"url":"...","partial":true}
-		if q == "" && strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		var patterns []string
+		for _, v := range r.Form["pattern"] {
+			patterns = append(patterns, splitCommaList(v)...)
+		}
+		var tags []string
+		for _, v := range r.Form["tag"] {
+			tags = append(tags, splitCommaList(v)...)
+		}
+		olderThan := r.FormValue("older_than")
+		rewarm := r.FormValue("rewarm") == "1" || strings.ToLower(r.FormValue("rewarm")) == "true"
+		// Limits which query-string variants an exact purge takes, e.g. "color=*"
+		query := r.FormValue("query")
+		// Support JSON body: {"url":"...","partial":true,"query":"color=*"}, {"patterns":["/blog/*"],"older_than":"24h"} or {"tags":["products"]}
+		if q == "" && len(patterns) == 0 && len(tags) == 0 && olderThan == "" && strings.Contains(r.Header.Get("Content-Type"), "application/json") {
 			var body struct {
-				URL     string `json:"url"`
-				Partial bool   `json:"partial"`
+				URL       string   `json:"url"`
+				Partial   bool     `json:"partial"`
+				Patterns  []string `json:"patterns"`
+				Tags      []string `json:"tags"`
+				OlderThan string   `json:"older_than"`
+				Rewarm    bool     `json:"rewarm"`
+				Query     string   `json:"query"`
 			}
 			b, _ := io.ReadAll(r.Body)
 			_ = json.Unmarshal(b, &body)
 			q = body.URL
 			partial = partial || body.Partial
+			patterns = body.Patterns
+			tags = body.Tags
+			olderThan = body.OlderThan
+			rewarm = rewarm || body.Rewarm
+			query = body.Query
+		}
+		if q == "" && (len(patterns) > 0 || len(tags) > 0 || olderThan != "") {
+			f := bulkPurgeFilter{Patterns: patterns, Tags: tags, Scope: sc}
+			if olderThan != "" {
+				d, err := parseAgeDuration(olderThan)
+				if err != nil {
+					http.Error(w, "invalid older_than", http.StatusBadRequest)
+					return
+				}
+				f.OlderThan = d
+			}
+			res := doBulkPurge(cfg, f)
+			if rewarm {
+				res.RewarmQueued = rewarmPurged(cfg, pf, r, res.urls)
+			}
+			a.purges.record("admin", f.describe(), res)
+			auditNote(r, map[string]interface{}{"patterns": patterns, "tags": tags, "older_than": olderThan, "rewarm": rewarm}, map[string]interface{}{"deleted": res.Deleted, "rewarm_queued": res.RewarmQueued})
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(res)
+			logger.Infow("admin_purge_bulk", map[string]interface{}{
+				"req_id":     getRequestID(r.Context()),
+				"patterns":   patterns,
+				"tags":       tags,
+				"older_than": olderThan,
+				"deleted":    res.Deleted,
+				"rewarm":     res.RewarmQueued,
+			})
+			return
 		}
 		if q == "" {
 			http.Error(w, "missing url", http.StatusBadRequest)
 			return
 		}
-		res, perr := doPurge(cfg, q, partial)
+		if _, err := path.Match(query, ""); err != nil {
+			http.Error(w, "invalid query pattern", http.StatusBadRequest)
+			return
+		}
+		if !partial && !sc.allowsURL(resolveBTarget(cfg, q)) {
+			errOutsideTenants(w)
+			return
+		}
+		res, perr := doPurge(cfg, q, partial, query, sc)
 		if perr != nil {
 			http.Error(w, "invalid url", http.StatusBadRequest)
 			return
 		}
+		if rewarm {
+			res.RewarmQueued = rewarmPurged(cfg, pf, r, res.urls)
+		}
 
+		a.purges.record("admin", q, res)
+		auditNote(r, map[string]interface{}{"url": q, "partial": partial, "query": query, "rewarm": rewarm}, map[string]interface{}{"deleted": res.Deleted, "rewarm_queued": res.RewarmQueued})
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(res)
 		logger.Infow("admin_purge", map[string]interface{}{
-			"req_id":  getRequestID(r.Context()),
-			"partial": partial,
-			"query":   q,
-			"deleted": res.Deleted,
+			"req_id":        getRequestID(r.Context()),
+			"partial":       partial,
+			"query":         q,
+			"query_pattern": query,
+			"deleted":       res.Deleted,
+			"rewarm":        res.RewarmQueued,
 		})
 	})
 
-	mux.HandleFunc("/admin/sitemap-cache/status", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.AdminToken == "" {
-			http.Error(w, "admin disabled: set ADMIN_TOKEN", http.StatusForbidden)
+	// Admin bot UA lists: GET shows configured lists, POST /admin/bot-ua/reload re-reads BOT_UA_FILE and BOT_ALLOW_CIDR_FILE
+	adminMux.HandleFunc("/admin/bot-ua", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
 			return
 		}
 		if r.Method != http.MethodGet {
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
-		token := r.Header.Get("X-Admin-Token")
-		if token == "" {
-			token = r.URL.Query().Get("token")
+		include, exclude := cfg.botUA.lists()
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"include": include, "exclude": exclude, "file": cfg.BotUAFile})
+	})
+
+	adminMux.HandleFunc("/admin/bot-ua/reload", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		include, exclude, err := reloadBotUA(cfg)
+		if err != nil {
+			logger.Warnw("bot_ua_reload_error", map[string]interface{}{"err": err.Error(), "file": cfg.BotUAFile, "req_id": getRequestID(r.Context())})
+			http.Error(w, "reload failed", http.StatusInternalServerError)
+			return
 		}
-		if token != cfg.AdminToken {
-			http.Error(w, "forbidden", http.StatusForbidden)
+		if err := reloadBotCIDRs(cfg); err != nil {
+			logger.Warnw("bot_cidr_reload_error", map[string]interface{}{"err": err.Error(), "file": cfg.BotAllowCIDRFile, "req_id": getRequestID(r.Context())})
+			http.Error(w, "reload failed", http.StatusInternalServerError)
+			return
+		}
+		allowN, denyN := cfg.botCIDRs.counts()
+		logger.Infow("bot_ua_reloaded", map[string]interface{}{"req_id": getRequestID(r.Context()), "include": len(include), "exclude": len(exclude), "allow_cidrs": allowN, "deny_cidrs": denyN, "source": "admin"})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"include": include, "exclude": exclude, "allow_cidrs": allowN, "deny_cidrs": denyN})
+	})
+
+	adminMux.HandleFunc("/admin/robots-txt", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminRobotsTxt(upstreamConfigForRequest(cfg, r), w, r)
+	})
+
+	adminMux.HandleFunc("/admin/cache/list", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminCacheList(cfg, w, r, adminTenantScope(cfg, r, adminRequestToken(r)))
+	})
+
+	adminMux.HandleFunc("/admin/cache/entry", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminCacheEntry(cfg, w, r, adminTenantScope(cfg, r, adminRequestToken(r)))
+	})
+
+	mux.HandleFunc("/webhooks/purge", func(w http.ResponseWriter, r *http.Request) {
+		handleWebhookPurge(upstreamConfigForRequest(cfg, r), pf, a.purges, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/config", a.handleAdminConfig)
+
+	adminMux.HandleFunc("/admin/stats/bots", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
 			return
 		}
+		a.botStats.handleAdminBotStats(w, r)
+	})
+
+	adminMux.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		a.handleAdminStatus(cfg, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/audit", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		a.audit.handleAdminAudit(cfg, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/preview", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminPreview(cfg, mux, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/rewrite-test", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		a.handleAdminRewriteTest(cfg, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/purges", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		a.purges.handleAdminPurges(w, r)
+	})
+
+	adminMux.HandleFunc("/admin/stats/cache", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		a.cacheStats.handleAdminCacheStats(w, r, adminTenantScope(cfg, r, adminRequestToken(r)))
+	})
+
+	adminMux.HandleFunc("/admin/cache/reindex", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n := cacheIndexFor(cfg.CacheDir).rebuild()
+		auditNote(r, nil, map[string]interface{}{"entries": n})
+		logger.Infow("cache_index_rebuilt", map[string]interface{}{"req_id": getRequestID(r.Context()), "entries": n})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"entries": n})
+	})
+
+	adminMux.HandleFunc("/admin/cache/export", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminCacheExport(cfg, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/cache/import", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminCacheImport(cfg, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/sitemap-cache/stream", a.handleSitemapWarmStream)
+
+	adminMux.HandleFunc("/admin/warm", func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		handleAdminWarm(cfg, warmMgr, w, r)
+	})
+
+	adminMux.HandleFunc("/admin/sitemap-cache/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !adminAuthorized(cfg, w, r) {
+			return
+		}
+		sc := adminTenantScope(cfg, r, adminRequestToken(r))
 		jobID := r.URL.Query().Get("job")
 		if jobID == "" {
 			jobID = r.URL.Query().Get("job_id")
 		}
 		w.Header().Set("Content-Type", "application/json")
 		if jobID != "" {
-			if job, ok := warmMgr.GetJob(jobID); ok {
+			if job, ok := warmMgr.GetJob(jobID); ok && sc.allowsTenant(job.Tenant) {
 				_ = json.NewEncoder(w).Encode(job.snapshot())
 				return
 			}
@@ -232,13 +721,15 @@ func buildHandler(cfg *Config) http.Handler {
 		jobs := warmMgr.ListJobs()
 		statuses := make([]sitemapWarmJobStatus, 0, len(jobs))
 		for _, job := range jobs {
-			statuses = append(statuses, job.snapshot())
+			if sc.allowsTenant(job.Tenant) {
+				statuses = append(statuses, job.snapshot())
+			}
 		}
 		_ = json.NewEncoder(w).Encode(map[string]interface{}{"jobs": statuses})
 	})
 
-	mux.HandleFunc("/admin/sitemap-cache", func(w http.ResponseWriter, r *http.Request) {
-		if cfg.AdminToken == "" {
+	adminMux.HandleFunc("/admin/sitemap-cache", func(w http.ResponseWriter, r *http.Request) {
+		if !cfg.adminEnabled() {
 			http.Error(w, "admin disabled: set ADMIN_TOKEN", http.StatusForbidden)
 			return
 		}
@@ -247,15 +738,16 @@ func buildHandler(cfg *Config) http.Handler {
 			return
 		}
 
-		token := r.Header.Get("X-Admin-Token")
-		if token == "" {
-			token = r.URL.Query().Get("token")
-		}
+		token := adminRequestToken(r)
 		var body struct {
 			SitemapURL string `json:"sitemap_url"`
 			MaxURLs    int    `json:"max_urls"`
 			ABaseURL   string `json:"a_base_url"`
 			Token      string `json:"token"`
+			// "crawl" follows links from StartURL instead of reading a sitemap
+			Mode     string `json:"mode"`
+			StartURL string `json:"start_url"`
+			MaxDepth int    `json:"max_depth"`
 		}
 
 		if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
@@ -276,32 +768,60 @@ func buildHandler(cfg *Config) http.Handler {
 				body.MaxURLs = n
 			}
 			body.ABaseURL = r.FormValue("a_base_url")
+			body.Mode = r.FormValue("mode")
+			body.StartURL = r.FormValue("start_url")
+			if v := r.FormValue("max_depth"); v != "" {
+				fmt.Sscanf(v, "%d", &body.MaxDepth)
+			}
 		}
 		if body.Token != "" {
 			token = body.Token
 		}
-		if token != cfg.AdminToken {
-			http.Error(w, "forbidden", http.StatusForbidden)
+		if !checkAdmin(cfg, w, r, token) {
 			return
 		}
+		sc := adminTenantScope(cfg, r, token)
 
-		body.SitemapURL = strings.TrimSpace(body.SitemapURL)
-		if body.SitemapURL == "" {
-			http.Error(w, "missing sitemap_url", http.StatusBadRequest)
-			return
-		}
-
-		job, err := warmMgr.StartJob(body.SitemapURL, body.MaxURLs, body.ABaseURL)
-		if err != nil {
-			http.Error(w, "failed to start job", http.StatusBadRequest)
+		var job *sitemapWarmJob
+		var err error
+		switch body.Mode {
+		case warmModeCrawl:
+			if !sc.allowsHost(warmJobBHost(cfg, strings.TrimSpace(body.StartURL))) {
+				errOutsideTenants(w)
+				return
+			}
+			job, err = warmMgr.StartCrawlJob(strings.TrimSpace(body.StartURL), body.MaxURLs, body.MaxDepth, body.ABaseURL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case "", warmModeSitemap:
+			body.SitemapURL = strings.TrimSpace(body.SitemapURL)
+			if body.SitemapURL == "" {
+				http.Error(w, "missing sitemap_url", http.StatusBadRequest)
+				return
+			}
+			if !sc.allowsHost(warmJobBHost(cfg, body.SitemapURL)) {
+				errOutsideTenants(w)
+				return
+			}
+			job, err = warmMgr.StartJob(body.SitemapURL, body.MaxURLs, body.ABaseURL)
+			if err != nil {
+				http.Error(w, "failed to start job", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "invalid mode (want sitemap or crawl)", http.StatusBadRequest)
 			return
 		}
+		auditNote(r, map[string]interface{}{"mode": job.mode(), "sitemap_url": job.SitemapURL, "max_urls": body.MaxURLs, "max_depth": body.MaxDepth, "a_base_url": body.ABaseURL}, map[string]interface{}{"job_id": job.ID})
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusAccepted)
 		resp := map[string]interface{}{
 			"job_id":      job.ID,
-			"state":       string(job.State),
+			"state":       job.snapshot().State,
 			"sitemap_url": job.SitemapURL,
+			"mode":        job.mode(),
 			"status_url":  "/admin/sitemap-cache/status?job=" + url.QueryEscape(job.ID),
 		}
 		if err := json.NewEncoder(w).Encode(resp); err != nil {
@@ -309,14 +829,19 @@ func buildHandler(cfg *Config) http.Handler {
 		}
 	})
 
-	// Admin UI page to purge cache at a long hashed path
-	if cfg.AdminToken != "" && cfg.AdminUIPath != "" {
-		mux.HandleFunc(cfg.AdminUIPath, func(w http.ResponseWriter, r *http.Request) {
+	// Admin dashboard at a long hashed path; it also takes the form posts of
+	// the former single-page admin tools
+	if cfg.adminEnabled() && cfg.AdminUIPath != "" {
+		adminMux.HandleFunc(cfg.AdminUIPath, func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Cache-Control", "no-store")
 			switch r.Method {
 			case http.MethodGet:
 				w.Header().Set("Content-Type", "text/html; charset=utf-8")
-				_, _ = w.Write([]byte(adminUIHTML()))
+				if sess := adminSessionFrom(r.Context()); sess != nil {
+					_, _ = w.Write([]byte(adminUIHTML(cfg.AdminUIPath, sess.csrf)))
+					return
+				}
+				_, _ = w.Write([]byte(adminLoginHTML(cfg.AdminUIPath)))
 			case http.MethodPost:
 				_ = r.ParseForm()
 				formType := r.FormValue("form")
@@ -324,20 +849,21 @@ func buildHandler(cfg *Config) http.Handler {
 				if token == "" {
 					token = r.FormValue("password")
 				}
-				if token != cfg.AdminToken {
-					http.Error(w, "forbidden", http.StatusForbidden)
+				if !checkAdmin(cfg, w, r, token) {
 					return
 				}
 				switch formType {
 				case "purge":
 					urlQ := r.FormValue("url")
 					partial := r.FormValue("partial") == "1" || strings.ToLower(r.FormValue("partial")) == "true" || r.FormValue("partial") == "on"
-					res, err := doPurge(cfg, urlQ, partial)
+					res, err := doPurge(cfg, urlQ, partial, r.FormValue("query"), nil)
 					w.Header().Set("Content-Type", "text/html; charset=utf-8")
 					if err != nil {
 						_, _ = w.Write([]byte("<p>Invalid URL</p>"))
 						return
 					}
+					a.purges.record("admin_ui", urlQ, res)
+					auditNote(r, nil, map[string]interface{}{"deleted": res.Deleted})
 					logger.Infow("admin_purge_ui", map[string]interface{}{"req_id": getRequestID(r.Context()), "partial": partial, "query": urlQ, "deleted": res.Deleted})
 					_, _ = w.Write([]byte(renderPurgeResultHTML(urlQ, partial, res)))
 				case "sitemap":
@@ -363,7 +889,32 @@ func buildHandler(cfg *Config) http.Handler {
 						"sitemap": sitemapURL,
 						"job_id":  job.ID,
 					})
-					_, _ = w.Write([]byte(renderSitemapJobQueuedHTML(job)))
+					auditNote(r, nil, map[string]interface{}{"job_id": job.ID})
+					_, _ = w.Write([]byte(renderSitemapJobQueuedHTML(job, token)))
+				case "crawl":
+					var maxURLs, maxDepth int
+					if v := r.FormValue("max_urls"); v != "" {
+						fmt.Sscanf(v, "%d", &maxURLs)
+					}
+					if v := r.FormValue("max_depth"); v != "" {
+						fmt.Sscanf(v, "%d", &maxDepth)
+					}
+					startURL := strings.TrimSpace(r.FormValue("start_url"))
+					job, err := warmMgr.StartCrawlJob(startURL, maxURLs, maxDepth, r.FormValue("a_base_url"))
+					w.Header().Set("Content-Type", "text/html; charset=utf-8")
+					if err != nil {
+						logger.Errorw("admin_sitemap_cache_ui_error", map[string]interface{}{"err": err.Error(), "start_url": startURL})
+						_, _ = w.Write([]byte("<p>Failed to start crawl: " + htmlEscape(err.Error()) + "</p>"))
+						return
+					}
+					logger.Infow("admin_sitemap_cache_queued", map[string]interface{}{
+						"req_id":    getRequestID(r.Context()),
+						"start_url": job.SitemapURL,
+						"mode":      warmModeCrawl,
+						"job_id":    job.ID,
+					})
+					auditNote(r, nil, map[string]interface{}{"job_id": job.ID})
+					_, _ = w.Write([]byte(renderSitemapJobQueuedHTML(job, token)))
 				default:
 					http.Error(w, "bad request", http.StatusBadRequest)
 				}
@@ -371,9 +922,23 @@ func buildHandler(cfg *Config) http.Handler {
 				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 			}
 		})
+		adminMux.HandleFunc(cfg.AdminUIPath+"/login", func(w http.ResponseWriter, r *http.Request) {
+			a.handleAdminLogin(cfg, w, r)
+		})
+		adminMux.HandleFunc(cfg.AdminUIPath+"/logout", func(w http.ResponseWriter, r *http.Request) {
+			a.handleAdminLogout(cfg, w, r)
+		})
 	}
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		cfg := upstreamConfigForRequest(cfg, r)
+		country := geoCountry(cfg, r)
+		if serveBlocked(cfg, w, r) || serveGeoBlocked(cfg, w, r, country) || a.serveBadBot(cfg, w, r) {
+			return
+		}
+		if serveMaintenance(cfg, w, r) {
+			return
+		}
 		if hasChineseAcceptLanguage(r.Header.Get("Accept-Language")) {
 			logger.Infow("accept_lang_redirect", map[string]interface{}{
 				"req_id": getRequestID(r.Context()),
@@ -383,14 +948,70 @@ func buildHandler(cfg *Config) http.Handler {
 			return
 		}
 
-		// Build target URL on B-site
-		target := strings.TrimRight(cfg.BBaseURL, "/") + r.URL.RequestURI()
+		// Build target URL on B-site, with the path mapped by a matching redirect rule
+		status := cfg.RedirectStatus
+		rule, bPath, ruled := redirectRuleFor(cfg, r.URL.Path)
+		if ruled && rule.Status != 0 {
+			status = rule.Status
+		}
+		reqURI := r.URL.RequestURI()
+		if bPath != r.URL.Path {
+			reqURI = (&url.URL{Path: bPath, RawQuery: r.URL.RawQuery}).RequestURI()
+		}
+		target := strings.TrimRight(cfg.BBaseURL, "/") + reqURI
 
-		// If human, redirect directly to B-site unless this is a sitemap path
-		if !isBot(r) && !isSitemapPath(r.URL.Path) {
+		// Humans are handled per HUMAN_RULES / HUMAN_MODE unless this is a sitemap path
+		bot := detectBot(cfg, r)
+		human := !bot && !isSitemapPath(r.URL.Path)
+		mode := humanModeRedirect
+		audience := headerAudienceBot
+		if human {
+			mode = humanModeFor(cfg, r.URL.Path)
+			audience = headerAudienceHuman
+		}
+		w = withHeaderRules(cfg, w, r, audience)
+		w, done := a.trackStats(cfg, w, r, bot)
+		defer done()
+		if human && mode == humanModeBlock {
+			logger.Infow("human_blocked", map[string]interface{}{
+				"req_id": getRequestID(r.Context()),
+				"path":   r.URL.Path,
+			})
+			http.NotFound(w, r)
+			return
+		}
+		// Spoofed browsers must pass a challenge before they are redirected or warm the cache
+		if human && a.challenge.required(cfg, r) {
+			a.challenge.serve(cfg, w, r)
+			return
+		}
+		// In cache mode humans continue to the bot path below
+		if human && mode != humanModeCache {
 			// Warm cache asynchronously (non-blocking)
 			a := deriveABaseURL(cfg, r)
-			pf.Enqueue(target, a.String())
+			pf.Enqueue(target, a.String(), clientForwardFor(cfg, r))
+			if mode == humanModeProxy {
+				// Transparent mirror: B is fetched through A, never cached for humans
+				logger.Infow("human_proxy", map[string]interface{}{
+					"req_id": getRequestID(r.Context()),
+					"target": target,
+				})
+				proxyBotRequest(cfg, client, w, r, target)
+				return
+			}
+			// Region mirror per GEO_RULES, else the visitor's pick of the weighted
+			// REDIRECT_TARGETS; the warm above still fetches BBaseURL
+			var assigned *RedirectTarget
+			sticky := false
+			if base := geoRedirectBase(cfg, country); base != "" {
+				target = strings.TrimRight(base, "/") + reqURI
+			} else if t, st, ok := pickRedirectTarget(cfg, r); ok {
+				assigned, sticky = &t, st
+				target = strings.TrimRight(t.BBaseURL, "/") + reqURI
+				if !sticky {
+					setRedirectTargetCookie(w, t)
+				}
+			}
 			redirectURL := target
 			if cfg.StaticRedirectURL != "" {
 				if staticURL, err := url.Parse(cfg.StaticRedirectURL); err == nil {
@@ -402,229 +1023,300 @@ func buildHandler(cfg *Config) http.Handler {
 					logger.Warnw("static_redirect_url_invalid", map[string]interface{}{"req_id": getRequestID(r.Context()), "url": cfg.StaticRedirectURL, "err": err.Error()})
 				}
 			}
-			logger.Infow("human_redirect", map[string]interface{}{
+			fields := map[string]interface{}{
 				"req_id":        getRequestID(r.Context()),
 				"target":        target,
 				"redirect_url":  redirectURL,
 				"static_bridge": cfg.StaticRedirectURL != "",
-			})
-			http.Redirect(w, r, redirectURL, cfg.RedirectStatus)
+				"status":        status,
+				"country":       country,
+			}
+			if assigned != nil {
+				// Experiment analysis: which arm the visitor got and whether it was new
+				fields["redirect_target"], fields["sticky"] = assigned.Name, sticky
+			}
+			logger.Infow("human_redirect", fields)
+			http.Redirect(w, r, redirectURL, status)
 			return
 		}
 
 		// Bots: fetch content from B-site (with caching)
 		methodCacheable := r.Method == http.MethodGet || r.Method == http.MethodHead
-		allowCache := cfg.CacheAll || patternsMatch(cfg.CachePatterns, r.URL.Path)
+		allowCache := cfg.CacheAll || patternsMatch(cfg.CachePatterns, r.URL.Path) || (cfg.CacheAssets && isStaticAssetPath(r.URL.Path))
+		if cookie := requestBypassCookie(cfg, r); cookie != "" && methodCacheable && allowCache {
+			// Personalized request: neither served from nor stored in the shared cache
+			allowCache = false
+			w.Header().Set("X-Cache", "BYPASS")
+			logger.Debugw("cache_bypass", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "cookie": cookie})
+		}
 		if methodCacheable && allowCache {
-			if ce, err := readCacheByURL(cfg.CacheDir, target); err == nil && ce.Status == http.StatusOK {
+			// Non-200 entries exist only when a status TTL rule allowed them
+			variant := requestCacheVariant(cfg, r)
+			setVaryHeader(cfg, w)
+			_, sp := startSpan(r.Context(), "cache.read", spanKindInternal)
+			ce, err := readCacheVariant(cfg.CacheDir, target, variant.key())
+			sp.setAttr("rerouter.cache_hit", err == nil && ce.Status > 0)
+			sp.finish()
+			if err == nil && ce.Status > 0 {
 				if isSitemapPath(r.URL.Path) {
 					// Ensure sitemap content is rewritten even if cache is from older version
 					aURL := deriveABaseURL(cfg, r)
 					bURL, _ := url.Parse(cfg.BBaseURL)
 					body := ce.Body
-					if nb, rw := rewriteBToA(body, aURL, bURL); rw {
+					if nb, rw := newURLRewriter(cfg, aURL, bURL).bToA(body); rw {
 						// Copy content-type only
 						w.Header().Set("X-Cache", "HIT")
 						setCacheMetaHeaders(w, ce)
 						if v := ce.Header["Content-Type"]; v != "" {
 							w.Header().Set("Content-Type", v)
 						}
-						w.WriteHeader(ce.Status)
-						_, _ = w.Write(nb)
+						serveBody(w, r, ce.Status, nb)
 						return
 					}
 				}
-				serveFromCache(w, ce)
+				serveFromCache(w, r, ce)
 				logger.Debugw("cache_hit", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target})
 				return
 			}
-			// miss or expired: fetch and populate cache
-			req, _ := http.NewRequest(r.Method, target, nil)
-			// Forward minimal headers to appear normal to origin
-			req.Header.Set("User-Agent", cfg.UpstreamUserAgent)
-			if v := r.Header.Get("Accept"); v != "" {
-				req.Header.Set("Accept", v)
-			}
-			resp, err := client.Do(req)
-			if err != nil {
-				logger.Errorw("fetch_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
-				http.Error(w, "upstream fetch error", http.StatusBadGateway)
+			aURL := deriveABaseURL(cfg, r)
+			if r.Header.Get("Range") != "" {
+				// Entries hold full bodies: pass the range through to B and warm
+				// the full (default variant) entry in the background
+				if variant.key() == "" {
+					pf.Enqueue(target, aURL.String(), clientForwardFor(cfg, r))
+				}
+				proxyBotRequest(cfg, client, w, r, target)
 				return
 			}
-			defer resp.Body.Close()
-
-			body, _ := io.ReadAll(resp.Body)
-
-			// Prepare cache entry (store minimal headers)
-			ch := map[string]string{}
-			if ct := resp.Header.Get("Content-Type"); ct != "" {
-				ch["Content-Type"] = ct
-			}
-			if lm := resp.Header.Get("Last-Modified"); lm != "" {
-				ch["Last-Modified"] = lm
+			// miss or expired: fetch and populate cache. Concurrent misses for the
+			// same target share a single upstream request; HEAD shares it with GET.
+			// Admin previews share no fetch with real misses, which must be cached
+			key := target + " " + aURL.String() + " " + variant.key()
+			preview := previewFrom(r.Context()) != nil
+			if preview {
+				key += " preview"
 			}
-			if et := resp.Header.Get("ETag"); et != "" {
-				ch["ETag"] = et
-			}
-
-			// Rewrite body links from B -> A for bots (HTML/XML), force for sitemap
-			aURL := deriveABaseURL(cfg, r)
-			bURL, _ := url.Parse(cfg.BBaseURL)
-			if strings.Contains(strings.ToLower(r.URL.Path), "sitemap") {
-				if nb, rw := rewriteBToA(body, aURL, bURL); rw {
-					body = nb
-					delete(ch, "ETag")
-					delete(ch, "Last-Modified")
-				}
-			} else {
-				if nb, rw := rewriteBodyForBots(body, ch["Content-Type"], aURL, bURL); rw {
-					body = nb
-					delete(ch, "ETag")
-					delete(ch, "Last-Modified")
+			v, err, shared := missFlight.Do(key, func() (interface{}, error) {
+				res, err := fetchBotMiss(cfg, client, r, target, aURL, variant)
+				if err == nil && res.status == http.StatusOK && !preview {
+					pf.EnqueueSubresources(cfg, target, res.header["Content-Type"], res.body, aURL.String())
 				}
-			}
-
-			if resp.StatusCode == http.StatusOK {
-				ttl := cacheTTLForPath(cfg, r.URL.Path)
-				ce := &cacheEntry{
-					URL:       target,
-					CreatedAt: time.Now().Unix(),
-					ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
-					Status:    resp.StatusCode,
-					Header:    ch,
-					Body:      body,
+				return res, err
+			})
+			if err != nil {
+				logger.Errorw("fetch_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
+				reason := "fetch_error"
+				if errors.Is(err, errCircuitOpen) {
+					reason = staleReasonCircuitOpen
 				}
-				if err := writeCacheByURL(cfg.CacheDir, target, ce); err != nil {
-					logger.Warnw("cache_write_error", map[string]interface{}{"err": err.Error(), "url": target, "req_id": getRequestID(r.Context())})
-				} else {
-					logger.Debugw("cache_store", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "ttl_seconds": ttl})
+				if serveStaleOnError(cfg, w, r, target, variant.key(), reason) {
+					return
 				}
+				writeUpstreamError(cfg, w, r, err)
+				return
+			}
+			res := v.(*upstreamResult)
+			if shared {
+				logger.Debugw("fetch_coalesced", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target})
+			}
+			if res.status >= 500 && serveStaleOnError(cfg, w, r, target, variant.key(), "upstream_"+strconv.Itoa(res.status)) {
+				return
 			}
 
 			// Serve response (cache miss)
 			w.Header().Set("X-Cache", "MISS")
-			for k, v := range ch {
+			for k, v := range res.header {
 				w.Header().Set(k, v)
 			}
-			w.WriteHeader(resp.StatusCode)
-			if len(body) > 0 && r.Method == http.MethodGet {
-				_, _ = w.Write(body)
-			}
+			serveBody(w, r, res.status, res.body)
 			return
 		}
 
-		// Not cached or caching disabled: simple fetch-through for bots
-		req, _ := http.NewRequest(r.Method, target, r.Body)
-		// Since it's a bot path but not cached, just forward as closely as feasible
-		req.Header.Set("User-Agent", cfg.UpstreamUserAgent)
-		if v := r.Header.Get("Accept"); v != "" {
-			req.Header.Set("Accept", v)
-		}
-		resp, err := client.Do(req)
-		if err != nil {
-			logger.Errorw("fetch_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
-			http.Error(w, "upstream fetch error", http.StatusBadGateway)
-			return
-		}
-		defer resp.Body.Close()
-		// Read body to potentially rewrite before serving
-		body, _ := io.ReadAll(resp.Body)
-		ct := resp.Header.Get("Content-Type")
-		aURL := deriveABaseURL(cfg, r)
-		bURL, _ := url.Parse(cfg.BBaseURL)
-		rewrote := false
-		if strings.Contains(strings.ToLower(r.URL.Path), "sitemap") {
-			if nb, rw := rewriteBToA(body, aURL, bURL); rw {
-				body = nb
-				rewrote = true
+		// Not cached or caching disabled: forward the request to B as is
+		proxyBotRequest(cfg, client, w, r, target)
+	})
+
+	// WordPress cache plugins purge with PURGE requests or GET /purge/<path>
+	pp := newPurgeProtocol(cfg, a.purges)
+	pp.guarded = adminGuard(cfg, a.adminLockout, a.adminSessions, a.audit, http.HandlerFunc(pp.serveToken))
+	admin := adminGuard(cfg, a.adminLockout, a.adminSessions, a.audit, adminMux)
+	handlerFor := func(role listenerRole) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if role != listenerPublic {
+				if _, pattern := adminMux.Handler(r); pattern != "" {
+					admin.ServeHTTP(w, r)
+					return
+				}
 			}
-		} else {
-			if nb, rw := rewriteBodyForBots(body, ct, aURL, bURL); rw {
-				body = nb
-				rewrote = true
+			if pp.serve(role, w, r) {
+				return
 			}
-		}
+			if role == listenerAdmin {
+				http.NotFound(w, r)
+				return
+			}
+			mux.ServeHTTP(w, r)
+		})
+	}
+	return map[listenerRole]http.Handler{
+		listenerAll:    handlerFor(listenerAll),
+		listenerPublic: handlerFor(listenerPublic),
+		listenerAdmin:  handlerFor(listenerAdmin),
+	}
+}
+
+// adminAuthorized checks the X-Admin-Token header (or ?token=, or an admin UI
+// session) and writes a 403 when admin is disabled or the credential does not
+// match or lacks the scope of r.
+func adminAuthorized(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	if !cfg.adminEnabled() {
+		http.Error(w, "admin disabled: set ADMIN_TOKEN", http.StatusForbidden)
+		return false
+	}
+	return checkAdmin(cfg, w, r, adminRequestToken(r))
+}
+
+// staleReasonCircuitOpen marks fetches refused by an open circuit breaker;
+// their stale entries are served even without ServeStaleOnError.
+const staleReasonCircuitOpen = "circuit_open"
 
-		// Copy minimal headers, but drop validators if rewritten
-		w.Header().Set("X-Cache", "MISS")
-		if v := ct; v != "" {
-			w.Header().Set("Content-Type", v)
+// serveStaleOnError serves the expired cache entry for target (and vary
+// variant) when cfg.ServeStaleOnError is set, or the B host's circuit is open.
+// It reports whether a response was written.
+func serveStaleOnError(cfg *Config, w http.ResponseWriter, r *http.Request, target, variant, reason string) bool {
+	if !cfg.ServeStaleOnError && reason != staleReasonCircuitOpen {
+		return false
+	}
+	ce, err := readStaleCacheVariant(cfg.CacheDir, target, variant)
+	if err != nil || ce.Status >= 500 {
+		return false
+	}
+	serveStaleFromCache(w, r, ce)
+	logger.Warnw("cache_serve_stale", map[string]interface{}{
+		"req_id": getRequestID(r.Context()),
+		"target": target,
+		"reason": reason,
+	})
+	return true
+}
+
+// upstreamResult is the rewritten upstream response shared between coalesced
+// cache-miss requests.
+type upstreamResult struct {
+	status int
+	header map[string]string
+	body   []byte
+}
+
+// fetchBotMiss fetches the variant of target from the B site, rewrites B links
+// to aURL and stores 200 responses in the cache (unless r is an admin preview). HEAD misses fetch the full GET
+// so the entry is populated and HEAD reports the length GET will serve.
+func fetchBotMiss(cfg *Config, client *http.Client, r *http.Request, target string, aURL *url.URL, variant cacheVariant) (*upstreamResult, error) {
+	// Coalesced waiters share this fetch: keep the trace but not the cancellation
+	ctx := context.WithoutCancel(r.Context())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Forward minimal headers to appear normal to origin
+	req.Header.Set("User-Agent", upstreamUserAgent(cfg, r))
+	if v := r.Header.Get("Accept"); v != "" {
+		req.Header.Set("Accept", v)
+	}
+	variant.setUpstreamHeaders(cfg, req)
+	clientForwardFor(cfg, r).apply(cfg, req)
+	// Revalidate an expired entry instead of refetching the full body
+	stale := staleForRevalidation(cfg.CacheDir, target, variant.key())
+	setConditionalHeaders(req, stale)
+	resp, err := doUpstream(cfg, client, req, r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		ttl, _ := cacheTTLFor(cfg, r.URL.Path, stale.Status, resp.Header)
+		if err := extendCacheEntry(cfg.CacheDir, target, stale, ttl); err != nil {
+			logger.Warnw("cache_write_error", map[string]interface{}{"err": err.Error(), "url": target, "req_id": getRequestID(r.Context())})
+		} else {
+			logger.Debugw("cache_revalidated", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "ttl_seconds": ttl})
 		}
-		if !rewrote {
-			if v := resp.Header.Get("Last-Modified"); v != "" {
-				w.Header().Set("Last-Modified", v)
-			}
-			if v := resp.Header.Get("ETag"); v != "" {
-				w.Header().Set("ETag", v)
-			}
+		return &upstreamResult{status: stale.Status, header: stale.Header, body: stale.Body}, nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	// Decided before the header policies strip Set-Cookie, a do-not-cache marker
+	ttl, cacheable := cacheTTLFor(cfg, r.URL.Path, resp.StatusCode, resp.Header)
+	bURL, _ := url.Parse(cfg.BBaseURL)
+	ch := botCacheHeaders(cfg, r.URL.Path, resp.Header, aURL, bURL)
+	// Transform the body for bots: B -> A links (always for sitemaps and feeds), injectors, minify
+	if nb, rw := rewriteBodyForBots(cfg, r.URL.Path, body, ch["Content-Type"], aURL, bURL); rw {
+		body = nb
+		delete(ch, "ETag")
+		delete(ch, "Last-Modified")
+	}
+	applyRobotsHeader(cfg, r.URL.Path, ch)
+	if resp.StatusCode == http.StatusOK && ch["ETag"] == "" {
+		ch["ETag"] = bodyETag(body)
+	}
+
+	// Keep the previous entry around as a stale fallback rather than caching an outage
+	keepStale := cfg.ServeStaleOnError && resp.StatusCode >= 500
+	if cacheable && !keepStale && previewFrom(r.Context()) == nil {
+		ce := &cacheEntry{
+			URL:          target,
+			CreatedAt:    time.Now().Unix(),
+			ExpiresAt:    time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
+			Status:       resp.StatusCode,
+			Header:       ch,
+			Body:         body,
+			Variant:      variant.key(),
+			BodyEncoding: cacheBodyEncoding(cfg, ch["Content-Type"]),
+			Tags:         cacheTagsFor(cfg, r.URL.Path, resp.Header),
 		}
-		w.WriteHeader(resp.StatusCode)
-		if r.Method == http.MethodGet && len(body) > 0 {
-			_, _ = w.Write(body)
+		setUpstreamValidators(ce, resp.Header)
+		_, sp := startSpan(ctx, "cache.write", spanKindInternal)
+		err := writeCacheByURL(cfg.CacheDir, target, ce)
+		sp.setError(err)
+		sp.finish()
+		if err != nil {
+			logger.Warnw("cache_write_error", map[string]interface{}{"err": err.Error(), "url": target, "req_id": getRequestID(r.Context())})
+		} else {
+			logger.Debugw("cache_store", map[string]interface{}{"req_id": getRequestID(r.Context()), "target": target, "variant": ce.Variant, "ttl_seconds": ttl})
 		}
-	})
-
-	return mux
+	}
+	return &upstreamResult{status: resp.StatusCode, header: ch, body: body}, nil
 }
 
-func adminUIHTML() string {
-	return `<!doctype html>
-<html lang="en">
-<head>
-  <meta charset="utf-8">
-  <meta name="viewport" content="width=device-width, initial-scale=1">
-  <title>Admin Tools</title>
-  <style>
-    body{font-family:system-ui,-apple-system,Segoe UI,Roboto,Ubuntu,Cantarell,Noto Sans,sans-serif;margin:2rem;line-height:1.5;color:#222;background:#f7f7f7}
-    h1{margin-bottom:0.5rem}
-    h2{margin-top:2rem}
-    form{max-width:640px;padding:1rem;margin-top:1rem;border:1px solid #ddd;border-radius:8px;background:#fff;box-shadow:0 1px 2px rgba(0,0,0,0.08)}
-    label{display:block;margin:.5rem 0 .25rem;font-weight:600;color:#333}
-    input[type=text],input[type=password],input[type=number]{width:100%;border:1px solid #bbb;border-radius:6px;font:inherit}
-    .row{display:flex;gap:1rem;align-items:center;margin-top:.5rem}
-    .hint{color:#555;font-size:.95rem;margin-bottom:.5rem}
-    button{margin-top:1rem;padding:.6rem 1.2rem;border:0;border-radius:6px;background:#0b5;color:#fff;cursor:pointer;font-weight:600}
-    button:hover{background:#0a4}
-    small{color:#666}
-  </style>
-  </head>
-<body>
-  <h1>Admin Utilities</h1>
-  <section>
-    <h2>Invalidate Cache Entry</h2>
-    <p class="hint">Enter a path or absolute URL from the B site. Enable Partial to delete every cached item containing the value.</p>
-    <form method="post">
-      <input type="hidden" name="form" value="purge">
-      <label for="url">URL or Path</label>
-      <input type="text" id="url" name="url" placeholder="/blog/post or https://b.site/blog/post" required>
-      <div class="row">
-        <label><input type="checkbox" name="partial"> Partial purge</label>
-      </div>
-      <label for="password">Admin token</label>
-      <input type="password" id="password" name="password" placeholder="Admin token" required>
-      <button type="submit">Purge Cache</button>
-    </form>
-  </section>
-
-  <section>
-    <h2>Warm Cache From Sitemap</h2>
-    <p class="hint">Provide a sitemap or sitemap index hosted on the B site. URLs outside the B host are skipped.</p>
-    <form method="post">
-      <input type="hidden" name="form" value="sitemap">
-      <label for="sitemap_url">Sitemap URL</label>
-      <input type="text" id="sitemap_url" name="sitemap_url" placeholder="https://b.site/sitemap.xml" required>
-      <label for="max_urls">Max URLs (optional)</label>
-      <input type="number" id="max_urls" name="max_urls" min="0" placeholder="Defaults to ` + fmtInt(defaultSitemapURLLimit) + `">
-      <label for="a_base_url">Override A-site base (optional)</label>
-      <input type="text" id="a_base_url" name="a_base_url" placeholder="http://localhost:8080">
-      <label for="token">Admin token</label>
-      <input type="password" id="token" name="token" placeholder="Admin token" required>
-      <small>Job runs in the background. Use the status endpoint with this token to check progress.</small>
-      <button type="submit">Warm Cache</button>
-    </form>
-  </section>
-</body>
-</html>`
+// botCacheHeaders returns the headers kept with a bot response from B, from
+// upstream headers h: content type, validators, Location mapped from B to A,
+// and the CSP, HSTS and CORS headers left by the header policies, which it
+// applies to h in place. Misses and prefetches share it so an entry carries
+// the same headers however it was filled. A nil aURL keeps B hosts as is.
+func botCacheHeaders(cfg *Config, reqPath string, h http.Header, aURL, bURL *url.URL) map[string]string {
+	ch := map[string]string{}
+	if ct := h.Get("Content-Type"); ct != "" {
+		ch["Content-Type"] = ct
+	} else if ct := guessContentType(reqPath); ct != "" {
+		ch["Content-Type"] = ct
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		ch["Last-Modified"] = lm
+	}
+	if et := h.Get("ETag"); et != "" {
+		ch["ETag"] = et
+	}
+	if aURL == nil {
+		aURL = bURL
+	}
+	rw := newURLRewriter(cfg, aURL, bURL)
+	if loc := h.Get("Location"); loc != "" {
+		ch["Location"], _ = rw.url(loc)
+	}
+	applyHeaderPolicies(cfg, h, rw)
+	cachePolicyHeaders(h, ch)
+	return ch
 }
 
 func renderPurgeResultHTML(q string, partial bool, res purgeResult) string {
@@ -637,17 +1329,54 @@ func renderPurgeResultHTML(q string, partial bool, res purgeResult) string {
 </body></html>`
 }
 
-func renderSitemapJobQueuedHTML(job *sitemapWarmJob) string {
+// renderSitemapJobQueuedHTML confirms a queued job and follows its progress
+// live through the SSE stream, authenticated with the token the form was sent
+// with, or by the session cookie when token is empty.
+func renderSitemapJobQueuedHTML(job *sitemapWarmJob, token string) string {
 	statusURL := "/admin/sitemap-cache/status?job=" + htmlEscape(job.ID)
+	stream := "/admin/sitemap-cache/stream?job=" + url.QueryEscape(job.ID)
+	if token != "" {
+		stream += "&token=" + url.QueryEscape(token)
+	}
+	streamURL, _ := json.Marshal(stream)
+	source := "sitemap"
+	if job.Mode == warmModeCrawl {
+		source = "crawl from"
+	}
 	return `<!doctype html>
 <html lang="en">
 <head><meta charset="utf-8"><meta name="viewport" content="width=device-width,initial-scale=1"><title>Sitemap Warm Started</title></head>
 <body>
   <h1>Sitemap Cache Warm Queued</h1>
-  <p>The sitemap <strong>` + htmlEscape(job.SitemapURL) + `</strong> was accepted for caching.</p>
+  <p>The ` + source + ` <strong>` + htmlEscape(job.SitemapURL) + `</strong> was accepted for caching.</p>
   <p>Job ID: <code>` + htmlEscape(job.ID) + `</code></p>
+  <p>Progress: <strong id="state">queued</strong> <span id="counts"></span></p>
+  <ol id="urls" reversed></ol>
   <p>Check progress via <code>` + statusURL + `</code> using the admin token.</p>
   <a href="">Back</a>
+  <script>
+  (function () {
+    var es = new EventSource(` + string(streamURL) + `);
+    var counts = function (d) {
+      document.getElementById("counts").textContent = d.processed_urls + "/" + d.total_urls + " processed, " + d.cached_urls + " cached, " + d.skipped_urls + " skipped";
+    };
+    es.addEventListener("state", function (e) {
+      var d = JSON.parse(e.data);
+      document.getElementById("state").textContent = d.state + (d.error ? ": " + d.error : "");
+      counts(d);
+      if (d.state === "completed" || d.state === "error" || d.state === "interrupted") { es.close(); }
+    });
+    es.addEventListener("url", function (e) {
+      var d = JSON.parse(e.data);
+      counts(d);
+      var li = document.createElement("li");
+      li.textContent = d.status + " " + (d.url || d.raw_url) + (d.reason ? " (" + d.reason + ")" : "");
+      var list = document.getElementById("urls");
+      list.insertBefore(li, list.firstChild);
+      while (list.children.length > 200) { list.removeChild(list.lastChild); }
+    });
+  })();
+  </script>
 </body></html>`
 }
 
@@ -1,14 +1,19 @@
-package main
+package rerouter
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -16,7 +21,7 @@ import (
 func TestAdminSitemapCacheEndpoint(t *testing.T) {
 	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
-		_, _ = w.Write([]byte(fmt.Sprintf("<html><body>host=%s</body></html>", r.Host)))
+		_, _ = w.Write([]byte(fmt.Sprintf(`<html><body><a href="http://%s/next">next</a></body></html>`, r.Host)))
 	}))
 	defer up.Close()
 
@@ -112,7 +117,7 @@ func TestAdminSitemapCacheEndpoint(t *testing.T) {
 func TestAdminSitemapCacheUIForm(t *testing.T) {
 	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html")
-		_, _ = w.Write([]byte(fmt.Sprintf("<html><body>host=%s</body></html>", r.Host)))
+		_, _ = w.Write([]byte(fmt.Sprintf(`<html><body><a href="http://%s/next">next</a></body></html>`, r.Host)))
 	}))
 	defer up.Close()
 
@@ -224,3 +229,705 @@ func waitForSitemapJob(t *testing.T, baseURL, token, jobID string) sitemapWarmJo
 	t.Fatalf("job %s did not complete in time (last state %s)", jobID, last.State)
 	return last
 }
+
+func TestShutdownInterruptsAndPersistsSitemapJob(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset>
+  <url><loc>` + up.URL + `/p1</loc></url>
+  <url><loc>` + up.URL + `/p2</loc></url>
+  <url><loc>` + up.URL + `/p3</loc></url>
+</urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.SitemapWarmDelaySeconds = 5
+	app := buildHandler(cfg)
+
+	job, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatalf("start job: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for job.snapshot().CachedURLs < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	st := job.snapshot()
+	if st.State != string(jobStateInterrupted) {
+		t.Fatalf("expected interrupted state, got %s", st.State)
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.CacheDir, "jobs", job.ID+".json"))
+	if err != nil {
+		t.Fatalf("expected persisted job state: %v", err)
+	}
+	var persisted sitemapWarmJobStatus
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		t.Fatalf("decode persisted job: %v", err)
+	}
+	if persisted.CachedURLs != 1 || persisted.State != string(jobStateInterrupted) {
+		t.Fatalf("unexpected persisted state: %+v", persisted)
+	}
+}
+
+func TestPersistedSitemapJobResumesAfterRestart(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset>
+  <url><loc>` + up.URL + `/p1</loc></url>
+  <url><loc>` + up.URL + `/p2</loc></url>
+</urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.SitemapWarmDelaySeconds = 5
+	app := buildHandler(cfg)
+	job, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatalf("start job: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for job.snapshot().CachedURLs < 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	// "Restart" with the same cache dir
+	cfg.SitemapWarmDelaySeconds = 0
+	app2 := buildHandler(cfg)
+	defer app2.Shutdown(context.Background())
+	resumed, ok := app2.warmMgr.GetJob(job.ID)
+	if !ok {
+		t.Fatalf("expected job %s to be restored", job.ID)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for resumed.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := resumed.snapshot()
+	if st.State != string(jobStateCompleted) || st.CachedURLs != 2 || st.Processed != 2 {
+		t.Fatalf("unexpected resumed job state: %+v", st)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits["/p1"] != 1 || hits["/p2"] != 1 {
+		t.Fatalf("expected each page fetched once, got %v", hits)
+	}
+
+	next, err := app2.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatalf("start job: %v", err)
+	}
+	if next.ID == job.ID {
+		t.Fatalf("expected a fresh job id after restore, got %s", next.ID)
+	}
+}
+
+func TestSitemapWarmScheduleRerunsJobs(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset><url><loc>` + up.URL + `/p1</loc></url></urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	app := buildHandler(cfg)
+	sitemapURL := sitemapSrv.URL + "/sitemap.xml"
+	app.warmMgr.startSchedule(SitemapWarmSchedule{SitemapURL: sitemapURL}, 50*time.Millisecond)
+
+	deadline := time.Now().Add(3 * time.Second)
+	completed := 0
+	for time.Now().Before(deadline) {
+		completed = 0
+		for _, job := range app.warmMgr.ListJobs() {
+			if st := job.snapshot(); st.SitemapURL == sitemapURL && st.State == string(jobStateCompleted) {
+				completed++
+			}
+		}
+		if completed >= 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := app.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if completed < 2 {
+		t.Fatalf("expected at least two scheduled runs, got %d", completed)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// Later runs find the page still fresh and skip the upstream fetch
+	if hits["/p1"] != 1 {
+		t.Fatalf("expected fresh page fetched once, got %d", hits["/p1"])
+	}
+}
+
+func TestParseSitemapWarmSchedules(t *testing.T) {
+	got, err := parseSitemapWarmSchedules("6h=https://b.com/sitemap.xml?a=1, 1d=https://b.com/news.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].SitemapURL != "https://b.com/sitemap.xml?a=1" || got[0].IntervalSeconds != 6*3600 || got[1].IntervalSeconds != 86400 {
+		t.Fatalf("unexpected schedules: %+v", got)
+	}
+	if _, err := parseSitemapWarmSchedules("https://b.com/sitemap.xml"); err == nil {
+		t.Fatalf("expected error for missing interval")
+	}
+	if err := validateSitemapWarmSchedule(SitemapWarmSchedule{SitemapURL: "https://b.com/s.xml", IntervalSeconds: 10}); err == nil {
+		t.Fatalf("expected error for too-short interval")
+	}
+}
+
+func TestSitemapWarmOrdersByHintsAndSkipsUnchanged(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		order = append(order, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>" + r.URL.Path + "</body></html>"))
+	}))
+	defer up.Close()
+
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset>
+  <url><loc>` + up.URL + `/low</loc><priority>0.1</priority></url>
+  <url><loc>` + up.URL + `/old</loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc>` + up.URL + `/unchanged</loc><lastmod>2001-01-01T00:00:00Z</lastmod></url>
+  <url><loc>` + up.URL + `/new</loc><lastmod>2024-05-01T10:00:00+02:00</lastmod><changefreq>daily</changefreq></url>
+  <url><loc>` + up.URL + `/changed</loc><lastmod>2100-01-01</lastmod><priority>0.8</priority></url>
+  <url><loc>` + up.URL + `/top</loc><priority>0.9</priority></url>
+</urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	// Fresh entries: one newer than its lastmod, one older than its lastmod
+	for _, path := range []string{"/unchanged", "/changed"} {
+		ce := &cacheEntry{URL: up.URL + path, CreatedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Hour).Unix(), Status: 200, Header: map[string]string{}, Body: []byte("cached")}
+		if err := writeCacheByURL(cfg.CacheDir, up.URL+path, ce); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app := buildHandler(cfg)
+	job, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for job.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	st := job.snapshot()
+	if st.State != string(jobStateCompleted) || st.CachedURLs != 5 || st.SkippedURLs != 1 {
+		t.Fatalf("unexpected job status: %+v", st)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(order, ","); got != "/top,/changed,/new,/old,/low" {
+		t.Fatalf("unexpected warm order %s", got)
+	}
+}
+
+func TestSitemapWarmRunsConcurrentWorkers(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, peak := 0, 0
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > peak {
+			peak = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+
+	var urls strings.Builder
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(&urls, "<url><loc>%s/p%d</loc></url>", up.URL, i)
+	}
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<urlset>" + urls.String() + "</urlset>"))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.SitemapWarmConcurrency = 4
+	app := buildHandler(cfg)
+	defer app.Shutdown(context.Background())
+	job, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for job.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := job.snapshot(); st.State != string(jobStateCompleted) || st.CachedURLs != 8 || st.Processed != 8 {
+		t.Fatalf("unexpected job status: %+v", st)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if peak < 2 || peak > 4 {
+		t.Fatalf("expected up to 4 parallel fetches, peak was %d", peak)
+	}
+}
+
+func TestHostPacerSpacesFetchesPerHost(t *testing.T) {
+	p := hostPacer{next: map[string]time.Time{}}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.wait(context.Background(), "b.example", 40*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Fatalf("expected fetches to one host spaced out, took %s", d)
+	}
+	// Another host is not held back
+	start = time.Now()
+	if err := p.wait(context.Background(), "c.example", 40*time.Millisecond); err != nil || time.Since(start) > 20*time.Millisecond {
+		t.Fatalf("expected other host to proceed immediately, err=%v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.wait(ctx, "b.example", time.Second); err == nil {
+		t.Fatal("expected cancelled wait to fail")
+	}
+}
+
+func TestAdminWarmURLList(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		order = append(order, r.URL.RequestURI())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>ok</html>"))
+	}))
+	defer up.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.AdminTokens = []AdminCredential{{Name: "content", Token: "purger", Scopes: []string{adminScopePurge}}}
+	app := buildHandler(cfg)
+	post := func(token, ct, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/warm", strings.NewReader(body))
+		req.Header.Set("X-Admin-Token", token)
+		req.Header.Set("Content-Type", ct)
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		return rr
+	}
+	wait := func(rr *httptest.ResponseRecorder) sitemapWarmJobStatus {
+		t.Helper()
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("unexpected status %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp struct {
+			JobID string `json:"job_id"`
+			Mode  string `json:"mode"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Mode != warmModeList {
+			t.Fatalf("unexpected response %s", rr.Body.String())
+		}
+		job, ok := app.warmMgr.GetJob(resp.JobID)
+		if !ok {
+			t.Fatalf("job %s not found", resp.JobID)
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for job.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return job.snapshot()
+	}
+
+	st := wait(post(cfg.AdminToken, "text/plain", "# landing pages\n/b\n\n"+up.URL+"/a?x=1\n/c\n"))
+	if st.State != string(jobStateCompleted) || st.Mode != warmModeList || st.CachedURLs != 3 {
+		t.Fatalf("unexpected job status: %+v", st)
+	}
+	mu.Lock()
+	if got := strings.Join(order, ","); got != "/b,/a?x=1,/c" {
+		t.Fatalf("unexpected warm order %s", got)
+	}
+	order = nil
+	mu.Unlock()
+	if _, err := readCacheByURL(cfg.CacheDir, up.URL+"/a?x=1"); err != nil {
+		t.Fatalf("listed URL not cached: %v", err)
+	}
+
+	st = wait(post(cfg.AdminToken, "application/json", `{"urls":["/d","/e","/f"],"max_urls":2}`))
+	if st.TotalURLs != 2 || st.CachedURLs != 2 {
+		t.Fatalf("max_urls not applied: %+v", st)
+	}
+
+	if rr := post(cfg.AdminToken, "text/plain", "/ok\nftp://b.site/x\n"); rr.Code != http.StatusBadRequest {
+		t.Fatalf("invalid url accepted: %d", rr.Code)
+	}
+	if rr := post("purger", "text/plain", "/ok\n"); rr.Code != http.StatusForbidden {
+		t.Fatalf("purge-only token may warm: %d", rr.Code)
+	}
+}
+
+func TestSitemapWarmStreamEmitsProgress(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset><url><loc>` + up.URL + `/p1</loc></url><url><loc>` + up.URL + `/p2</loc></url></urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	app := buildHandler(cfg)
+	srv := httptest.NewServer(app)
+	defer srv.Close()
+	job, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := http.Get(srv.URL + "/admin/sitemap-cache/stream?job=" + job.ID + "&token=wrong"); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a bad token, got %v %v", resp, err)
+	}
+	resp, err := http.Get(srv.URL + "/admin/sitemap-cache/stream?job=" + job.ID + "&token=" + cfg.AdminToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	var names []string
+	var last sitemapWarmJobStatus
+	sc := bufio.NewScanner(resp.Body)
+	name := ""
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+			names = append(names, name)
+			if len(names) == 1 {
+				close(release)
+			}
+		case strings.HasPrefix(line, "data: ") && name == "state":
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &last); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	urlEvents := 0
+	for _, n := range names {
+		if n == "url" {
+			urlEvents++
+		}
+	}
+	if names[0] != "state" || urlEvents != 2 || last.State != string(jobStateCompleted) || last.CachedURLs != 2 {
+		t.Fatalf("unexpected events %v, last state %+v", names, last)
+	}
+}
+
+func TestSitemapWarmJobHistoryIsCappedAndPruned(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html><body>ok</body></html>"))
+	}))
+	defer up.Close()
+	sitemapSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<urlset><url><loc>` + up.URL + `/p1</loc></url><url><loc>` + up.URL + `/p2</loc></url><url><loc>` + up.URL + `/p3</loc></url></urlset>`))
+	}))
+	defer sitemapSrv.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.SitemapWarmJobHistory = 1
+	cfg.SitemapWarmJobMaxAgeDays = 30
+	cfg.SitemapWarmMaxURLStatuses = 2
+	// An old job left on disk by an earlier process
+	old := sitemapWarmJobStatus{JobID: "job-90", SitemapURL: "https://b.example/old.xml", State: string(jobStateCompleted),
+		SubmittedAt: time.Now().AddDate(0, 0, -41), CompletedAt: time.Now().AddDate(0, 0, -40)}
+	if err := persistSitemapWarmJob(cfg.CacheDir, old); err != nil {
+		t.Fatal(err)
+	}
+	app := buildHandler(cfg)
+	defer app.Shutdown(context.Background())
+	if _, ok := app.warmMgr.GetJob(old.JobID); ok {
+		t.Fatalf("expected job older than the max age to be pruned on load")
+	}
+
+	waitDone := func(job *sitemapWarmJob) sitemapWarmJobStatus {
+		deadline := time.Now().Add(3 * time.Second)
+		for time.Now().Before(deadline) {
+			if st := job.snapshot(); st.State == string(jobStateCompleted) {
+				return st
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("job %s did not complete", job.ID)
+		return sitemapWarmJobStatus{}
+	}
+	first, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := waitDone(first)
+	if len(st.URLStatuses) != 2 || st.URLStatusesDropped != 1 || st.CachedURLs != 3 {
+		t.Fatalf("expected URL statuses capped at 2, got %+v", st)
+	}
+	b, err := os.ReadFile(filepath.Join(cfg.CacheDir, "jobs", first.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted sitemapWarmJobStatus
+	if err := json.Unmarshal(b, &persisted); err != nil {
+		t.Fatal(err)
+	}
+	if persisted.URLStatuses != nil || persisted.URLStatusesDropped != 3 || persisted.CachedURLs != 3 {
+		t.Fatalf("expected a summary without URL statuses on disk, got %+v", persisted)
+	}
+
+	second, err := app.warmMgr.StartJob(sitemapSrv.URL+"/sitemap.xml", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitDone(second)
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := app.warmMgr.GetJob(first.ID); !ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := app.warmMgr.GetJob(first.ID); ok {
+		t.Fatalf("expected the oldest finished job to be pruned")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.CacheDir, "jobs", first.ID+".json")); !os.IsNotExist(err) {
+		t.Fatalf("expected pruned job file to be removed, got %v", err)
+	}
+	if _, ok := app.warmMgr.GetJob(second.ID); !ok {
+		t.Fatalf("expected the newest job to be kept")
+	}
+}
+
+func TestCrawlWarmFollowsLinksWithinDepthAndRobots(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	pages := map[string]string{
+		"/":          `<a href="/a">a</a> <a href="b">b</a> <a href="/private/x">p</a> <a href="https://elsewhere.example/">x</a> <a rel="nofollow" href="/nf">nf</a>`,
+		"/a":         `<a href="/a/deep">deep</a> <a href="/">home</a> <a href="/a#top">self</a>`,
+		"/b":         `<a href="/b/deep">deep</a>`,
+		"/a/deep":    `<a href="/too-deep">x</a>`,
+		"/b/deep":    `end`,
+		"/private/x": `secret`,
+	}
+	var up *httptest.Server
+	up = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		if r.URL.Path == "/robots.txt" {
+			io.WriteString(w, "User-agent: *\nDisallow: /private/\n")
+			return
+		}
+		body, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		// Absolute B links are rewritten to A in the cache; the crawler maps them back
+		io.WriteString(w, "<html><body>"+strings.ReplaceAll(body, `href="/a"`, `href="`+up.URL+`/a"`)+"</body></html>")
+	}))
+	defer up.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	cfg.ABaseURL = "https://a.example"
+	cfg.CrawlWarmMaxURLs = 100
+	app := buildHandler(cfg)
+	defer app.Shutdown(context.Background())
+
+	job, err := app.warmMgr.StartCrawlJob("", 0, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	var st sitemapWarmJobStatus
+	for time.Now().Before(deadline) {
+		if st = job.snapshot(); st.State == string(jobStateCompleted) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st.State != string(jobStateCompleted) || st.Mode != warmModeCrawl {
+		t.Fatalf("unexpected job status %+v", st)
+	}
+	mu.Lock()
+	for _, p := range []string{"/", "/a", "/b", "/a/deep", "/b/deep"} {
+		if hits[p] != 1 {
+			t.Fatalf("expected %s fetched once, got %d (%v)", p, hits[p], hits)
+		}
+	}
+	for _, p := range []string{"/private/x", "/nf", "/too-deep"} {
+		if hits[p] != 0 {
+			t.Fatalf("expected %s not fetched (%v)", p, hits)
+		}
+	}
+	mu.Unlock()
+	if st.CachedURLs != 5 || st.SkippedURLs != 1 {
+		t.Fatalf("expected 5 cached and 1 robots skip, got %+v", st)
+	}
+
+	// The page budget stops discovery
+	job2, err := app.warmMgr.StartCrawlJob(up.URL+"/", 2, 3, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline = time.Now().Add(3 * time.Second)
+	for job2.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := job2.snapshot(); st.TotalURLs != 2 {
+		t.Fatalf("expected crawl limited to 2 URLs, got %+v", st)
+	}
+	if _, err := app.warmMgr.StartCrawlJob("/relative", 0, 0, ""); err == nil {
+		t.Fatalf("expected relative start URL to be rejected")
+	}
+}
+
+func TestRobotsRulesLongestMatchWins(t *testing.T) {
+	rules := parseRobotsRules([]byte("User-agent: googlebot\nDisallow: /\n\nUser-agent: *\nDisallow: /shop/\nAllow: /shop/public\nDisallow: /*.pdf$\n"), crawlRobotsAgent)
+	cases := map[string]bool{
+		"/":              true,
+		"/shop/cart":     false,
+		"/shop/public/1": true,
+		"/doc.pdf":       false,
+		"/doc.pdf?x=1":   true,
+	}
+	for p, want := range cases {
+		if got := rules.allowed(p); got != want {
+			t.Fatalf("allowed(%q) = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestSitemapWarmObeysRobotsTxt(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			_, _ = w.Write([]byte("User-agent: *\nDisallow: /cart\nDisallow: /wp-admin/\nCrawl-delay: 0.2\n"))
+			return
+		}
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte("<html>ok</html>"))
+	}))
+	defer up.Close()
+
+	cfg := newTestCfg(t, up.URL)
+	app := buildHandler(cfg)
+	run := func() sitemapWarmJobStatus {
+		t.Helper()
+		job, err := app.warmMgr.StartListJob([]string{up.URL + "/a", up.URL + "/cart", up.URL + "/wp-admin/options.php", up.URL + "/b"}, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(3 * time.Second)
+		for job.snapshot().State != string(jobStateCompleted) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return job.snapshot()
+	}
+	start := time.Now()
+	st := run()
+	if st.CachedURLs != 2 || st.SkippedURLs != 2 {
+		t.Fatalf("unexpected job status %+v", st)
+	}
+	if got := strings.Join(fetched, ","); got != "/a,/b" {
+		t.Fatalf("fetched %s", got)
+	}
+	if time.Since(start) < 200*time.Millisecond {
+		t.Fatalf("Crawl-delay not applied")
+	}
+	var reasons []string
+	for _, u := range st.URLStatuses {
+		if u.Status == "skipped" {
+			reasons = append(reasons, u.Reason)
+		}
+	}
+	if strings.Join(reasons, ",") != "robots_disallowed,robots_disallowed" {
+		t.Fatalf("skip reasons %v", reasons)
+	}
+
+	// WarmIgnoreRobots fetches everything
+	cfg2 := *cfg
+	cfg2.WarmIgnoreRobots = true
+	app.applyConfig(&cfg2)
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+	if st := run(); st.CachedURLs != 4 {
+		t.Fatalf("robots ignored: %+v", st)
+	}
+}
@@ -0,0 +1,224 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Upstream response header groups with a policy in cfg.HeaderPolicies.
+const (
+	headerGroupSetCookie = "set-cookie"
+	headerGroupCSP       = "csp"
+	headerGroupHSTS      = "hsts"
+	headerGroupCORS      = "cors"
+)
+
+// Header policy actions. Headers of a group without a policy are stripped.
+const (
+	headerPolicyStrip   = "strip"
+	headerPolicyPass    = "pass"
+	headerPolicyRewrite = "rewrite"
+)
+
+// headerPolicyGroups lists the canonical header names in each group.
+var headerPolicyGroups = map[string][]string{
+	headerGroupSetCookie: {"Set-Cookie"},
+	headerGroupCSP:       {"Content-Security-Policy", "Content-Security-Policy-Report-Only"},
+	headerGroupHSTS:      {"Strict-Transport-Security"},
+	headerGroupCORS: {
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Expose-Headers",
+		"Access-Control-Max-Age",
+	},
+}
+
+// parseHeaderPolicies parses "set-cookie=rewrite,csp=pass,hsts=strip".
+func parseHeaderPolicies(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, item := range splitCommaList(v) {
+		group, action, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want group=action", item)
+		}
+		out[strings.ToLower(strings.TrimSpace(group))] = strings.ToLower(strings.TrimSpace(action))
+	}
+	return out, nil
+}
+
+// validateHeaderPolicies checks groups and actions; HSTS has nothing to rewrite.
+func validateHeaderPolicies(m map[string]string) error {
+	groups := make([]string, 0, len(m))
+	for g := range m {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		if _, ok := headerPolicyGroups[g]; !ok {
+			return fmt.Errorf("unknown group %q (want set-cookie, csp, hsts or cors)", g)
+		}
+		switch a := m[g]; {
+		case a == headerPolicyStrip || a == headerPolicyPass:
+		case a == headerPolicyRewrite && g != headerGroupHSTS:
+		default:
+			return fmt.Errorf("invalid action %q for %s", a, g)
+		}
+	}
+	return nil
+}
+
+// headerPolicyFor returns the action for group. FORWARD_COOKIES without an
+// explicit set-cookie policy keeps passing Set-Cookie as it always did.
+func headerPolicyFor(cfg *Config, group string) string {
+	if a, ok := cfg.HeaderPolicies[group]; ok {
+		return a
+	}
+	if group == headerGroupSetCookie && cfg.ForwardCookies {
+		return headerPolicyPass
+	}
+	return headerPolicyStrip
+}
+
+// applyHeaderPolicies strips or rewrites the policy-controlled headers of an
+// upstream response in place. Rewrites map B hosts to A with rw: cookie
+// Domain attributes, CSP source expressions and Access-Control-Allow-Origin.
+func applyHeaderPolicies(cfg *Config, h http.Header, rw *urlRewriter) {
+	for group, names := range headerPolicyGroups {
+		action := headerPolicyFor(cfg, group)
+		for _, k := range names {
+			vv := h.Values(k)
+			if len(vv) == 0 {
+				continue
+			}
+			h.Del(k)
+			if action == headerPolicyStrip {
+				continue
+			}
+			for _, v := range vv {
+				if action == headerPolicyRewrite {
+					var ok bool
+					if v, ok = rw.headerValue(k, v); !ok {
+						continue
+					}
+				}
+				h.Add(k, v)
+			}
+		}
+	}
+}
+
+// cachePolicyHeaders copies the CSP, HSTS and CORS headers left in h by
+// applyHeaderPolicies into the cache entry headers ch. Set-Cookie is never
+// cached: a cached response is shared by every bot.
+func cachePolicyHeaders(h http.Header, ch map[string]string) {
+	for _, group := range []string{headerGroupCSP, headerGroupHSTS, headerGroupCORS} {
+		for _, k := range headerPolicyGroups[group] {
+			if vv := h.Values(k); len(vv) > 0 {
+				ch[k] = strings.Join(vv, ", ")
+			}
+		}
+	}
+}
+
+// headerValue rewrites the value of policy header k from B to A. It reports
+// false when the header must be dropped instead, such as a cookie scoped to a
+// domain that is neither B nor a parent of B.
+func (rw *urlRewriter) headerValue(k, v string) (string, bool) {
+	switch k {
+	case "Set-Cookie":
+		return rw.setCookie(v)
+	case "Content-Security-Policy", "Content-Security-Policy-Report-Only":
+		nv, _ := rw.csp(v)
+		return nv, true
+	case "Access-Control-Allow-Origin":
+		nv, _ := rw.url(v)
+		return nv, true
+	}
+	return v, true
+}
+
+// setCookie maps the Domain attribute of a Set-Cookie value from a B host (or
+// a parent domain of it) to the matching A host. Host-only cookies need no change.
+func (rw *urlRewriter) setCookie(v string) (string, bool) {
+	parts := strings.Split(v, ";")
+	for i, p := range parts[1:] {
+		name, val, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if !strings.EqualFold(name, "domain") {
+			continue
+		}
+		d := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(val)), ".")
+		found := false
+		for _, pair := range rw.pairs {
+			from := stripPort(pair.from)
+			if d == from || strings.HasSuffix(from, "."+d) {
+				parts[i+1] = " Domain=" + pair.to.Hostname()
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", false
+		}
+	}
+	return strings.Join(parts, ";"), true
+}
+
+// csp maps B origins and hosts in the source lists of a CSP value to A, so
+// URLs rewritten to A are not blocked. It reports whether anything changed.
+func (rw *urlRewriter) csp(v string) (string, bool) {
+	var directives []string
+	changed := false
+	for _, d := range strings.Split(v, ";") {
+		fields := strings.Fields(d)
+		if len(fields) == 0 {
+			continue
+		}
+		out := []string{fields[0]}
+		for _, src := range fields[1:] {
+			srcs, ok := rw.cspSource(src)
+			out = append(out, srcs...)
+			changed = changed || ok
+		}
+		directives = append(directives, strings.Join(out, " "))
+	}
+	if !changed {
+		return v, false
+	}
+	return strings.Join(directives, "; "), true
+}
+
+// cspSource maps one CSP host source from B to A. Explicit B hosts, with or
+// without scheme, port or path, are replaced; a wildcard covering B such as
+// *.b.com is kept and the A host is added beside it.
+func (rw *urlRewriter) cspSource(src string) ([]string, bool) {
+	if nv, ok := rw.url(src); ok {
+		return []string{nv}, true
+	}
+	scheme, rest := "", src
+	if i := strings.Index(src, "://"); i > 0 {
+		scheme, rest = src[:i+3], src[i+3:]
+	}
+	authority, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		authority, path = rest[:i], rest[i:]
+	}
+	host, _, _ := strings.Cut(authority, ":")
+	for _, pair := range rw.pairs {
+		fromHost, _, _ := strings.Cut(pair.from, ":")
+		to := pair.to.Host + path
+		if scheme != "" {
+			to = pair.to.Scheme + "://" + to
+		}
+		switch {
+		case strings.EqualFold(authority, pair.from) || strings.EqualFold(host, pair.from):
+			return []string{to}, true
+		case strings.HasPrefix(host, "*.") && (strings.EqualFold(host[2:], fromHost) || strings.HasSuffix(strings.ToLower(fromHost), strings.ToLower(host[1:]))):
+			return []string{src, to}, true
+		}
+	}
+	return []string{src}, false
+}
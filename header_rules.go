@@ -0,0 +1,148 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Header rule actions.
+const (
+	headerRuleSet    = "set"
+	headerRuleAppend = "append"
+	headerRuleRemove = "remove"
+)
+
+// Header rule audiences: responses to bots (served content) or to humans
+// (redirects, or content in proxy/cache mode). Empty means both.
+const (
+	headerAudienceBot   = "bot"
+	headerAudienceHuman = "human"
+)
+
+// HeaderRule sets, appends or removes a response header on paths matching
+// Pattern. Every matching rule applies, in order, after rerouter's own headers.
+type HeaderRule struct {
+	Pattern  string `json:"pattern"`
+	Audience string `json:"audience,omitempty"`
+	Action   string `json:"action"`
+	Name     string `json:"name"`
+	Value    string `json:"value,omitempty"`
+}
+
+// parseHeaderRules parses "[bot:|human:]pattern=action:Name[=value]" entries
+// separated by semicolons, e.g.
+// "bot:/blog/*=set:Cache-Control=public, max-age=600;human:/=remove:X-Powered-By".
+func parseHeaderRules(v string) ([]HeaderRule, error) {
+	out := []HeaderRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pat, spec, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid header rule %q", p)
+		}
+		rule := HeaderRule{Pattern: strings.TrimSpace(pat)}
+		for _, aud := range []string{headerAudienceBot, headerAudienceHuman} {
+			if strings.HasPrefix(rule.Pattern, aud+":") {
+				rule.Audience, rule.Pattern = aud, rule.Pattern[len(aud)+1:]
+			}
+		}
+		action, header, _ := strings.Cut(spec, ":")
+		name, value, _ := strings.Cut(header, "=")
+		rule.Action = strings.ToLower(strings.TrimSpace(action))
+		rule.Name = strings.TrimSpace(name)
+		rule.Value = strings.TrimSpace(value)
+		if err := validateHeaderRule(rule); err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func validateHeaderRule(r HeaderRule) error {
+	if r.Pattern == "" || r.Name == "" {
+		return fmt.Errorf("header rule needs a pattern and a header name")
+	}
+	if !strings.HasPrefix(r.Pattern, "/") {
+		return fmt.Errorf("header rule %q: pattern must start with / (audience prefix is bot: or human:)", r.Pattern)
+	}
+	switch r.Audience {
+	case "", headerAudienceBot, headerAudienceHuman:
+	default:
+		return fmt.Errorf("header rule %q: unknown audience %q (want bot or human)", r.Pattern, r.Audience)
+	}
+	switch r.Action {
+	case headerRuleRemove:
+	case headerRuleSet, headerRuleAppend:
+		if r.Value == "" {
+			return fmt.Errorf("header rule %q: %s %s needs a value", r.Pattern, r.Action, r.Name)
+		}
+	default:
+		return fmt.Errorf("header rule %q: unknown action %q (want set, append or remove)", r.Pattern, r.Action)
+	}
+	return nil
+}
+
+// headerRulesFor returns the rules for reqPath and audience, in order.
+func headerRulesFor(cfg *Config, reqPath, audience string) []HeaderRule {
+	var out []HeaderRule
+	for _, r := range cfg.HeaderRules {
+		if (r.Audience == "" || r.Audience == audience) && patternsMatch([]string{r.Pattern}, reqPath) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func applyHeaderRules(h http.Header, rules []HeaderRule) {
+	for _, r := range rules {
+		switch r.Action {
+		case headerRuleSet:
+			h.Set(r.Name, r.Value)
+		case headerRuleAppend:
+			h.Add(r.Name, r.Value)
+		case headerRuleRemove:
+			h.Del(r.Name)
+		}
+	}
+}
+
+// withHeaderRules wraps w so the HEADER_RULES matching the request apply
+// just before the status line is written, whichever path produces it.
+func withHeaderRules(cfg *Config, w http.ResponseWriter, r *http.Request, audience string) http.ResponseWriter {
+	rules := headerRulesFor(cfg, r.URL.Path, audience)
+	if len(rules) == 0 {
+		return w
+	}
+	return &headerRuleWriter{ResponseWriter: w, rules: rules}
+}
+
+type headerRuleWriter struct {
+	http.ResponseWriter
+	rules   []HeaderRule
+	applied bool
+}
+
+func (hw *headerRuleWriter) WriteHeader(code int) {
+	if !hw.applied {
+		hw.applied = true
+		applyHeaderRules(hw.Header(), hw.rules)
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerRuleWriter) Write(b []byte) (int, error) {
+	if !hw.applied {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (hw *headerRuleWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
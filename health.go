@@ -0,0 +1,157 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Readiness checks run by /readyz, selected with READYZ_CHECKS.
+const (
+	readyCheckCacheDir      = "cache_dir"
+	readyCheckUpstream      = "upstream"
+	readyCheckPrefetchQueue = "prefetch_queue"
+)
+
+var defaultReadyChecks = []string{readyCheckCacheDir, readyCheckUpstream, readyCheckPrefetchQueue}
+
+const (
+	readyUpstreamTimeout = 5 * time.Second
+	// readyUpstreamCacheFor reuses an upstream probe result so frequent load
+	// balancer checks do not each hit the origin.
+	readyUpstreamCacheFor = 5 * time.Second
+	// readyPrefetchSaturated is the queue fill ratio at which an instance stops
+	// taking traffic.
+	readyPrefetchSaturated = 0.9
+)
+
+func validateReadyChecks(checks []string) error {
+	for _, c := range checks {
+		switch c {
+		case readyCheckCacheDir, readyCheckUpstream, readyCheckPrefetchQueue:
+		default:
+			return fmt.Errorf("unknown readiness check %q (want cache_dir, upstream or prefetch_queue)", c)
+		}
+	}
+	return nil
+}
+
+// readyCheck is the outcome of one readiness check.
+type readyCheck struct {
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	// upstream
+	URL    string `json:"url,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Cached bool   `json:"cached,omitempty"`
+	// prefetch_queue
+	Depth    *int `json:"depth,omitempty"`
+	Capacity int  `json:"capacity,omitempty"`
+}
+
+// readyProber runs the readiness checks. Upstream probes bypass retries, the
+// circuit breakers and the rate limiter, so probing never trips or starves
+// them, but keep the auth and host overrides real fetches use.
+type readyProber struct {
+	client *http.Client
+
+	mu       sync.Mutex
+	lastURL  string
+	lastAt   time.Time
+	lastProb readyCheck
+}
+
+func checkCacheDirWritable(dir string) readyCheck {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err == nil {
+		_, err = f.Write([]byte("ok"))
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		return readyCheck{Error: err.Error()}
+	}
+	return readyCheck{OK: true}
+}
+
+// checkUpstream sends a HEAD for target and accepts any answer below 500.
+func (p *readyProber) checkUpstream(target string) readyCheck {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.lastURL == target && time.Since(p.lastAt) < readyUpstreamCacheFor {
+		c := p.lastProb
+		c.Cached = true
+		return c
+	}
+	c := readyCheck{URL: target}
+	req, err := http.NewRequest(http.MethodHead, target, nil)
+	if err == nil {
+		req.Header.Set("User-Agent", defaultUpstreamUserAgent)
+		var resp *http.Response
+		if resp, err = p.client.Do(req); err == nil {
+			resp.Body.Close()
+			c.Status = resp.StatusCode
+			if resp.StatusCode >= 500 {
+				err = fmt.Errorf("upstream returned %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		c.Error = err.Error()
+	} else {
+		c.OK = true
+	}
+	p.lastURL, p.lastAt, p.lastProb = target, time.Now(), c
+	return c
+}
+
+// handleReadyz reports whether this instance should receive traffic: 200
+// when every configured check passes, 503 otherwise, with details as JSON.
+func (a *appHandler) handleReadyz(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	checks := cfg.ReadyzChecks
+	if len(checks) == 0 {
+		checks = defaultReadyChecks
+	}
+	results := map[string]readyCheck{}
+	ready := true
+	for _, name := range checks {
+		start := time.Now()
+		var c readyCheck
+		switch name {
+		case readyCheckCacheDir:
+			c = checkCacheDirWritable(cfg.CacheDir)
+		case readyCheckUpstream:
+			path := cfg.ReadyzUpstreamPath
+			if path == "" {
+				path = "/"
+			}
+			c = a.prober.checkUpstream(strings.TrimRight(cfg.BBaseURL, "/") + "/" + strings.TrimLeft(path, "/"))
+		case readyCheckPrefetchQueue:
+			depth, capacity := a.pf.queueDepth()
+			c = readyCheck{OK: float64(depth) < readyPrefetchSaturated*float64(capacity), Depth: &depth, Capacity: capacity}
+			if !c.OK {
+				c.Error = "prefetch queue saturated"
+			}
+		}
+		if !c.Cached {
+			c.DurationMs = time.Since(start).Milliseconds()
+		}
+		results[name] = c
+		ready = ready && c.OK
+	}
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "not_ready", http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": results})
+}
@@ -1,7 +1,11 @@
-package main
+package rerouter
 
 import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
     "net/http"
+    "strconv"
     "time"
 )
 
@@ -18,15 +22,53 @@ func copyImportantHeaders(dst http.ResponseWriter, src *http.Response) {
     }
 }
 
-func serveFromCache(w http.ResponseWriter, ce *cacheEntry) {
-    w.Header().Set("X-Cache", "HIT")
+func serveFromCache(w http.ResponseWriter, r *http.Request, ce *cacheEntry) {
+    serveCacheEntry(w, r, ce, "HIT")
+}
+
+// serveStaleFromCache serves an expired entry while the upstream is failing.
+func serveStaleFromCache(w http.ResponseWriter, r *http.Request, ce *cacheEntry) {
+    serveCacheEntry(w, r, ce, "STALE")
+}
+
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, ce *cacheEntry, xCache string) {
+    w.Header().Set("X-Cache", xCache)
     setCacheMetaHeaders(w, ce)
     for k, v := range ce.Header {
         w.Header().Set(k, v)
     }
-    w.WriteHeader(ce.Status)
-    if len(ce.Body) > 0 {
-        _, _ = w.Write(ce.Body)
+    serveBody(w, r, ce.Status, ce.Body)
+}
+
+// serveBody sends a bot-served body. 200 responses always carry an ETag
+// (B's, or a hash of the body when B's was dropped by rewriting) and honour
+// If-None-Match (304), Range (206/416) and If-Range.
+func serveBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+    if status != http.StatusOK {
+        writeBody(w, r, status, body)
+        return
+    }
+    if w.Header().Get("ETag") == "" {
+        w.Header().Set("ETag", bodyETag(body))
+    }
+    http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// bodyETag returns a strong ETag for body.
+func bodyETag(body []byte) string {
+    h := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+// writeBody sends status and body with an exact Content-Length. HEAD gets the
+// same headers as the matching GET, without the body.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, body []byte) {
+    if status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified {
+        w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+    }
+    w.WriteHeader(status)
+    if r.Method != http.MethodHead && len(body) > 0 {
+        _, _ = w.Write(body)
     }
 }
 
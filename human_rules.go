@@ -0,0 +1,79 @@
+package rerouter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Human visitor handling modes accepted in cfg.HumanMode and HumanRule.Action.
+const (
+	// Redirect to the B site (the default).
+	humanModeRedirect = "redirect"
+	// Reverse-proxy B through A with rewritten pages, uncached.
+	humanModeProxy = "proxy"
+	// Serve the cached copy exactly like bots get it.
+	humanModeCache = "cache"
+	// Answer 404.
+	humanModeBlock = "block"
+)
+
+// HumanRule sets how human visitors are handled on paths matching Pattern,
+// overriding HumanMode.
+type HumanRule struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+}
+
+func validHumanMode(m string) bool {
+	switch m {
+	case humanModeRedirect, humanModeProxy, humanModeCache, humanModeBlock:
+		return true
+	}
+	return false
+}
+
+// parseHumanRules parses "pattern=action" entries separated by semicolons,
+// e.g. "/feeds/*=cache;/checkout/=redirect;/internal/=block".
+func parseHumanRules(v string) ([]HumanRule, error) {
+	out := []HumanRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pat, action, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid human rule %q", p)
+		}
+		rule := HumanRule{Pattern: strings.TrimSpace(pat), Action: strings.ToLower(strings.TrimSpace(action))}
+		if err := validateHumanRule(rule); err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func validateHumanRule(r HumanRule) error {
+	if r.Pattern == "" {
+		return fmt.Errorf("human rule needs a pattern")
+	}
+	if !validHumanMode(r.Action) {
+		return fmt.Errorf("human rule %q: unknown action %q (want redirect, proxy, cache or block)", r.Pattern, r.Action)
+	}
+	return nil
+}
+
+// humanModeFor returns how a human request for reqPath is handled: the action
+// of the first matching rule, else HumanMode.
+func humanModeFor(cfg *Config, reqPath string) string {
+	for _, r := range cfg.HumanRules {
+		if patternsMatch([]string{r.Pattern}, reqPath) {
+			return r.Action
+		}
+	}
+	if cfg.HumanMode == "" {
+		return humanModeRedirect
+	}
+	return cfg.HumanMode
+}
@@ -0,0 +1,163 @@
+package logger
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Access log formats.
+const (
+    AccessFormatJSON     = "json"
+    AccessFormatCombined = "combined" // Apache/NCSA combined
+    AccessFormatCommon   = "common"   // Common Log Format
+)
+
+// ValidAccessFormat reports whether f names an access log format.
+func ValidAccessFormat(f string) bool {
+    switch f {
+    case "", AccessFormatJSON, AccessFormatCombined, AccessFormatCommon:
+        return true
+    }
+    return false
+}
+
+// AccessConfig configures the dedicated access log. Rotation works as for
+// the app log (Config); Level is ignored.
+type AccessConfig struct {
+    Config
+    Format string
+}
+
+// AccessRecord is one served request.
+type AccessRecord struct {
+    Time       time.Time
+    RequestID  string
+    Method     string
+    URI        string
+    Proto      string
+    Remote     string // client address, host or host:port
+    User       string // authenticated user, if any
+    Status     int
+    Bytes      int
+    Duration   time.Duration
+    Referer    string
+    UserAgent  string
+    TraceID    string // OpenTelemetry trace, when tracing is on
+    Country    string // GeoIP country of the client, when a database is set
+}
+
+var (
+    access       *Logger
+    accessFormat string
+)
+
+// InitAccess sends access records to their own file instead of the app log.
+// An empty File keeps them in the app log as "access" events.
+func InitAccess(cfg AccessConfig) error {
+    if cfg.File == "" {
+        access = nil
+        return nil
+    }
+    if err := os.MkdirAll(filepath.Dir(cfg.File), 0o755); err != nil {
+        return err
+    }
+    f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+    if err != nil {
+        return err
+    }
+    access = &Logger{file: f, cfg: cfg.Config}
+    accessFormat = cfg.Format
+    return nil
+}
+
+// CloseAccess closes the access log file; later records go to the app log.
+func CloseAccess() {
+    if access != nil && access.file != nil {
+        _ = access.file.Close()
+    }
+    access = nil
+}
+
+// Access records one served request.
+func Access(rec AccessRecord) {
+    if access == nil {
+        Infow("access", rec.fields())
+        return
+    }
+    line := rec.format(accessFormat)
+    access.mu.Lock()
+    defer access.mu.Unlock()
+    access.rotateIfNeededLocked()
+    if access.file != nil {
+        fmt.Fprintln(access.file, line)
+    }
+}
+
+func (rec AccessRecord) fields() map[string]interface{} {
+    fields := map[string]interface{}{
+        "req_id": rec.RequestID,
+        "method": rec.Method,
+        "path": rec.URI,
+        "remote": rec.Remote,
+        "status": rec.Status,
+        "bytes": rec.Bytes,
+        "duration_ms": rec.Duration.Milliseconds(),
+        "ua": rec.UserAgent,
+    }
+    if rec.TraceID != "" {
+        fields["trace_id"] = rec.TraceID
+    }
+    if rec.Country != "" {
+        fields["country"] = rec.Country
+    }
+    return fields
+}
+
+func (rec AccessRecord) format(f string) string {
+    switch f {
+    case AccessFormatCombined, AccessFormatCommon:
+        host := rec.Remote
+        if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+            host = host[:i]
+        }
+        host = strings.Trim(host, "[]")
+        bytes := "-"
+        if rec.Bytes > 0 {
+            bytes = strconv.Itoa(rec.Bytes)
+        }
+        line := fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`, dash(host), dash(rec.User),
+            rec.Time.Format("02/Jan/2006:15:04:05 -0700"), rec.Method, escapeQuoted(rec.URI), rec.Proto, rec.Status, bytes)
+        if f == AccessFormatCombined {
+            line += fmt.Sprintf(` "%s" "%s"`, dash(escapeQuoted(rec.Referer)), dash(escapeQuoted(rec.UserAgent)))
+        }
+        return line
+    }
+    fields := rec.fields()
+    fields["ts"] = rec.Time.UTC().Format(time.RFC3339Nano)
+    fields["proto"] = rec.Proto
+    if rec.Referer != "" {
+        fields["referer"] = rec.Referer
+    }
+    if rec.User != "" {
+        fields["user"] = rec.User
+    }
+    b, _ := json.Marshal(fields)
+    return string(b)
+}
+
+func dash(s string) string {
+    if s == "" { return "-" }
+    return s
+}
+
+// escapeQuoted escapes quotes and control characters so a value cannot break
+// out of its quoted log field.
+func escapeQuoted(s string) string {
+    q := strconv.Quote(s)
+    return q[1 : len(q)-1]
+}
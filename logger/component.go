@@ -0,0 +1,114 @@
+package logger
+
+import (
+    "fmt"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Components group events by name for per-component levels: events are
+// named "<component>_..." (prefetch_fetch_error, sitemap_cache_job_started,
+// cache_store); everything else belongs to the request handler.
+const (
+    ComponentHandler  = "handler"
+    ComponentPrefetch = "prefetch"
+    ComponentSitemap  = "sitemap"
+    ComponentCache    = "cache"
+)
+
+// Components lists the component names accepted in per-component levels.
+var Components = []string{ComponentHandler, ComponentPrefetch, ComponentSitemap, ComponentCache}
+
+// Console outputs.
+const (
+    OutputStdout = "stdout"
+    OutputStderr = "stderr"
+    OutputNone   = "none" // file only
+)
+
+// ValidOutput reports whether o names a console output.
+func ValidOutput(o string) bool {
+    switch o {
+    case "", OutputStdout, OutputStderr, OutputNone:
+        return true
+    }
+    return false
+}
+
+// Component returns the component an event belongs to.
+func Component(event string) string {
+    for _, c := range Components[1:] {
+        if strings.HasPrefix(event, c+"_") {
+            return c
+        }
+    }
+    return ComponentHandler
+}
+
+// ParseModuleLevels checks per-component level names ("cache": "warn").
+func ParseModuleLevels(m map[string]string) (map[string]Level, error) {
+    out := make(map[string]Level, len(m))
+    for c, lvl := range m {
+        c = strings.ToLower(strings.TrimSpace(c))
+        known := false
+        for _, k := range Components {
+            known = known || k == c
+        }
+        if !known {
+            return nil, fmt.Errorf("unknown log component %q (want %s)", c, strings.Join(Components, ", "))
+        }
+        switch strings.ToLower(strings.TrimSpace(lvl)) {
+        case "debug", "info", "warn", "warning", "error":
+        default:
+            return nil, fmt.Errorf("invalid log level %q for component %s", lvl, c)
+        }
+        out[c] = ParseLevel(lvl)
+    }
+    return out, nil
+}
+
+// sampler thins out high-volume debug events: per event name and second, the
+// first `initial` entries are logged, then every `thereafter`th.
+type sampler struct {
+    initial    int64
+    thereafter int64
+
+    mu     sync.Mutex
+    counts map[string]*sampleCount
+}
+
+type sampleCount struct {
+    second int64
+    n      int64
+}
+
+func newSampler(initial, thereafter int) *sampler {
+    if initial <= 0 {
+        return nil
+    }
+    return &sampler{initial: int64(initial), thereafter: int64(thereafter), counts: map[string]*sampleCount{}}
+}
+
+// allow reports whether the next entry of event at now is logged.
+func (s *sampler) allow(event string, now time.Time) bool {
+    if s == nil {
+        return true
+    }
+    sec := now.Unix()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    c := s.counts[event]
+    if c == nil {
+        c = &sampleCount{}
+        s.counts[event] = c
+    }
+    if c.second != sec {
+        c.second, c.n = sec, 0
+    }
+    c.n++
+    if c.n <= s.initial {
+        return true
+    }
+    return s.thereafter > 0 && (c.n-s.initial)%s.thereafter == 0
+}
@@ -3,6 +3,7 @@ package logger
 import (
     "encoding/json"
     "fmt"
+    "io"
     "os"
     "path/filepath"
     "sort"
@@ -35,10 +36,19 @@ func ParseLevel(s string) Level {
 
 type Config struct {
     Level       Level
+    Modules     map[string]Level // per-component levels overriding Level
+    Output      string // console output: stdout (default), stderr or none
     File        string // path to log file; if empty, file logging disabled
     MaxSizeMB   int    // rotate when size exceeds this (0 disables)
     MaxBackups  int    // keep at most N rotated files (0 disables cleanup)
     MaxAgeDays  int    // remove rotated files older than this (0 disables)
+    // Debug sampling: per event and second, log the first SampleInitial
+    // entries, then every SampleThereafter-th (0 drops the rest).
+    // SampleInitial 0 disables sampling.
+    SampleInitial    int
+    SampleThereafter int
+    // Sinks also receive every logged line (syslog, HTTP, Loki).
+    Sinks []Sink
 }
 
 type entry struct {
@@ -49,16 +59,25 @@ type entry struct {
 }
 
 type Logger struct {
-    mu     sync.Mutex
-    level  Level
-    file   *os.File
-    cfg    Config
+    mu      sync.Mutex
+    level   Level
+    console io.Writer // nil when Output is none
+    file    *os.File
+    cfg     Config
+    sampler *sampler
 }
 
 var global *Logger
 
 func Init(cfg Config) error {
-    l := &Logger{level: cfg.Level, cfg: cfg}
+    l := &Logger{level: cfg.Level, cfg: cfg, sampler: newSampler(cfg.SampleInitial, cfg.SampleThereafter)}
+    switch cfg.Output {
+    case OutputStderr:
+        l.console = os.Stderr
+    case OutputNone:
+    default:
+        l.console = os.Stdout
+    }
     if cfg.File != "" {
         if err := os.MkdirAll(filepath.Dir(cfg.File), 0o755); err != nil {
             return err
@@ -73,17 +92,25 @@ func Init(cfg Config) error {
     return nil
 }
 
+// Close closes the log file and flushes and closes the sinks.
 func Close() {
-    if global != nil && global.file != nil {
+    if global == nil {
+        return
+    }
+    if global.file != nil {
         _ = global.file.Close()
     }
+    for _, s := range global.cfg.Sinks {
+        _ = s.Close()
+    }
 }
 
 func L() *Logger { return global }
 
 func (l *Logger) log(lvl Level, msg string, fields map[string]interface{}) {
     if l == nil { return }
-    if lvl < l.level { return }
+    if lvl < l.levelFor(msg) { return }
+    if lvl == Debug && !l.sampler.allow(msg, time.Now()) { return }
     e := entry{
         Time:    time.Now().UTC().Format(time.RFC3339Nano),
         Level:   levelString(lvl),
@@ -93,8 +120,9 @@ func (l *Logger) log(lvl Level, msg string, fields map[string]interface{}) {
     b, _ := json.Marshal(e)
     l.mu.Lock()
     defer l.mu.Unlock()
-    // Console always
-    fmt.Fprintln(os.Stdout, string(b))
+    if l.console != nil {
+        fmt.Fprintln(l.console, string(b))
+    }
     // File with rotation
     if l.file != nil {
         l.rotateIfNeededLocked()
@@ -102,6 +130,17 @@ func (l *Logger) log(lvl Level, msg string, fields map[string]interface{}) {
             fmt.Fprintln(l.file, string(b))
         }
     }
+    for _, s := range l.cfg.Sinks {
+        s.Write(lvl, b)
+    }
+}
+
+// levelFor is the minimum level logged for event, per its component.
+func (l *Logger) levelFor(event string) Level {
+    if lvl, ok := l.cfg.Modules[Component(event)]; ok {
+        return lvl
+    }
+    return l.level
 }
 
 func (l *Logger) rotateIfNeededLocked() {
@@ -6,10 +6,24 @@ import (
     "runtime"
     "strconv"
     "strings"
+    "sync"
     "syscall"
     "time"
 )
 
+var (
+    sourcesMu sync.Mutex
+    sources   []func() map[string]interface{}
+)
+
+// AddMetricsSource registers fn; the fields it returns are added to every
+// system_metrics line.
+func AddMetricsSource(fn func() map[string]interface{}) {
+    sourcesMu.Lock()
+    defer sourcesMu.Unlock()
+    sources = append(sources, fn)
+}
+
 // StartMetricsLogger periodically logs system and process metrics.
 // diskPath controls where to sample disk usage (e.g., cache dir); if empty, "/".
 func StartMetricsLogger(interval time.Duration, diskPath string) chan struct{} {
@@ -63,6 +77,13 @@ func logMetrics(diskPath string) {
         "mem_total_mb": memTotalMB,
         "mem_free_mb": memFreeMB,
     }
+    sourcesMu.Lock()
+    for _, fn := range sources {
+        for k, v := range fn() {
+            fields[k] = v
+        }
+    }
+    sourcesMu.Unlock()
     Infow("system_metrics", fields)
 }
 
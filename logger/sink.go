@@ -0,0 +1,241 @@
+package logger
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "log/syslog"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Sink ships log lines somewhere besides the console and file. Lines are the
+// same JSON entries; Write must not block on the network.
+type Sink interface {
+    Write(lvl Level, line []byte)
+    Close() error
+}
+
+// Batching of the HTTP and Loki sinks: a batch is sent when it reaches
+// sinkBatchSize lines or every sinkFlushInterval. Lines beyond sinkMaxPending
+// are dropped while the endpoint is slow or down.
+const (
+    sinkBatchSize     = 200
+    sinkFlushInterval = 2 * time.Second
+    sinkMaxPending    = 10000
+    sinkSendTimeout   = 10 * time.Second
+)
+
+// syslogSink sends each line to syslog with the priority of its level.
+type syslogSink struct {
+    w *syslog.Writer
+}
+
+// NewSyslogSink connects to syslog at target: "local" for the local daemon,
+// or udp://host:port, tcp://host:port.
+func NewSyslogSink(target, tag string) (Sink, error) {
+    if err := ValidateSyslogTarget(target); err != nil {
+        return nil, err
+    }
+    network, addr := "", ""
+    if u, _ := url.Parse(target); target != "local" {
+        network, addr = u.Scheme, u.Host
+    }
+    w, err := syslog.Dial(network, addr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+    if err != nil {
+        return nil, err
+    }
+    return &syslogSink{w: w}, nil
+}
+
+// ValidateSyslogTarget checks a NewSyslogSink target without connecting.
+func ValidateSyslogTarget(target string) error {
+    if target == "local" {
+        return nil
+    }
+    u, err := url.Parse(target)
+    if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+        return fmt.Errorf("syslog target %q must be local, udp://host:port or tcp://host:port", target)
+    }
+    return nil
+}
+
+func (s *syslogSink) Write(lvl Level, line []byte) {
+    msg := string(line)
+    switch lvl {
+    case Debug:
+        _ = s.w.Debug(msg)
+    case Warn:
+        _ = s.w.Warning(msg)
+    case Error:
+        _ = s.w.Err(msg)
+    default:
+        _ = s.w.Info(msg)
+    }
+}
+
+func (s *syslogSink) Close() error { return s.w.Close() }
+
+type sinkLine struct {
+    at   time.Time
+    lvl  Level
+    line []byte
+}
+
+// batchSink queues lines and sends them in batches from a background goroutine.
+type batchSink struct {
+    name    string
+    send    func([]sinkLine) error
+    mu      sync.Mutex
+    pending []sinkLine
+    dropped int
+    kick    chan struct{}
+    stop    chan struct{}
+    done    chan struct{}
+}
+
+func newBatchSink(name string, send func([]sinkLine) error) *batchSink {
+    s := &batchSink{name: name, send: send, kick: make(chan struct{}, 1), stop: make(chan struct{}), done: make(chan struct{})}
+    go s.loop()
+    return s
+}
+
+func (s *batchSink) Write(lvl Level, line []byte) {
+    s.mu.Lock()
+    if len(s.pending) >= sinkMaxPending {
+        s.dropped++
+        s.mu.Unlock()
+        return
+    }
+    s.pending = append(s.pending, sinkLine{at: time.Now(), lvl: lvl, line: append([]byte(nil), line...)})
+    full := len(s.pending) >= sinkBatchSize
+    s.mu.Unlock()
+    if full {
+        select {
+        case s.kick <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// Close sends what is queued and stops the sink.
+func (s *batchSink) Close() error {
+    close(s.stop)
+    <-s.done
+    return nil
+}
+
+func (s *batchSink) loop() {
+    defer close(s.done)
+    t := time.NewTicker(sinkFlushInterval)
+    defer t.Stop()
+    for {
+        select {
+        case <-t.C:
+        case <-s.kick:
+        case <-s.stop:
+            s.flush()
+            return
+        }
+        s.flush()
+    }
+}
+
+func (s *batchSink) flush() {
+    s.mu.Lock()
+    batch, dropped := s.pending, s.dropped
+    s.pending, s.dropped = nil, 0
+    s.mu.Unlock()
+    // Failures go to stderr: logging them would feed the sink itself
+    if dropped > 0 {
+        fmt.Fprintf(os.Stderr, "log sink %s: dropped %d lines\n", s.name, dropped)
+    }
+    for len(batch) > 0 {
+        n := min(len(batch), sinkBatchSize)
+        if err := s.send(batch[:n]); err != nil {
+            fmt.Fprintf(os.Stderr, "log sink %s: %v (%d lines lost)\n", s.name, err, n)
+        }
+        batch = batch[n:]
+    }
+}
+
+func postSink(client *http.Client, endpoint, contentType string, headers map[string]string, body []byte) error {
+    req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", contentType)
+    for k, v := range headers {
+        req.Header.Set(k, v)
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode/100 != 2 {
+        return fmt.Errorf("%s returned %d", endpoint, resp.StatusCode)
+    }
+    return nil
+}
+
+// ValidateSinkURL checks an HTTP or Loki sink endpoint.
+func ValidateSinkURL(endpoint string) error {
+    u, err := url.Parse(endpoint)
+    if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+        return fmt.Errorf("log sink URL %q must be http(s)://host/...", endpoint)
+    }
+    return nil
+}
+
+// NewHTTPSink posts batches of lines to endpoint as newline-delimited JSON.
+func NewHTTPSink(endpoint string, headers map[string]string) (Sink, error) {
+    if err := ValidateSinkURL(endpoint); err != nil {
+        return nil, err
+    }
+    client := &http.Client{Timeout: sinkSendTimeout}
+    return newBatchSink("http", func(batch []sinkLine) error {
+        var body bytes.Buffer
+        for _, l := range batch {
+            body.Write(l.line)
+            body.WriteByte('\n')
+        }
+        return postSink(client, endpoint, "application/x-ndjson", headers, body.Bytes())
+    }), nil
+}
+
+// NewLokiSink pushes batches of lines to Loki's push API. A base URL without
+// a path gets /loki/api/v1/push; each stream carries labels plus "level".
+func NewLokiSink(endpoint string, labels, headers map[string]string) (Sink, error) {
+    if err := ValidateSinkURL(endpoint); err != nil {
+        return nil, err
+    }
+    if u, _ := url.Parse(endpoint); strings.Trim(u.Path, "/") == "" {
+        endpoint = strings.TrimRight(endpoint, "/") + "/loki/api/v1/push"
+    }
+    client := &http.Client{Timeout: sinkSendTimeout}
+    return newBatchSink("loki", func(batch []sinkLine) error {
+        byLevel := map[Level][][2]string{}
+        for _, l := range batch {
+            byLevel[l.lvl] = append(byLevel[l.lvl], [2]string{strconv.FormatInt(l.at.UnixNano(), 10), string(l.line)})
+        }
+        streams := make([]interface{}, 0, len(byLevel))
+        for lvl, values := range byLevel {
+            stream := map[string]string{"level": levelString(lvl)}
+            for k, v := range labels {
+                stream[k] = v
+            }
+            streams = append(streams, map[string]interface{}{"stream": stream, "values": values})
+        }
+        body, err := json.Marshal(map[string]interface{}{"streams": streams})
+        if err != nil {
+            return err
+        }
+        return postSink(client, endpoint, "application/json", headers, body)
+    }), nil
+}
@@ -1,10 +1,12 @@
-package main
+package rerouter
 
 import (
     "context"
     "fmt"
     "net/http"
+    "net/url"
     "os"
+    "strings"
     "time"
     "rerouter/logger"
 )
@@ -13,6 +15,30 @@ type ctxKey string
 
 const requestIDKey ctxKey = "req_id"
 
+// accessNoteKey is the context key of the request's accessNote.
+const accessNoteKey ctxKey = "access_note"
+
+// accessNote carries what handlers learn about a request into its access record.
+type accessNote struct {
+    country string
+    // remote is the client per the serving config's trusted proxies.
+    remote string
+}
+
+// accessNoteFrom returns the note of the request, or nil outside loggingMiddleware.
+func accessNoteFrom(ctx context.Context) *accessNote {
+    n, _ := ctx.Value(accessNoteKey).(*accessNote)
+    return n
+}
+
+// remoteOr returns the remote a handler recorded, or peer when none did.
+func (n *accessNote) remoteOr(peer string) string {
+    if n.remote == "" {
+        return peer
+    }
+    return n.remote
+}
+
 func withRequestID(ctx context.Context, id string) context.Context {
     return context.WithValue(ctx, requestIDKey, id)
 }
@@ -35,6 +61,23 @@ func newRequestID() string {
     return fmt.Sprintf("%x", b)
 }
 
+// validRequestID accepts inbound request IDs of up to 128 URL- and
+// log-safe characters, so they cannot forge log fields or headers.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 128 {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case strings.ContainsRune("-_.:/+=@", c):
+        default:
+            return false
+        }
+    }
+    return true
+}
+
 // indirection for testing
 var randRead = func(b []byte) (int, error) { return randReader.Read(b) }
 
@@ -59,26 +102,68 @@ func readFromDevURandom(b []byte) (int, error) {
 // loggingMiddleware wraps an http.Handler to add request ID and access log
 func loggingMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        rid := newRequestID()
-        r = r.WithContext(withRequestID(r.Context(), rid))
+        // Keep the ID a load balancer or the client already assigned
+        rid := r.Header.Get("X-Request-ID")
+        if !validRequestID(rid) {
+            rid = newRequestID()
+        }
+        ctx, sp := startSpan(withTraceparent(r.Context(), r.Header.Get("traceparent"), r.Header.Get("tracestate")), "HTTP "+r.Method, spanKindServer)
+        note := &accessNote{}
+        r = r.WithContext(context.WithValue(withRequestID(ctx, rid), accessNoteKey, note))
         w.Header().Set("X-Request-ID", rid)
         sw := &statusWriter{ResponseWriter: w, status: 200}
         start := time.Now()
         next.ServeHTTP(sw, r)
-        dur := time.Since(start)
-        logger.Infow("access", map[string]interface{}{
-            "req_id": rid,
-            "method": r.Method,
-            "path": r.URL.RequestURI(),
-            "remote": r.RemoteAddr,
-            "status": sw.status,
-            "bytes": sw.written,
-            "duration_ms": dur.Milliseconds(),
-            "ua": r.UserAgent(),
+        user, _, _ := r.BasicAuth()
+        if sp != nil {
+            sp.setAttr("http.request.method", r.Method)
+            sp.setAttr("url.path", r.URL.Path)
+            sp.setAttr("user_agent.original", r.UserAgent())
+            sp.setAttr("http.response.status_code", sw.status)
+            sp.setAttr("rerouter.req_id", rid)
+            if xc := sw.Header().Get("X-Cache"); xc != "" {
+                sp.setAttr("rerouter.cache", xc)
+            }
+            if sw.status >= 500 {
+                sp.setError(fmt.Errorf("status %d", sw.status))
+            }
+            sp.finish()
+        }
+        logger.Access(logger.AccessRecord{
+            Time:      start,
+            RequestID: rid,
+            Method:    r.Method,
+            URI:       accessLogURI(r.URL),
+            Proto:     r.Proto,
+            Remote:    note.remoteOr(r.RemoteAddr),
+            User:      user,
+            Status:    sw.status,
+            Bytes:     sw.written,
+            Duration:  time.Since(start),
+            Referer:   r.Referer(),
+            UserAgent: r.UserAgent(),
+            TraceID:   sp.traceIDString(),
+            Country:   note.country,
         })
     })
 }
 
+// accessLogURI is the request URI as logged, with an admin ?token= masked.
+func accessLogURI(u *url.URL) string {
+    if !strings.Contains(u.RawQuery, "token=") {
+        return u.RequestURI()
+    }
+    parts := strings.Split(u.RawQuery, "&")
+    for i, p := range parts {
+        if strings.HasPrefix(p, "token=") {
+            parts[i] = "token=REDACTED"
+        }
+    }
+    c := *u
+    c.RawQuery = strings.Join(parts, "&")
+    return c.RequestURI()
+}
+
 type statusWriter struct {
     http.ResponseWriter
     status  int
@@ -95,3 +180,8 @@ func (w *statusWriter) Write(b []byte) (int, error) {
     w.written += n
     return n, err
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer (flushing, deadlines).
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
+}
@@ -0,0 +1,375 @@
+package rerouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// stripHTMLSelectors removes elements matching any of sels, with their
+// content, from an HTML document.
+func stripHTMLSelectors(body []byte, sels []string) ([]byte, bool) {
+	var parsed []htmlSelector
+	for _, s := range sels {
+		if hs, ok := parseHTMLSelector(s); ok {
+			parsed = append(parsed, hs)
+		}
+	}
+	if len(parsed) == 0 {
+		return body, false
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body))
+	changed := false
+	// Open stripped element: its tag name and nesting depth.
+	skipTag, skipDepth := "", 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if !changed {
+				return body, false
+			}
+			out.Write(z.Raw())
+			return out.Bytes(), true
+		}
+		raw := z.Raw()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if skipDepth > 0 {
+				if tt == html.StartTagToken && tok.Data == skipTag {
+					skipDepth++
+				}
+				continue
+			}
+			matched := false
+			for _, sel := range parsed {
+				if sel.matches(tok) {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				changed = true
+				if tt == html.StartTagToken && !htmlVoidElements[tok.Data] {
+					skipTag, skipDepth = tok.Data, 1
+				}
+				continue
+			}
+		case html.EndTagToken:
+			if skipDepth > 0 {
+				if name, _ := z.TagName(); string(name) == skipTag {
+					skipDepth--
+				}
+				continue
+			}
+		default:
+			if skipDepth > 0 {
+				continue
+			}
+		}
+		out.Write(raw)
+	}
+}
+
+// htmlBlockElements are elements whose boundaries make surrounding
+// whitespace insignificant by default, so whitespace-only text next to them
+// can be dropped.
+var htmlBlockElements = map[string]bool{
+	"html": true, "head": true, "body": true, "title": true, "meta": true, "link": true, "script": true, "style": true, "base": true, "noscript": true,
+	"div": true, "p": true, "ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true, "section": true, "article": true, "aside": true,
+	"header": true, "footer": true, "nav": true, "main": true, "figure": true, "figcaption": true, "form": true, "fieldset": true, "hr": true, "br": true,
+	"table": true, "thead": true, "tbody": true, "tfoot": true, "tr": true, "td": true, "th": true, "caption": true, "blockquote": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "option": true, "template": true,
+}
+
+// minifyHTML drops comments (except IE conditional comments), collapses
+// whitespace in text, drops whitespace-only text next to block elements and
+// minifies inline <style>, JavaScript and JSON-LD. <pre> and <textarea>
+// content is kept as is.
+func minifyHTML(body []byte) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body))
+	preDepth := 0
+	// Raw text handling for the current <script>/<style>: "js", "json", "css" or "keep".
+	rawText := ""
+	afterBlock := true
+	var pendingSpace bool
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := z.Raw()
+		switch tt {
+		case html.CommentToken:
+			if bytes.HasPrefix(raw, []byte("<!--[if")) {
+				out.Write(raw)
+			}
+			continue
+		case html.TextToken:
+			switch {
+			case rawText == "js":
+				out.WriteString(minifyJS(string(raw)))
+			case rawText == "css":
+				out.WriteString(minifyCSS(string(raw)))
+			case rawText == "json":
+				var buf bytes.Buffer
+				if json.Compact(&buf, bytes.TrimSpace(raw)) == nil {
+					out.Write(buf.Bytes())
+				} else {
+					out.Write(raw)
+				}
+			case rawText != "" || preDepth > 0:
+				out.Write(raw)
+			default:
+				text := collapseHTMLSpace(string(raw))
+				if strings.TrimSpace(text) == "" {
+					// Decided by the next tag: dropped before a block element
+					pendingSpace = !afterBlock
+					continue
+				}
+				if afterBlock {
+					text = strings.TrimLeft(text, " ")
+				} else if pendingSpace && text[0] != ' ' {
+					out.WriteByte(' ')
+				}
+				pendingSpace = false
+				out.WriteString(text)
+				afterBlock = false
+			}
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			tok := z.Token()
+			block := htmlBlockElements[tok.Data]
+			if pendingSpace && !block {
+				out.WriteByte(' ')
+			}
+			pendingSpace = false
+			afterBlock = block
+			switch {
+			case tt == html.EndTagToken:
+				rawText = ""
+				if tok.Data == "pre" || tok.Data == "textarea" {
+					preDepth = max(preDepth-1, 0)
+				}
+			case tt == html.StartTagToken && (tok.Data == "pre" || tok.Data == "textarea"):
+				preDepth++
+			case tt == html.StartTagToken && tok.Data == "style":
+				rawText = "css"
+			case tt == html.StartTagToken && tok.Data == "script":
+				rawText = "keep"
+				if isJSONLDScript(tok) {
+					rawText = "json"
+				} else if t := strings.ToLower(strings.TrimSpace(attrVal(tok, "type"))); t == "" || t == "module" || isJavaScriptType(t) {
+					rawText = "js"
+				}
+			}
+		}
+		out.Write(raw)
+	}
+	if out.Len() >= len(body) {
+		return body, false
+	}
+	return out.Bytes(), true
+}
+
+// collapseHTMLSpace replaces each run of HTML whitespace with one space.
+func collapseHTMLSpace(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	space := false
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' {
+			if !space {
+				b.WriteByte(' ')
+			}
+			space = true
+			continue
+		}
+		space = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// minifyCSS removes comments (keeping /*! license comments), collapses
+// whitespace and drops it around punctuation where CSS ignores it. Quoted
+// strings are kept as is; spaces around + and - stay, as calc() needs them,
+// and so do spaces before ":" in selectors, where they separate a descendant
+// pseudo-class.
+func minifyCSS(css string) string {
+	b := make([]byte, 0, len(css))
+	space := false
+	// Whether each open block holds declarations rather than rules (@media).
+	var blocks []bool
+	prelude := 0
+	flushSpace := func(next byte) {
+		inDecl := len(blocks) > 0 && blocks[len(blocks)-1]
+		if space && len(b) > 0 && !strings.ContainsRune("{};,>", rune(next)) && !(next == ':' && inDecl) &&
+			!strings.ContainsRune("{};:,>", rune(b[len(b)-1])) && !bytes.HasSuffix(b, []byte("*/")) {
+			b = append(b, ' ')
+		}
+		space = false
+	}
+	for i := 0; i < len(css); i++ {
+		c := css[i]
+		switch {
+		case c == '/' && i+1 < len(css) && css[i+1] == '*':
+			end := strings.Index(css[i+2:], "*/")
+			if end < 0 {
+				end = len(css) - i - 2
+			}
+			if i+2 < len(css) && css[i+2] == '!' {
+				flushSpace(c)
+				b = append(b, css[i:min(i+end+4, len(css))]...)
+			}
+			i += end + 3
+		case c == '"' || c == '\'':
+			flushSpace(c)
+			j := i + 1
+			for j < len(css) && css[j] != c {
+				if css[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			b = append(b, css[i:min(j+1, len(css))]...)
+			i = j
+		case isCSSSpace(c):
+			space = true
+		default:
+			if c == '}' && len(b) > 0 && b[len(b)-1] == ';' {
+				b = b[:len(b)-1]
+			}
+			flushSpace(c)
+			switch c {
+			case '{':
+				p := strings.TrimSpace(string(b[prelude:]))
+				blocks = append(blocks, !strings.HasPrefix(p, "@") || strings.HasPrefix(p, "@font-face") || strings.HasPrefix(p, "@page"))
+			case '}':
+				if len(blocks) > 0 {
+					blocks = blocks[:len(blocks)-1]
+				}
+			}
+			b = append(b, c)
+			if c == '{' || c == '}' || c == ';' {
+				prelude = len(b)
+			}
+		}
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// minifyJS removes comments (keeping /*! license comments) and collapses
+// whitespace runs to one space, or one newline when the run had one so
+// automatic semicolon insertion still applies. Strings, template literals
+// and regular expression literals are copied as is.
+func minifyJS(js string) string {
+	var b strings.Builder
+	b.Grow(len(js))
+	// Last significant byte written, used to tell a regex literal from division.
+	last := byte(0)
+	ws := byte(0)
+	flush := func(next byte) {
+		if ws == '\n' && (strings.IndexByte(";{,([", last) >= 0 || strings.IndexByte(";}),]", next) >= 0) {
+			// No statement can end here, so the newline is not needed for ASI
+			ws = ' '
+		}
+		if ws != 0 && last != 0 {
+			if ws == '\n' || (isJSIdentByte(last) && isJSIdentByte(next)) || (last == next && (last == '+' || last == '-')) {
+				b.WriteByte(ws)
+			}
+		}
+		ws = 0
+	}
+	for i := 0; i < len(js); i++ {
+		c := js[i]
+		switch {
+		case c == '/' && i+1 < len(js) && js[i+1] == '/':
+			end := strings.IndexByte(js[i:], '\n')
+			if end < 0 {
+				i = len(js)
+				continue
+			}
+			i += end - 1
+		case c == '/' && i+1 < len(js) && js[i+1] == '*':
+			end := strings.Index(js[i+2:], "*/")
+			if end < 0 {
+				end = len(js) - i - 2
+			}
+			if i+2 < len(js) && js[i+2] == '!' {
+				flush(c)
+				b.WriteString(js[i:min(i+end+4, len(js))])
+				last = '/'
+			} else if ws == 0 {
+				ws = ' '
+			}
+			i += end + 3
+		case c == '"' || c == '\'' || c == '`' || (c == '/' && (last == 0 || strings.IndexByte("(,=:[!&|?{};+-*%<>~^", last) >= 0 || jsKeywordBeforeRegex(b.String()))):
+			flush(c)
+			j := i + 1
+			inClass := false
+			for j < len(js) {
+				d := js[j]
+				if d == '\\' {
+					j += 2
+					continue
+				}
+				if c == '/' {
+					if d == '\n' {
+						break
+					}
+					if d == '[' {
+						inClass = true
+					} else if d == ']' {
+						inClass = false
+					} else if d == '/' && !inClass {
+						break
+					}
+				} else if d == c {
+					break
+				}
+				j++
+			}
+			j = min(j, len(js)-1)
+			b.WriteString(js[i : j+1])
+			i = j
+			last = c
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == '\v':
+			if c == '\n' {
+				ws = '\n'
+			} else if ws == 0 {
+				ws = ' '
+			}
+		default:
+			flush(c)
+			b.WriteByte(c)
+			last = c
+		}
+	}
+	return b.String()
+}
+
+func isJSIdentByte(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// jsKeywordBeforeRegex reports whether out ends with a keyword after which a
+// "/" starts a regular expression rather than a division.
+func jsKeywordBeforeRegex(out string) bool {
+	i := len(out)
+	for i > 0 && isJSIdentByte(out[i-1]) {
+		i--
+	}
+	switch out[i:] {
+	case "return", "typeof", "case", "in", "of", "void", "delete", "throw", "else", "do", "yield", "await", "instanceof", "new":
+		return i == 0 || out[i-1] != '.'
+	}
+	return false
+}
@@ -1,149 +1,498 @@
-package main
+package rerouter
 
 import (
+	"container/heap"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
 	"rerouter/logger"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// prefetchPriority orders queued prefetches; higher ones run first.
+type prefetchPriority int
+
+const (
+	// prefetchLow is opportunistic warming: human visits, bot range requests
+	// and the subresources of cached pages.
+	prefetchLow prefetchPriority = iota
+	// prefetchHigh is warming an admin asked for, such as rewarms after a purge.
+	prefetchHigh
+)
+
+func (pr prefetchPriority) String() string {
+	if pr == prefetchHigh {
+		return "high"
+	}
+	return "low"
+}
+
 type prefetchJob struct {
 	target string
 	aBase  string // optional A-site base URL for rewriting
+	fwd    clientForward
+	// Refetch a fresh entry created before this time (sitemap lastmod).
+	since time.Time
+	// Queued as a subresource of another page: its own links are not followed.
+	linked   bool
+	priority prefetchPriority
+	// Fetches already made; failed jobs are re-queued until PrefetchMaxAttempts.
+	attempts int
+}
+
+// prefetchItem is a queued job; seq keeps jobs of equal priority in FIFO order.
+type prefetchItem struct {
+	job   prefetchJob
+	seq   uint64
+	index int
+}
+
+// prefetchQueue is a container/heap of queued jobs, highest priority first.
+type prefetchQueue []*prefetchItem
+
+func (q prefetchQueue) Len() int { return len(q) }
+
+func (q prefetchQueue) Less(i, j int) bool {
+	if q[i].job.priority != q[j].job.priority {
+		return q[i].job.priority > q[j].job.priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q prefetchQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *prefetchQueue) Push(x interface{}) {
+	it := x.(*prefetchItem)
+	it.index = len(*q)
+	*q = append(*q, it)
+}
+
+func (q *prefetchQueue) Pop() interface{} {
+	old := *q
+	it := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return it
+}
+
+// evictable returns the job a full queue gives up first: the newest of the
+// lowest priority.
+func (q prefetchQueue) evictable() *prefetchItem {
+	var out *prefetchItem
+	for _, it := range q {
+		if out == nil || it.job.priority < out.job.priority || it.job.priority == out.job.priority && it.seq > out.seq {
+			out = it
+		}
+	}
+	return out
 }
 
+// Prefetcher warms the cache in the background from a bounded priority
+// queue. Warm jobs fetch through FetchAndStore and do not queue.
 type Prefetcher struct {
-	cfg      *Config
+	cfg      atomic.Pointer[Config]
 	client   *http.Client
-	jobs     chan prefetchJob
+	mu       sync.Mutex
+	queue    prefetchQueue
+	queued   map[string]*prefetchItem // target -> queued job
+	seq      uint64
+	capacity int
+	workers  int
+	// One token per queued job wakes a worker.
+	ready    chan struct{}
 	inFlight sync.Map // target -> struct{}
+	flight   flightGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// Counters for /admin/status and the system_metrics log line.
+	dropped      [prefetchHigh + 1]atomic.Int64
+	retries      atomic.Int64
+	failed       atomic.Int64
+	retryWaiting atomic.Int64
 }
 
-func NewPrefetcher(cfg *Config) *Prefetcher {
-	return &Prefetcher{
-		cfg:    cfg,
-		client: &http.Client{Timeout: 15 * time.Second},
-		jobs:   make(chan prefetchJob, 256),
+// NewPrefetcher creates a prefetcher whose fetches go through transport
+// (nil uses http.DefaultTransport). Its queue holds cfg.PrefetchQueueSize jobs.
+func NewPrefetcher(cfg *Config, transport http.RoundTripper) *Prefetcher {
+	capacity := cfg.PrefetchQueueSize
+	if capacity <= 0 {
+		capacity = 256
 	}
+	p := &Prefetcher{
+		client:   &http.Client{Timeout: upstreamTimeout(cfg), Transport: transport},
+		queued:   map[string]*prefetchItem{},
+		capacity: capacity,
+		ready:    make(chan struct{}, capacity),
+		stop:     make(chan struct{}),
+	}
+	p.client.CheckRedirect = func(_ *http.Request, via []*http.Request) error {
+		return upstreamCheckRedirect(p.cfg.Load(), via)
+	}
+	p.cfg.Store(cfg)
+	return p
+}
+
+// queueDepth returns the number of queued jobs and the queue's capacity.
+func (p *Prefetcher) queueDepth() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue), p.capacity
+}
+
+// queueStats reports the queue by priority along with the drop and retry
+// counters, for /admin/status.
+func (p *Prefetcher) queueStats() map[string]int {
+	p.mu.Lock()
+	byPriority := [prefetchHigh + 1]int{}
+	for _, it := range p.queue {
+		byPriority[it.job.priority]++
+	}
+	st := map[string]int{"depth": len(p.queue), "capacity": p.capacity, "workers": p.workers}
+	p.mu.Unlock()
+	for pr := prefetchLow; pr <= prefetchHigh; pr++ {
+		st[pr.String()] = byPriority[pr]
+		st["dropped_"+pr.String()] = int(p.dropped[pr].Load())
+	}
+	st["retry_waiting"] = int(p.retryWaiting.Load())
+	st["retries"] = int(p.retries.Load())
+	st["failed"] = int(p.failed.Load())
+	return st
+}
+
+// metrics reports the queue for the periodic system_metrics log line.
+func (p *Prefetcher) metrics() map[string]interface{} {
+	out := map[string]interface{}{}
+	for k, v := range p.queueStats() {
+		out["prefetch_queue_"+k] = v
+	}
+	return out
+}
+
+// setConfig makes jobs started from now on use cfg.
+func (p *Prefetcher) setConfig(cfg *Config) {
+	p.cfg.Store(cfg)
 }
 
 func (p *Prefetcher) Start(workers int) {
 	if workers <= 0 {
 		workers = 2
 	}
+	p.mu.Lock()
+	p.workers += workers
+	p.mu.Unlock()
 	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
 		go p.worker()
 	}
 }
 
-func (p *Prefetcher) Enqueue(target string, aBase string) {
-	if _, exists := p.inFlight.LoadOrStore(target, struct{}{}); exists {
-		return
+// Stop prevents new jobs from starting and waits for in-progress fetches to
+// finish or ctx to expire. Queued jobs that have not started are dropped.
+func (p *Prefetcher) Stop(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// Enqueue schedules target for an opportunistic background fetch on behalf
+// of fwd's client. It reports whether the target is queued or already in
+// flight; false means the job was dropped.
+func (p *Prefetcher) Enqueue(target string, aBase string, fwd clientForward) bool {
+	return p.enqueue(prefetchJob{target: target, aBase: aBase, fwd: fwd})
+}
+
+func (p *Prefetcher) enqueue(job prefetchJob) bool {
 	select {
-	case p.jobs <- prefetchJob{target: target, aBase: aBase}:
-		// enqueued
+	case <-p.stop:
+		return false
 	default:
-		// queue full; drop and clear inFlight marker
-		p.inFlight.Delete(target)
 	}
+	p.mu.Lock()
+	// A queued job takes the higher of its two priorities
+	if it, ok := p.queued[job.target]; ok {
+		if job.priority > it.job.priority {
+			it.job.priority = job.priority
+			heap.Fix(&p.queue, it.index)
+		}
+		p.mu.Unlock()
+		return true
+	}
+	if _, exists := p.inFlight.LoadOrStore(job.target, struct{}{}); exists {
+		p.mu.Unlock()
+		return true
+	}
+	ok := p.pushLocked(job)
+	p.mu.Unlock()
+	if !ok {
+		p.inFlight.Delete(job.target)
+	}
+	return ok
+}
+
+// pushLocked queues job, whose target is marked in flight. A full queue makes
+// room by dropping its newest lower-priority job, else job is dropped.
+func (p *Prefetcher) pushLocked(job prefetchJob) bool {
+	if len(p.queue) >= p.capacity {
+		victim := p.queue.evictable()
+		if victim == nil || victim.job.priority >= job.priority {
+			p.noteDropped(job)
+			return false
+		}
+		heap.Remove(&p.queue, victim.index)
+		delete(p.queued, victim.job.target)
+		p.inFlight.Delete(victim.job.target)
+		p.noteDropped(victim.job)
+	} else {
+		// Every queued job holds one wake-up token
+		p.ready <- struct{}{}
+	}
+	p.seq++
+	it := &prefetchItem{job: job, seq: p.seq}
+	heap.Push(&p.queue, it)
+	p.queued[job.target] = it
+	return true
+}
+
+func (p *Prefetcher) noteDropped(job prefetchJob) {
+	p.dropped[job.priority].Add(1)
+	logger.Debugw("prefetch_dropped", map[string]interface{}{"target": job.target, "priority": job.priority.String(), "capacity": p.capacity})
+}
+
+// next pops the highest-priority queued job.
+func (p *Prefetcher) next() (prefetchJob, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) == 0 {
+		return prefetchJob{}, false
+	}
+	it := heap.Pop(&p.queue).(*prefetchItem)
+	delete(p.queued, it.job.target)
+	return it.job, true
 }
 
 func (p *Prefetcher) worker() {
-	for job := range p.jobs {
-		if _, err := p.handle(job); err != nil {
-			// Errors already logged inside handle.
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.ready:
+			job, ok := p.next()
+			if !ok {
+				continue
+			}
+			// Errors are logged inside handle
+			if ok, err := p.handle(job); !ok && err != nil && p.retry(job, err) {
+				continue
+			}
+			p.inFlight.Delete(job.target)
 		}
-		p.inFlight.Delete(job.target)
 	}
 }
 
-func (p *Prefetcher) FetchAndStore(target, aBase string) (bool, error) {
+// retry re-queues a failed job after a backoff, keeping its target in flight,
+// unless it is out of attempts or failed for good.
+func (p *Prefetcher) retry(job prefetchJob, err error) bool {
+	cfg := p.cfg.Load()
+	job.attempts++
+	var se prefetchStatusError
+	if job.attempts >= cfg.PrefetchMaxAttempts || errors.As(err, &se) && se.status != http.StatusTooManyRequests && se.status < 500 {
+		p.failed.Add(1)
+		return false
+	}
+	p.retries.Add(1)
+	p.retryWaiting.Add(1)
+	backoff := prefetchRetryBackoff(cfg, job.attempts-1)
+	logger.Debugw("prefetch_retry", map[string]interface{}{"target": job.target, "attempt": job.attempts, "backoff_ms": backoff.Milliseconds(), "err": err.Error()})
+	time.AfterFunc(backoff, func() {
+		p.retryWaiting.Add(-1)
+		select {
+		case <-p.stop:
+			p.inFlight.Delete(job.target)
+			return
+		default:
+		}
+		p.mu.Lock()
+		ok := p.pushLocked(job)
+		p.mu.Unlock()
+		if !ok {
+			p.inFlight.Delete(job.target)
+		}
+	})
+	return true
+}
+
+// prefetchRetryBackoff is the wait before retry n+1, computed like
+// upstreamRetryBackoff from PrefetchRetryBackoffMs.
+func prefetchRetryBackoff(cfg *Config, n int) time.Duration {
+	if cfg.PrefetchRetryBackoffMs <= 0 {
+		return 0
+	}
+	d := time.Duration(cfg.PrefetchRetryBackoffMs) * time.Millisecond << min(n, 16)
+	if d <= 0 || d > maxUpstreamRetryBackoff {
+		d = maxUpstreamRetryBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// prefetchStatusError is a prefetch answered with an uncacheable status.
+type prefetchStatusError struct {
+	status int
+}
+
+func (e prefetchStatusError) Error() string {
+	return fmt.Sprintf("prefetch status %d", e.status)
+}
+
+// FetchAndStore fetches target into the cache now unless a fresh entry exists
+// that is not older than since (zero since accepts any fresh entry).
+func (p *Prefetcher) FetchAndStore(target, aBase string, since time.Time) (bool, error) {
 	if target == "" {
 		return false, fmt.Errorf("empty target")
 	}
-	if _, exists := p.inFlight.LoadOrStore(target, struct{}{}); exists {
-		return true, nil
+	if _, exists := p.inFlight.LoadOrStore(target, struct{}{}); !exists {
+		defer p.inFlight.Delete(target)
 	}
-	defer p.inFlight.Delete(target)
-	return p.handle(prefetchJob{target: target, aBase: aBase})
+	return p.handle(prefetchJob{target: target, aBase: aBase, since: since})
 }
 
+// handle coalesces concurrent fetches of the same target so a queued prefetch
+// and a synchronous FetchAndStore share one upstream request.
 func (p *Prefetcher) handle(job prefetchJob) (bool, error) {
-	// Skip if cache fresh
-	if ce, err := readCacheByURL(p.cfg.CacheDir, job.target); err == nil && ce.Status == http.StatusOK {
+	v, err, _ := p.flight.Do(job.target, func() (interface{}, error) {
+		ok, err := p.fetchAndStore(job)
+		return ok, err
+	})
+	ok, _ := v.(bool)
+	return ok, err
+}
+
+func (p *Prefetcher) fetchAndStore(job prefetchJob) (ok bool, err error) {
+	cfg := p.cfg.Load()
+	ctx, sp := startSpan(context.Background(), "prefetch", spanKindInternal)
+	sp.setAttr("url.full", job.target)
+	defer func() {
+		sp.setAttr("rerouter.cached", ok)
+		sp.setError(err)
+		sp.finish()
+	}()
+	// Skip if cache fresh and not older than the content it should reflect
+	if ce, err := readCacheByURL(cfg.CacheDir, job.target); err == nil && ce.Status == http.StatusOK && ce.CreatedAt >= job.since.Unix() {
 		return true, nil
 	}
 	// Fetch
-	req, err := http.NewRequest(http.MethodGet, job.target, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.target, nil)
 	if err != nil {
 		logger.Warnw("prefetch_build_request_error", map[string]interface{}{"err": err.Error(), "target": job.target})
 		return false, err
 	}
-	// Use configured desktop-like UA for upstream requests
-	req.Header.Set("User-Agent", p.cfg.UpstreamUserAgent)
-	resp, err := p.client.Do(req)
+	// Nobody is waiting on prefetches: the "background" UA policy applies
+	req.Header.Set("User-Agent", upstreamUserAgent(cfg, nil))
+	job.fwd.apply(cfg, req)
+	stale := staleForRevalidation(cfg.CacheDir, job.target, "")
+	setConditionalHeaders(req, stale)
+	// Determine TTL based on target path and the upstream response
+	reqPath := "/"
+	if u, err := url.Parse(job.target); err == nil {
+		reqPath = u.Path
+	}
+	resp, err := doUpstream(cfg, p.client, req, reqPath)
 	if err != nil {
 		logger.Warnw("prefetch_fetch_error", map[string]interface{}{"err": err.Error(), "target": job.target})
 		return false, err
 	}
 	defer resp.Body.Close()
+
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		ttl, _ := cacheTTLFor(cfg, reqPath, stale.Status, resp.Header)
+		if err := extendCacheEntry(cfg.CacheDir, job.target, stale, ttl); err != nil {
+			logger.Warnw("prefetch_cache_write_error", map[string]interface{}{"err": err.Error(), "target": job.target})
+			return false, err
+		}
+		logger.Debugw("cache_revalidated", map[string]interface{}{"target": job.target, "ttl_seconds": ttl, "source": "prefetch"})
+		return true, nil
+	}
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logger.Warnw("prefetch_read_error", map[string]interface{}{"err": err.Error(), "target": job.target})
 		return false, err
 	}
 
-	// Headers (minimal)
-	ch := map[string]string{}
-	if ct := resp.Header.Get("Content-Type"); ct != "" {
-		ch["Content-Type"] = ct
-	}
-	if lm := resp.Header.Get("Last-Modified"); lm != "" {
-		ch["Last-Modified"] = lm
+	// Decided before the header policies strip Set-Cookie, as for misses
+	ttl, cacheable := cacheTTLFor(cfg, reqPath, resp.StatusCode, resp.Header)
+	// The B base is the target's own origin so every configured upstream is rewritten.
+	var aURL, bURL *url.URL
+	if tURL, err := url.Parse(job.target); err == nil {
+		bURL = &url.URL{Scheme: tURL.Scheme, Host: tURL.Host}
 	}
-	if et := resp.Header.Get("ETag"); et != "" {
-		ch["ETag"] = et
+	if job.aBase != "" {
+		aURL, _ = url.Parse(job.aBase)
 	}
+	ch := botCacheHeaders(cfg, reqPath, resp.Header, aURL, bURL)
 
 	// Optional rewrite if aBase provided and HTML
-	if job.aBase != "" {
-		if aURL, err := url.Parse(job.aBase); err == nil {
-			if bURL, err2 := url.Parse(p.cfg.BBaseURL); err2 == nil {
-				if newBody, rewrote := rewriteBodyForBots(body, ch["Content-Type"], aURL, bURL); rewrote {
-					body = newBody
-					delete(ch, "ETag")
-					delete(ch, "Last-Modified")
-				}
-			}
+	if aURL != nil && bURL != nil {
+		if newBody, rewrote := rewriteBodyForBots(cfg, reqPath, body, ch["Content-Type"], aURL, bURL); rewrote {
+			body = newBody
+			delete(ch, "ETag")
+			delete(ch, "Last-Modified")
 		}
 	}
 
-	if resp.StatusCode == http.StatusOK {
-		// Determine TTL based on target path
-		ttl := p.cfg.CacheTTLSeconds
-		if u, err := url.Parse(job.target); err == nil {
-			ttl = cacheTTLForPath(p.cfg, u.Path)
-		}
+	applyRobotsHeader(cfg, reqPath, ch)
+	if resp.StatusCode == http.StatusOK && ch["ETag"] == "" {
+		ch["ETag"] = bodyETag(body)
+	}
+
+	if cacheable {
 		ce := &cacheEntry{
-			URL:       job.target,
-			CreatedAt: time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
-			Status:    resp.StatusCode,
-			Header:    ch,
-			Body:      body,
+			URL:          job.target,
+			CreatedAt:    time.Now().Unix(),
+			ExpiresAt:    time.Now().Add(time.Duration(ttl) * time.Second).Unix(),
+			Status:       resp.StatusCode,
+			Header:       ch,
+			Body:         body,
+			BodyEncoding: cacheBodyEncoding(cfg, ch["Content-Type"]),
+			Tags:         cacheTagsFor(cfg, reqPath, resp.Header),
 		}
-		if err := writeCacheByURL(p.cfg.CacheDir, job.target, ce); err != nil {
+		setUpstreamValidators(ce, resp.Header)
+		_, wsp := startSpan(ctx, "cache.write", spanKindInternal)
+		err := writeCacheByURL(cfg.CacheDir, job.target, ce)
+		wsp.setError(err)
+		wsp.finish()
+		if err != nil {
 			logger.Warnw("prefetch_cache_write_error", map[string]interface{}{"err": err.Error(), "target": job.target})
 			return false, err
 		}
 		logger.Debugw("cache_store", map[string]interface{}{"target": job.target, "ttl_seconds": ttl, "source": "prefetch"})
-		return true, nil
+		if resp.StatusCode == http.StatusOK {
+			if !job.linked {
+				p.EnqueueSubresources(cfg, job.target, ch["Content-Type"], body, job.aBase)
+			}
+			return true, nil
+		}
 	}
 
 	logger.Warnw("prefetch_unexpected_status", map[string]interface{}{"status": resp.StatusCode, "target": job.target})
-	return false, fmt.Errorf("prefetch status %d", resp.StatusCode)
+	return false, prefetchStatusError{status: resp.StatusCode}
 }
@@ -0,0 +1,177 @@
+package rerouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const previewKey ctxKey = "preview"
+
+// previewUserAgents are the crawler User-Agents /admin/preview sends for
+// ?ua=<family>; any other ua value is sent as is.
+var previewUserAgents = map[string]string{
+	"google": "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+	"bing":   "Mozilla/5.0 (compatible; bingbot/2.0; +http://www.bing.com/bingbot.htm)",
+	"baidu":  "Mozilla/5.0 (compatible; Baiduspider/2.0; +http://www.baidu.com/search/spider.html)",
+	"yandex": "Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)",
+}
+
+// defaultPreviewUA is the crawler /admin/preview poses as without ?ua=.
+const defaultPreviewUA = "google"
+
+// previewState marks a preview request: its miss is fetched and rewritten but
+// not cached, counted in no stats and does not queue subresources. xCache is
+// the cache result noted before header rules could remove X-Cache.
+type previewState struct {
+	xCache string
+}
+
+func withPreview(ctx context.Context, p *previewState) context.Context {
+	return context.WithValue(ctx, previewKey, p)
+}
+
+// previewFrom returns the preview state of a request built by
+// handleAdminPreview, or nil for real traffic.
+func previewFrom(ctx context.Context) *previewState {
+	p, _ := ctx.Value(previewKey).(*previewState)
+	return p
+}
+
+// previewRecorder buffers the response the public handler writes.
+type previewRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *previewRecorder) Header() http.Header { return rec.header }
+
+func (rec *previewRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+}
+
+func (rec *previewRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+// previewResult is the JSON answer of /admin/preview.
+type previewResult struct {
+	URL       string `json:"url"`
+	UserAgent string `json:"user_agent"`
+	// X-Cache of the response: HIT, MISS (fetched from B for the preview,
+	// not stored) or STALE; empty when the path is not cached.
+	Cache      string            `json:"cache"`
+	Status     int               `json:"status"`
+	Headers    map[string]string `json:"headers"`
+	Body       string            `json:"body"`
+	BodyBase64 []byte            `json:"body_base64,omitempty"`
+}
+
+// handleAdminPreview serves GET /admin/preview?url=/path&ua=bing: it replays
+// url through public, posing as the crawler ua (a family or a full
+// User-Agent, Googlebot by default), and returns the status, headers and body
+// a bot would receive. Extra request headers (e.g. Accept-Language for a vary
+// variant) go in repeated header=Name:Value parameters. With raw=1 the
+// response is sent as is instead of as JSON.
+func handleAdminPreview(cfg *Config, public http.Handler, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	raw := q.Get("url")
+	if raw == "" {
+		http.Error(w, "missing url", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Path == "" && u.Host == "" || !strings.HasPrefix(u.Path, "/") && u.Path != "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	// A path is previewed on A_BASE_URL's host, else on the host of this request
+	host := u.Host
+	if host == "" {
+		host = r.Host
+		if a, err := url.Parse(cfg.ABaseURL); err == nil && a.Host != "" {
+			host = a.Host
+		}
+	}
+	ua := q.Get("ua")
+	if ua == "" {
+		ua = defaultPreviewUA
+	}
+	if v, ok := previewUserAgents[strings.ToLower(ua)]; ok {
+		ua = v
+	}
+
+	state := &previewState{}
+	preq, err := http.NewRequestWithContext(withPreview(r.Context(), state), http.MethodGet, (&url.URL{Path: u.Path, RawQuery: u.RawQuery}).RequestURI(), nil)
+	if err != nil {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	preq.Host = host
+	for _, h := range q["header"] {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			http.Error(w, "invalid header (want Name:Value)", http.StatusBadRequest)
+			return
+		}
+		preq.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	preq.Header.Set("User-Agent", ua)
+	// Taken for a crawler regardless of VERIFY_BOTS and the bot CIDR lists,
+	// which would judge the admin's IP; no client IP is forwarded to B.
+	preq.Header.Set("X-Bot", "true")
+	scheme := "http"
+	if u.Scheme == "https" {
+		scheme = "https"
+		preq.Header.Set("X-Forwarded-Proto", scheme)
+	}
+
+	rec := &previewRecorder{header: http.Header{}}
+	public.ServeHTTP(rec, preq)
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	if q.Get("raw") == "1" {
+		for k, v := range rec.header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.status)
+		_, _ = w.Write(rec.body.Bytes())
+		return
+	}
+	res := previewResult{
+		URL:       scheme + "://" + host + preq.URL.RequestURI(),
+		UserAgent: ua,
+		Cache:     state.xCache,
+		Status:    rec.status,
+		Headers:   map[string]string{},
+	}
+	for k := range rec.header {
+		res.Headers[k] = rec.header.Get(k)
+	}
+	if utf8.Valid(rec.body.Bytes()) {
+		res.Body = rec.body.String()
+	} else {
+		res.BodyBase64 = rec.body.Bytes()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
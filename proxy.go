@@ -0,0 +1,143 @@
+package rerouter
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// forwardedRequestHeaders are copied from bot requests to B on the
+// fetch-through path, on top of cfg.ForwardHeaders. Cookie is forwarded only
+// with cfg.ForwardCookies. Accept-Encoding is left to the transport so bodies
+// arrive decoded and can be rewritten.
+var forwardedRequestHeaders = []string{
+	"Accept",
+	"Accept-Language",
+	"Content-Type",
+	"Range",
+	"If-Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"Origin",
+	"X-Requested-With",
+}
+
+// hopByHopHeaders describe a single connection and are never proxied.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// proxyBotRequest forwards a bot request that is not served from cache (POST
+// forms, ranges, uncached paths), or any human request in HUMAN_MODE=proxy, to
+// target with its body and whitelisted headers, and relays B's response. Rewritable bodies (HTML, CSS, JS, XML,
+// sitemaps) are buffered and rewritten to A; everything else is streamed.
+// Redirects B sends back are passed on with B locations mapped to A.
+func proxyBotRequest(cfg *Config, client *http.Client, w http.ResponseWriter, r *http.Request, target string) {
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target, r.Body)
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	req.ContentLength = r.ContentLength
+	req.Header.Set("User-Agent", upstreamUserAgent(cfg, r))
+	for _, k := range append(forwardedRequestHeaders, cfg.ForwardHeaders...) {
+		if hopByHopHeaders[http.CanonicalHeaderKey(k)] {
+			continue
+		}
+		for _, v := range r.Header.Values(k) {
+			req.Header.Add(k, v)
+		}
+	}
+	if cfg.ForwardCookies {
+		for _, v := range r.Header.Values("Cookie") {
+			req.Header.Add("Cookie", v)
+		}
+	}
+	clientForwardFor(cfg, r).apply(cfg, req)
+	// Redirects of other methods must reach the bot, which decides how to re-submit
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		noRedirect := *client
+		noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		client = &noRedirect
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Errorw("fetch_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
+		writeUpstreamError(cfg, w, r, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	aURL := deriveABaseURL(cfg, r)
+	bURL, _ := url.Parse(cfg.BBaseURL)
+	rw := newURLRewriter(cfg, aURL, bURL)
+	applyHeaderPolicies(cfg, resp.Header, rw)
+	ct := resp.Header.Get("Content-Type")
+	var body []byte
+	rewrote := false
+	if r.Method != http.MethodHead && resp.StatusCode != http.StatusPartialContent && proxyBodyRewritable(r.URL.Path, ct) {
+		body, _ = io.ReadAll(resp.Body)
+		body, rewrote = rewriteBodyForBots(cfg, r.URL.Path, body, ct, aURL, bURL)
+	}
+
+	connHeaders := map[string]bool{}
+	for _, v := range resp.Header.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			connHeaders[http.CanonicalHeaderKey(strings.TrimSpace(k))] = true
+		}
+	}
+	for k, vv := range resp.Header {
+		switch {
+		case hopByHopHeaders[k] || connHeaders[k] || k == noCacheHeader:
+			continue
+		case rewrote && (k == "Content-Length" || k == "Etag" || k == "Last-Modified"):
+			// The rewritten body no longer matches B's length and validators
+			continue
+		}
+		for _, v := range vv {
+			if k == "Location" {
+				v = rewriteLocation(cfg, v, aURL, bURL)
+			}
+			w.Header().Add(k, v)
+		}
+	}
+	if w.Header().Get("X-Cache") == "" {
+		w.Header().Set("X-Cache", "MISS") // BYPASS when a cookie skipped the cache
+	}
+	if p, ok := robotsPolicyFor(cfg, r.URL.Path); ok && p.Action == robotsActionOverride {
+		w.Header().Set("X-Robots-Tag", p.Value)
+	}
+	if body != nil {
+		writeBody(w, r, resp.StatusCode, body)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		logger.Debugw("proxy_stream_error", map[string]interface{}{"err": err.Error(), "target": target, "req_id": getRequestID(r.Context())})
+	}
+}
+
+// proxyBodyRewritable reports whether a response may contain B URLs worth
+// rewriting, and so has to be buffered instead of streamed.
+func proxyBodyRewritable(reqPath, contentType string) bool {
+	if isSitemapPath(reqPath) || isFeedPath(reqPath) {
+		return true
+	}
+	ct := strings.ToLower(contentType)
+	return strings.Contains(ct, "text/html") || strings.Contains(ct, "text/css") || isJavaScriptType(ct) || strings.Contains(ct, "xml") || strings.Contains(ct, "feed+json")
+}
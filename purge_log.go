@@ -0,0 +1,60 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// purgeLogSize is how many recent purges /admin/purges lists.
+const purgeLogSize = 100
+
+// purgeEvent is one purge as listed by /admin/purges.
+type purgeEvent struct {
+	Time time.Time `json:"time"`
+	// admin, admin_ui, purge_protocol or webhook
+	Source       string `json:"source"`
+	Query        string `json:"query"`
+	Deleted      int    `json:"deleted"`
+	RewarmQueued int    `json:"rewarm_queued,omitempty"`
+}
+
+// purgeLog keeps the most recent purges in memory, newest last. It lives on
+// appHandler so it survives config reloads.
+type purgeLog struct {
+	mu     sync.Mutex
+	events []purgeEvent
+}
+
+// record notes a purge from source of query (a URL, pattern or filter
+// description) that removed res.Deleted entries.
+func (l *purgeLog) record(source, query string, res purgeResult) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.events) >= purgeLogSize {
+		l.events = append(l.events[:0], l.events[len(l.events)-purgeLogSize+1:]...)
+	}
+	l.events = append(l.events, purgeEvent{Time: time.Now().UTC(), Source: source, Query: query, Deleted: res.Deleted, RewarmQueued: res.RewarmQueued})
+}
+
+// recent returns the logged purges, newest first.
+func (l *purgeLog) recent() []purgeEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make([]purgeEvent, len(l.events))
+	for i, e := range l.events {
+		out[len(out)-1-i] = e
+	}
+	return out
+}
+
+// handleAdminPurges serves GET /admin/purges.
+func (l *purgeLog) handleAdminPurges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"purges": l.recent()})
+}
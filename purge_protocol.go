@@ -0,0 +1,148 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"rerouter/logger"
+)
+
+// purgeProtocolPrefix is the ngx_cache_purge location used by Nginx Helper:
+// GET /purge/<path> purges <path>, /purge/* purges everything.
+const purgeProtocolPrefix = "/purge/"
+
+// purgeProtocol accepts purge requests in the formats WordPress cache plugins
+// already speak, so they can invalidate rerouter without custom scripts:
+//   - PURGE <path> (Varnish HTTP Purge, Proxy Cache Purge); with
+//     "X-Purge-Method: regex" the path is a regular expression such as /.*
+//   - GET|PURGE /purge/<path> (Nginx Helper with ngx_cache_purge); a trailing
+//     "*" purges by prefix.
+//
+// Requests must come from cfg.PurgeAllowCIDRs or, except on a public-only
+// listener, carry an admin token with the purge scope. Token purges pass the
+// admin guard (allowlist, basic auth, lockout, audit log) like the admin
+// routes do; a token limited to tenants only purges entries on their B hosts.
+type purgeProtocol struct {
+	cfg    *Config
+	allow  []*net.IPNet
+	purges *purgeLog
+	// guarded serves token purges behind the admin guard.
+	guarded http.Handler
+}
+
+func newPurgeProtocol(cfg *Config, purges *purgeLog) *purgeProtocol {
+	allow, _ := parseCIDRList(cfg.PurgeAllowCIDRs) // validated in LoadConfig
+	return &purgeProtocol{cfg: cfg, allow: allow, purges: purges}
+}
+
+// purgeProtocolRequest reports whether r is in one of the plugin purge formats.
+func purgeProtocolRequest(r *http.Request) bool {
+	return r.Method == "PURGE" || (r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, purgeProtocolPrefix))
+}
+
+// allowedIP reports whether r comes from cfg.PurgeAllowCIDRs.
+func (pp *purgeProtocol) allowedIP(r *http.Request) bool {
+	if ip := net.ParseIP(clientIP(pp.cfg, r)); ip != nil {
+		for _, n := range pp.allow {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serve handles r if it is a plugin purge request and reports whether it did.
+// Unauthorized GET /purge/... requests fall through so B pages under /purge/
+// stay reachable; unauthorized PURGE requests are rejected. Admin tokens are
+// only accepted when role serves the admin routes too.
+func (pp *purgeProtocol) serve(role listenerRole, w http.ResponseWriter, r *http.Request) bool {
+	if !purgeProtocolRequest(r) {
+		return false
+	}
+	switch {
+	case pp.allowedIP(r):
+		pp.purge(w, r)
+	case role != listenerPublic && pp.guarded != nil && adminRequestToken(r) != "":
+		pp.guarded.ServeHTTP(w, r)
+	case r.Method == "PURGE":
+		http.Error(w, "forbidden", http.StatusForbidden)
+	default:
+		return false
+	}
+	return true
+}
+
+// serveToken serves a purge request authenticated by its admin token; it
+// runs behind the admin guard, which counts its 403s toward the lockout.
+func (pp *purgeProtocol) serveToken(w http.ResponseWriter, r *http.Request) {
+	cred := adminCredentialFor(pp.cfg, adminRequestToken(r))
+	if cred == nil || !cred.allows(adminScopePurge) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	pp.purge(w, r)
+}
+
+// purge runs the purge r asks for.
+func (pp *purgeProtocol) purge(w http.ResponseWriter, r *http.Request) {
+	prefixed := strings.HasPrefix(r.URL.Path, purgeProtocolPrefix)
+	cfg := upstreamConfigForRequest(pp.cfg, r)
+	target := r.URL.Path
+	if prefixed {
+		target = "/" + strings.TrimPrefix(target, purgeProtocolPrefix)
+	}
+	rawQuery := r.URL.RawQuery
+	if q := r.URL.Query(); q.Has("token") {
+		q.Del("token")
+		rawQuery = q.Encode()
+	}
+	if rawQuery != "" {
+		target += "?" + rawQuery
+	}
+
+	sc := adminTenantScope(pp.cfg, r, adminRequestToken(r))
+	var (
+		res  purgeResult
+		mode string
+	)
+	switch {
+	case strings.EqualFold(r.Header.Get("X-Purge-Method"), "regex"):
+		re, err := regexp.Compile("^" + target)
+		if err != nil {
+			http.Error(w, "invalid purge regex", http.StatusBadRequest)
+			return
+		}
+		mode = "regex"
+		res = doBulkPurge(cfg, bulkPurgeFilter{URIRegex: re, Scope: sc})
+	case strings.HasSuffix(target, "*"):
+		mode = "prefix"
+		res = doBulkPurge(cfg, bulkPurgeFilter{Patterns: []string{target}, Scope: sc})
+		res.ByPattern = nil
+	default:
+		mode = "exact"
+		if !sc.allowsURL(resolveBTarget(cfg, target)) {
+			errOutsideTenants(w)
+			return
+		}
+		var err error
+		if res, err = doPurge(cfg, target, false, "", sc); err != nil {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+	}
+	pp.purges.record("purge_protocol", target, res)
+	auditNote(r, map[string]interface{}{"mode": mode, "target": target}, map[string]interface{}{"deleted": res.Deleted})
+	logger.Infow("purge_protocol", map[string]interface{}{
+		"req_id":  getRequestID(r.Context()),
+		"method":  r.Method,
+		"mode":    mode,
+		"target":  target,
+		"deleted": res.Deleted,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
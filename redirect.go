@@ -0,0 +1,30 @@
+package rerouter
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Upstream redirect handling modes accepted in cfg.UpstreamRedirects.
+const (
+	upstreamRedirectFollow  = "follow"
+	upstreamRedirectRewrite = "rewrite"
+)
+
+// upstreamCheckRedirect is the CheckRedirect policy of the upstream clients.
+// In follow mode B's redirects are followed server-side for up to
+// cfg.UpstreamMaxRedirects hops; past that, and always in rewrite mode, the
+// 3xx itself is returned so its Location can be mapped to A for the bot.
+func upstreamCheckRedirect(cfg *Config, via []*http.Request) error {
+	if cfg.UpstreamRedirects == upstreamRedirectRewrite || len(via) > cfg.UpstreamMaxRedirects {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+// rewriteLocation maps a Location pointing at a B host onto A. Relative
+// locations and other hosts are returned unchanged.
+func rewriteLocation(cfg *Config, loc string, aBase, bBase *url.URL) string {
+	v, _ := newURLRewriter(cfg, aBase, bBase).url(loc)
+	return v
+}
@@ -0,0 +1,121 @@
+package rerouter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// RedirectRule overrides the human redirect for matching A paths. Status
+// replaces RedirectStatus (e.g. 301 for a permanent move) and Target, when
+// set, maps the A path to a different B path.
+type RedirectRule struct {
+	// Glob path pattern ("/blog/*", "/blog/") like CACHE_PATTERNS.
+	Pattern string `json:"pattern,omitempty"`
+	// Regular expression matched against the request path.
+	Regex  string `json:"regex,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// B path. A trailing "*" takes the rest of the path matched by a trailing
+	// "*" or "/" in Pattern; Regex rules may use $1-style references.
+	Target string `json:"target,omitempty"`
+}
+
+// parseRedirectRules parses "pattern=status[:target]" entries separated by
+// semicolons, e.g. "/blog/*=301;/old/=308:/new/*;~^/p/([0-9]+)$=301:/product/$1".
+// A "~" prefix makes the pattern a regular expression.
+func parseRedirectRules(v string) ([]RedirectRule, error) {
+	out := []RedirectRule{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		i := strings.LastIndex(p, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid redirect rule %q", p)
+		}
+		rule := RedirectRule{}
+		if pat := strings.TrimSpace(p[:i]); strings.HasPrefix(pat, "~") {
+			rule.Regex = pat[1:]
+		} else {
+			rule.Pattern = pat
+		}
+		status, target, _ := strings.Cut(p[i+1:], ":")
+		n, err := strconv.Atoi(strings.TrimSpace(status))
+		if err != nil {
+			return nil, fmt.Errorf("redirect rule %q: invalid status", p)
+		}
+		rule.Status = n
+		rule.Target = strings.TrimSpace(target)
+		if err := validateRedirectRule(rule); err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+func validateRedirectRule(r RedirectRule) error {
+	name := r.Pattern
+	switch {
+	case r.Pattern == "" && r.Regex == "":
+		return fmt.Errorf("redirect rule needs a pattern or regex")
+	case r.Pattern != "" && r.Regex != "":
+		return fmt.Errorf("redirect rule %q: pattern and regex are exclusive", r.Pattern)
+	case r.Regex != "":
+		name = "~" + r.Regex
+		if _, err := compileTTLRegex(r.Regex); err != nil {
+			return fmt.Errorf("redirect rule %q: %w", name, err)
+		}
+	}
+	if r.Status != 0 && (r.Status < 300 || r.Status >= 400) {
+		return fmt.Errorf("redirect rule %q: status must be 3xx", name)
+	}
+	if r.Target != "" && !strings.HasPrefix(r.Target, "/") {
+		return fmt.Errorf("redirect rule %q: target must be a path", name)
+	}
+	return nil
+}
+
+// redirectRuleFor returns the first rule matching reqPath and the B path it
+// maps reqPath to (reqPath itself when the rule has no target).
+func redirectRuleFor(cfg *Config, reqPath string) (RedirectRule, string, bool) {
+	for _, r := range cfg.RedirectRules {
+		if r.Regex != "" {
+			re, err := compileTTLRegex(r.Regex)
+			if err != nil {
+				continue
+			}
+			m := re.FindStringSubmatchIndex(reqPath)
+			if m == nil {
+				continue
+			}
+			if r.Target == "" {
+				return r, reqPath, true
+			}
+			return r, string(re.ExpandString(nil, r.Target, reqPath, m)), true
+		}
+		if !patternsMatch([]string{r.Pattern}, reqPath) {
+			continue
+		}
+		return r, redirectTargetPath(r, reqPath), true
+	}
+	return RedirectRule{}, reqPath, false
+}
+
+// redirectTargetPath substitutes the wildcard part of reqPath into a glob
+// rule's target: "/old/" -> "/new/*" maps /old/a/b to /new/a/b.
+func redirectTargetPath(r RedirectRule, reqPath string) string {
+	if r.Target == "" {
+		return reqPath
+	}
+	if !strings.HasSuffix(r.Target, "*") {
+		return r.Target
+	}
+	prefix := strings.TrimSuffix(r.Pattern, "*")
+	rest := ""
+	if (strings.HasSuffix(r.Pattern, "*") || strings.HasSuffix(r.Pattern, "/")) && strings.HasPrefix(reqPath, prefix) {
+		rest = reqPath[len(prefix):]
+	}
+	return strings.TrimSuffix(r.Target, "*") + rest
+}
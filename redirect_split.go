@@ -0,0 +1,111 @@
+package rerouter
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	// redirectTargetCookie remembers which of cfg.RedirectTargets a visitor
+	// was assigned, so they keep landing on the same origin.
+	redirectTargetCookie = "rerouter_target"
+	// redirectTargetCookieMaxAge keeps the assignment for 30 days.
+	redirectTargetCookieMaxAge = 30 * 24 * 3600
+)
+
+// RedirectTarget is one origin humans are redirected to, picked with
+// probability Weight / (sum of all weights).
+type RedirectTarget struct {
+	// Label in logs and the sticky cookie; defaults to the URL's host.
+	Name     string `json:"name,omitempty"`
+	BBaseURL string `json:"b_base_url"`
+	Weight   int    `json:"weight"`
+}
+
+// parseRedirectTargets parses "url=weight" entries separated by commas,
+// e.g. "https://b.example.com=90,https://b2.example.com=10".
+func parseRedirectTargets(v string) ([]RedirectTarget, error) {
+	out := []RedirectTarget{}
+	for _, p := range splitCommaList(v) {
+		i := strings.LastIndex(p, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid redirect target %q (want url=weight)", p)
+		}
+		w, err := strconv.Atoi(strings.TrimSpace(p[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid redirect target %q (want url=weight)", p)
+		}
+		out = append(out, RedirectTarget{BBaseURL: strings.TrimSpace(p[:i]), Weight: w})
+	}
+	return out, nil
+}
+
+// validateRedirectTargets checks the targets' URLs and weights and fills in
+// missing names.
+func validateRedirectTargets(targets []RedirectTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+	total := 0
+	names := map[string]bool{}
+	for i := range targets {
+		t := &targets[i]
+		u, err := url.Parse(t.BBaseURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid b_base_url %q", t.BBaseURL)
+		}
+		if t.Weight < 0 {
+			return fmt.Errorf("%s: negative weight %d", t.BBaseURL, t.Weight)
+		}
+		if t.Name == "" {
+			t.Name = u.Host
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate target name %q", t.Name)
+		}
+		names[t.Name] = true
+		total += t.Weight
+	}
+	if total == 0 {
+		return fmt.Errorf("all weights are 0")
+	}
+	return nil
+}
+
+// pickRedirectTarget returns the target r's visitor is assigned to: the one
+// named in their cookie while it still has weight, else a weighted random
+// pick. sticky reports whether the cookie decided. ok is false when no
+// targets are configured.
+func pickRedirectTarget(cfg *Config, r *http.Request) (t RedirectTarget, sticky, ok bool) {
+	if len(cfg.RedirectTargets) == 0 {
+		return RedirectTarget{}, false, false
+	}
+	if c, err := r.Cookie(redirectTargetCookie); err == nil {
+		for _, t := range cfg.RedirectTargets {
+			if t.Name == c.Value && t.Weight > 0 {
+				return t, true, true
+			}
+		}
+	}
+	total := 0
+	for _, t := range cfg.RedirectTargets {
+		total += t.Weight
+	}
+	n := rand.IntN(total)
+	for _, t := range cfg.RedirectTargets {
+		if n < t.Weight {
+			return t, false, true
+		}
+		n -= t.Weight
+	}
+	return cfg.RedirectTargets[len(cfg.RedirectTargets)-1], false, true
+}
+
+// setRedirectTargetCookie makes t the visitor's assignment.
+func setRedirectTargetCookie(w http.ResponseWriter, t RedirectTarget) {
+	http.SetCookie(w, &http.Cookie{Name: redirectTargetCookie, Value: t.Name, Path: "/", MaxAge: redirectTargetCookieMaxAge, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+}
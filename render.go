@@ -0,0 +1,88 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"rerouter/logger"
+)
+
+const defaultRenderTimeoutSeconds = 30
+
+// renderPath reports whether reqPath is fetched through the rendering
+// service. Sitemaps, feeds and static assets are never rendered.
+func renderPath(cfg *Config, reqPath string) bool {
+	if cfg.RenderServiceURL == "" || !patternsMatch(cfg.RenderPatterns, reqPath) {
+		return false
+	}
+	return !isSitemapPath(reqPath) && !isFeedPath(reqPath) && !isStaticAssetPath(reqPath)
+}
+
+// renderServiceURL builds the rendering request for target. A "{url}"
+// placeholder in base receives the escaped target (query-style services);
+// otherwise target is appended as is, as Rendertron (/render/) and Prerender
+// expect.
+func renderServiceURL(base, target string) string {
+	if strings.Contains(base, "{url}") {
+		return strings.ReplaceAll(base, "{url}", url.QueryEscape(target))
+	}
+	return base + target
+}
+
+// validateRenderService checks RENDER_SERVICE_URL when one is configured.
+func validateRenderService(cfg *Config) error {
+	if cfg.RenderServiceURL == "" {
+		return nil
+	}
+	u, err := url.Parse(strings.ReplaceAll(cfg.RenderServiceURL, "{url}", ""))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("render_service_url must be an absolute http(s) URL")
+	}
+	return nil
+}
+
+// doUpstream sends req to B, or for paths in RENDER_PATTERNS asks the
+// rendering service for the page as a browser would build it, so SPA content
+// reaches bots and the cache. The rendered page is handled like B's own
+// response; B's validators do not apply to it and are dropped. When the
+// service fails or answers 5xx, B is fetched directly instead.
+func doUpstream(cfg *Config, client *http.Client, req *http.Request, reqPath string) (*http.Response, error) {
+	if req.Method != http.MethodGet || !renderPath(cfg, reqPath) {
+		return client.Do(req)
+	}
+	target := req.URL.String()
+	rreq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, renderServiceURL(cfg.RenderServiceURL, target), nil)
+	if err != nil {
+		return nil, err
+	}
+	rreq.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+	if cfg.RenderServiceToken != "" {
+		rreq.Header.Set("X-Prerender-Token", cfg.RenderServiceToken)
+	}
+	timeout := cfg.RenderTimeoutSeconds
+	if timeout <= 0 {
+		timeout = defaultRenderTimeoutSeconds
+	}
+	rc := *client
+	rc.Timeout = time.Duration(timeout) * time.Second
+	start := time.Now()
+	resp, err := rc.Do(rreq)
+	if err == nil && resp.StatusCode < 500 {
+		resp.Header.Del("ETag")
+		resp.Header.Del("Last-Modified")
+		logger.Debugw("render_fetch", map[string]interface{}{"target": target, "status": resp.StatusCode, "duration_ms": time.Since(start).Milliseconds()})
+		return resp, nil
+	}
+	fields := map[string]interface{}{"target": target}
+	if err != nil {
+		fields["err"] = err.Error()
+	} else {
+		fields["status"] = resp.StatusCode
+		resp.Body.Close()
+	}
+	logger.Warnw("render_error", fields)
+	return client.Do(req)
+}
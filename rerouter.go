@@ -0,0 +1,248 @@
+// Package rerouter serves a B site to search engine crawlers under the A
+// domain, rewritten and cached, and sends human visitors on to B.
+//
+// The rerouter command (cmd/rerouter) runs it standalone; other programs can
+// embed it with NewServer, either on its own listeners (Start) or by mounting
+// Handler on their own server. Logging and tracing are process-wide.
+package rerouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Server is a rerouter instance: the handler chain for a Config, its
+// listeners and its background work (prefetching, sitemap warming).
+type Server struct {
+	app         *appHandler
+	stopTracing func(context.Context)
+	stopWatch   context.CancelFunc
+	listeners   []*listenerServer
+	errCh       chan error
+	upgradeState
+}
+
+// NewServer builds the handler chain for cfg, from LoadConfig or filled in by
+// the caller, and starts its background workers. It does not listen; see
+// Start and Handler.
+func NewServer(cfg *Config) (*Server, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create cache dir: %w", err)
+	}
+	s := &Server{errCh: make(chan error, 1)}
+	inherited, ready, err := inheritedListeners()
+	if err != nil {
+		logger.Warnw("upgrade_inherit_error", map[string]interface{}{"err": err.Error()})
+	}
+	s.inherited, s.upgradeReady = inherited, ready
+	s.stopTracing = startTracing(cfg)
+	s.app = newAppHandler(cfg)
+	if ready == nil {
+		s.app.resumeWarmJobs()
+	} else {
+		// The previous process still runs its warm jobs until it has drained
+		go func(ppid int) {
+			waitForParentExit(ppid)
+			s.app.resumeWarmJobs()
+		}(os.Getppid())
+	}
+	logger.AddMetricsSource(s.app.upstream.metrics)
+	logger.AddMetricsSource(s.app.cacheStats.metrics)
+	logger.AddMetricsSource(s.app.pf.metrics)
+	logger.AddMetricsSource(s.app.cacheCheck.metrics)
+	logger.AddMetricsSource(s.app.badBots.metrics)
+	logger.AddMetricsSource(s.app.challenge.metrics)
+	if s.app.remote != nil {
+		logger.AddMetricsSource(s.app.remote.metrics)
+	}
+	return s, nil
+}
+
+// Handler serves public traffic and the admin routes, with access logging,
+// for mounting on the caller's own http.Server.
+func (s *Server) Handler() http.Handler {
+	return loggingMiddleware(s.app.handlerFor(listenerAll))
+}
+
+// Config returns the effective configuration.
+func (s *Server) Config() *Config {
+	return s.app.config()
+}
+
+// Start binds the configured listeners (ListenAddr, AdminListenAddr), or
+// takes over those of the process upgraded from, and serves them in the
+// background, then writes PidFile and starts watching the config file when
+// ConfigWatchIntervalSeconds is set. A listener failing later is reported on
+// Err.
+func (s *Server) Start() error {
+	cfg := s.app.config()
+	servers, err := newListenerServers(cfg, func(role listenerRole) http.Handler {
+		return loggingMiddleware(s.app.handlerFor(role))
+	})
+	if err != nil {
+		return err
+	}
+	for i, ls := range servers {
+		inherited := s.inherited[ls.spec.String()]
+		delete(s.inherited, ls.spec.String())
+		if err := ls.listen(inherited); err != nil {
+			for _, prev := range servers[:i] {
+				prev.ln.Close()
+			}
+			return fmt.Errorf("listen on %s: %w", ls.spec, err)
+		}
+		logger.Infow("listening", map[string]interface{}{"listen": ls.spec.String(), "role": ls.spec.Role.String(), "inherited": inherited != nil})
+	}
+	// Sockets of listeners no longer configured
+	for _, ln := range s.inherited {
+		ln.Close()
+	}
+	s.inherited = nil
+	s.listeners = servers
+	for _, ls := range servers {
+		go func(ls *listenerServer) {
+			if err := ls.serve(); err != nil && err != http.ErrServerClosed && !s.handedOver.Load() {
+				select {
+				case s.errCh <- err:
+				default:
+				}
+			}
+		}(ls)
+	}
+	if cfg.ConfigWatchIntervalSeconds > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopWatch = cancel
+		go s.app.watchConfig(ctx, time.Duration(cfg.ConfigWatchIntervalSeconds)*time.Second)
+	}
+	if err := writePIDFile(cfg.PidFile); err != nil {
+		logger.Warnw("pid_file_error", map[string]interface{}{"err": err.Error(), "file": cfg.PidFile})
+	}
+	s.notifyUpgradeReady()
+	return nil
+}
+
+// Addrs returns the addresses Start bound, e.g. to learn the port of ":0".
+func (s *Server) Addrs() []net.Addr {
+	out := make([]net.Addr, 0, len(s.listeners))
+	for _, ls := range s.listeners {
+		out = append(out, ls.ln.Addr())
+	}
+	return out
+}
+
+// Err reports the first listener that stopped serving with an error.
+func (s *Server) Err() <-chan error {
+	return s.errCh
+}
+
+// Reload re-reads the environment and config file, as on SIGHUP, and applies
+// the settings that can change without a restart. source labels the
+// config_reloaded log entry.
+func (s *Server) Reload(source string) error {
+	return s.app.reloadConfig(source)
+}
+
+// Shutdown stops the listeners, letting in-flight requests finish, then
+// drains the background work and flushes traces, all within ctx.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	if s.handedOver.Load() {
+		select {
+		case <-time.After(handoverGrace):
+		case <-ctx.Done():
+		}
+	}
+	var errs []error
+	for _, ls := range s.listeners {
+		if err := ls.srv.Shutdown(ctx); err != nil {
+			logger.Warnw("server_shutdown_error", map[string]interface{}{"err": err.Error(), "listen": ls.spec.String()})
+			errs = append(errs, err)
+		}
+	}
+	if err := s.app.Shutdown(ctx); err != nil {
+		logger.Warnw("background_shutdown_error", map[string]interface{}{"err": err.Error()})
+		errs = append(errs, err)
+	}
+	s.stopTracing(ctx)
+	removePIDFile(s.app.config().PidFile)
+	return errors.Join(errs...)
+}
+
+// SetupLogging configures the process-wide logger from cfg: levels, console,
+// log file, shipping sinks, the access log and the periodic metrics line.
+// Call the returned func on exit to flush them.
+func SetupLogging(cfg *Config) func() {
+	_ = os.MkdirAll("./logs", 0o755)
+	modules, _ := logger.ParseModuleLevels(cfg.LogLevels) // validated by LoadConfig
+	sinks, sinkErrs := logSinks(cfg)
+	_ = logger.Init(logger.Config{
+		Level:            logger.ParseLevel(cfg.LogLevel),
+		Modules:          modules,
+		Output:           cfg.LogOutput,
+		File:             cfg.LogFile,
+		MaxSizeMB:        cfg.LogMaxSizeMB,
+		MaxBackups:       cfg.LogMaxBackups,
+		MaxAgeDays:       cfg.LogMaxAgeDays,
+		SampleInitial:    cfg.LogSampleInitial,
+		SampleThereafter: cfg.LogSampleThereafter,
+		Sinks:            sinks,
+	})
+	for _, err := range sinkErrs {
+		logger.Errorw("log_sink_error", map[string]interface{}{"err": err.Error()})
+	}
+	if err := logger.InitAccess(logger.AccessConfig{
+		Config: logger.Config{
+			File:       cfg.AccessLogFile,
+			MaxSizeMB:  cfg.AccessLogMaxSizeMB,
+			MaxBackups: cfg.AccessLogMaxBackups,
+			MaxAgeDays: cfg.AccessLogMaxAgeDays,
+		},
+		Format: cfg.AccessLogFormat,
+	}); err != nil {
+		logger.Errorw("access_log_open_error", map[string]interface{}{"err": err.Error(), "file": cfg.AccessLogFile})
+	}
+	if cfg.MetricsIntervalSeconds > 0 {
+		logger.StartMetricsLogger(time.Duration(cfg.MetricsIntervalSeconds)*time.Second, cfg.CacheDir)
+	}
+	return func() {
+		logger.CloseAccess()
+		logger.Close()
+	}
+}
+
+// logSinks opens the configured log shipping sinks; one that fails is left
+// out so the others and local logging still work.
+func logSinks(cfg *Config) ([]logger.Sink, []error) {
+	var sinks []logger.Sink
+	var errs []error
+	add := func(s logger.Sink, err error) {
+		if err != nil {
+			errs = append(errs, err)
+			return
+		}
+		sinks = append(sinks, s)
+	}
+	if cfg.LogSyslog != "" {
+		add(logger.NewSyslogSink(cfg.LogSyslog, "rerouter"))
+	}
+	if cfg.LogHTTPURL != "" {
+		add(logger.NewHTTPSink(cfg.LogHTTPURL, cfg.LogShipHeaders))
+	}
+	if cfg.LogLokiURL != "" {
+		labels := cfg.LogLokiLabels
+		if len(labels) == 0 {
+			labels = map[string]string{"job": "rerouter"}
+		}
+		add(logger.NewLokiSink(cfg.LogLokiURL, labels, cfg.LogShipHeaders))
+	}
+	return sinks, errs
+}
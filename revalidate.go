@@ -0,0 +1,52 @@
+package rerouter
+
+import (
+	"net/http"
+	"time"
+)
+
+// staleForRevalidation returns the expired cache entry for target (and vary
+// variant) if it carries upstream validators usable for a conditional request.
+func staleForRevalidation(cacheDir, target, variant string) *cacheEntry {
+	ce, err := readStaleCacheVariant(cacheDir, target, variant)
+	if err != nil || ce.Status != http.StatusOK {
+		return nil
+	}
+	if ce.UpstreamETag == "" && ce.UpstreamLastModified == "" {
+		return nil
+	}
+	return ce
+}
+
+// setConditionalHeaders adds If-None-Match / If-Modified-Since from a stale entry.
+func setConditionalHeaders(req *http.Request, stale *cacheEntry) {
+	if stale == nil {
+		return
+	}
+	if stale.UpstreamETag != "" {
+		req.Header.Set("If-None-Match", stale.UpstreamETag)
+	}
+	if stale.UpstreamLastModified != "" {
+		req.Header.Set("If-Modified-Since", stale.UpstreamLastModified)
+	}
+}
+
+// setUpstreamValidators records the upstream ETag/Last-Modified on ce.
+func setUpstreamValidators(ce *cacheEntry, h http.Header) {
+	ce.UpstreamETag = h.Get("ETag")
+	ce.UpstreamLastModified = h.Get("Last-Modified")
+}
+
+// extendCacheEntry renews a stale entry after a 304 Not Modified response.
+// v2 entries only rewrite their metadata; v1 entries are migrated to v2.
+func extendCacheEntry(cacheDir, target string, stale *cacheEntry, ttl int) error {
+	stale.ExpiresAt = time.Now().Add(time.Duration(ttl) * time.Second).Unix()
+	if stale.Format >= cacheFormatV2 {
+		p, err := cacheFilePathForVariant(cacheDir, target, stale.Variant)
+		if err != nil {
+			return err
+		}
+		return writeCacheMeta(cacheDir, p, stale)
+	}
+	return writeCacheByURL(cacheDir, target, stale)
+}
@@ -1,6 +1,7 @@
-package main
+package rerouter
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"strings"
@@ -13,8 +14,12 @@ func deriveABaseURL(cfg *Config, r *http.Request) *url.URL {
 			return u
 		}
 	}
-	// Fallback: build from request
-	scheme := r.Header.Get("X-Forwarded-Proto")
+	// Fallback: build from request. Without TRUSTED_PROXIES X-Forwarded-Proto
+	// is taken from any peer, as before that setting existed.
+	scheme := ""
+	if len(cfg.trustedProxyNets) == 0 || forwardedHeadersTrusted(cfg, r) {
+		scheme = forwardedProto(r)
+	}
 	if scheme == "" {
 		if r.TLS != nil {
 			scheme = "https"
@@ -26,14 +31,30 @@ func deriveABaseURL(cfg *Config, r *http.Request) *url.URL {
 	return u
 }
 
-// rewriteBodyForBots replaces absolute URLs pointing to B-site with A-site in HTML-like content.
-func rewriteBodyForBots(body []byte, contentType string, aBase, bBase *url.URL) (out []byte, rewrote bool) {
-	ct := strings.ToLower(contentType)
-	// Rewrite HTML, XHTML, and XML content (sitemap/feeds)
-	if !(strings.Contains(ct, "text/html") || strings.Contains(ct, "application/xhtml") || strings.Contains(ct, "xml")) {
+// rewriteBodyForBots runs the transformer chain (cfg.Transformers, by default
+// rewrite, strip, canonical, structured_data, robots, minify) over a body
+// served to bots. The rewrite step replaces absolute URLs pointing to B-site
+// with A-site: HTML attribute by attribute, CSS by url() reference, JS by
+// origin literal; XML and sitemaps/feeds use plain host replacement. Paths
+// in cfg.RewriteExcludePaths are not transformed at all, except sitemaps and
+// feeds, whose links must always point to A.
+func rewriteBodyForBots(cfg *Config, reqPath string, body []byte, contentType string, aBase, bBase *url.URL) (out []byte, rewrote bool) {
+	if cfg != nil && patternsMatch(cfg.RewriteExcludePaths, reqPath) && !isSitemapPath(reqPath) && !isFeedPath(reqPath) {
 		return body, false
 	}
-	return rewriteBToA(body, aBase, bBase)
+	tc := &transformContext{cfg: cfg, reqPath: reqPath, contentType: contentType, ct: strings.ToLower(contentType), aBase: aBase, bBase: bBase}
+	out = body
+	for _, t := range transformChain(cfg) {
+		if nb, ok := t.Transform(tc, out); ok {
+			out, rewrote = nb, true
+		}
+	}
+	return out, rewrote
+}
+
+// isJavaScriptType reports whether the lowercased content type ct is a script.
+func isJavaScriptType(ct string) bool {
+	return strings.Contains(ct, "javascript") || strings.Contains(ct, "ecmascript")
 }
 
 // rewriteBToA performs URL host replacement regardless of content type.
@@ -134,3 +155,20 @@ func isHostChar(ch byte) bool {
 	}
 	return ch == '-' || ch == '.' || ch == ':'
 }
+
+// parseRewriteHosts parses "b_host=a_host" entries separated by commas.
+func parseRewriteHosts(v string) ([]RewriteHostMapping, error) {
+	out := []RewriteHostMapping{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid rewrite host mapping %q", p)
+		}
+		out = append(out, RewriteHostMapping{From: strings.TrimSpace(kv[0]), To: strings.TrimSpace(kv[1])})
+	}
+	return out, nil
+}
@@ -0,0 +1,675 @@
+package rerouter
+
+import (
+	"bytes"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlURLAttrs lists attributes whose values are URLs and get rewritten from B to A.
+var htmlURLAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"poster":     true,
+	"cite":       true,
+	"data-src":   true,
+	"data-href":  true,
+}
+
+// htmlSrcsetAttrs lists attributes holding comma-separated image candidates.
+var htmlSrcsetAttrs = map[string]bool{
+	"srcset":      true,
+	"data-srcset": true,
+}
+
+// hostPair maps one B origin host to an A origin.
+type hostPair struct {
+	from string   // B host, lowercased, optionally with port
+	to   *url.URL // A scheme and host
+}
+
+// urlRewriter rewrites B URLs to A. The first pair is the primary B->A mapping;
+// further pairs come from cfg.RewriteHosts (e.g. cdn.b.com -> cdn.a.com).
+type urlRewriter struct {
+	pairs   []hostPair
+	exclude []htmlSelector
+	// hreflang -> A origin for alternate links (cfg.HreflangHosts).
+	langs map[string]*url.URL
+}
+
+func newURLRewriter(cfg *Config, aBase, bBase *url.URL) *urlRewriter {
+	rw := &urlRewriter{}
+	if bBase != nil && bBase.Host != "" {
+		rw.pairs = append(rw.pairs, hostPair{from: strings.ToLower(bBase.Host), to: aBase})
+	}
+	if cfg == nil {
+		return rw
+	}
+	// Pages of a B site fetched under another Host link to that host
+	if h := strings.ToLower(cfg.UpstreamHostHeader); h != "" && bBase != nil && h != strings.ToLower(bBase.Host) {
+		rw.pairs = append(rw.pairs, hostPair{from: h, to: aBase})
+	}
+	for _, m := range cfg.RewriteHosts {
+		to := m.To
+		if !strings.Contains(to, "://") {
+			to = aBase.Scheme + "://" + to
+		}
+		u, err := url.Parse(to)
+		if err != nil || u.Host == "" || m.From == "" {
+			continue
+		}
+		rw.pairs = append(rw.pairs, hostPair{from: strings.ToLower(m.From), to: u})
+	}
+	for lang, host := range cfg.HreflangHosts {
+		if !strings.Contains(host, "://") {
+			host = aBase.Scheme + "://" + host
+		}
+		u, err := url.Parse(host)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		if rw.langs == nil {
+			rw.langs = map[string]*url.URL{}
+		}
+		rw.langs[strings.ToLower(lang)] = u
+	}
+	for _, sel := range cfg.RewriteExcludeSelectors {
+		if hs, ok := parseHTMLSelector(sel); ok {
+			rw.exclude = append(rw.exclude, hs)
+		}
+	}
+	return rw
+}
+
+// mentionsB reports whether s contains any B host at all (cheap pre-check).
+func (rw *urlRewriter) mentionsB(s string) bool {
+	lower := asciiLower(s)
+	for _, p := range rw.pairs {
+		if strings.Contains(lower, p.from) {
+			return true
+		}
+	}
+	return false
+}
+
+// html rewrites B URLs in URL-bearing attributes, inline CSS and JSON-LD blocks
+// only. Text content and inline scripts are copied byte-for-byte; tags without
+// B URLs keep their original markup. Elements matching an exclusion selector
+// are copied verbatim together with their content.
+func (rw *urlRewriter) html(body []byte) ([]byte, bool) {
+	if !rw.mentionsB(string(body)) {
+		return body, false
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body))
+	changed := false
+	// Raw text of the current <script type="application/ld+json"> or <style> element.
+	inJSONLD, inStyle := false, false
+	// Open excluded element: its tag name and nesting depth.
+	skipTag, skipDepth := "", 0
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// io.EOF or a tokenizer failure; either way the remaining input was
+			// not consumed as tokens, so never return a truncated document.
+			if !changed {
+				return body, false
+			}
+			out.Write(z.Raw())
+			return out.Bytes(), true
+		case html.StartTagToken, html.SelfClosingTagToken:
+			raw := z.Raw()
+			tok := z.Token()
+			if skipDepth > 0 {
+				if tt == html.StartTagToken && tok.Data == skipTag {
+					skipDepth++
+				}
+				out.Write(raw)
+				continue
+			}
+			if rw.excluded(tok) {
+				if tt == html.StartTagToken && !htmlVoidElements[tok.Data] {
+					skipTag, skipDepth = tok.Data, 1
+				}
+				out.Write(raw)
+				continue
+			}
+			inJSONLD = tt == html.StartTagToken && tok.Data == "script" && isJSONLDScript(tok)
+			inStyle = tt == html.StartTagToken && tok.Data == "style"
+			if rw.tagAttrs(&tok) {
+				out.WriteString(tok.String())
+				changed = true
+			} else {
+				out.Write(raw)
+			}
+		case html.TextToken:
+			raw := z.Raw()
+			if skipDepth == 0 && inJSONLD {
+				if nb, ok := rw.bToA(raw); ok {
+					out.Write(nb)
+					changed = true
+					continue
+				}
+			}
+			if skipDepth == 0 && inStyle {
+				if ns, ok := rw.css(string(raw)); ok {
+					out.WriteString(ns)
+					changed = true
+					continue
+				}
+			}
+			out.Write(raw)
+		default:
+			raw := z.Raw()
+			if tt == html.EndTagToken {
+				inJSONLD, inStyle = false, false
+				if skipDepth > 0 {
+					if name, _ := z.TagName(); string(name) == skipTag {
+						skipDepth--
+					}
+				}
+			}
+			out.Write(raw)
+		}
+	}
+}
+
+// htmlVoidElements never have an end tag.
+var htmlVoidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "source": true, "track": true, "wbr": true,
+}
+
+// htmlSelector is a minimal CSS selector: tag, #id, .class or a tag combined with one of them.
+type htmlSelector struct {
+	tag, id, class string
+}
+
+func parseHTMLSelector(s string) (htmlSelector, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, " >+~[:") {
+		return htmlSelector{}, false
+	}
+	var sel htmlSelector
+	if i := strings.IndexAny(s, "#."); i != -1 {
+		sel.tag = strings.ToLower(s[:i])
+		if s[i] == '#' {
+			sel.id = s[i+1:]
+		} else {
+			sel.class = s[i+1:]
+		}
+	} else {
+		sel.tag = strings.ToLower(s)
+	}
+	return sel, sel.tag != "" || sel.id != "" || sel.class != ""
+}
+
+func (sel htmlSelector) matches(tok html.Token) bool {
+	if sel.tag != "" && sel.tag != tok.Data {
+		return false
+	}
+	if sel.id == "" && sel.class == "" {
+		return true
+	}
+	for _, a := range tok.Attr {
+		if sel.id != "" && a.Key == "id" && a.Val == sel.id {
+			return true
+		}
+		if sel.class != "" && a.Key == "class" {
+			for _, c := range strings.Fields(a.Val) {
+				if c == sel.class {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (rw *urlRewriter) excluded(tok html.Token) bool {
+	for _, sel := range rw.exclude {
+		if sel.matches(tok) {
+			return true
+		}
+	}
+	return false
+}
+
+func isJSONLDScript(tok html.Token) bool {
+	for _, a := range tok.Attr {
+		if a.Key == "type" {
+			return strings.EqualFold(strings.TrimSpace(a.Val), "application/ld+json")
+		}
+	}
+	return false
+}
+
+// tagAttrs rewrites URL-bearing attributes of tok in place. The href of an
+// hreflang alternate goes to the A host configured for its language.
+func (rw *urlRewriter) tagAttrs(tok *html.Token) bool {
+	changed := false
+	lang := attrVal(*tok, "hreflang")
+	for i, a := range tok.Attr {
+		var (
+			nv string
+			ok bool
+		)
+		switch {
+		case a.Key == "href" && lang != "":
+			nv, ok = rw.alternate(lang, a.Val)
+		case htmlURLAttrs[a.Key]:
+			nv, ok = rw.url(a.Val)
+		case htmlSrcsetAttrs[a.Key]:
+			nv, ok = rw.srcset(a.Val)
+		case a.Key == "content" && tok.Data == "meta" && isCSPMeta(*tok):
+			nv, ok = rw.csp(a.Val)
+		case a.Key == "content" && tok.Data == "meta":
+			nv, ok = rw.metaContent(a.Val)
+		case a.Key == "style":
+			nv, ok = rw.css(a.Val)
+		}
+		if ok {
+			tok.Attr[i].Val = nv
+			changed = true
+		}
+	}
+	return changed
+}
+
+// bToA applies plain host replacement for every pair (used for JSON-LD and XML).
+// Sitemap <xhtml:link hreflang> alternates are mapped per language first.
+func (rw *urlRewriter) bToA(body []byte) ([]byte, bool) {
+	changed := false
+	if len(rw.langs) != 0 {
+		body, changed = rw.xmlAlternates(body)
+	}
+	for _, p := range rw.pairs {
+		if nb, ok := rewriteBToA(body, p.to, &url.URL{Scheme: "https", Host: p.from}); ok {
+			body = nb
+			changed = true
+		}
+	}
+	return body, changed
+}
+
+// url swaps a leading B origin (http, https or protocol-relative) for the
+// matching A origin. Relative URLs and other hosts are left alone.
+func (rw *urlRewriter) url(v string) (string, bool) {
+	return rw.urlTo(v, nil)
+}
+
+// urlTo is url with every B origin sent to the fixed origin to (when non-nil).
+func (rw *urlRewriter) urlTo(v string, to *url.URL) (string, bool) {
+	s := strings.TrimSpace(v)
+	lower := asciiLower(s)
+	for _, p := range rw.pairs {
+		for _, prefix := range []string{"https://", "http://", "//"} {
+			if !strings.HasPrefix(lower, prefix+p.from) {
+				continue
+			}
+			rest := s[len(prefix)+len(p.from):]
+			if rest != "" && !strings.ContainsRune("/?#", rune(rest[0])) {
+				// Longer hostname or explicit port, e.g. b.com.evil.net
+				break
+			}
+			dst := p.to
+			if to != nil {
+				dst = to
+			}
+			if prefix == "//" {
+				return "//" + dst.Host + rest, true
+			}
+			return dst.Scheme + "://" + dst.Host + rest, true
+		}
+	}
+	return v, false
+}
+
+// langHost returns the A origin for an hreflang value: exact match first
+// ("pt-br", "x-default"), then the primary language subtag ("pt").
+func (rw *urlRewriter) langHost(lang string) *url.URL {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if u, ok := rw.langs[lang]; ok {
+		return u
+	}
+	if i := strings.IndexAny(lang, "-_"); i > 0 {
+		return rw.langs[lang[:i]]
+	}
+	return nil
+}
+
+// alternate rewrites the href of an hreflang alternate. Unmapped languages
+// fall back to the regular B->A rewrite.
+func (rw *urlRewriter) alternate(lang, v string) (string, bool) {
+	return rw.urlTo(v, rw.langHost(lang))
+}
+
+var (
+	xmlLinkTagRe  = regexp.MustCompile(`(?i)<(?:[a-z0-9]+:)?link\b[^>]*>`)
+	xmlHreflangRe = regexp.MustCompile(`(?i)\bhreflang\s*=\s*["']([^"']*)["']`)
+	xmlHrefRe     = regexp.MustCompile(`(?i)\bhref\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// xmlAlternates rewrites href values of link elements carrying hreflang in XML
+// (e.g. <xhtml:link rel="alternate" hreflang="de" href="..."/> in sitemaps).
+func (rw *urlRewriter) xmlAlternates(body []byte) ([]byte, bool) {
+	changed := false
+	out := xmlLinkTagRe.ReplaceAllFunc(body, func(tag []byte) []byte {
+		m := xmlHreflangRe.FindSubmatch(tag)
+		if m == nil {
+			return tag
+		}
+		to := rw.langHost(string(m[1]))
+		if to == nil {
+			return tag
+		}
+		loc := xmlHrefRe.FindSubmatchIndex(tag)
+		if loc == nil {
+			return tag
+		}
+		start, end := loc[2], loc[3]
+		if start < 0 {
+			start, end = loc[4], loc[5]
+		}
+		nv, ok := rw.urlTo(string(tag[start:end]), to)
+		if !ok {
+			return tag
+		}
+		changed = true
+		nt := make([]byte, 0, len(tag)+len(nv))
+		nt = append(nt, tag[:start]...)
+		nt = append(nt, nv...)
+		return append(nt, tag[end:]...)
+	})
+	if !changed {
+		return body, false
+	}
+	return out, true
+}
+
+// srcset rewrites the URL of each "url [descriptors]" candidate, following
+// the HTML srcset parsing rules: URLs may contain commas, and candidates are
+// separated by a comma after the URL or its descriptors.
+func (rw *urlRewriter) srcset(v string) (string, bool) {
+	var b strings.Builder
+	changed := false
+	i := 0
+	for i < len(v) {
+		// Separators between candidates
+		start := i
+		for i < len(v) && (isCSSSpace(v[i]) || v[i] == ',') {
+			i++
+		}
+		b.WriteString(v[start:i])
+		if i >= len(v) {
+			break
+		}
+		// URL: run of non-whitespace; trailing commas end the candidate
+		start = i
+		for i < len(v) && !isCSSSpace(v[i]) {
+			i++
+		}
+		u := v[start:i]
+		trail := len(u) - len(strings.TrimRight(u, ","))
+		u = u[:len(u)-trail]
+		if nu, ok := rw.url(u); ok {
+			b.WriteString(nu)
+			changed = true
+		} else {
+			b.WriteString(u)
+		}
+		b.WriteString(v[i-trail : i])
+		if trail > 0 {
+			continue
+		}
+		// Descriptors up to the next comma outside parentheses
+		start = i
+		depth := 0
+		for i < len(v) && (v[i] != ',' || depth > 0) {
+			switch v[i] {
+			case '(':
+				depth++
+			case ')':
+				if depth > 0 {
+					depth--
+				}
+			}
+			i++
+		}
+		b.WriteString(v[start:i])
+	}
+	if !changed {
+		return v, false
+	}
+	return b.String(), true
+}
+
+// js rewrites absolute and protocol-relative B URLs in script source,
+// including the escaped "https:\/\/" form of JSON strings. Bare host names are
+// left alone: in code they are as likely to be comparisons as links.
+func (rw *urlRewriter) js(src string) (string, bool) {
+	if !rw.mentionsB(src) {
+		return src, false
+	}
+	changed := false
+	for _, p := range rw.pairs {
+		for _, pre := range [][2]string{
+			{"https://", p.to.Scheme + "://"},
+			{"http://", p.to.Scheme + "://"},
+			{`https:\/\/`, p.to.Scheme + `:\/\/`},
+			{`http:\/\/`, p.to.Scheme + `:\/\/`},
+			{"//", "//"},
+			{`\/\/`, `\/\/`},
+		} {
+			if ns, ok := replaceHostLiteral(src, pre[0]+p.from, pre[1]+p.to.Host); ok {
+				src, changed = ns, true
+			}
+		}
+	}
+	return src, changed
+}
+
+// css rewrites B URLs in url(...) references and @import strings,
+// as found in stylesheets, <style> elements and style attributes.
+func (rw *urlRewriter) css(css string) (string, bool) {
+	if !rw.mentionsB(css) {
+		return css, false
+	}
+	var b strings.Builder
+	changed := false
+	lower := asciiLower(css)
+	i := 0
+	for i < len(css) {
+		urlIdx := strings.Index(lower[i:], "url(")
+		impIdx := strings.Index(lower[i:], "@import")
+		if urlIdx == -1 && impIdx == -1 {
+			break
+		}
+		var start int
+		if urlIdx != -1 && (impIdx == -1 || urlIdx < impIdx) {
+			start = i + urlIdx + len("url(")
+		} else {
+			start = i + impIdx + len("@import")
+		}
+		// Skip whitespace before the value
+		for start < len(css) && isCSSSpace(css[start]) {
+			start++
+		}
+		if strings.HasPrefix(lower[start:], "url(") {
+			// @import url(...) is handled as a url() reference
+			b.WriteString(css[i:start])
+			i = start
+			continue
+		}
+		b.WriteString(css[i:start])
+		i = start
+		if i >= len(css) {
+			break
+		}
+		var end int
+		if q := css[i]; q == '"' || q == '\'' {
+			b.WriteByte(q)
+			i++
+			end = strings.IndexByte(css[i:], q)
+		} else {
+			end = strings.IndexAny(css[i:], ") \t\n\r\f;")
+		}
+		if end == -1 {
+			end = len(css) - i
+		}
+		val := css[i : i+end]
+		if nv, ok := rw.url(val); ok {
+			b.WriteString(nv)
+			changed = true
+		} else {
+			b.WriteString(val)
+		}
+		i += end
+	}
+	if !changed {
+		return css, false
+	}
+	b.WriteString(css[i:])
+	return b.String(), true
+}
+
+// asciiLower lowercases ASCII letters only, keeping byte offsets aligned with s.
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + ('a' - 'A')
+		}
+	}
+	return string(b)
+}
+
+func isCSSSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// isCSPMeta reports whether tok is a <meta http-equiv="Content-Security-Policy">
+// (or its -Report-Only variant), whose content is a policy rather than a URL.
+func isCSPMeta(tok html.Token) bool {
+	v := strings.ToLower(strings.TrimSpace(attrVal(tok, "http-equiv")))
+	return v == "content-security-policy" || v == "content-security-policy-report-only"
+}
+
+// metaContent handles URL-valued meta tags (og:url, twitter:image, ...)
+// and the "0; url=..." form of http-equiv refresh.
+func (rw *urlRewriter) metaContent(v string) (string, bool) {
+	if nv, ok := rw.url(v); ok {
+		return nv, true
+	}
+	lower := strings.ToLower(v)
+	if i := strings.Index(lower, "url="); i != -1 {
+		if nu, ok := rw.url(v[i+4:]); ok {
+			return v[:i+4] + nu, true
+		}
+	}
+	return v, false
+}
+
+// injectCanonicalTags points <link rel="canonical">, og:url and twitter:url at
+// canonical, overwriting existing values and adding missing tags before </head>
+// (or before <body> when the head is not closed explicitly).
+func injectCanonicalTags(body []byte, canonical string) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body) + 256)
+	changed := false
+	hasCanonical, hasOG, hasTwitter, injected := false, false, false, false
+	inject := func() {
+		if injected {
+			return
+		}
+		injected = true
+		esc := html.EscapeString(canonical)
+		if !hasCanonical {
+			out.WriteString(`<link rel="canonical" href="` + esc + `">`)
+			changed = true
+		}
+		if !hasOG {
+			out.WriteString(`<meta property="og:url" content="` + esc + `">`)
+			changed = true
+		}
+		if !hasTwitter {
+			out.WriteString(`<meta name="twitter:url" content="` + esc + `">`)
+			changed = true
+		}
+	}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := z.Raw()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if injected {
+				out.Write(raw)
+				continue
+			}
+			if tok.Data == "body" {
+				inject()
+				out.Write(raw)
+				continue
+			}
+			key := ""
+			switch {
+			case tok.Data == "link" && strings.EqualFold(attrVal(tok, "rel"), "canonical"):
+				key, hasCanonical = "href", true
+			case tok.Data == "meta" && strings.EqualFold(attrVal(tok, "property"), "og:url"):
+				key, hasOG = "content", true
+			case tok.Data == "meta" && strings.EqualFold(attrVal(tok, "name"), "twitter:url"):
+				key, hasTwitter = "content", true
+			}
+			if key == "" || attrVal(tok, key) == canonical {
+				out.Write(raw)
+				continue
+			}
+			setAttr(&tok, key, canonical)
+			out.WriteString(tok.String())
+			changed = true
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				inject()
+			}
+			out.Write(raw)
+		default:
+			out.Write(raw)
+		}
+	}
+	if !changed {
+		return body, false
+	}
+	return out.Bytes(), true
+}
+
+func attrVal(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(tok *html.Token, key, val string) {
+	for i, a := range tok.Attr {
+		if a.Key == key {
+			tok.Attr[i].Val = val
+			return
+		}
+	}
+	tok.Attr = append(tok.Attr, html.Attribute{Key: key, Val: val})
+}
@@ -1,6 +1,7 @@
-package main
+package rerouter
 
 import (
+	"encoding/json"
 	"net/url"
 	"strings"
 	"testing"
@@ -117,3 +118,394 @@ func TestRewriteBToARewritesQueryParams(t *testing.T) {
 		t.Fatalf("expected three occurrences of localhost:8080, got: %s", s)
 	}
 }
+
+func TestRewriteHTMLOnlyTouchesURLAttributes(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+
+	body := `<!DOCTYPE html><html><head>
+<link rel="canonical" href="https://b.example/post">
+<meta property="og:url" content="https://b.example/post">
+<meta property="og:description" content="Moved from b.example last year">
+<script>ga('create', 'UA-1', 'b.example');</script>
+<script type="application/ld+json">{"url":"https://b.example/post"}</script>
+</head><body>
+<p>Visit b.example or https://b.example/ for more</p>
+<a href="//b.example/x?y=1" class='keep'>x</a>
+<img src="https://b.example/i.png" srcset="https://b.example/i-1x.png 1x, /i-2x.png 2x">
+<a href="https://b.example.evil.net/">evil</a>
+<form action="http://b.example/search"></form>
+</body></html>`
+	got, rewrote := newURLRewriter(nil, aBase, bBase).html([]byte(body))
+	if !rewrote {
+		t.Fatalf("expected rewrite")
+	}
+	s := string(got)
+	for _, want := range []string{
+		`<link rel="canonical" href="https://a.example/post">`,
+		`<meta property="og:url" content="https://a.example/post">`,
+		`content="Moved from b.example last year"`,
+		`ga('create', 'UA-1', 'b.example');`,
+		`{"url":"https://a.example/post"}`,
+		`<p>Visit b.example or https://b.example/ for more</p>`,
+		`<a href="//a.example/x?y=1" class="keep">`,
+		`src="https://a.example/i.png" srcset="https://a.example/i-1x.png 1x, /i-2x.png 2x"`,
+		`<a href="https://b.example.evil.net/">evil</a>`,
+		`<form action="https://a.example/search">`,
+		`<!DOCTYPE html><html><head>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("expected %q in output:\n%s", want, s)
+		}
+	}
+}
+
+func TestRewriteHTMLWithoutBURLsIsUnchanged(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	body := []byte(`<p>b.example is our old name</p><a HREF='/rel'>x</a>`)
+	got, rewrote := rewriteBodyForBots(nil, "/", body, "text/html; charset=utf-8", aBase, bBase)
+	if rewrote || string(got) != string(body) {
+		t.Fatalf("expected body untouched, got %s", got)
+	}
+}
+
+func TestRewriteSrcsetCandidates(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	rw := newURLRewriter(nil, aBase, bBase)
+	cases := map[string]string{
+		"https://b.example/a.jpg 1x, https://b.example/b.jpg 2x":    "https://a.example/a.jpg 1x, https://a.example/b.jpg 2x",
+		"https://b.example/a.jpg 320w,https://b.example/b.jpg 640w": "https://a.example/a.jpg 320w,https://a.example/b.jpg 640w",
+		"https://b.example/img,w_100,h_50.jpg 100w, /local.jpg 2x":  "https://a.example/img,w_100,h_50.jpg 100w, /local.jpg 2x",
+		"  //b.example/x.png  ": "  //a.example/x.png  ",
+	}
+	for in, want := range cases {
+		got, ok := rw.srcset(in)
+		if !ok || got != want {
+			t.Fatalf("srcset(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if _, ok := rw.srcset("/a.jpg 1x, https://cdn.example/b.jpg 2x"); ok {
+		t.Fatalf("expected srcset without B URLs untouched")
+	}
+}
+
+func TestRewriteCSSURLs(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	css := `@import "https://b.example/base.css";
+@import url(//b.example/print.css) print;
+.hero{background:URL( 'https://b.example/hero.jpg' )}
+.logo{background:url(https://b.example/logo.svg#icon)}
+.other{background:url(/rel.png)}
+/* b.example */`
+	got, ok := rewriteBodyForBots(nil, "/style.css", []byte(css), "text/css", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected css rewrite")
+	}
+	want := `@import "https://a.example/base.css";
+@import url(//a.example/print.css) print;
+.hero{background:URL( 'https://a.example/hero.jpg' )}
+.logo{background:url(https://a.example/logo.svg#icon)}
+.other{background:url(/rel.png)}
+/* b.example */`
+	if string(got) != want {
+		t.Fatalf("unexpected css:\n%s", got)
+	}
+
+	htmlBody := `<style>.a{background:url("https://b.example/a.png")}</style><div style="background-image:url(https://b.example/d.png)">b.example</div>`
+	out, ok := newURLRewriter(nil, aBase, bBase).html([]byte(htmlBody))
+	if !ok {
+		t.Fatalf("expected html rewrite")
+	}
+	s := string(out)
+	if !strings.Contains(s, `url("https://a.example/a.png")`) || !strings.Contains(s, `style="background-image:url(https://a.example/d.png)"`) || !strings.Contains(s, `>b.example</div>`) {
+		t.Fatalf("unexpected html: %s", s)
+	}
+}
+
+func TestRewriteContentSecurityPolicy(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	rw := newURLRewriter(nil, aBase, bBase)
+	cases := map[string]string{
+		"default-src 'self' https://b.example; img-src b.example data:":   "default-src 'self' https://a.example; img-src a.example data:",
+		"script-src http://b.example:443/js/ 'nonce-abc'":                 "script-src https://a.example/js/ 'nonce-abc'",
+		"img-src https://*.b.example; font-src *.b.example https://cdn.x": "img-src https://*.b.example https://a.example; font-src *.b.example a.example https://cdn.x",
+	}
+	for in, want := range cases {
+		got, ok := rw.csp(in)
+		if !ok || got != want {
+			t.Fatalf("csp(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got, ok := rw.csp("default-src  'self'; img-src *"); ok || got != "default-src  'self'; img-src *" {
+		t.Fatalf("expected CSP without B hosts untouched, got %q", got)
+	}
+
+	body := `<html><head><meta http-equiv="Content-Security-Policy" content="img-src 'self' https://b.example"></head>` +
+		`<body><img src="https://b.example/i.png"></body></html>`
+	got, rewrote := rw.html([]byte(body))
+	if !rewrote || !strings.Contains(string(got), `content="img-src &#39;self&#39; https://a.example"`) {
+		t.Fatalf("expected meta CSP rewritten, got %s", got)
+	}
+}
+
+func TestRewriteExtraHostsAndExclusions(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	cfg := &Config{
+		RewriteHosts:            []RewriteHostMapping{{From: "cdn.b.example", To: "cdn.a.example"}, {From: "img.b.example", To: "http://img.a.example"}},
+		RewriteExcludeSelectors: []string{"#widget", "div.raw"},
+		RewriteExcludePaths:     []string{"/embed/*"},
+	}
+	body := `<link href="https://cdn.b.example/site.css" rel="stylesheet">
+<img src="//img.b.example/a.png" srcset="https://cdn.b.example/a.png 1x">
+<div id="widget"><a href="https://b.example/keep">k</a><div><a href="https://b.example/keep2">k</a></div></div>
+<div class="box raw"><img src="https://b.example/keep.png"></div>
+<a href="https://b.example/after">after</a>`
+	got, ok := rewriteBodyForBots(cfg, "/page", []byte(body), "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected rewrite")
+	}
+	s := string(got)
+	for _, want := range []string{
+		`href="https://cdn.a.example/site.css"`,
+		`src="//img.a.example/a.png" srcset="https://cdn.a.example/a.png 1x"`,
+		`<a href="https://b.example/keep">k</a><div><a href="https://b.example/keep2">k</a></div></div>`,
+		`<img src="https://b.example/keep.png">`,
+		`<a href="https://a.example/after">after</a>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("expected %q in output:\n%s", want, s)
+		}
+	}
+
+	xml := []byte(`<image:loc>https://img.b.example/p.jpg</image:loc><loc>https://b.example/p</loc>`)
+	gotXML, _ := rewriteBodyForBots(cfg, "/sitemap-images.xml", xml, "application/xml", aBase, bBase)
+	if string(gotXML) != `<image:loc>http://img.a.example/p.jpg</image:loc><loc>https://a.example/p</loc>` {
+		t.Fatalf("unexpected xml: %s", gotXML)
+	}
+
+	if _, ok := rewriteBodyForBots(cfg, "/embed/x", []byte(body), "text/html", aBase, bBase); ok {
+		t.Fatalf("expected excluded path to skip rewriting")
+	}
+	if maps, err := parseRewriteHosts("cdn.b.example=cdn.a.example, img.b.example=https://img.a.example"); err != nil || len(maps) != 2 || maps[1].To != "https://img.a.example" {
+		t.Fatalf("unexpected parse result %+v %v", maps, err)
+	}
+}
+
+func TestRewriteHreflangAlternates(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	cfg := &Config{HreflangHosts: map[string]string{"de": "de.a.example", "pt-br": "https://br.a.example", "x-default": "a.example"}}
+	body := `<link rel="alternate" hreflang="de-AT" href="https://b.example/de/p">
+<link rel="alternate" hreflang="pt-BR" href="https://b.example/pt/p">
+<link rel="alternate" hreflang="fr" href="https://b.example/fr/p">
+<link rel="alternate" hreflang="x-default" href="https://b.example/p">
+<a href="https://b.example/plain">p</a>`
+	got, ok := rewriteBodyForBots(cfg, "/p", []byte(body), "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected rewrite")
+	}
+	for _, want := range []string{
+		`hreflang="de-AT" href="https://de.a.example/de/p"`,
+		`hreflang="pt-BR" href="https://br.a.example/pt/p"`,
+		`hreflang="fr" href="https://a.example/fr/p"`,
+		`hreflang="x-default" href="https://a.example/p"`,
+		`<a href="https://a.example/plain">`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Fatalf("expected %q in output:\n%s", want, got)
+		}
+	}
+
+	xml := []byte(`<url><loc>https://b.example/p</loc><xhtml:link rel="alternate" hreflang="de" href='https://b.example/de/p'/></url>`)
+	gotXML, _ := newURLRewriter(cfg, aBase, bBase).bToA(xml)
+	if string(gotXML) != `<url><loc>https://a.example/p</loc><xhtml:link rel="alternate" hreflang="de" href='https://de.a.example/de/p'/></url>` {
+		t.Fatalf("unexpected xml: %s", gotXML)
+	}
+}
+
+func TestInjectCanonicalTags(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	cfg := &Config{InjectCanonical: true}
+
+	// Missing tags are added before </head>
+	body := []byte(`<html><head><title>T</title></head><body>x</body></html>`)
+	got, ok := rewriteBodyForBots(cfg, "/post/1", body, "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected injection")
+	}
+	want := `<html><head><title>T</title><link rel="canonical" href="https://a.example/post/1"><meta property="og:url" content="https://a.example/post/1"><meta name="twitter:url" content="https://a.example/post/1"></head><body>x</body></html>`
+	if string(got) != want {
+		t.Fatalf("unexpected output:\n%s", got)
+	}
+
+	// Existing tags are overwritten, not duplicated
+	body = []byte(`<head><link rel="Canonical" href="https://other.example/p"><meta property="og:url" content="https://b.example/p?utm=1"></head><body></body>`)
+	got, _ = rewriteBodyForBots(cfg, "/p", body, "text/html", aBase, bBase)
+	s := string(got)
+	if strings.Count(strings.ToLower(s), "canonical") != 1 || !strings.Contains(s, `href="https://a.example/p"`) || !strings.Contains(s, `<meta property="og:url" content="https://a.example/p">`) || !strings.Contains(s, `<meta name="twitter:url" content="https://a.example/p">`) {
+		t.Fatalf("unexpected output:\n%s", s)
+	}
+
+	// Head without an explicit close tag
+	got, _ = injectCanonicalTags([]byte(`<title>T</title><body>x</body>`), "https://a.example/")
+	if !strings.Contains(string(got), `<link rel="canonical" href="https://a.example/"><meta property="og:url" content="https://a.example/"><meta name="twitter:url" content="https://a.example/"><body>`) {
+		t.Fatalf("unexpected output:\n%s", got)
+	}
+
+	// Disabled by default
+	if _, ok := rewriteBodyForBots(&Config{}, "/p", []byte(`<head></head>`), "text/html", aBase, bBase); ok {
+		t.Fatalf("expected no injection when disabled")
+	}
+}
+
+func TestInjectStructuredData(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	cfg := &Config{StructuredData: []StructuredDataRule{
+		{Pattern: "/", Type: structuredDataOrganization, Fields: map[string]string{"logo": "https://a.example/logo.png"}},
+		{Pattern: "/products/", Type: structuredDataBreadcrumbs},
+		{Pattern: "/products/", Type: structuredDataProduct},
+		{Pattern: "/products/", Template: json.RawMessage(`{"@context":"https://schema.org","@type":"WebPage","name":"{{title}}","keywords":"{{meta:keywords}}"}`)},
+	}}
+	for _, r := range cfg.StructuredData {
+		if err := validateStructuredDataRule(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body := []byte(`<html><head><title>Blue Mug | Shop</title><meta property="og:site_name" content="Shop">
+<meta property="og:image" content="https://b.example/mug.jpg"><meta property="product:price:amount" content="12.50">
+<script type="application/ld+json">{"@type":"WebPage"}</script></head><body><h1>Blue <em>Mug</em></h1></body></html>`)
+	got, ok := rewriteBodyForBots(cfg, "/products/blue-mug", body, "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected injection")
+	}
+	s := string(got)
+	for _, want := range []string{
+		`{"@context":"https://schema.org","@type":"Organization","logo":"https://a.example/logo.png","name":"Shop","url":"https://a.example/"}`,
+		`{"@type":"ListItem","item":"https://a.example/products/","name":"Products","position":2}`,
+		`{"@type":"ListItem","item":"https://a.example/products/blue-mug","name":"Blue Mug","position":3}`,
+		`"image":"https://a.example/mug.jpg","name":"Blue Mug","offers":{"@type":"Offer","price":"12.50"},"url":"https://a.example/products/blue-mug"}`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("expected %s in output:\n%s", want, s)
+		}
+	}
+	if strings.Count(s, "WebPage") != 1 || !strings.Contains(s, "</script></head>") {
+		t.Fatalf("expected the page's own WebPage block kept alone and blocks before </head>:\n%s", s)
+	}
+
+	// Nothing to name the organization with, and no crumbs for the home page
+	if _, ok := rewriteBodyForBots(cfg, "/", []byte(`<head><title>T</title></head><body></body>`), "text/html", aBase, bBase); ok {
+		t.Fatalf("expected no injection without a name")
+	}
+	if err := validateStructuredDataRule(StructuredDataRule{Pattern: "/", Type: "event"}); err == nil {
+		t.Fatalf("expected unknown type rejected")
+	}
+}
+
+func TestMinifyAndStripSelectors(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	cfg := &Config{MinifyResponses: true, StripSelectors: []string{"#wpadminbar", "script.tracker"}}
+	body := []byte(`<!DOCTYPE html>
+<html>
+  <head>
+    <!-- build 42 -->
+    <style>
+      a  >  b , .x :hover { color : red ; }
+    </style>
+    <script class="tracker">track()</script>
+    <script type="application/ld+json">
+      { "url" : "https://b.example/" }
+    </script>
+  </head>
+  <body>
+    <div id="wpadminbar"><div>Edit</div><img src="x.png"></div>
+    <p>Hello   <b>big</b>   <i>world</i> </p>
+    <pre>  keep
+    this  </pre>
+    <script>
+      // greet
+      var s = "a  b" , r = /a b\/c/ ; return
+      x
+    </script>
+  </body>
+</html>`)
+	got, ok := rewriteBodyForBots(cfg, "/", body, "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected pipeline to change the page")
+	}
+	s := string(got)
+	for _, want := range []string{
+		`<!DOCTYPE html><html><head><style>a>b,.x :hover{color:red}</style>`,
+		`<script type="application/ld+json">{"url":"https://a.example/"}</script></head>`,
+		`<body><p>Hello <b>big</b> <i>world</i></p><pre>  keep
+    this  </pre>`,
+		`<script>var s="a  b",r=/a b\/c/;return
+x</script></body></html>`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatalf("expected %q in output:\n%s", want, s)
+		}
+	}
+	for _, gone := range []string{"build 42", "track()", "wpadminbar", "Edit", "x.png"} {
+		if strings.Contains(s, gone) {
+			t.Fatalf("expected %q removed:\n%s", gone, s)
+		}
+	}
+
+	css, _ := rewriteBodyForBots(cfg, "/s.css", []byte("/*! keep */\n.a { width : calc(100%  -  2px) ; }\n/* drop */"), "text/css", aBase, bBase)
+	if string(css) != "/*! keep */.a{width:calc(100% - 2px)}" {
+		t.Fatalf("unexpected CSS: %q", css)
+	}
+	js, _ := rewriteBodyForBots(cfg, "/a.js", []byte("a = b + +c;\nif (a) { x = a / 2 / y }\nconst t = `x  ${y}`"), "application/javascript", aBase, bBase)
+	if string(js) != "a=b+ +c;if(a){x=a/2/y}\nconst t=`x  ${y}`" {
+		t.Fatalf("unexpected JS: %q", js)
+	}
+}
+
+func TestRobotsPolicies(t *testing.T) {
+	aBase, _ := url.Parse("https://a.example")
+	bBase, _ := url.Parse("https://b.example")
+	pols, err := parseRobotsPolicies("/private/*=override:noindex, nofollow; /=strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{RobotsPolicies: pols}
+
+	body := []byte(`<head><meta name="robots" content="noindex, nofollow"><meta name="googlebot" content="noindex, max-snippet:50"></head><body></body>`)
+	got, ok := rewriteBodyForBots(cfg, "/post", body, "text/html", aBase, bBase)
+	if !ok {
+		t.Fatalf("expected strip")
+	}
+	if s := string(got); s != `<head><meta name="googlebot" content="max-snippet:50"></head><body></body>` {
+		t.Fatalf("unexpected strip output: %s", s)
+	}
+
+	got, _ = rewriteBodyForBots(cfg, "/private/x", []byte(`<head><title>t</title></head>`), "text/html", aBase, bBase)
+	if s := string(got); s != `<head><title>t</title><meta name="robots" content="noindex, nofollow"></head>` {
+		t.Fatalf("unexpected override output: %s", s)
+	}
+	h := map[string]string{}
+	applyRobotsHeader(cfg, "/private/x", h)
+	if h["X-Robots-Tag"] != "noindex, nofollow" {
+		t.Fatalf("expected X-Robots-Tag override, got %v", h)
+	}
+	h = map[string]string{}
+	applyRobotsHeader(cfg, "/post", h)
+	if _, set := h["X-Robots-Tag"]; set {
+		t.Fatalf("expected no X-Robots-Tag for strip policy")
+	}
+
+	for _, bad := range []string{"/=delete", "/=override", "nopattern"} {
+		if _, err := parseRobotsPolicies(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
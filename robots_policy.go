@@ -0,0 +1,173 @@
+package rerouter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	robotsActionStrip    = "strip"
+	robotsActionOverride = "override"
+)
+
+// RobotsPolicy controls robots directives in bot-served responses for matching paths.
+// "strip" removes noindex/nofollow/none from robots meta tags; "override" replaces
+// them (and sets X-Robots-Tag) with Value.
+type RobotsPolicy struct {
+	Pattern string `json:"pattern"`
+	Action  string `json:"action"`
+	Value   string `json:"value,omitempty"`
+}
+
+// robotsMetaNames are meta names carrying robots directives.
+var robotsMetaNames = map[string]bool{
+	"robots":         true,
+	"googlebot":      true,
+	"googlebot-news": true,
+	"bingbot":        true,
+	"yandex":         true,
+	"baiduspider":    true,
+}
+
+// parseRobotsPolicies parses "pattern=action[:value]" entries separated by
+// semicolons, e.g. "/=strip;/private/*=override:noindex, nofollow".
+func parseRobotsPolicies(v string) ([]RobotsPolicy, error) {
+	out := []RobotsPolicy{}
+	for _, p := range strings.Split(v, ";") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid robots policy %q", p)
+		}
+		pol := RobotsPolicy{Pattern: strings.TrimSpace(kv[0])}
+		action, value, _ := strings.Cut(kv[1], ":")
+		pol.Action = strings.ToLower(strings.TrimSpace(action))
+		pol.Value = strings.TrimSpace(value)
+		if err := validateRobotsPolicy(pol); err != nil {
+			return nil, err
+		}
+		out = append(out, pol)
+	}
+	return out, nil
+}
+
+func validateRobotsPolicy(p RobotsPolicy) error {
+	switch p.Action {
+	case robotsActionStrip:
+		return nil
+	case robotsActionOverride:
+		if p.Value == "" {
+			return fmt.Errorf("robots policy %q: override requires a value", p.Pattern)
+		}
+		return nil
+	}
+	return fmt.Errorf("robots policy %q: unknown action %q", p.Pattern, p.Action)
+}
+
+// robotsPolicyFor returns the first policy matching reqPath.
+func robotsPolicyFor(cfg *Config, reqPath string) (RobotsPolicy, bool) {
+	if cfg == nil {
+		return RobotsPolicy{}, false
+	}
+	for _, p := range cfg.RobotsPolicies {
+		if patternsMatch([]string{p.Pattern}, reqPath) {
+			return p, true
+		}
+	}
+	return RobotsPolicy{}, false
+}
+
+// applyRobotsHeader sets X-Robots-Tag in h for override policies. Upstream
+// X-Robots-Tag headers are never forwarded, so strip needs no header work.
+func applyRobotsHeader(cfg *Config, reqPath string, h map[string]string) {
+	if p, ok := robotsPolicyFor(cfg, reqPath); ok && p.Action == robotsActionOverride {
+		h["X-Robots-Tag"] = p.Value
+	}
+}
+
+// stripRestrictiveDirectives drops noindex, nofollow and none from a directive list.
+func stripRestrictiveDirectives(v string) string {
+	kept := []string{}
+	for _, d := range strings.Split(v, ",") {
+		d = strings.TrimSpace(d)
+		switch strings.ToLower(d) {
+		case "", "noindex", "nofollow", "none":
+			continue
+		}
+		kept = append(kept, d)
+	}
+	return strings.Join(kept, ", ")
+}
+
+// applyRobotsMeta rewrites robots meta tags in HTML according to p. Stripped tags
+// left without directives are removed; override adds a robots meta tag when missing.
+func applyRobotsMeta(body []byte, p RobotsPolicy) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body))
+	changed, hasRobots, injected := false, false, false
+	inject := func() {
+		if injected {
+			return
+		}
+		injected = true
+		if p.Action == robotsActionOverride && !hasRobots {
+			out.WriteString(`<meta name="robots" content="` + html.EscapeString(p.Value) + `">`)
+			changed = true
+		}
+	}
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		raw := z.Raw()
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			if tok.Data == "body" {
+				inject()
+			}
+			name := strings.ToLower(attrVal(tok, "name"))
+			if tok.Data != "meta" || !robotsMetaNames[name] {
+				out.Write(raw)
+				continue
+			}
+			hasRobots = hasRobots || name == "robots"
+			content := attrVal(tok, "content")
+			next := p.Value
+			if p.Action == robotsActionStrip {
+				next = stripRestrictiveDirectives(content)
+			}
+			if next == content {
+				out.Write(raw)
+				continue
+			}
+			changed = true
+			if next == "" {
+				// Nothing left to say; drop the tag
+				continue
+			}
+			setAttr(&tok, "content", next)
+			out.WriteString(tok.String())
+		case html.EndTagToken:
+			if name, _ := z.TagName(); string(name) == "head" {
+				inject()
+			}
+			out.Write(raw)
+		default:
+			out.Write(raw)
+		}
+	}
+	if !changed {
+		return body, false
+	}
+	return out.Bytes(), true
+}
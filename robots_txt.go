@@ -0,0 +1,173 @@
+package rerouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"rerouter/logger"
+)
+
+// robotsTxtOverrideFile holds the template uploaded via /admin/robots-txt, under CacheDir.
+const robotsTxtOverrideFile = "robots.override.txt"
+
+// defaultRobotsTxtTemplate is served when ROBOTS_TXT_SYNTHESIZE is set without a template.
+const defaultRobotsTxtTemplate = `User-agent: *
+Allow: /
+{{range .Sitemaps}}
+Sitemap: {{.}}{{end}}
+`
+
+const maxRobotsTxtTemplateBytes = 512 << 10
+
+// robotsTxtVars are the variables available to robots.txt templates.
+type robotsTxtVars struct {
+	AHost    string   // A host of the request, e.g. a.example.com
+	ABaseURL string   // A origin, e.g. https://a.example.com
+	Sitemaps []string // absolute sitemap URLs on the A site
+}
+
+func robotsTxtOverridePath(cacheDir string) string {
+	return filepath.Join(cacheDir, robotsTxtOverrideFile)
+}
+
+// robotsTxtTemplate returns the local robots.txt template and where it came from.
+// Precedence: admin upload, ROBOTS_TXT_FILE, inline robots_txt, synthesized default.
+// ok is false when B's robots.txt should be proxied.
+func robotsTxtTemplate(cfg *Config) (tmpl, source string, ok bool, err error) {
+	if b, err := os.ReadFile(robotsTxtOverridePath(cfg.CacheDir)); err == nil {
+		return string(b), "admin", true, nil
+	}
+	if cfg.RobotsTxtFile != "" {
+		b, err := os.ReadFile(cfg.RobotsTxtFile)
+		if err != nil {
+			return "", "file", false, err
+		}
+		return string(b), "file", true, nil
+	}
+	if cfg.RobotsTxt != "" {
+		return cfg.RobotsTxt, "config", true, nil
+	}
+	if cfg.RobotsTxtSynthesize {
+		return defaultRobotsTxtTemplate, "synthesized", true, nil
+	}
+	return "", "", false, nil
+}
+
+// renderRobotsTxt executes tmpl for the A site at aURL. Relative sitemap paths
+// are resolved against the A origin; absolute B URLs are rewritten to A.
+func renderRobotsTxt(cfg *Config, tmpl string, aURL *url.URL) ([]byte, error) {
+	t, err := template.New("robots.txt").Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	aBase := aURL.Scheme + "://" + aURL.Host
+	vars := robotsTxtVars{AHost: aURL.Host, ABaseURL: aBase}
+	sitemaps := cfg.RobotsTxtSitemaps
+	if len(sitemaps) == 0 {
+		sitemaps = []string{"/sitemap.xml"}
+	}
+	bURL, _ := url.Parse(cfg.BBaseURL)
+	rw := newURLRewriter(cfg, aURL, bURL)
+	for _, s := range sitemaps {
+		if !strings.Contains(s, "://") {
+			if !strings.HasPrefix(s, "/") {
+				s = "/" + s
+			}
+			s = aBase + s
+		} else if ns, ok := rw.url(s); ok {
+			s = ns
+		}
+		vars.Sitemaps = append(vars.Sitemaps, s)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, vars); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serveLocalRobotsTxt writes the locally configured robots.txt, if any. It
+// reports false when the request should fall through to proxying B.
+func serveLocalRobotsTxt(cfg *Config, w http.ResponseWriter, r *http.Request) bool {
+	tmpl, source, ok, err := robotsTxtTemplate(cfg)
+	if err != nil {
+		logger.Warnw("robots_template_error", map[string]interface{}{"err": err.Error(), "source": source, "req_id": getRequestID(r.Context())})
+		return false
+	}
+	if !ok {
+		return false
+	}
+	body, err := renderRobotsTxt(cfg, tmpl, deriveABaseURL(cfg, r))
+	if err != nil {
+		logger.Warnw("robots_template_error", map[string]interface{}{"err": err.Error(), "source": source, "req_id": getRequestID(r.Context())})
+		return false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Robots-Source", source)
+	writeBody(w, r, http.StatusOK, body)
+	return true
+}
+
+// handleAdminRobotsTxt serves /admin/robots-txt: GET shows the active template and
+// its rendering, PUT/POST stores a new template (request body), DELETE removes it.
+func handleAdminRobotsTxt(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	p := robotsTxtOverridePath(cfg.CacheDir)
+	switch r.Method {
+	case http.MethodGet:
+		tmpl, source, ok, err := robotsTxtTemplate(cfg)
+		resp := map[string]interface{}{"source": source, "local": ok}
+		if err != nil {
+			resp["error"] = err.Error()
+		}
+		if ok {
+			resp["template"] = tmpl
+			if body, err := renderRobotsTxt(cfg, tmpl, deriveABaseURL(cfg, r)); err == nil {
+				resp["rendered"] = string(body)
+			} else {
+				resp["error"] = err.Error()
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	case http.MethodPut, http.MethodPost:
+		b, err := io.ReadAll(io.LimitReader(r.Body, maxRobotsTxtTemplateBytes+1))
+		if err != nil || len(b) > maxRobotsTxtTemplateBytes {
+			http.Error(w, "template too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if _, err := template.New("robots.txt").Parse(string(b)); err != nil {
+			http.Error(w, "invalid template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+			http.Error(w, "save failed", http.StatusInternalServerError)
+			return
+		}
+		tmp := p + ".tmp"
+		if err := os.WriteFile(tmp, b, 0o644); err != nil || os.Rename(tmp, p) != nil {
+			http.Error(w, "save failed", http.StatusInternalServerError)
+			return
+		}
+		logger.Infow("admin_robots_txt_set", map[string]interface{}{"req_id": getRequestID(r.Context()), "bytes": len(b)})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"source": "admin", "bytes": len(b)})
+	case http.MethodDelete:
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, "delete failed", http.StatusInternalServerError)
+			return
+		}
+		logger.Infow("admin_robots_txt_cleared", map[string]interface{}{"req_id": getRequestID(r.Context())})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"deleted": err == nil})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -67,5 +67,5 @@ echo
 echo "Then verify: go version"
 echo "Finally, run this app:"
 echo "  cd $(pwd)"
-echo "  B_BASE_URL=https://your-b-site.example.com go run ."
+echo "  B_BASE_URL=https://your-b-site.example.com go run ./cmd/rerouter"
 
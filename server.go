@@ -0,0 +1,211 @@
+package rerouter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// listenerRole selects which routes a listener serves.
+type listenerRole int
+
+const (
+	// listenerAll serves public traffic and the admin routes.
+	listenerAll listenerRole = iota
+	// listenerPublic serves public traffic; admin paths are handled like any other path.
+	listenerPublic
+	// listenerAdmin serves only the admin routes.
+	listenerAdmin
+)
+
+func (r listenerRole) String() string {
+	switch r {
+	case listenerPublic:
+		return "public"
+	case listenerAdmin:
+		return "admin"
+	}
+	return "all"
+}
+
+// listenerSpec is one entry of LISTEN_ADDR: "host:port", "https://host:port"
+// (TLS with TLS_CERT_FILE/TLS_KEY_FILE) or "unix:/path/to.sock".
+type listenerSpec struct {
+	Network string // "tcp" or "unix"
+	Addr    string
+	TLS     bool
+	Role    listenerRole
+}
+
+func (s listenerSpec) String() string {
+	switch {
+	case s.Network == "unix":
+		return "unix:" + s.Addr
+	case s.TLS:
+		return "https://" + s.Addr
+	}
+	return s.Addr
+}
+
+// parseListenAddrs parses a comma-separated LISTEN_ADDR.
+func parseListenAddrs(v string) ([]listenerSpec, error) {
+	var out []listenerSpec
+	for _, a := range splitCommaList(v) {
+		spec := listenerSpec{Network: "tcp", Addr: a}
+		switch {
+		case strings.HasPrefix(a, "unix:"):
+			spec.Network, spec.Addr = "unix", strings.TrimPrefix(a, "unix:")
+			if spec.Addr == "" {
+				return nil, fmt.Errorf("unix listener %q: missing socket path", a)
+			}
+		case strings.HasPrefix(a, "https://"):
+			spec.Addr, spec.TLS = strings.TrimPrefix(a, "https://"), true
+		case strings.HasPrefix(a, "http://"):
+			spec.Addr = strings.TrimPrefix(a, "http://")
+		}
+		if spec.Network == "tcp" {
+			if _, _, err := net.SplitHostPort(spec.Addr); err != nil {
+				return nil, fmt.Errorf("listener %q: %w", a, err)
+			}
+		}
+		out = append(out, spec)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no listen address")
+	}
+	return out, nil
+}
+
+// configuredListeners returns the listeners of cfg with their roles. With
+// AdminListenAddr the admin routes are served only there and the LISTEN_ADDR
+// listeners are public; otherwise AdminUnixOnly keeps them on unix sockets.
+func configuredListeners(cfg *Config) ([]listenerSpec, error) {
+	specs, err := parseListenAddrs(cfg.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	var admin []listenerSpec
+	if cfg.AdminListenAddr != "" {
+		if admin, err = parseListenAddrs(cfg.AdminListenAddr); err != nil {
+			return nil, fmt.Errorf("ADMIN_LISTEN_ADDR: %w", err)
+		}
+	}
+	hasUnix := false
+	for i := range specs {
+		switch {
+		case len(admin) > 0:
+			specs[i].Role = listenerPublic
+		case specs[i].Network == "unix":
+			hasUnix = true
+		case cfg.AdminUnixOnly:
+			specs[i].Role = listenerPublic
+		}
+	}
+	if len(admin) == 0 && cfg.AdminUnixOnly && !hasUnix {
+		return nil, fmt.Errorf("ADMIN_UNIX_ONLY needs a unix: listener")
+	}
+	for _, a := range admin {
+		a.Role = listenerAdmin
+		specs = append(specs, a)
+	}
+	for _, s := range specs {
+		if s.TLS && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+			return nil, fmt.Errorf("https listener %s needs TLS_CERT_FILE and TLS_KEY_FILE", s.Addr)
+		}
+	}
+	return specs, nil
+}
+
+// newHTTPServer builds the public server with configured timeouts and HTTP/2.
+// HTTP/2 is negotiated automatically over TLS; h2c additionally serves
+// prior-knowledge HTTP/2 on cleartext connections when enabled.
+func newHTTPServer(cfg *Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.ListenAddr,
+		ReadTimeout:       time.Duration(cfg.ServerReadTimeoutSeconds) * time.Second,
+		ReadHeaderTimeout: time.Duration(cfg.ServerReadHeaderTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(cfg.ServerWriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(cfg.ServerIdleTimeoutSeconds) * time.Second,
+		MaxHeaderBytes:    cfg.ServerMaxHeaderBytes,
+	}
+	h2s := &http2.Server{IdleTimeout: srv.IdleTimeout}
+	if cfg.EnableH2C {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	srv.Handler = handler
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// listenerServer is one http.Server bound to one listener.
+type listenerServer struct {
+	spec listenerSpec
+	srv  *http.Server
+	ln   net.Listener
+	// raw is ln without TLS, the socket handed over in a binary upgrade.
+	raw net.Listener
+}
+
+// newListenerServers builds a server per listener of cfg; handlerFor supplies
+// the handler for each listener role.
+func newListenerServers(cfg *Config, handlerFor func(listenerRole) http.Handler) ([]*listenerServer, error) {
+	specs, err := configuredListeners(cfg)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*listenerServer, 0, len(specs))
+	for _, spec := range specs {
+		srv, err := newHTTPServer(cfg, handlerFor(spec.Role))
+		if err != nil {
+			return nil, err
+		}
+		srv.Addr = spec.Addr
+		if spec.TLS {
+			cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load TLS certificate: %w", err)
+			}
+			srv.TLSConfig.Certificates = []tls.Certificate{cert}
+		}
+		out = append(out, &listenerServer{spec: spec, srv: srv})
+	}
+	return out, nil
+}
+
+// listen binds the socket, or takes over inherited when a previous process
+// handed it over in a binary upgrade. A stale unix socket file left by a
+// previous run is removed first.
+func (s *listenerServer) listen(inherited net.Listener) error {
+	ln := inherited
+	if ln == nil {
+		if s.spec.Network == "unix" {
+			if fi, err := os.Stat(s.spec.Addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				_ = os.Remove(s.spec.Addr)
+			}
+		}
+		var err error
+		if ln, err = net.Listen(s.spec.Network, s.spec.Addr); err != nil {
+			return err
+		}
+	}
+	s.raw = ln
+	if s.spec.TLS {
+		ln = tls.NewListener(ln, s.srv.TLSConfig)
+	}
+	s.ln = ln
+	return nil
+}
+
+// serve runs the server on the bound listener until it is shut down.
+func (s *listenerServer) serve() error {
+	return s.srv.Serve(s.ln)
+}
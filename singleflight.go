@@ -0,0 +1,50 @@
+package rerouter
+
+import "sync"
+
+// flightCall is an in-flight or completed flightGroup.Do call.
+type flightCall struct {
+	wg   sync.WaitGroup
+	val  interface{}
+	err  error
+	dups int
+}
+
+// flightGroup coalesces concurrent calls that share a key so only one runs
+// at a time; the others wait and receive the same result (singleflight).
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[string]*flightCall
+}
+
+// Do executes fn for key unless a call for the same key is already running,
+// in which case it waits for that call and returns its result. shared reports
+// whether the result was handed to more than one caller.
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*flightCall)
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := new(flightCall)
+	c.wg.Add(1)
+	g.m[key] = c
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.m, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	g.mu.Lock()
+	shared = c.dups > 0
+	g.mu.Unlock()
+	return c.val, c.err, shared
+}
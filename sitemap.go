@@ -1,4 +1,4 @@
-package main
+package rerouter
 
 import (
 	"bytes"
@@ -10,6 +10,8 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,7 +21,18 @@ const defaultSitemapURLLimit = 5000
 var errSitemapURLLimitReached = errors.New("sitemap url limit reached")
 
 type sitemapURLEntry struct {
-	Loc string `xml:"loc"`
+	Loc        string `xml:"loc"`
+	LastMod    string `xml:"lastmod"`
+	ChangeFreq string `xml:"changefreq"`
+	Priority   string `xml:"priority"`
+}
+
+// sitemapURL is a page listed in a sitemap with its optional hints.
+type sitemapURL struct {
+	Loc        string
+	LastMod    time.Time // zero when absent or unparseable
+	ChangeFreq string
+	Priority   float64 // 0.5 when absent, as the protocol specifies
 }
 
 type sitemapURLSet struct {
@@ -31,12 +44,42 @@ type sitemapIndexSet struct {
 }
 
 func collectSitemapURLs(ctx context.Context, client *http.Client, sitemap string, max int) ([]string, error) {
+	entries, err := collectSitemapEntries(ctx, client, sitemap, max)
+	urls := make([]string, 0, len(entries))
+	for _, e := range entries {
+		urls = append(urls, e.Loc)
+	}
+	return urls, err
+}
+
+// collectSitemapEntries walks sitemap (and nested sitemap indexes) and returns
+// up to max pages in document order with their lastmod, changefreq and priority.
+// RSS, Atom and JSON feeds are accepted as well, contributing their item links,
+// and an HTML page is searched for feeds it advertises with <link rel="alternate">.
+func collectSitemapEntries(ctx context.Context, client *http.Client, sitemap string, max int) ([]sitemapURL, error) {
 	if max <= 0 {
 		max = defaultSitemapURLLimit
 	}
 	visited := make(map[string]struct{})
 	seenURLs := make(map[string]struct{})
-	urls := make([]string, 0, 128)
+	urls := make([]sitemapURL, 0, 128)
+
+	add := func(current, loc string, entry sitemapURL) error {
+		resolved, err := resolveSitemapLocation(current, loc)
+		if err != nil {
+			return err
+		}
+		if _, dup := seenURLs[resolved]; dup {
+			return nil
+		}
+		seenURLs[resolved] = struct{}{}
+		entry.Loc = resolved
+		urls = append(urls, entry)
+		if len(urls) >= max {
+			return errSitemapURLLimitReached
+		}
+		return nil
+	}
 
 	var walk func(string) error
 	walk = func(current string) error {
@@ -68,18 +111,13 @@ func collectSitemapURLs(ctx context.Context, client *http.Client, sitemap string
 				if loc == "" {
 					continue
 				}
-				resolved, err := resolveSitemapLocation(current, loc)
-				if err != nil {
+				if err := add(current, loc, sitemapURL{
+					LastMod:    parseSitemapLastMod(entry.LastMod),
+					ChangeFreq: strings.ToLower(strings.TrimSpace(entry.ChangeFreq)),
+					Priority:   parseSitemapPriority(entry.Priority),
+				}); err != nil {
 					return err
 				}
-				if _, dup := seenURLs[resolved]; dup {
-					continue
-				}
-				seenURLs[resolved] = struct{}{}
-				urls = append(urls, resolved)
-				if len(urls) >= max {
-					return errSitemapURLLimitReached
-				}
 			}
 			return nil
 		}
@@ -111,7 +149,32 @@ func collectSitemapURLs(ctx context.Context, client *http.Client, sitemap string
 			return nil
 		}
 
-		return fmt.Errorf("unrecognized sitemap format: %s", current)
+		if items, ok := parseFeedItems(trimmed); ok {
+			for _, item := range items {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if err := add(current, item.Loc, item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		if feeds := discoverFeedLinks(trimmed); len(feeds) > 0 {
+			for _, loc := range feeds {
+				resolved, err := resolveSitemapLocation(current, loc)
+				if err != nil {
+					return err
+				}
+				if err := walk(resolved); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		return fmt.Errorf("unrecognized sitemap or feed format: %s", current)
 	}
 
 	err := walk(sitemap)
@@ -121,6 +184,66 @@ func collectSitemapURLs(ctx context.Context, client *http.Client, sitemap string
 	return urls, err
 }
 
+// sitemapLastModLayouts are the W3C datetime forms allowed in <lastmod>.
+var sitemapLastModLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+	"2006-01",
+	"2006",
+}
+
+func parseSitemapLastMod(v string) time.Time {
+	v = strings.TrimSpace(v)
+	for _, layout := range sitemapLastModLayouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func parseSitemapPriority(v string) float64 {
+	p, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0.5
+	}
+	return p
+}
+
+// sitemapChangeFreqRank orders changefreq values from most to least volatile.
+var sitemapChangeFreqRank = map[string]int{
+	"always":  0,
+	"hourly":  1,
+	"daily":   2,
+	"weekly":  3,
+	"monthly": 4,
+	"yearly":  5,
+	"never":   6,
+}
+
+func changeFreqRank(v string) int {
+	if r, ok := sitemapChangeFreqRank[v]; ok {
+		return r
+	}
+	return 3 // absent or unknown ranks like weekly
+}
+
+// orderSitemapEntries sorts entries for warming: highest priority first, then
+// most recently modified, then most frequently changing. Ties keep document order.
+func orderSitemapEntries(entries []sitemapURL) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		if !a.LastMod.Equal(b.LastMod) {
+			return a.LastMod.After(b.LastMod)
+		}
+		return changeFreqRank(a.ChangeFreq) < changeFreqRank(b.ChangeFreq)
+	})
+}
+
 func fetchSitemapBody(ctx context.Context, client *http.Client, sitemapURL string) ([]byte, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
 	if err != nil {
@@ -181,21 +304,28 @@ func resolveSitemapLocation(baseURL, ref string) (string, error) {
 }
 
 func newSitemapHTTPClient(timeout time.Duration, userAgent string) *http.Client {
-	if timeout <= 0 {
-		timeout = 15 * time.Second
-	}
 	ua := strings.TrimSpace(userAgent)
 	if ua == "" {
 		ua = defaultUpstreamUserAgent
 	}
+	return newSitemapHTTPClientWithTransport(timeout, func() string { return ua }, nil)
+}
+
+// newSitemapHTTPClientWithTransport is newSitemapHTTPClient over a custom base
+// transport (e.g. the shared upstream limiter), with the User-Agent looked up
+// per request. nil uses http.DefaultTransport.
+func newSitemapHTTPClientWithTransport(timeout time.Duration, userAgent func() string, base http.RoundTripper) *http.Client {
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
 	return &http.Client{
 		Timeout:   timeout,
-		Transport: &userAgentTransport{userAgent: ua, base: http.DefaultTransport},
+		Transport: &userAgentTransport{userAgent: userAgent, base: base},
 	}
 }
 
 type userAgentTransport struct {
-	userAgent string
+	userAgent func() string
 	base      http.RoundTripper
 }
 
@@ -211,6 +341,6 @@ func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error
 	if clone.Header == nil {
 		clone.Header = make(http.Header)
 	}
-	clone.Header.Set("User-Agent", t.userAgent)
+	clone.Header.Set("User-Agent", t.userAgent())
 	return base.RoundTrip(clone)
 }
@@ -1,4 +1,4 @@
-package main
+package rerouter
 
 import (
 	"bytes"
@@ -6,6 +6,7 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -92,3 +93,63 @@ func TestCollectSitemapURLsRespectsLimit(t *testing.T) {
 		t.Fatalf("expected 2 URLs due to limit, got %d", len(urls))
 	}
 }
+
+func TestCollectSitemapURLsReadsFeedsAndDiscoversThem(t *testing.T) {
+	mux := http.NewServeMux()
+	var base string
+	mux.HandleFunc("/blog/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = w.Write([]byte(`<!doctype html><html><head>
+<link rel="alternate" type="application/rss+xml" href="/feed/">
+<link rel="alternate" type="application/atom+xml" href="` + base + `/atom.xml">
+<link rel="stylesheet" href="/style.css">
+</head><body><a href="/ignored">x</a></body></html>`))
+	})
+	mux.HandleFunc("/feed/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/rss+xml")
+		_, _ = w.Write([]byte(`<?xml version="1.0"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom"><channel>
+  <link>` + base + `/</link>
+  <atom:link href="` + base + `/feed/" rel="self"/>
+  <item><title>One</title><link>` + base + `/post-1</link><pubDate>Mon, 5 Jan 2026 10:00:00 +0000</pubDate></item>
+  <item><title>Two</title><guid>` + base + `/post-2</guid></item>
+  <item><title>No link</title><guid isPermaLink="false">tag:1</guid></item>
+</channel></rss>`))
+	})
+	mux.HandleFunc("/atom.xml", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <link rel="self" href="/atom.xml"/>
+  <entry><link rel="replies" href="/post-3#comments"/><link href="/post-3"/><updated>2026-01-06T00:00:00Z</updated></entry>
+  <entry><link rel="alternate" href="` + base + `/post-1"/></entry>
+</feed>`))
+	})
+	mux.HandleFunc("/feed.json", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"version":"https://jsonfeed.org/version/1.1","items":[{"id":"1","url":"/post-4"}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	base = srv.URL
+
+	client := newSitemapHTTPClient(0, defaultUpstreamUserAgent)
+	entries, err := collectSitemapEntries(context.Background(), client, srv.URL+"/blog/", 10)
+	if err != nil {
+		t.Fatalf("collectSitemapEntries error: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Loc)
+	}
+	want := []string{base + "/post-1", base + "/post-2", base + "/post-3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if entries[0].LastMod.IsZero() || entries[2].LastMod.IsZero() {
+		t.Fatalf("expected pubDate/updated as lastmod, got %+v", entries)
+	}
+
+	urls, err := collectSitemapURLs(context.Background(), client, srv.URL+"/feed.json", 10)
+	if err != nil || len(urls) != 1 || urls[0] != base+"/post-4" {
+		t.Fatalf("expected JSON feed item, got %v %v", urls, err)
+	}
+}
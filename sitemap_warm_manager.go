@@ -1,10 +1,11 @@
-package main
+package rerouter
 
 import (
 	"context"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,11 +21,16 @@ const (
 	jobStateRunning   sitemapWarmJobState = "running"
 	jobStateCompleted sitemapWarmJobState = "completed"
 	jobStateErrored   sitemapWarmJobState = "error"
+	// Stopped by shutdown before finishing; progress is persisted for resuming.
+	jobStateInterrupted sitemapWarmJobState = "interrupted"
 )
 
 const sitemapWarmJobTimeout = 72 * time.Hour
 const sitemapWarmMaxAttempts = 3
 
+// sitemapWarmPersistEvery controls how many URLs are processed between progress snapshots on disk.
+const sitemapWarmPersistEvery = 50
+
 type sitemapWarmURLStatus struct {
 	RawURL       string `json:"raw_url"`
 	URL          string `json:"url,omitempty"`
@@ -42,40 +48,116 @@ type sitemapWarmJob struct {
 	SitemapURL    string
 	MaxURLs       int
 	ABaseOverride string
-	State         sitemapWarmJobState
-	SubmittedAt   time.Time
-	StartedAt     time.Time
-	CompletedAt   time.Time
-	Total         int
-	Processed     int
-	Cached        int
-	Skipped       int
-	Interrupted   bool
-	Error         string
-	Duration      time.Duration
-	URLStatuses   []sitemapWarmURLStatus
+	// Mode is warmModeCrawl for crawl jobs; SitemapURL then holds the start page.
+	// List jobs (warmModeList) have no SitemapURL and warm URLs in order.
+	Mode     string
+	MaxDepth int
+	URLs     []string
+	// Tenant owning the B host the job warms, set when it is submitted.
+	Tenant      string
+	State       sitemapWarmJobState
+	SubmittedAt time.Time
+	StartedAt   time.Time
+	CompletedAt time.Time
+	Total       int
+	Processed   int
+	Cached      int
+	Skipped     int
+	Interrupted bool
+	Error       string
+	Duration    time.Duration
+	URLStatuses []sitemapWarmURLStatus
+	// Oldest URL statuses discarded to stay within maxStatuses.
+	URLStatusesDropped int
+	// Cap on len(URLStatuses); 0 means unlimited.
+	maxStatuses int
+	// Live progress subscribers (see subscribe).
+	subs map[chan sitemapWarmEvent]struct{}
+}
+
+// sitemapWarmEvent is a progress update pushed to stream subscribers: "url"
+// for each URL handled (data sitemapWarmURLEvent) and "state" for state
+// changes (data sitemapWarmJobStatus without URL statuses).
+type sitemapWarmEvent struct {
+	Name string
+	Data interface{}
+}
+
+type sitemapWarmURLEvent struct {
+	sitemapWarmURLStatus
+	TotalURLs   int `json:"total_urls"`
+	Processed   int `json:"processed_urls"`
+	CachedURLs  int `json:"cached_urls"`
+	SkippedURLs int `json:"skipped_urls"`
+}
+
+// sitemapWarmEventBuffer is how many events a slow subscriber may lag behind
+// before further events are dropped for it.
+const sitemapWarmEventBuffer = 256
+
+// subscribe registers for progress events until cancel is called.
+func (job *sitemapWarmJob) subscribe() (<-chan sitemapWarmEvent, func()) {
+	ch := make(chan sitemapWarmEvent, sitemapWarmEventBuffer)
+	job.mu.Lock()
+	if job.subs == nil {
+		job.subs = make(map[chan sitemapWarmEvent]struct{})
+	}
+	job.subs[ch] = struct{}{}
+	job.mu.Unlock()
+	return ch, func() {
+		job.mu.Lock()
+		delete(job.subs, ch)
+		job.mu.Unlock()
+	}
+}
+
+// publishLocked sends ev to every subscriber without blocking; job.mu must be held.
+func (job *sitemapWarmJob) publishLocked(ev sitemapWarmEvent) {
+	for ch := range job.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (job *sitemapWarmJob) publishStateLocked() {
+	if len(job.subs) == 0 {
+		return
+	}
+	st := job.snapshotLocked()
+	st.URLStatuses = nil
+	job.publishLocked(sitemapWarmEvent{Name: "state", Data: st})
 }
 
 func (job *sitemapWarmJob) snapshot() sitemapWarmJobStatus {
 	job.mu.Lock()
 	defer job.mu.Unlock()
+	return job.snapshotLocked()
+}
+
+func (job *sitemapWarmJob) snapshotLocked() sitemapWarmJobStatus {
 	return sitemapWarmJobStatus{
-		JobID:         job.ID,
-		SitemapURL:    job.SitemapURL,
-		State:         string(job.State),
-		TotalURLs:     job.Total,
-		Processed:     job.Processed,
-		CachedURLs:    job.Cached,
-		SkippedURLs:   job.Skipped,
-		Interrupted:   job.Interrupted,
-		Error:         job.Error,
-		SubmittedAt:   job.SubmittedAt,
-		StartedAt:     job.StartedAt,
-		CompletedAt:   job.CompletedAt,
-		DurationMS:    job.Duration.Milliseconds(),
-		MaxURLs:       job.MaxURLs,
-		ABaseOverride: job.ABaseOverride,
-		URLStatuses:   append([]sitemapWarmURLStatus(nil), job.URLStatuses...),
+		JobID:              job.ID,
+		SitemapURL:         job.SitemapURL,
+		State:              string(job.State),
+		TotalURLs:          job.Total,
+		Processed:          job.Processed,
+		CachedURLs:         job.Cached,
+		SkippedURLs:        job.Skipped,
+		Interrupted:        job.Interrupted,
+		Error:              job.Error,
+		SubmittedAt:        job.SubmittedAt,
+		StartedAt:          job.StartedAt,
+		CompletedAt:        job.CompletedAt,
+		DurationMS:         job.Duration.Milliseconds(),
+		MaxURLs:            job.MaxURLs,
+		ABaseOverride:      job.ABaseOverride,
+		Mode:               job.mode(),
+		MaxDepth:           job.MaxDepth,
+		Tenant:             job.Tenant,
+		URLStatuses:        append([]sitemapWarmURLStatus(nil), job.URLStatuses...),
+		URLStatusesDropped: job.URLStatusesDropped,
 	}
 }
 
@@ -85,12 +167,13 @@ func (job *sitemapWarmJob) setState(state sitemapWarmJobState) {
 	job.State = state
 	if state == jobStateRunning {
 		job.StartedAt = time.Now()
-	} else if state == jobStateCompleted || state == jobStateErrored {
+	} else if state == jobStateCompleted || state == jobStateErrored || state == jobStateInterrupted {
 		job.CompletedAt = time.Now()
 		if !job.StartedAt.IsZero() {
 			job.Duration = job.CompletedAt.Sub(job.StartedAt)
 		}
 	}
+	job.publishStateLocked()
 }
 
 func (job *sitemapWarmJob) markError(err error) {
@@ -101,6 +184,7 @@ func (job *sitemapWarmJob) markError(err error) {
 	if !job.StartedAt.IsZero() {
 		job.Duration = job.CompletedAt.Sub(job.StartedAt)
 	}
+	job.publishStateLocked()
 	job.mu.Unlock()
 }
 
@@ -131,9 +215,48 @@ func (job *sitemapWarmJob) incrementSkipped() {
 func (job *sitemapWarmJob) addURLStatus(status sitemapWarmURLStatus) {
 	job.mu.Lock()
 	job.URLStatuses = append(job.URLStatuses, status)
+	job.trimStatusesLocked()
+	job.publishLocked(sitemapWarmEvent{Name: "url", Data: sitemapWarmURLEvent{
+		sitemapWarmURLStatus: status,
+		TotalURLs:            job.Total,
+		Processed:            job.Processed,
+		CachedURLs:           job.Cached,
+		SkippedURLs:          job.Skipped,
+	}})
 	job.mu.Unlock()
 }
 
+// trimStatusesLocked drops the oldest URL statuses beyond maxStatuses so huge
+// sitemaps don't hold one entry per URL in memory; job.mu must be held.
+func (job *sitemapWarmJob) trimStatusesLocked() {
+	if job.maxStatuses <= 0 || len(job.URLStatuses) <= job.maxStatuses {
+		return
+	}
+	n := len(job.URLStatuses) - job.maxStatuses
+	job.URLStatusesDropped += n
+	job.URLStatuses = append([]sitemapWarmURLStatus(nil), job.URLStatuses[n:]...)
+}
+
+// finished reports whether state is terminal for a job run.
+func (st sitemapWarmJobStatus) finished() bool {
+	switch sitemapWarmJobState(st.State) {
+	case jobStateCompleted, jobStateErrored, jobStateInterrupted:
+		return true
+	}
+	return false
+}
+
+// processedRawURLs returns the raw sitemap locations already handled by the job.
+func (job *sitemapWarmJob) processedRawURLs() map[string]struct{} {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	out := make(map[string]struct{}, len(job.URLStatuses))
+	for _, st := range job.URLStatuses {
+		out[st.RawURL] = struct{}{}
+	}
+	return out
+}
+
 func (job *sitemapWarmJob) setInterrupted() {
 	job.mu.Lock()
 	job.Interrupted = true
@@ -156,80 +279,353 @@ type sitemapWarmJobStatus struct {
 	DurationMS    int64                  `json:"duration_ms"`
 	MaxURLs       int                    `json:"max_urls"`
 	ABaseOverride string                 `json:"a_base_url_override,omitempty"`
+	Mode          string                 `json:"mode"`
+	MaxDepth      int                    `json:"max_depth,omitempty"`
+	Tenant        string                 `json:"tenant,omitempty"`
 	URLStatuses   []sitemapWarmURLStatus `json:"url_statuses,omitempty"`
+	// URLs of an unfinished list job; only kept in its snapshot on disk.
+	URLs []string `json:"urls,omitempty"`
+	// URL statuses no longer listed: trimmed to SITEMAP_WARM_MAX_URL_STATUSES,
+	// or not kept at all in the summary of a finished job loaded from disk.
+	URLStatusesDropped int `json:"url_statuses_dropped,omitempty"`
 }
 
 type sitemapWarmManager struct {
-	cfg    *Config
+	cfg    atomic.Pointer[Config]
 	pf     *Prefetcher
 	client *http.Client
 	mu     sync.Mutex
 	jobs   map[string]*sitemapWarmJob
 	seq    uint64
+	// ctx is cancelled by Shutdown to interrupt running jobs.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	pacer  hostPacer
 }
 
 func newSitemapWarmManager(cfg *Config, pf *Prefetcher, client *http.Client) *sitemapWarmManager {
-	return &sitemapWarmManager{
-		cfg:    cfg,
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &sitemapWarmManager{
 		pf:     pf,
 		client: client,
 		jobs:   make(map[string]*sitemapWarmJob),
+		ctx:    ctx,
+		cancel: cancel,
+		pacer:  hostPacer{next: map[string]time.Time{}},
+	}
+	m.cfg.Store(cfg)
+	return m
+}
+
+// setConfig makes jobs started from now on use cfg.
+func (m *sitemapWarmManager) setConfig(cfg *Config) {
+	m.cfg.Store(cfg)
+}
+
+// Shutdown interrupts running jobs, waits for them to stop (or ctx to expire)
+// and persists every unfinished job under <CacheDir>/jobs.
+func (m *sitemapWarmManager) Shutdown(ctx context.Context) error {
+	m.cancel()
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	for _, job := range m.ListJobs() {
+		st := job.snapshot()
+		if st.State == string(jobStateCompleted) || st.State == string(jobStateErrored) {
+			continue
+		}
+		m.persist(job)
+	}
+	return err
+}
+
+// scopeURL returns the URL whose host selects the upstream job warms: the
+// sitemap or crawl start page, or the first URL of a list.
+func (job *sitemapWarmJob) scopeURL() string {
+	if job.Mode == warmModeList && len(job.URLs) > 0 {
+		return job.URLs[0]
+	}
+	return job.SitemapURL
+}
+
+// warmJobBHost returns the B host a warm job scoped by rawURL fetches from:
+// that of the upstream whose B site hosts rawURL, else B_BASE_URL's.
+func warmJobBHost(cfg *Config, rawURL string) string {
+	if u, err := url.Parse(rawURL); err == nil && u.Host != "" {
+		cfg, _ = upstreamForBHost(cfg, u.Host)
+	}
+	if u, err := url.Parse(cfg.BBaseURL); err == nil {
+		return u.Host
 	}
+	return ""
 }
 
 func (m *sitemapWarmManager) StartJob(sitemapURL string, max int, aBaseOverride string) (*sitemapWarmJob, error) {
 	if sitemapURL == "" {
 		return nil, fmt.Errorf("sitemap_url required")
 	}
-	id := fmt.Sprintf("job-%d", atomic.AddUint64(&m.seq, 1))
-	job := &sitemapWarmJob{
-		ID:            id,
+	return m.start(&sitemapWarmJob{
 		SitemapURL:    sitemapURL,
 		MaxURLs:       max,
 		ABaseOverride: strings.TrimSpace(aBaseOverride),
-		State:         jobStateQueued,
-		SubmittedAt:   time.Now(),
+	}), nil
+}
+
+// StartListJob warms urls (absolute B URLs or paths on B) in the given order,
+// at most maxURLs of them when positive.
+func (m *sitemapWarmManager) StartListJob(urls []string, maxURLs int, aBaseOverride string) (*sitemapWarmJob, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("urls required")
+	}
+	if maxURLs > 0 && len(urls) > maxURLs {
+		urls = urls[:maxURLs]
+	}
+	return m.start(&sitemapWarmJob{
+		MaxURLs:       maxURLs,
+		ABaseOverride: strings.TrimSpace(aBaseOverride),
+		Mode:          warmModeList,
+		URLs:          urls,
+	}), nil
+}
+
+// StartCrawlJob warms pages found by following same-host links from startURL
+// (the B homepage when empty) up to maxDepth links away, caching at most
+// maxURLs pages. Zero limits use CRAWL_WARM_MAX_DEPTH and CRAWL_WARM_MAX_URLS.
+func (m *sitemapWarmManager) StartCrawlJob(startURL string, maxURLs, maxDepth int, aBaseOverride string) (*sitemapWarmJob, error) {
+	cfg := m.cfg.Load()
+	if startURL == "" {
+		startURL = strings.TrimRight(cfg.BBaseURL, "/") + "/"
 	}
+	u, err := url.Parse(startURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("start_url must be an absolute http(s) URL")
+	}
+	if maxURLs <= 0 {
+		maxURLs = cfg.CrawlWarmMaxURLs
+	}
+	if maxDepth <= 0 {
+		maxDepth = cfg.CrawlWarmMaxDepth
+	}
+	return m.start(&sitemapWarmJob{
+		SitemapURL:    startURL,
+		MaxURLs:       maxURLs,
+		ABaseOverride: strings.TrimSpace(aBaseOverride),
+		Mode:          warmModeCrawl,
+		MaxDepth:      maxDepth,
+	}), nil
+}
+
+// start registers a new job, persists it and runs it in the background.
+func (m *sitemapWarmManager) start(job *sitemapWarmJob) *sitemapWarmJob {
+	job.ID = fmt.Sprintf("job-%d", atomic.AddUint64(&m.seq, 1))
+	job.State = jobStateQueued
+	job.SubmittedAt = time.Now()
+	cfg := m.cfg.Load()
+	job.maxStatuses = cfg.SitemapWarmMaxURLStatuses
+	job.Tenant = tenantForHost(cfg, warmJobBHost(cfg, job.scopeURL()))
 	m.mu.Lock()
-	m.jobs[id] = job
+	m.jobs[job.ID] = job
 	m.mu.Unlock()
 
-	logger.Infow("sitemap_cache_job_enqueued", map[string]interface{}{"job_id": id, "sitemap": sitemapURL, "max_urls": max, "override": job.ABaseOverride})
-	go m.run(job)
-	return job, nil
+	logger.Infow("sitemap_cache_job_enqueued", map[string]interface{}{"job_id": job.ID, "sitemap": job.SitemapURL, "max_urls": job.MaxURLs, "override": job.ABaseOverride, "mode": job.mode()})
+	m.persist(job)
+	m.launch(job)
+	return job
+}
+
+func (m *sitemapWarmManager) launch(job *sitemapWarmJob) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.run(job)
+	}()
+}
+
+// persist snapshots job progress to disk; failures are logged and otherwise ignored.
+// Finished jobs are saved as summaries: their URL statuses are only needed to
+// resume an unfinished run.
+func (m *sitemapWarmManager) persist(job *sitemapWarmJob) {
+	st := job.snapshot()
+	if st.State == string(jobStateCompleted) || st.State == string(jobStateErrored) {
+		st.URLStatusesDropped += len(st.URLStatuses)
+		st.URLStatuses = nil
+	} else {
+		st.URLs = job.URLs
+	}
+	if err := persistSitemapWarmJob(m.cfg.Load().CacheDir, st); err != nil {
+		logger.Warnw("sitemap_cache_job_persist_error", map[string]interface{}{"job_id": st.JobID, "err": err.Error()})
+	}
+}
+
+// ResumePersistedJobs loads job snapshots from <CacheDir>/jobs. Finished jobs are
+// kept for status queries; unfinished ones are restarted, skipping URLs already processed.
+func (m *sitemapWarmManager) ResumePersistedJobs() int {
+	statuses, err := loadPersistedSitemapWarmJobs(m.cfg.Load().CacheDir)
+	if err != nil {
+		logger.Warnw("sitemap_cache_job_load_error", map[string]interface{}{"err": err.Error()})
+	}
+	resumed := 0
+	for _, st := range statuses {
+		job := sitemapWarmJobFromStatus(st)
+		job.maxStatuses = m.cfg.Load().SitemapWarmMaxURLStatuses
+		job.trimStatusesLocked()
+		var n uint64
+		if _, err := fmt.Sscanf(job.ID, "job-%d", &n); err == nil {
+			for {
+				cur := atomic.LoadUint64(&m.seq)
+				if n <= cur || atomic.CompareAndSwapUint64(&m.seq, cur, n) {
+					break
+				}
+			}
+		}
+		m.mu.Lock()
+		m.jobs[job.ID] = job
+		m.mu.Unlock()
+		if job.State == jobStateCompleted || job.State == jobStateErrored {
+			continue
+		}
+		job.State = jobStateQueued
+		job.Interrupted = false
+		logger.Infow("sitemap_cache_job_resumed", map[string]interface{}{"job_id": job.ID, "sitemap": job.SitemapURL, "processed": job.Processed})
+		m.launch(job)
+		resumed++
+	}
+	m.pruneHistory()
+	return resumed
+}
+
+// pruneHistory forgets finished jobs beyond SitemapWarmJobHistory (oldest
+// first) or older than SitemapWarmJobMaxAgeDays, in memory and on disk.
+func (m *sitemapWarmManager) pruneHistory() {
+	cfg := m.cfg.Load()
+	var finished []sitemapWarmJobStatus
+	for _, job := range m.ListJobs() {
+		st := job.snapshot()
+		if st.State == string(jobStateCompleted) || st.State == string(jobStateErrored) {
+			finished = append(finished, st)
+		}
+	}
+	// Newest first
+	sort.SliceStable(finished, func(i, j int) bool { return finished[i].CompletedAt.After(finished[j].CompletedAt) })
+	cutoff := time.Time{}
+	if cfg.SitemapWarmJobMaxAgeDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -cfg.SitemapWarmJobMaxAgeDays)
+	}
+	for i, st := range finished {
+		keep := cfg.SitemapWarmJobHistory <= 0 || i < cfg.SitemapWarmJobHistory
+		if keep && (cutoff.IsZero() || st.CompletedAt.After(cutoff)) {
+			continue
+		}
+		m.mu.Lock()
+		delete(m.jobs, st.JobID)
+		m.mu.Unlock()
+		if err := removePersistedSitemapWarmJob(cfg.CacheDir, st.JobID); err != nil {
+			logger.Warnw("sitemap_cache_job_prune_error", map[string]interface{}{"job_id": st.JobID, "err": err.Error()})
+			continue
+		}
+		logger.Debugw("sitemap_cache_job_pruned", map[string]interface{}{"job_id": st.JobID, "completed_at": st.CompletedAt.Format(time.RFC3339)})
+	}
 }
 
 func (m *sitemapWarmManager) run(job *sitemapWarmJob) {
-	bURL, err := url.Parse(m.cfg.BBaseURL)
+	defer m.pruneHistory()
+	defer m.persist(job)
+	// A resumed job whose older statuses were trimmed recognizes those URLs by
+	// cache entries written since it first started.
+	var resumeSince time.Time
+	if prev := job.snapshot(); prev.URLStatusesDropped > 0 {
+		resumeSince = prev.StartedAt
+	}
+	// Scope the job to the upstream hosting the sitemap (or the first listed
+	// URL); falls back to BBaseURL.
+	base := m.cfg.Load()
+	cfg := base
+	if su, err := url.Parse(job.scopeURL()); err == nil {
+		cfg, _ = upstreamForBHost(base, su.Host)
+	}
+	bURL, err := url.Parse(cfg.BBaseURL)
 	if err != nil {
 		job.markError(fmt.Errorf("invalid b_base_url: %w", err))
 		logger.Errorw("sitemap_cache_job_error", map[string]interface{}{"job_id": job.ID, "err": err.Error()})
 		return
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), sitemapWarmJobTimeout)
+	ctx, cancel := context.WithTimeout(m.ctx, sitemapWarmJobTimeout)
 	defer cancel()
+	ctx, sp := startSpan(ctx, "sitemap_warm_job", spanKindInternal)
+	defer func() {
+		st := job.snapshot()
+		sp.setAttr("rerouter.job_id", job.ID)
+		sp.setAttr("rerouter.sitemap", job.SitemapURL)
+		sp.setAttr("rerouter.warm_mode", job.mode())
+		sp.setAttr("rerouter.state", st.State)
+		sp.setAttr("rerouter.processed", st.Processed)
+		sp.finish()
+	}()
 	job.setState(jobStateRunning)
-	logger.Infow("sitemap_cache_job_started", map[string]interface{}{"job_id": job.ID, "sitemap": job.SitemapURL})
-
-	urls, err := collectSitemapURLs(ctx, m.client, job.SitemapURL, job.MaxURLs)
-	if err != nil {
-		job.markError(err)
-		logger.Errorw("sitemap_cache_job_error", map[string]interface{}{"job_id": job.ID, "err": err.Error()})
-		return
-	}
-	job.updateTotal(len(urls))
-	aBase := strings.TrimSpace(m.cfg.ABaseURL)
+	logger.Infow("sitemap_cache_job_started", map[string]interface{}{"job_id": job.ID, "sitemap": job.SitemapURL, "mode": job.mode()})
+	aBase := strings.TrimSpace(cfg.ABaseURL)
 	if job.ABaseOverride != "" {
 		aBase = job.ABaseOverride
 	}
+	robots := warmRobotsRules(ctx, cfg, m.client, bURL)
+	if job.Mode == warmModeCrawl {
+		m.crawl(ctx, job, cfg, bURL, aBase, robots)
+		m.finish(ctx, job)
+		return
+	}
+
+	var entries []sitemapURL
+	if job.Mode == warmModeList {
+		// Submitted lists are warmed in their own order
+		for _, u := range job.URLs {
+			entries = append(entries, sitemapURL{Loc: u})
+		}
+	} else {
+		entries, err = collectSitemapEntries(ctx, m.client, job.SitemapURL, job.MaxURLs)
+		if err != nil && m.ctx.Err() != nil {
+			job.setInterrupted()
+			job.setState(jobStateInterrupted)
+			logger.Warnw("sitemap_cache_job_interrupted", map[string]interface{}{"job_id": job.ID, "sitemap": job.SitemapURL, "reason": "shutdown"})
+			return
+		}
+		if err != nil {
+			job.markError(err)
+			logger.Errorw("sitemap_cache_job_error", map[string]interface{}{"job_id": job.ID, "err": err.Error()})
+			return
+		}
+		// Warm what crawlers most likely want first
+		orderSitemapEntries(entries)
+	}
+	job.updateTotal(len(entries))
 	seen := make(map[string]struct{})
-	delay := time.Duration(m.cfg.SitemapWarmDelaySeconds) * time.Second
+	done := job.processedRawURLs()
+	sinceSave := 0
+	// Workers fetch; this loop filters URLs and hands them out in order
+	work, wait := m.startWarmWorkers(ctx, job, aBase, robots)
 urlsLoop:
-	for idx, loc := range urls {
+	for _, entry := range entries {
+		loc := entry.Loc
 		if ctx.Err() != nil {
 			job.setInterrupted()
 			break
 		}
+		if _, ok := done[loc]; ok {
+			// Already handled before a restart
+			continue
+		}
+		if sinceSave++; sinceSave >= sitemapWarmPersistEvery {
+			m.persist(job)
+			sinceSave = 0
+		}
 		u, err := url.Parse(loc)
 		if err != nil {
 			job.incrementProcessed()
@@ -277,6 +673,10 @@ urlsLoop:
 		}
 		u.Fragment = ""
 		target := u.String()
+		if !robots.allowed(u.RequestURI()) {
+			job.skipRobotsDisallowed(loc, target)
+			continue
+		}
 		if _, dup := seen[target]; dup {
 			job.incrementProcessed()
 			job.incrementSkipped()
@@ -295,70 +695,79 @@ urlsLoop:
 			continue
 		}
 		seen[target] = struct{}{}
-		job.incrementProcessed()
-		var (
-			success bool
-			lastErr error
-		)
-		for attempt := 1; attempt <= sitemapWarmMaxAttempts; attempt++ {
-			success, lastErr = m.pf.FetchAndStore(target, aBase)
-			if success {
-				job.incrementCached()
-				logger.Infow("sitemap_cache_job_url_cached", map[string]interface{}{
-					"job_id":  job.ID,
-					"sitemap": job.SitemapURL,
-					"target":  target,
-					"attempt": attempt,
-					"a_base":  aBase,
-				})
-				job.addURLStatus(sitemapWarmURLStatus{
-					RawURL:   loc,
-					URL:      target,
-					Status:   "cached",
-					Attempts: attempt,
-				})
-				break
-			}
-			if ctx.Err() != nil {
-				job.setInterrupted()
-				break urlsLoop
-			}
-		}
-		if ctx.Err() != nil {
-			job.setInterrupted()
-			break
+		if !resumeSince.IsZero() && cachedSince(cfg.CacheDir, target, resumeSince) {
+			continue
 		}
-		if !success {
+		if cachedSince(cfg.CacheDir, target, entry.LastMod) {
+			job.incrementProcessed()
 			job.incrementSkipped()
-			errMsg := ""
-			if lastErr != nil {
-				errMsg = lastErr.Error()
-			}
-			logger.Warnw("sitemap_cache_job_url_failed", map[string]interface{}{
-				"job_id":   job.ID,
-				"sitemap":  job.SitemapURL,
-				"target":   target,
-				"attempts": sitemapWarmMaxAttempts,
-				"error":    errMsg,
-			})
 			job.addURLStatus(sitemapWarmURLStatus{
-				RawURL:   loc,
-				URL:      target,
-				Status:   "failed",
-				Reason:   "fetch_failed",
-				Attempts: sitemapWarmMaxAttempts,
-				Error:    errMsg,
+				RawURL: loc,
+				URL:    target,
+				Status: "skipped",
+				Reason: "not_modified",
+			})
+			logger.Debugw("sitemap_cache_job_url_skipped", map[string]interface{}{
+				"job_id":  job.ID,
+				"sitemap": job.SitemapURL,
+				"target":  target,
+				"reason":  "not_modified",
+				"lastmod": entry.LastMod.Format(time.RFC3339),
 			})
+			continue
 		}
-		if delay > 0 && idx < len(urls)-1 {
-			select {
-			case <-ctx.Done():
-				job.setInterrupted()
-				break urlsLoop
-			case <-time.After(delay):
-			}
+		select {
+		case work <- sitemapWarmTarget{rawURL: loc, target: target, since: entry.LastMod, host: u.Host}:
+		case <-ctx.Done():
+			job.setInterrupted()
+			break urlsLoop
 		}
 	}
+	close(work)
+	wait()
+	m.finish(ctx, job)
+}
+
+// startWarmWorkers starts SitemapWarmConcurrency workers warming the targets
+// sent on the returned channel, spaced per host as warmDelay says for robots.
+// Close the channel, then call wait to drain them.
+func (m *sitemapWarmManager) startWarmWorkers(ctx context.Context, job *sitemapWarmJob, aBase string, robots robotsRules) (chan<- sitemapWarmTarget, func()) {
+	cfg := m.cfg.Load()
+	delay := warmDelay(cfg, robots)
+	workers := cfg.SitemapWarmConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	work := make(chan sitemapWarmTarget)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range work {
+				m.warmURL(ctx, job, t, aBase, delay)
+			}
+		}()
+	}
+	return work, wg.Wait
+}
+
+// finish records how a job run ended once all its URLs were handed out.
+func (m *sitemapWarmManager) finish(ctx context.Context, job *sitemapWarmJob) {
+	if ctx.Err() != nil {
+		job.setInterrupted()
+	}
+	if job.Interrupted && m.ctx.Err() != nil {
+		job.setState(jobStateInterrupted)
+		logger.Warnw("sitemap_cache_job_interrupted", map[string]interface{}{
+			"job_id":    job.ID,
+			"sitemap":   job.SitemapURL,
+			"reason":    "shutdown",
+			"total":     job.Total,
+			"processed": job.Processed,
+		})
+		return
+	}
 	if job.Interrupted {
 		err := fmt.Errorf("job timed out after %s before processing all URLs", sitemapWarmJobTimeout)
 		job.markError(err)
@@ -383,6 +792,118 @@ urlsLoop:
 	})
 }
 
+// sitemapWarmTarget is a sitemap URL handed to a warm worker.
+type sitemapWarmTarget struct {
+	rawURL string
+	target string
+	since  time.Time
+	host   string
+}
+
+// warmURL fetches one sitemap URL into the cache, retrying failures, once the
+// per-host politeness delay allows it.
+func (m *sitemapWarmManager) warmURL(ctx context.Context, job *sitemapWarmJob, t sitemapWarmTarget, aBase string, delay time.Duration) {
+	if err := m.pacer.wait(ctx, t.host, delay); err != nil {
+		return
+	}
+	job.incrementProcessed()
+	var (
+		success bool
+		lastErr error
+	)
+	for attempt := 1; attempt <= sitemapWarmMaxAttempts; attempt++ {
+		success, lastErr = m.pf.FetchAndStore(t.target, aBase, t.since)
+		if success {
+			job.incrementCached()
+			logger.Infow("sitemap_cache_job_url_cached", map[string]interface{}{
+				"job_id":  job.ID,
+				"sitemap": job.SitemapURL,
+				"target":  t.target,
+				"attempt": attempt,
+				"a_base":  aBase,
+			})
+			job.addURLStatus(sitemapWarmURLStatus{
+				RawURL:   t.rawURL,
+				URL:      t.target,
+				Status:   "cached",
+				Attempts: attempt,
+			})
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	job.incrementSkipped()
+	errMsg := ""
+	if lastErr != nil {
+		errMsg = lastErr.Error()
+	}
+	logger.Warnw("sitemap_cache_job_url_failed", map[string]interface{}{
+		"job_id":   job.ID,
+		"sitemap":  job.SitemapURL,
+		"target":   t.target,
+		"attempts": sitemapWarmMaxAttempts,
+		"error":    errMsg,
+	})
+	job.addURLStatus(sitemapWarmURLStatus{
+		RawURL:   t.rawURL,
+		URL:      t.target,
+		Status:   "failed",
+		Reason:   "fetch_failed",
+		Attempts: sitemapWarmMaxAttempts,
+		Error:    errMsg,
+	})
+}
+
+// hostPacer spaces fetch starts to the same host by a minimum gap, across all
+// workers and jobs.
+type hostPacer struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// wait blocks until host may be fetched again and reserves the following slot.
+func (p *hostPacer) wait(ctx context.Context, host string, gap time.Duration) error {
+	if gap <= 0 {
+		return ctx.Err()
+	}
+	host = strings.ToLower(host)
+	p.mu.Lock()
+	now := time.Now()
+	at := p.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	p.next[host] = at.Add(gap)
+	p.mu.Unlock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(at)):
+		return nil
+	}
+}
+
+// cachedSince reports whether target has an unexpired cache entry created at
+// or after lastMod, so warming it again would fetch the same content. It is
+// false when the sitemap gives no lastmod.
+func cachedSince(cacheDir, target string, lastMod time.Time) bool {
+	if lastMod.IsZero() {
+		return false
+	}
+	p, err := cacheFilePathForURL(cacheDir, target)
+	if err != nil {
+		return false
+	}
+	ce, err := readCacheMeta(p)
+	if err != nil {
+		return false
+	}
+	now := time.Now().Unix()
+	return now < ce.ExpiresAt && ce.CreatedAt >= lastMod.Unix()
+}
+
 func (m *sitemapWarmManager) GetJob(id string) (*sitemapWarmJob, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -397,5 +918,6 @@ func (m *sitemapWarmManager) ListJobs() []*sitemapWarmJob {
 	for _, job := range m.jobs {
 		out = append(out, job)
 	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SubmittedAt.Before(out[j].SubmittedAt) })
 	return out
 }
@@ -0,0 +1,134 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"rerouter/logger"
+)
+
+// SitemapWarmSchedule re-runs a sitemap warm job on a fixed interval.
+type SitemapWarmSchedule struct {
+	SitemapURL      string `json:"sitemap_url"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	MaxURLs         int    `json:"max_urls,omitempty"`
+	ABaseURL        string `json:"a_base_url,omitempty"`
+}
+
+// parseSitemapWarmSchedules parses "interval=sitemap_url" entries separated by
+// commas, e.g. "6h=https://b.com/sitemap.xml,1d=https://b.com/news.xml".
+func parseSitemapWarmSchedules(v string) ([]SitemapWarmSchedule, error) {
+	out := []SitemapWarmSchedule{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid sitemap warm schedule %q", p)
+		}
+		d, err := parseAgeDuration(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, SitemapWarmSchedule{
+			SitemapURL:      strings.TrimSpace(kv[1]),
+			IntervalSeconds: int(d / time.Second),
+		})
+	}
+	return out, nil
+}
+
+func validateSitemapWarmSchedule(s SitemapWarmSchedule) error {
+	if u, err := url.Parse(s.SitemapURL); err != nil || u.Host == "" {
+		return fmt.Errorf("invalid sitemap_url %q", s.SitemapURL)
+	}
+	if s.IntervalSeconds < 60 {
+		return fmt.Errorf("interval for %s must be at least 60s", s.SitemapURL)
+	}
+	return nil
+}
+
+// StartSchedules launches one scheduler goroutine per schedule. They stop when
+// the manager shuts down.
+func (m *sitemapWarmManager) StartSchedules(schedules []SitemapWarmSchedule) {
+	for _, s := range schedules {
+		m.startSchedule(s, time.Duration(s.IntervalSeconds)*time.Second)
+	}
+}
+
+func (m *sitemapWarmManager) startSchedule(s SitemapWarmSchedule, interval time.Duration) {
+	if s.SitemapURL == "" || interval <= 0 {
+		return
+	}
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.runSchedule(s, interval)
+	}()
+}
+
+// runSchedule starts a warm job every interval. The first run is timed from the
+// last known job for the sitemap (including persisted ones), so restarts do not
+// postpone it indefinitely. A run is skipped while the previous job is still
+// active. Fresh cache entries are left untouched by the Prefetcher.
+func (m *sitemapWarmManager) runSchedule(s SitemapWarmSchedule, interval time.Duration) {
+	wait := interval
+	if last, ok := m.lastSubmitted(s.SitemapURL); ok {
+		wait = time.Until(last.Add(interval))
+		if wait < 0 {
+			wait = 0
+		}
+	}
+	logger.Infow("sitemap_cache_schedule_started", map[string]interface{}{
+		"sitemap":  s.SitemapURL,
+		"interval": interval.String(),
+		"next_in":  wait.Round(time.Second).String(),
+	})
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+		if id, busy := m.activeJobFor(s.SitemapURL); busy {
+			logger.Infow("sitemap_cache_schedule_skipped", map[string]interface{}{"sitemap": s.SitemapURL, "active_job_id": id})
+		} else if job, err := m.StartJob(s.SitemapURL, s.MaxURLs, s.ABaseURL); err != nil {
+			logger.Warnw("sitemap_cache_schedule_error", map[string]interface{}{"sitemap": s.SitemapURL, "err": err.Error()})
+		} else {
+			logger.Infow("sitemap_cache_schedule_triggered", map[string]interface{}{"sitemap": s.SitemapURL, "job_id": job.ID})
+		}
+		t.Reset(interval)
+	}
+}
+
+// lastSubmitted returns the submission time of the newest job for sitemapURL.
+func (m *sitemapWarmManager) lastSubmitted(sitemapURL string) (time.Time, bool) {
+	var last time.Time
+	for _, job := range m.ListJobs() {
+		st := job.snapshot()
+		if st.SitemapURL == sitemapURL && st.SubmittedAt.After(last) {
+			last = st.SubmittedAt
+		}
+	}
+	return last, !last.IsZero()
+}
+
+// activeJobFor returns the ID of a queued or running job for sitemapURL, if any.
+func (m *sitemapWarmManager) activeJobFor(sitemapURL string) (string, bool) {
+	for _, job := range m.ListJobs() {
+		st := job.snapshot()
+		if st.SitemapURL != sitemapURL {
+			continue
+		}
+		if st.State == string(jobStateQueued) || st.State == string(jobStateRunning) {
+			return st.JobID, true
+		}
+	}
+	return "", false
+}
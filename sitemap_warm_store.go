@@ -0,0 +1,97 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sitemapWarmJobsDir returns the directory holding persisted warm job snapshots.
+func sitemapWarmJobsDir(cacheDir string) string {
+	return filepath.Join(cacheDir, "jobs")
+}
+
+// persistSitemapWarmJob writes a job status snapshot to <cacheDir>/jobs/<id>.json.
+func persistSitemapWarmJob(cacheDir string, st sitemapWarmJobStatus) error {
+	dir := sitemapWarmJobsDir(cacheDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(dir, st.JobID+".json")
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// removePersistedSitemapWarmJob deletes a job snapshot; a missing file is not an error.
+func removePersistedSitemapWarmJob(cacheDir, id string) error {
+	err := os.Remove(filepath.Join(sitemapWarmJobsDir(cacheDir), id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// loadPersistedSitemapWarmJobs reads all job snapshots, oldest submission first.
+func loadPersistedSitemapWarmJobs(cacheDir string) ([]sitemapWarmJobStatus, error) {
+	entries, err := os.ReadDir(sitemapWarmJobsDir(cacheDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	out := make([]sitemapWarmJobStatus, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(sitemapWarmJobsDir(cacheDir), e.Name()))
+		if err != nil {
+			continue
+		}
+		var st sitemapWarmJobStatus
+		if err := json.Unmarshal(b, &st); err != nil || st.JobID == "" {
+			continue
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].SubmittedAt.Before(out[j].SubmittedAt) })
+	return out, nil
+}
+
+// sitemapWarmJobFromStatus rebuilds a job from its persisted snapshot.
+func sitemapWarmJobFromStatus(st sitemapWarmJobStatus) *sitemapWarmJob {
+	return &sitemapWarmJob{
+		ID:                 st.JobID,
+		SitemapURL:         st.SitemapURL,
+		MaxURLs:            st.MaxURLs,
+		ABaseOverride:      st.ABaseOverride,
+		Mode:               st.Mode,
+		MaxDepth:           st.MaxDepth,
+		URLs:               st.URLs,
+		Tenant:             st.Tenant,
+		State:              sitemapWarmJobState(st.State),
+		SubmittedAt:        st.SubmittedAt,
+		StartedAt:          st.StartedAt,
+		CompletedAt:        st.CompletedAt,
+		Total:              st.TotalURLs,
+		Processed:          st.Processed,
+		Cached:             st.CachedURLs,
+		Skipped:            st.SkippedURLs,
+		Interrupted:        st.Interrupted,
+		Error:              st.Error,
+		Duration:           time.Duration(st.DurationMS) * time.Millisecond,
+		URLStatuses:        st.URLStatuses,
+		URLStatusesDropped: st.URLStatusesDropped,
+	}
+}
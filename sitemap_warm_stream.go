@@ -0,0 +1,83 @@
+package rerouter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"rerouter/logger"
+)
+
+// sitemapWarmStreamHeartbeat keeps idle streams alive through proxies.
+const sitemapWarmStreamHeartbeat = 15 * time.Second
+
+// handleSitemapWarmStream serves /admin/sitemap-cache/stream?job=ID as
+// Server-Sent Events: a "state" event with the current status first, then
+// "url" events as URLs are handled and "state" events on state changes. The
+// stream ends once the job finishes. EventSource cannot set headers, so the
+// admin token may be passed as ?token=.
+func (a *appHandler) handleSitemapWarmStream(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(a.config(), w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobID := r.URL.Query().Get("job")
+	if jobID == "" {
+		jobID = r.URL.Query().Get("job_id")
+	}
+	job, ok := a.warmMgr.GetJob(jobID)
+	if !ok || !adminTenantScope(a.config(), r, adminRequestToken(r)).allowsTenant(job.Tenant) {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	events, cancel := job.subscribe()
+	defer cancel()
+
+	rc := http.NewResponseController(w)
+	// Warm jobs outlive the server write timeout
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(name string, data interface{}) bool {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, b); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	st := job.snapshot()
+	st.URLStatuses = nil
+	if !send("state", st) || st.finished() {
+		return
+	}
+	heartbeat := time.NewTicker(sitemapWarmStreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case ev := <-events:
+			if !send(ev.Name, ev.Data) {
+				logger.Debugw("sitemap_stream_closed", map[string]interface{}{"req_id": getRequestID(r.Context()), "job_id": job.ID})
+				return
+			}
+			if st, ok := ev.Data.(sitemapWarmJobStatus); ok && st.finished() {
+				return
+			}
+		}
+	}
+}
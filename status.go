@@ -0,0 +1,115 @@
+package rerouter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"syscall"
+	"time"
+)
+
+// Build information, set with -ldflags "-X rerouter.version=... -X rerouter.commit=...
+// -X rerouter.buildTime=...". commit and buildTime fall back to the VCS stamp Go
+// embeds when building from a checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildTime = ""
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+func currentBuildInfo() buildInfo {
+	b := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && b.Commit == "":
+				b.Commit = s.Value
+			case s.Key == "vcs.time" && b.BuildTime == "":
+				b.BuildTime = s.Value
+			}
+		}
+	}
+	return b
+}
+
+// configHash identifies the effective config, so instances can be compared
+// and a reload confirmed without dumping the config itself.
+func configHash(cfg *Config) string {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:8])
+}
+
+type cacheStatus struct {
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+	DiskFreeBytes uint64 `json:"disk_free_bytes"`
+	DiskSizeBytes uint64 `json:"disk_size_bytes"`
+	DiskError     string `json:"disk_error,omitempty"`
+}
+
+type warmJobBrief struct {
+	JobID      string `json:"job_id"`
+	SitemapURL string `json:"sitemap_url"`
+	State      string `json:"state"`
+	Processed  int    `json:"processed_urls"`
+	TotalURLs  int    `json:"total_urls"`
+}
+
+type adminStatus struct {
+	buildInfo
+	StartedAt     time.Time      `json:"started_at"`
+	UptimeSeconds int64          `json:"uptime_seconds"`
+	ConfigHash    string         `json:"config_hash"`
+	Cache         cacheStatus    `json:"cache"`
+	PrefetchQueue map[string]int `json:"prefetch_queue"`
+	WarmJobs      []warmJobBrief `json:"active_warm_jobs"`
+}
+
+// handleAdminStatus serves GET /admin/status: build, uptime, config hash,
+// cache size and the background work in flight.
+func (a *appHandler) handleAdminStatus(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st := adminStatus{
+		buildInfo:     currentBuildInfo(),
+		StartedAt:     a.startedAt.UTC(),
+		UptimeSeconds: int64(time.Since(a.startedAt) / time.Second),
+		ConfigHash:    configHash(cfg),
+		WarmJobs:      []warmJobBrief{},
+	}
+	st.Cache.Entries, st.Cache.Bytes = cacheIndexFor(cfg.CacheDir).totals()
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(cfg.CacheDir, &fs); err != nil {
+		st.Cache.DiskError = err.Error()
+	} else {
+		st.Cache.DiskFreeBytes = fs.Bavail * uint64(fs.Bsize)
+		st.Cache.DiskSizeBytes = fs.Blocks * uint64(fs.Bsize)
+	}
+	st.PrefetchQueue = a.pf.queueStats()
+	for _, job := range a.warmMgr.ListJobs() {
+		js := job.snapshot()
+		if js.State != string(jobStateQueued) && js.State != string(jobStateRunning) {
+			continue
+		}
+		st.WarmJobs = append(st.WarmJobs, warmJobBrief{JobID: js.JobID, SitemapURL: js.SitemapURL, State: js.State, Processed: js.Processed, TotalURLs: js.TotalURLs})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,307 @@
+package rerouter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Structured data presets. A rule without a type uses its own template.
+const (
+	structuredDataOrganization = "organization"
+	structuredDataBreadcrumbs  = "breadcrumbs"
+	structuredDataProduct      = "product"
+)
+
+// StructuredDataRule injects a JSON-LD block into bot-served HTML on paths
+// matching Pattern. Template string values may hold {{field}} placeholders
+// filled from the page (title, description, image, h1, site_name, url,
+// origin, path, meta:<name>) and from Fields; values left empty are dropped.
+type StructuredDataRule struct {
+	Pattern  string            `json:"pattern"`
+	Type     string            `json:"type,omitempty"`
+	Template json.RawMessage   `json:"template,omitempty"`
+	Fields   map[string]string `json:"fields,omitempty"`
+}
+
+// structuredDataPresets are the templates of the organization and product
+// presets; breadcrumbs are built from the path instead.
+var structuredDataPresets = map[string]string{
+	structuredDataOrganization: `{"@context":"https://schema.org","@type":"Organization","name":"{{site_name}}","url":"{{origin}}/","logo":"{{logo}}"}`,
+	structuredDataProduct: `{"@context":"https://schema.org","@type":"Product","name":"{{h1}}","description":"{{description}}","image":"{{image}}","url":"{{url}}",
+		"offers":{"@type":"Offer","price":"{{meta:product:price:amount}}","priceCurrency":"{{meta:product:price:currency}}","availability":"{{meta:product:availability}}"}}`,
+}
+
+var structuredDataPlaceholder = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+var jsonLDType = regexp.MustCompile(`"@type"\s*:\s*"([^"]+)"`)
+
+func validateStructuredDataRule(r StructuredDataRule) error {
+	if r.Pattern == "" {
+		return fmt.Errorf("structured data rule needs a pattern")
+	}
+	switch r.Type {
+	case structuredDataOrganization, structuredDataProduct, structuredDataBreadcrumbs:
+	case "":
+		if len(r.Template) == 0 {
+			return fmt.Errorf("structured data rule %q needs a type or a template", r.Pattern)
+		}
+	default:
+		return fmt.Errorf("structured data rule %q: unknown type %q (want organization, breadcrumbs or product)", r.Pattern, r.Type)
+	}
+	if len(r.Template) != 0 {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(r.Template, &obj); err != nil {
+			return fmt.Errorf("structured data rule %q: template must be a JSON object: %w", r.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// injectStructuredData adds the JSON-LD blocks of every rule matching
+// reqPath before </head>. A block whose @type the page already declares in
+// its own JSON-LD is skipped, as are organization and product blocks
+// without a name and breadcrumbs for the home page.
+func injectStructuredData(cfg *Config, body []byte, reqPath string, aBase *url.URL) ([]byte, bool) {
+	var rules []StructuredDataRule
+	for _, r := range cfg.StructuredData {
+		if patternsMatch([]string{r.Pattern}, reqPath) {
+			rules = append(rules, r)
+		}
+	}
+	if len(rules) == 0 {
+		return body, false
+	}
+	origin := strings.TrimRight(aBase.Scheme+"://"+aBase.Host, "/")
+	page, existing := extractPageFields(body)
+	page["origin"] = origin
+	page["path"] = reqPath
+	page["url"] = origin + reqPath
+
+	var blocks []string
+	for _, r := range rules {
+		fields := make(map[string]string, len(page)+len(r.Fields))
+		for k, v := range page {
+			fields[k] = v
+		}
+		for k, v := range r.Fields {
+			fields[k] = v
+		}
+		var doc interface{}
+		if r.Type == structuredDataBreadcrumbs && len(r.Template) == 0 {
+			doc = breadcrumbList(reqPath, fields)
+		} else {
+			tmpl := []byte(structuredDataPresets[r.Type])
+			if len(r.Template) != 0 {
+				tmpl = r.Template
+			}
+			if err := json.Unmarshal(tmpl, &doc); err != nil {
+				continue
+			}
+		}
+		filled, ok := fillStructuredData(doc, fields)
+		obj, isObj := filled.(map[string]interface{})
+		if !ok || !isObj {
+			continue
+		}
+		if (r.Type == structuredDataOrganization || r.Type == structuredDataProduct) && obj["name"] == nil {
+			continue
+		}
+		if t, _ := obj["@type"].(string); t != "" && existing[t] {
+			continue
+		}
+		b, err := json.Marshal(obj)
+		if err != nil {
+			continue
+		}
+		blocks = append(blocks, `<script type="application/ld+json">`+string(b)+`</script>`)
+	}
+	if len(blocks) == 0 {
+		return body, false
+	}
+	return insertBeforeHeadEnd(body, strings.Join(blocks, ""))
+}
+
+// breadcrumbList builds a BreadcrumbList from the segments of reqPath. The
+// last crumb is named after the page's <h1> when it has one.
+func breadcrumbList(reqPath string, fields map[string]string) interface{} {
+	segs := strings.FieldsFunc(reqPath, func(r rune) bool { return r == '/' })
+	if len(segs) == 0 {
+		return nil
+	}
+	home := fields["home"]
+	if home == "" {
+		home = "Home"
+	}
+	items := []interface{}{map[string]interface{}{"@type": "ListItem", "position": 1, "name": home, "item": fields["origin"] + "/"}}
+	for i, seg := range segs {
+		name := fields["h1"]
+		if i < len(segs)-1 || name == "" {
+			name = humanizePathSegment(seg)
+		}
+		link := fields["origin"] + "/" + strings.Join(segs[:i+1], "/")
+		if i < len(segs)-1 || strings.HasSuffix(reqPath, "/") {
+			link += "/"
+		}
+		items = append(items, map[string]interface{}{"@type": "ListItem", "position": i + 2, "name": name, "item": link})
+	}
+	return map[string]interface{}{"@context": "https://schema.org", "@type": "BreadcrumbList", "itemListElement": items}
+}
+
+// humanizePathSegment turns "summer-sale_2024.html" into "Summer sale 2024".
+func humanizePathSegment(seg string) string {
+	if s, err := url.PathUnescape(seg); err == nil {
+		seg = s
+	}
+	if i := strings.LastIndex(seg, "."); i > 0 {
+		seg = seg[:i]
+	}
+	seg = strings.Join(strings.FieldsFunc(seg, func(r rune) bool { return r == '-' || r == '_' }), " ")
+	if seg == "" {
+		return seg
+	}
+	return strings.ToUpper(seg[:1]) + seg[1:]
+}
+
+// fillStructuredData substitutes placeholders in the string values of v. It
+// reports false for values that end up empty: blank strings, empty lists and
+// objects with nothing but @type/@context, which their parent then drops.
+func fillStructuredData(v interface{}, fields map[string]string) (interface{}, bool) {
+	switch t := v.(type) {
+	case string:
+		s := strings.TrimSpace(structuredDataPlaceholder.ReplaceAllStringFunc(t, func(m string) string {
+			return fields[structuredDataPlaceholder.FindStringSubmatch(m)[1]]
+		}))
+		return s, s != ""
+	case []interface{}:
+		out := make([]interface{}, 0, len(t))
+		for _, e := range t {
+			if f, ok := fillStructuredData(e, fields); ok {
+				out = append(out, f)
+			}
+		}
+		return out, len(out) > 0
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		content := false
+		for k, e := range t {
+			f, ok := fillStructuredData(e, fields)
+			if !ok {
+				continue
+			}
+			out[k] = f
+			content = content || (k != "@type" && k != "@context")
+		}
+		return out, content
+	case nil:
+		return nil, false
+	}
+	return v, true
+}
+
+// extractPageFields collects the values placeholders draw from an HTML page,
+// and the @type values of its own JSON-LD blocks.
+func extractPageFields(body []byte) (map[string]string, map[string]bool) {
+	fields := map[string]string{}
+	types := map[string]bool{}
+	var title, h1 strings.Builder
+	inTitle, inH1, inJSONLD, h1Done := false, false, false, false
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if fields["title"] == "" {
+				fields["title"] = strings.TrimSpace(title.String())
+			}
+			if fields["description"] == "" {
+				fields["description"] = fields["meta:og:description"]
+			}
+			fields["image"] = fields["meta:og:image"]
+			fields["site_name"] = fields["meta:og:site_name"]
+			fields["h1"] = strings.Join(strings.Fields(h1.String()), " ")
+			if fields["h1"] == "" {
+				fields["h1"] = fields["title"]
+			}
+			return fields, types
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.Data {
+			case "title":
+				inTitle = true
+			case "h1":
+				inH1 = !h1Done
+			case "script":
+				inJSONLD = isJSONLDScript(tok)
+			case "meta":
+				name := strings.ToLower(attrVal(tok, "property"))
+				if name == "" {
+					name = strings.ToLower(attrVal(tok, "name"))
+				}
+				if name != "" && fields["meta:"+name] == "" {
+					fields["meta:"+name] = strings.TrimSpace(attrVal(tok, "content"))
+				}
+				switch name {
+				case "og:title":
+					fields["title"] = fields["meta:"+name]
+				case "description":
+					fields["description"] = fields["meta:"+name]
+				}
+			}
+		case html.EndTagToken:
+			switch name, _ := z.TagName(); string(name) {
+			case "title":
+				inTitle = false
+			case "h1":
+				if inH1 {
+					inH1, h1Done = false, true
+				}
+			case "script":
+				inJSONLD = false
+			}
+		case html.TextToken:
+			switch {
+			case inTitle:
+				title.Write(z.Text())
+			case inH1:
+				h1.Write(z.Text())
+			case inJSONLD:
+				for _, m := range jsonLDType.FindAllSubmatch(z.Text(), -1) {
+					types[string(m[1])] = true
+				}
+			}
+		}
+	}
+}
+
+// insertBeforeHeadEnd writes markup before </head>, or before <body> when
+// the head is not closed explicitly.
+func insertBeforeHeadEnd(body []byte, markup string) ([]byte, bool) {
+	z := html.NewTokenizer(bytes.NewReader(body))
+	var out bytes.Buffer
+	out.Grow(len(body) + len(markup))
+	injected := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			out.Write(z.Raw())
+			break
+		}
+		if !injected {
+			name, _ := z.TagName()
+			if (tt == html.EndTagToken && string(name) == "head") || (tt == html.StartTagToken && string(name) == "body") {
+				out.WriteString(markup)
+				injected = true
+			}
+		}
+		out.Write(z.Raw())
+	}
+	if !injected {
+		return body, false
+	}
+	return out.Bytes(), true
+}
@@ -0,0 +1,151 @@
+package rerouter
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// PREFETCH_SUBRESOURCES modes.
+const (
+	subresourcesOff    = "off"
+	subresourcesAssets = "assets"
+	subresourcesAll    = "all"
+)
+
+const defaultPrefetchSubresourcesMax = 50
+
+func validSubresourceMode(m string) bool {
+	switch m {
+	case "", subresourcesOff, subresourcesAssets, subresourcesAll:
+		return true
+	}
+	return false
+}
+
+// subresourceLinkRels are the <link rel> values naming a resource a page loads.
+var subresourceLinkRels = map[string]bool{
+	"stylesheet":       true,
+	"icon":             true,
+	"shortcut":         true,
+	"apple-touch-icon": true,
+	"preload":          true,
+	"modulepreload":    true,
+}
+
+// extractSubresources returns the URLs an HTML page loads (stylesheets,
+// scripts, images, media, icons) and, with links, its <a> targets not marked
+// rel="nofollow". For srcset only the first candidate is taken.
+func extractSubresources(body []byte, links bool) []string {
+	var out []string
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return out
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if !hasAttr {
+				continue
+			}
+			attrs := map[string]string{}
+			for more := true; more; {
+				var k, v []byte
+				k, v, more = z.TagAttr()
+				attrs[strings.ToLower(string(k))] = strings.TrimSpace(string(v))
+			}
+			switch string(name) {
+			case "link":
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					if subresourceLinkRels[rel] {
+						out = appendNonEmpty(out, attrs["href"])
+						break
+					}
+				}
+			case "script", "img", "source", "video", "audio", "track", "iframe":
+				out = appendNonEmpty(out, attrs["src"])
+				if first, _, _ := strings.Cut(attrs["srcset"], ","); attrs["src"] == "" {
+					if f := strings.Fields(first); len(f) > 0 {
+						out = appendNonEmpty(out, f[0])
+					}
+				}
+				out = appendNonEmpty(out, attrs["poster"])
+			case "a":
+				rel := " " + strings.ToLower(attrs["rel"]) + " "
+				if links && !strings.Contains(rel, " nofollow ") && !strings.HasPrefix(attrs["href"], "#") {
+					out = appendNonEmpty(out, attrs["href"])
+				}
+			}
+		}
+	}
+}
+
+func appendNonEmpty(out []string, v string) []string {
+	if v == "" || strings.HasPrefix(v, "data:") {
+		return out
+	}
+	return append(out, v)
+}
+
+// sameSiteTargets resolves refs found on page and keeps those on page's host,
+// as deduplicated B URLs without fragments. A page body may already be
+// rewritten to A, so references to aHost are mapped back to bURL.
+func sameSiteTargets(refs []string, page *url.URL, aHost string, bURL *url.URL) []string {
+	seen := map[string]struct{}{page.String(): {}}
+	var out []string
+	for _, href := range refs {
+		ref, err := url.Parse(href)
+		if err != nil {
+			continue
+		}
+		u := page.ResolveReference(ref)
+		if aHost != "" && strings.EqualFold(u.Host, aHost) {
+			u.Scheme, u.Host = bURL.Scheme, bURL.Host
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || !strings.EqualFold(u.Host, page.Host) {
+			continue
+		}
+		u.Fragment = ""
+		if _, dup := seen[u.String()]; dup {
+			continue
+		}
+		seen[u.String()] = struct{}{}
+		out = append(out, u.String())
+	}
+	return out
+}
+
+// EnqueueSubresources queues for prefetch the same-host resources an HTML
+// page references, per cfg.PrefetchSubresources. body is the page as cached,
+// possibly rewritten for aBase. The queued fetches don't look further.
+func (p *Prefetcher) EnqueueSubresources(cfg *Config, pageURL, contentType string, body []byte, aBase string) int {
+	mode := cfg.PrefetchSubresources
+	if mode == "" || mode == subresourcesOff || !strings.Contains(strings.ToLower(contentType), "text/html") {
+		return 0
+	}
+	page, err := url.Parse(pageURL)
+	if err != nil {
+		return 0
+	}
+	aHost := ""
+	if u, err := url.Parse(aBase); err == nil {
+		aHost = u.Host
+	}
+	bURL := &url.URL{Scheme: page.Scheme, Host: page.Host}
+	limit := cfg.PrefetchSubresourcesMax
+	if limit <= 0 {
+		limit = defaultPrefetchSubresourcesMax
+	}
+	queued := 0
+	for _, target := range sameSiteTargets(extractSubresources(body, mode == subresourcesAll), page, aHost, bURL) {
+		if queued >= limit {
+			break
+		}
+		if p.enqueue(prefetchJob{target: target, aBase: aBase, linked: true}) {
+			queued++
+		}
+	}
+	return queued
+}
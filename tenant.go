@@ -0,0 +1,146 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// parseTenants parses "name=host|host" entries separated by commas, e.g.
+// "shop=b-shop.com|cdn.b-shop.com,blog=b-blog.com".
+func parseTenants(v string) (map[string][]string, error) {
+	out := map[string][]string{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		name, hosts, ok := strings.Cut(p, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tenant %q (want name=host|host)", p)
+		}
+		name = strings.TrimSpace(name)
+		for _, h := range strings.Split(hosts, "|") {
+			if h = strings.TrimSpace(h); h != "" {
+				out[name] = append(out[name], h)
+			}
+		}
+	}
+	return out, nil
+}
+
+// validateTenants rejects unnamed or empty tenants and B hosts claimed by two
+// tenants.
+func validateTenants(tenants map[string][]string) error {
+	owner := map[string]string{}
+	for name, hosts := range tenants {
+		if name == "" || len(hosts) == 0 {
+			return fmt.Errorf("every tenant needs a name and at least one B host")
+		}
+		for _, h := range hosts {
+			h = strings.ToLower(h)
+			if strings.Contains(h, "/") {
+				return fmt.Errorf("tenant %s: %q is not a host", name, h)
+			}
+			if prev, ok := owner[h]; ok && prev != name {
+				return fmt.Errorf("B host %s belongs to tenants %s and %s", h, prev, name)
+			}
+			owner[h] = name
+		}
+	}
+	return nil
+}
+
+// tenantForHost returns the tenant owning B host host, or "" when none does.
+func tenantForHost(cfg *Config, host string) string {
+	for name, hosts := range cfg.Tenants {
+		for _, h := range hosts {
+			if strings.EqualFold(h, host) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// tenantForConfig returns the tenant of the B site cfg is scoped to.
+func tenantForConfig(cfg *Config) string {
+	if len(cfg.Tenants) == 0 {
+		return ""
+	}
+	u, err := url.Parse(cfg.BBaseURL)
+	if err != nil {
+		return ""
+	}
+	return tenantForHost(cfg, u.Host)
+}
+
+// tenantScope limits an admin request to the B hosts of some tenants. A nil
+// scope allows everything.
+type tenantScope struct {
+	tenants []string
+	hosts   map[string]bool
+}
+
+// adminTenantScope returns the scope of r's admin credential, or nil when
+// the credential is not limited to tenants.
+func adminTenantScope(cfg *Config, r *http.Request, token string) *tenantScope {
+	cred := adminRequestCredential(cfg, r, token)
+	if cred == nil || len(cred.Tenants) == 0 {
+		return nil
+	}
+	sc := &tenantScope{tenants: append([]string(nil), cred.Tenants...), hosts: map[string]bool{}}
+	sort.Strings(sc.tenants)
+	for _, name := range cred.Tenants {
+		for _, h := range cfg.Tenants[name] {
+			sc.hosts[strings.ToLower(h)] = true
+		}
+	}
+	return sc
+}
+
+func (sc *tenantScope) allowsHost(host string) bool {
+	return sc == nil || sc.hosts[strings.ToLower(host)]
+}
+
+// allowsURL reports whether absolute URL raw is on one of the scope's hosts.
+func (sc *tenantScope) allowsURL(raw string) bool {
+	if sc == nil {
+		return true
+	}
+	u, err := url.Parse(raw)
+	return err == nil && sc.allowsHost(u.Host)
+}
+
+func (sc *tenantScope) allowsTenant(name string) bool {
+	if sc == nil {
+		return true
+	}
+	for _, t := range sc.tenants {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// adminTenantRoute reports whether r goes to an admin route that honors
+// tenant scopes; tokens limited to tenants may use no other.
+func adminTenantRoute(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/admin/purge", "/admin/cache/list", "/admin/cache/entry",
+		"/admin/sitemap-cache", "/admin/sitemap-cache/status", "/admin/sitemap-cache/stream", "/admin/warm":
+		return true
+	case "/admin/stats/cache":
+		return r.Method == http.MethodGet
+	}
+	return false
+}
+
+// errOutsideTenants answers an admin request for a URL its token's tenants
+// do not cover.
+func errOutsideTenants(w http.ResponseWriter) {
+	http.Error(w, "forbidden: url outside the token's tenants", http.StatusForbidden)
+}
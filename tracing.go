@@ -0,0 +1,452 @@
+package rerouter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Tracing emits OpenTelemetry spans for the request path, upstream fetches,
+// cache reads and writes, prefetches and warm jobs, and exports them with
+// OTLP/HTTP (JSON encoding) to TracingEndpoint. Incoming W3C traceparent
+// headers are continued and outgoing upstream requests carry one, so origin
+// traces join ours.
+
+const (
+	defaultTracingServiceName = "rerouter"
+	// tracingBatchSize spans trigger an early export; tracingMaxPending caps the
+	// queue while the collector is slow or down (newer spans are dropped).
+	tracingBatchSize     = 512
+	tracingMaxPending    = 4096
+	tracingFlushInterval = 5 * time.Second
+	tracingExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+const spanKey ctxKey = "span"
+
+// span is one timed operation. A nil *span is valid and does nothing, so call
+// sites need not check whether tracing is on.
+type span struct {
+	tracer  *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte
+	sampled bool
+	remote  bool   // parent context from a traceparent header, never exported
+	state   string // tracestate passed along unchanged
+
+	name  string
+	kind  int
+	start time.Time
+
+	mu     sync.Mutex
+	end    time.Time
+	attrs  map[string]interface{}
+	errMsg string
+}
+
+// activeTracer is the process tracer, nil when tracing is off.
+var activeTracer atomic.Pointer[tracer]
+
+// startSpan starts a span named name as a child of the span in ctx, or as a
+// new trace root, and returns ctx carrying it.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	t := activeTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if p, _ := ctx.Value(spanKey).(*span); p != nil {
+		s.traceID, s.parent, s.sampled, s.state = p.traceID, p.id, p.sampled, p.state
+	} else {
+		_, _ = randRead(s.traceID[:])
+		s.sampled = t.sample(s.traceID)
+	}
+	_, _ = randRead(s.id[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// withTraceparent returns ctx carrying the remote parent of W3C traceparent
+// and tracestate header values, if traceparent is valid. It applies whether
+// or not tracing is on, so the trace context still reaches the origin.
+func withTraceparent(ctx context.Context, v, state string) context.Context {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return ctx
+	}
+	s := &span{remote: true}
+	flags, err := hex.DecodeString(parts[3])
+	if _, err1 := hex.Decode(s.traceID[:], []byte(parts[1])); err1 != nil || err != nil {
+		return ctx
+	}
+	if _, err := hex.Decode(s.id[:], []byte(parts[2])); err != nil {
+		return ctx
+	}
+	if s.traceID == ([16]byte{}) || s.id == ([8]byte{}) {
+		return ctx
+	}
+	s.sampled = flags[0]&1 == 1
+	s.state = strings.TrimSpace(state)
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// traceparent is the W3C header value identifying s as the parent.
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-" + flags
+}
+
+// traceIDString is the hex trace ID, or "" for a nil span.
+func (s *span) traceIDString() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+func (s *span) setAttr(key string, v interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = map[string]interface{}{}
+	}
+	s.attrs[key] = v
+}
+
+// setError marks the span failed with err (nil is ignored).
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errMsg = err.Error()
+	s.mu.Unlock()
+}
+
+// finish ends the span and queues it for export when sampled.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// tracingTransport wraps each upstream fetch in a client span and sends the
+// request ID and trace context to the origin, so its logs can be matched with
+// ours. With tracing off, an incoming traceparent is passed through as is.
+type tracingTransport struct {
+	base http.RoundTripper
+}
+
+// setCorrelationHeaders sets X-Request-ID and the trace context of ctx,
+// parent being the span the origin's work belongs to.
+func setCorrelationHeaders(ctx context.Context, req *http.Request, parent *span) {
+	if rid := getRequestID(ctx); rid != "" {
+		req.Header.Set("X-Request-ID", rid)
+	}
+	if parent == nil {
+		return
+	}
+	req.Header.Set("traceparent", parent.traceparent())
+	if parent.state != "" {
+		req.Header.Set("tracestate", parent.state)
+	}
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, sp := startSpan(req.Context(), "HTTP "+req.Method, spanKindClient)
+	if sp == nil {
+		parent, _ := ctx.Value(spanKey).(*span)
+		if parent == nil && getRequestID(ctx) == "" {
+			return t.base.RoundTrip(req)
+		}
+		req = req.Clone(ctx)
+		setCorrelationHeaders(ctx, req, parent)
+		return t.base.RoundTrip(req)
+	}
+	defer sp.finish()
+	sp.setAttr("http.request.method", req.Method)
+	sp.setAttr("url.full", req.URL.String())
+	sp.setAttr("server.address", req.URL.Hostname())
+	req = req.Clone(ctx)
+	setCorrelationHeaders(ctx, req, sp)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		sp.setError(err)
+		return resp, err
+	}
+	sp.setAttr("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 500 {
+		sp.setError(fmt.Errorf("upstream status %d", resp.StatusCode))
+	}
+	return resp, nil
+}
+
+// tracer batches finished spans and exports them in the background.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	ratio    float64
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []*span
+	dropped int64
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// tracingEndpointURL resolves the OTLP/HTTP traces URL: the traces-specific
+// endpoint is used as-is, the generic one gets /v1/traces appended.
+func tracingEndpointURL(traces, generic string) string {
+	if traces != "" {
+		return traces
+	}
+	if generic != "" {
+		return strings.TrimRight(generic, "/") + "/v1/traces"
+	}
+	return ""
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS: "key=value" pairs
+// separated by commas, values URL-encoded.
+func parseOTLPHeaders(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(p, "=")
+		if !ok || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q (want key=value)", p)
+		}
+		if dec, err := url.QueryUnescape(strings.TrimSpace(val)); err == nil {
+			val = dec
+		}
+		out[strings.TrimSpace(k)] = val
+	}
+	return out, nil
+}
+
+func validateTracing(cfg *Config) error {
+	if cfg.TracingEndpoint != "" {
+		u, err := url.Parse(cfg.TracingEndpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("tracing endpoint %q must be an http(s) URL", cfg.TracingEndpoint)
+		}
+	}
+	if cfg.TracingSampleRatio < 0 || cfg.TracingSampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// startTracing turns tracing on when cfg has an endpoint. The returned func
+// stops it, exporting what is still queued.
+func startTracing(cfg *Config) func(context.Context) {
+	if cfg.TracingEndpoint == "" {
+		return func(context.Context) {}
+	}
+	service := cfg.TracingServiceName
+	if service == "" {
+		service = defaultTracingServiceName
+	}
+	t := &tracer{
+		endpoint: cfg.TracingEndpoint,
+		headers:  cfg.TracingHeaders,
+		service:  service,
+		ratio:    cfg.TracingSampleRatio,
+		client:   &http.Client{Timeout: tracingExportTimeout},
+		kick:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.loop()
+	activeTracer.Store(t)
+	logger.Infow("tracing_enabled", map[string]interface{}{"endpoint": t.endpoint, "service": service, "sample_ratio": t.ratio})
+	return func(ctx context.Context) {
+		activeTracer.CompareAndSwap(t, nil)
+		close(t.stop)
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// sample decides a new root trace from its ID so all spans of a trace agree.
+func (t *tracer) sample(id [16]byte) bool {
+	if t.ratio >= 1 {
+		return true
+	}
+	return float64(binary.BigEndian.Uint64(id[8:])>>11)/(1<<53) < t.ratio
+}
+
+func (t *tracer) enqueue(s *span) {
+	t.mu.Lock()
+	if len(t.pending) >= tracingMaxPending {
+		t.dropped++
+		t.mu.Unlock()
+		return
+	}
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= tracingBatchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *tracer) loop() {
+	defer close(t.done)
+	tick := time.NewTicker(tracingFlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.kick:
+		case <-t.stop:
+			t.flush()
+			return
+		}
+		t.flush()
+	}
+}
+
+// flush exports every queued span.
+func (t *tracer) flush() {
+	t.mu.Lock()
+	batch, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		logger.Warnw("tracing_spans_dropped", map[string]interface{}{"count": dropped})
+	}
+	for len(batch) > 0 {
+		n := min(len(batch), tracingBatchSize)
+		if err := t.export(batch[:n]); err != nil {
+			logger.Warnw("tracing_export_error", map[string]interface{}{"err": err.Error(), "spans": n})
+		}
+		batch = batch[n:]
+	}
+}
+
+// export posts spans as an OTLP/HTTP JSON ExportTraceServiceRequest.
+func (t *tracer) export(spans []*span) error {
+	out := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		out = append(out, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service})},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "rerouter"},
+				"spans": out,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.id[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parent != ([8]byte{}) {
+		m["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.errMsg != "" {
+		m["status"] = map[string]interface{}{"code": 2, "message": s.errMsg}
+	}
+	return m
+}
+
+// otlpAttributes encodes attrs as OTLP KeyValues.
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	out := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var val map[string]interface{}
+		switch v := v.(type) {
+		case bool:
+			val = map[string]interface{}{"boolValue": v}
+		case int:
+			val = map[string]interface{}{"intValue": strconv.Itoa(v)}
+		case int64:
+			val = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			val = map[string]interface{}{"doubleValue": v}
+		default:
+			val = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]interface{}{"key": k, "value": val})
+	}
+	return out
+}
@@ -0,0 +1,289 @@
+package rerouter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"plugin"
+	"strings"
+	"sync"
+	"time"
+
+	"rerouter/logger"
+)
+
+// Built-in transformer names for cfg.Transformers.
+const (
+	transformRewrite        = "rewrite"
+	transformStrip          = "strip"
+	transformCanonical      = "canonical"
+	transformStructuredData = "structured_data"
+	transformRobots         = "robots"
+	transformMinify         = "minify"
+)
+
+// External transformers: "hook:<url>" POSTs the body to an HTTP endpoint,
+// "plugin:<path>" calls a Go plugin.
+const (
+	transformHookPrefix   = "hook:"
+	transformPluginPrefix = "plugin:"
+)
+
+const defaultTransformHookTimeoutSeconds = 5
+
+// maxTransformHookBytes bounds a hook's response; larger ones keep the body as is.
+const maxTransformHookBytes = 32 << 20
+
+// defaultTransformers is the chain used when cfg.Transformers is empty.
+var defaultTransformers = []string{transformRewrite, transformStrip, transformCanonical, transformStructuredData, transformRobots, transformMinify}
+
+// transformContext describes the response a transformer works on.
+type transformContext struct {
+	cfg         *Config
+	reqPath     string
+	contentType string
+	// ct is contentType lowercased.
+	ct           string
+	aBase, bBase *url.URL
+}
+
+func (tc *transformContext) isHTML() bool { return strings.Contains(tc.ct, "text/html") }
+
+// bodyTransformer changes a bot-served body before it is cached or served,
+// and reports whether it did.
+type bodyTransformer interface {
+	Transform(tc *transformContext, body []byte) ([]byte, bool)
+}
+
+type transformFunc func(tc *transformContext, body []byte) ([]byte, bool)
+
+func (f transformFunc) Transform(tc *transformContext, body []byte) ([]byte, bool) {
+	return f(tc, body)
+}
+
+// builtinTransformers are the transformations rerouter ships with; each
+// still follows its own settings (INJECT_CANONICAL, MINIFY_RESPONSES, ...).
+var builtinTransformers = map[string]bodyTransformer{
+	transformRewrite: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		rw := newURLRewriter(tc.cfg, tc.aBase, tc.bBase)
+		switch {
+		case isSitemapPath(tc.reqPath) || isFeedPath(tc.reqPath):
+			return rw.bToA(body)
+		case tc.isHTML():
+			return rw.html(body)
+		case strings.Contains(tc.ct, "text/css"):
+			s, ok := rw.css(string(body))
+			return []byte(s), ok
+		case isJavaScriptType(tc.ct):
+			s, ok := rw.js(string(body))
+			return []byte(s), ok
+		case strings.Contains(tc.ct, "application/xhtml") || strings.Contains(tc.ct, "xml") || strings.Contains(tc.ct, "feed+json"):
+			return rw.bToA(body)
+		}
+		return body, false
+	}),
+	transformStrip: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		if tc.cfg == nil || !tc.isHTML() {
+			return body, false
+		}
+		return stripHTMLSelectors(body, tc.cfg.StripSelectors)
+	}),
+	transformCanonical: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		if tc.cfg == nil || !tc.cfg.InjectCanonical || !tc.isHTML() {
+			return body, false
+		}
+		return injectCanonicalTags(body, strings.TrimRight(tc.aBase.Scheme+"://"+tc.aBase.Host, "/")+tc.reqPath)
+	}),
+	transformStructuredData: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		if tc.cfg == nil || len(tc.cfg.StructuredData) == 0 || !tc.isHTML() {
+			return body, false
+		}
+		return injectStructuredData(tc.cfg, body, tc.reqPath, tc.aBase)
+	}),
+	transformRobots: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		p, ok := robotsPolicyFor(tc.cfg, tc.reqPath)
+		if !ok || !tc.isHTML() {
+			return body, false
+		}
+		return applyRobotsMeta(body, p)
+	}),
+	transformMinify: transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		if tc.cfg == nil || !tc.cfg.MinifyResponses {
+			return body, false
+		}
+		var minify func(string) string
+		switch {
+		case tc.isHTML():
+			return minifyHTML(body)
+		case strings.Contains(tc.ct, "text/css"):
+			minify = minifyCSS
+		case isJavaScriptType(tc.ct):
+			minify = minifyJS
+		default:
+			return body, false
+		}
+		if m := minify(string(body)); len(m) < len(body) {
+			return []byte(m), true
+		}
+		return body, false
+	}),
+}
+
+// transformerFor resolves one cfg.Transformers entry.
+func transformerFor(name string) (bodyTransformer, error) {
+	switch {
+	case strings.HasPrefix(name, transformHookPrefix):
+		u, err := url.Parse(strings.TrimPrefix(name, transformHookPrefix))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("transformer %q: hook needs an absolute http(s) URL", name)
+		}
+		return hookTransformer{url: u.String()}, nil
+	case strings.HasPrefix(name, transformPluginPrefix):
+		return loadTransformPlugin(strings.TrimPrefix(name, transformPluginPrefix))
+	}
+	if t, ok := builtinTransformers[name]; ok {
+		return t, nil
+	}
+	return nil, fmt.Errorf("unknown transformer %q (want rewrite, strip, canonical, structured_data, robots, minify, hook:<url> or plugin:<path>)", name)
+}
+
+func validateTransformers(names []string) error {
+	for _, name := range names {
+		if _, err := transformerFor(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateTransformerPatch rejects plugin entries in a runtime change of the
+// transformers that cur was not already loaded with: opening a plugin runs
+// its code, so new ones only come from the config file or the environment.
+func validateTransformerPatch(cur []string, next []string) error {
+	loaded := map[string]bool{}
+	for _, name := range cur {
+		loaded[name] = true
+	}
+	for _, name := range next {
+		if strings.HasPrefix(name, transformPluginPrefix) && !loaded[name] {
+			return fmt.Errorf("transformer %q: plugins can only be set in the config file or environment", name)
+		}
+	}
+	return nil
+}
+
+// transformChain returns the configured transformers in order, as resolved
+// when cfg was applied, or resolves them now for a config never applied.
+func transformChain(cfg *Config) []bodyTransformer {
+	if cfg != nil && cfg.transformers != nil {
+		return cfg.transformers
+	}
+	return buildTransformChain(cfg)
+}
+
+// buildTransformChain resolves the configured transformers. Entries were
+// validated with the config, so failures here are skipped.
+func buildTransformChain(cfg *Config) []bodyTransformer {
+	names := defaultTransformers
+	if cfg != nil && len(cfg.Transformers) != 0 {
+		names = cfg.Transformers
+	}
+	out := make([]bodyTransformer, 0, len(names))
+	for _, name := range names {
+		if t, err := transformerFor(name); err == nil {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// isTextualType reports whether the lowercased content type ct is a text
+// format external transformers are handed.
+func isTextualType(ct string) bool {
+	return strings.HasPrefix(ct, "text/") || isJavaScriptType(ct) || strings.Contains(ct, "xml") || strings.Contains(ct, "json")
+}
+
+// hookTransformer POSTs text bodies to an external endpoint, which answers
+// 200 with the new body or 204 to keep it. Failures keep the body as is.
+type hookTransformer struct {
+	url string
+}
+
+var transformHookClient = &http.Client{}
+
+func (h hookTransformer) Transform(tc *transformContext, body []byte) ([]byte, bool) {
+	if !isTextualType(tc.ct) {
+		return body, false
+	}
+	timeout := defaultTransformHookTimeoutSeconds
+	if tc.cfg != nil && tc.cfg.TransformHookTimeoutSeconds > 0 {
+		timeout = tc.cfg.TransformHookTimeoutSeconds
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return body, false
+	}
+	req.Header.Set("Content-Type", tc.contentType)
+	req.Header.Set("X-Rerouter-Path", tc.reqPath)
+	if tc.aBase != nil {
+		req.Header.Set("X-Rerouter-A-Base", tc.aBase.Scheme+"://"+tc.aBase.Host)
+	}
+	resp, err := transformHookClient.Do(req)
+	if err != nil {
+		logger.Warnw("transform_hook_error", map[string]interface{}{"err": err.Error(), "hook": h.url, "path": tc.reqPath})
+		return body, false
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return body, false
+	case http.StatusOK:
+		nb, err := io.ReadAll(io.LimitReader(resp.Body, maxTransformHookBytes+1))
+		if err == nil && len(nb) > maxTransformHookBytes {
+			err = fmt.Errorf("response larger than %d bytes", maxTransformHookBytes)
+		}
+		if err != nil {
+			logger.Warnw("transform_hook_error", map[string]interface{}{"err": err.Error(), "hook": h.url, "path": tc.reqPath})
+			return body, false
+		}
+		return nb, !bytes.Equal(nb, body)
+	}
+	logger.Warnw("transform_hook_error", map[string]interface{}{"status": resp.StatusCode, "hook": h.url, "path": tc.reqPath})
+	return body, false
+}
+
+// transformPluginFunc is the Transform symbol a plugin must export.
+type transformPluginFunc = func(reqPath, contentType string, body []byte) ([]byte, bool)
+
+// transformPlugins caches opened plugins by path; Go plugins cannot be unloaded.
+var transformPlugins sync.Map
+
+// loadTransformPlugin opens a Go plugin (go build -buildmode=plugin) that
+// exports Transform as a transformPluginFunc.
+func loadTransformPlugin(path string) (bodyTransformer, error) {
+	if t, ok := transformPlugins.Load(path); ok {
+		return t.(bodyTransformer), nil
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("transformer plugin %q: %w", path, err)
+	}
+	sym, err := p.Lookup("Transform")
+	if err != nil {
+		return nil, fmt.Errorf("transformer plugin %q: %w", path, err)
+	}
+	fn, ok := sym.(transformPluginFunc)
+	if !ok {
+		return nil, fmt.Errorf("transformer plugin %q: Transform must be func(reqPath, contentType string, body []byte) ([]byte, bool)", path)
+	}
+	t := transformFunc(func(tc *transformContext, body []byte) ([]byte, bool) {
+		return fn(tc.reqPath, tc.contentType, body)
+	})
+	transformPlugins.Store(path, t)
+	return t, nil
+}
@@ -0,0 +1,123 @@
+package rerouter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Keywords accepted in cfg.TrustedProxies next to CIDRs and single IPs.
+const (
+	trustedProxyCloudflare = "cloudflare"
+	trustedProxyPrivate    = "private"
+)
+
+// cloudflareRanges are Cloudflare's published edge ranges
+// (https://www.cloudflare.com/ips/).
+var cloudflareRanges = []string{
+	"173.245.48.0/20", "103.21.244.0/22", "103.22.200.0/22", "103.31.4.0/22",
+	"141.101.64.0/18", "108.162.192.0/18", "190.93.240.0/20", "188.114.96.0/20",
+	"197.234.240.0/22", "198.41.128.0/17", "162.158.0.0/15", "104.16.0.0/13",
+	"104.24.0.0/14", "172.64.0.0/13", "131.0.72.0/22",
+	"2400:cb00::/32", "2606:4700::/32", "2803:f800::/32", "2405:b500::/32",
+	"2405:8100::/32", "2a06:98c0::/29", "2c0f:f248::/32",
+}
+
+// privateRanges cover load balancers and sidecars on the local network.
+var privateRanges = []string{
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7",
+}
+
+// trustedProxy reports whether ip is one of cfg's trusted proxies, the peers
+// whose X-Forwarded-For and X-Forwarded-Proto headers are believed.
+func trustedProxy(cfg *Config, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range cfg.trustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses CIDRs, single IPs and the "cloudflare" and
+// "private" keywords.
+func parseTrustedProxies(items []string) ([]*net.IPNet, error) {
+	var expanded []string
+	for _, s := range items {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case trustedProxyCloudflare:
+			expanded = append(expanded, cloudflareRanges...)
+		case trustedProxyPrivate:
+			expanded = append(expanded, privateRanges...)
+		default:
+			expanded = append(expanded, s)
+		}
+	}
+	return parseCIDRList(expanded)
+}
+
+// loadTrustedProxies parses cfg.TrustedProxies into cfg. On error no proxy
+// is trusted.
+func loadTrustedProxies(cfg *Config) error {
+	nets, err := parseTrustedProxies(cfg.TrustedProxies)
+	cfg.trustedProxyNets = nets
+	return err
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// forwardedHeadersTrusted reports whether r's X-Forwarded-* headers come
+// from a proxy we trust: with TrustedProxies only when the peer is one of
+// them, otherwise per TrustXForwardedFor.
+func forwardedHeadersTrusted(cfg *Config, r *http.Request) bool {
+	if len(cfg.trustedProxyNets) != 0 {
+		return trustedProxy(cfg, net.ParseIP(peerIP(r)))
+	}
+	return cfg.TrustXForwardedFor
+}
+
+// trustedClientIP walks X-Forwarded-For from the peer leftwards past the
+// trusted proxies and returns the first address that is not one, i.e. the
+// client as the outermost trusted proxy saw it. An untrusted peer is the
+// client itself.
+func trustedClientIP(cfg *Config, r *http.Request) string {
+	ip := peerIP(r)
+	chain := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(chain) - 1; i >= 0 && trustedProxy(cfg, net.ParseIP(ip)); i-- {
+		hop := strings.TrimSpace(chain[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// forwardedProto returns the scheme the client used per X-Forwarded-Proto,
+// taking the first (client-side) value of a chain, or "" when absent or invalid.
+func forwardedProto(r *http.Request) string {
+	p, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	switch p = strings.ToLower(strings.TrimSpace(p)); p {
+	case "http", "https":
+		return p
+	}
+	return ""
+}
+
+// accessRemote is the remote logged for r: the client behind trusted
+// proxies when TrustedProxies is set, else the peer address.
+func accessRemote(cfg *Config, r *http.Request) string {
+	if len(cfg.trustedProxyNets) == 0 {
+		return r.RemoteAddr
+	}
+	return trustedClientIP(cfg, r)
+}
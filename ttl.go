@@ -1,32 +1,195 @@
-package main
+package rerouter
 
-import "strings"
+import (
+    "net/http"
+    "regexp"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
 
-// cacheTTLForPath returns the TTL seconds for a given request path based on config rules.
+// cacheTTLForPath returns the TTL seconds for a 200 response on a given request path based on config rules.
 // Rules are evaluated in order; first match wins. Falls back to global CacheTTLSeconds.
 func cacheTTLForPath(cfg *Config, reqPath string) int {
-    if cfg == nil {
-        return 0
-    }
-    if len(cfg.CacheTTLRules) > 0 {
-        for _, r := range cfg.CacheTTLRules {
-            pat := r.Pattern
-            if strings.HasPrefix(pat, "*.") || strings.HasPrefix(pat, ".") {
-                // Extension/suffix pattern (case-insensitive)
-                suf := strings.TrimPrefix(pat, "*.")
-                suf = strings.TrimPrefix(suf, ".")
-                if strings.HasSuffix(strings.ToLower(reqPath), strings.ToLower("."+suf)) {
-                    if r.TTLSeconds > 0 { return r.TTLSeconds }
-                }
-                continue
-            }
-            if patternsMatch([]string{pat}, reqPath) {
-                if r.TTLSeconds > 0 { return r.TTLSeconds }
+    ttl, _ := cacheTTLFor(cfg, reqPath, http.StatusOK, nil)
+    return ttl
+}
+
+// cacheTTLFor returns the TTL seconds for an upstream response and whether it should be cached.
+// Rules are evaluated in order; first match wins. Rules without a status only apply to 200
+// responses, and non-200 responses are cached only when a status rule matches. Responses
+// carrying one of cfg.CacheBypassResponse's markers are never cached.
+func cacheTTLFor(cfg *Config, reqPath string, status int, h http.Header) (int, bool) {
+    if cfg == nil || responseBypassReason(cfg, h) != "" {
+        return 0, false
+    }
+    for _, r := range cfg.CacheTTLRules {
+        if !r.matches(reqPath, status) {
+            continue
+        }
+        if r.RespectCacheControl || cfg.CacheRespectCacheControl {
+            if ttl, ok, found := originCacheTTL(cfg, h); found {
+                return ttl, ok
             }
         }
+        if r.TTLSeconds > 0 { return r.TTLSeconds, true }
+    }
+    if status != http.StatusOK {
+        return 0, false
+    }
+    if cfg.CacheRespectCacheControl {
+        if ttl, ok, found := originCacheTTL(cfg, h); found {
+            return ttl, ok
+        }
     }
     if cfg.CacheTTLSeconds > 0 {
-        return cfg.CacheTTLSeconds
+        return cfg.CacheTTLSeconds, true
+    }
+    return 0, true
+}
+
+func (r TTLRule) matches(reqPath string, status int) bool {
+    if r.Pattern == "" && r.Regex == "" && r.Status == "" {
+        return false
+    }
+    if !statusMatches(r.Status, status) {
+        return false
+    }
+    if pat := r.Pattern; pat != "" {
+        if strings.HasPrefix(pat, "*.") || strings.HasPrefix(pat, ".") {
+            // Extension/suffix pattern (case-insensitive)
+            suf := strings.TrimPrefix(pat, "*.")
+            suf = strings.TrimPrefix(suf, ".")
+            if !strings.HasSuffix(strings.ToLower(reqPath), strings.ToLower("."+suf)) {
+                return false
+            }
+        } else if !patternsMatch([]string{pat}, reqPath) {
+            return false
+        }
+    }
+    if r.Regex != "" {
+        re, err := compileTTLRegex(r.Regex)
+        if err != nil || !re.MatchString(reqPath) {
+            return false
+        }
+    }
+    return true
+}
+
+// statusMatches checks status against a comma-separated list of codes or classes
+// like "404,410" or "4xx". An empty list matches 200 only.
+func statusMatches(spec string, status int) bool {
+    if strings.TrimSpace(spec) == "" {
+        return status == http.StatusOK
+    }
+    code := strconv.Itoa(status)
+    for _, s := range strings.Split(spec, ",") {
+        s = strings.ToLower(strings.TrimSpace(s))
+        if s == code {
+            return true
+        }
+        if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] == code[0] {
+            return true
+        }
+    }
+    return false
+}
+
+// originCacheTTL applies the origin's caching headers: no-store and private
+// forbid caching, otherwise the TTL of originTTL is bounded by
+// CacheTTLMinSeconds/CacheTTLMaxSeconds. found is false when h says nothing.
+func originCacheTTL(cfg *Config, h http.Header) (ttl int, ok, found bool) {
+    if cacheControlNoStore(h) {
+        return 0, false, true
+    }
+    ttl, found = originTTL(h)
+    if !found {
+        return 0, false, false
+    }
+    if ttl < cfg.CacheTTLMinSeconds {
+        ttl = cfg.CacheTTLMinSeconds
+    }
+    if cfg.CacheTTLMaxSeconds > 0 && ttl > cfg.CacheTTLMaxSeconds {
+        ttl = cfg.CacheTTLMaxSeconds
+    }
+    return ttl, ttl > 0, true
+}
+
+// originTTL returns the TTL the origin gives in h: s-maxage or max-age from
+// Cache-Control, else Expires relative to Date (or now). An unparsable
+// Expires, such as "0", means already expired.
+func originTTL(h http.Header) (int, bool) {
+    if maxAge, ok := cacheControlMaxAge(h); ok {
+        return maxAge, true
+    }
+    if h == nil || h.Get("Expires") == "" {
+        return 0, false
+    }
+    exp, err := http.ParseTime(h.Get("Expires"))
+    if err != nil {
+        return 0, true
+    }
+    now := time.Now()
+    if d, err := http.ParseTime(h.Get("Date")); err == nil {
+        now = d
+    }
+    if secs := int(exp.Sub(now) / time.Second); secs > 0 {
+        return secs, true
+    }
+    return 0, true
+}
+
+// cacheControlNoStore reports whether h forbids a shared cache from storing
+// the response: Cache-Control no-store or private.
+func cacheControlNoStore(h http.Header) bool {
+    if h == nil {
+        return false
+    }
+    for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+        k, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+        switch strings.ToLower(k) {
+        case "no-store", "private":
+            return true
+        }
+    }
+    return false
+}
+
+// cacheControlMaxAge returns s-maxage, or max-age, from the Cache-Control header.
+func cacheControlMaxAge(h http.Header) (int, bool) {
+    if h == nil {
+        return 0, false
+    }
+    maxAge, found := 0, false
+    for _, d := range strings.Split(h.Get("Cache-Control"), ",") {
+        k, v, _ := strings.Cut(strings.TrimSpace(d), "=")
+        k = strings.ToLower(k)
+        if k != "s-maxage" && k != "max-age" {
+            continue
+        }
+        n, err := strconv.Atoi(strings.Trim(v, `"`))
+        if err != nil || n < 0 {
+            continue
+        }
+        if k == "s-maxage" {
+            return n, true
+        }
+        maxAge, found = n, true
+    }
+    return maxAge, found
+}
+
+var ttlRegexCache sync.Map // pattern -> *regexp.Regexp
+
+func compileTTLRegex(expr string) (*regexp.Regexp, error) {
+    if re, ok := ttlRegexCache.Load(expr); ok {
+        return re.(*regexp.Regexp), nil
+    }
+    re, err := regexp.Compile(expr)
+    if err != nil {
+        return nil, err
     }
-    return 0
+    ttlRegexCache.Store(expr, re)
+    return re, nil
 }
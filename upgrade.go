@@ -0,0 +1,222 @@
+package rerouter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rerouter/logger"
+)
+
+// A binary upgrade starts the current executable again with the bound
+// listeners as inherited file descriptors: fd 3 is a pipe the new process
+// writes to once it serves, the listeners follow from fd 4 in the order of
+// upgradeListenersEnv (their listenerSpec strings, newline-separated).
+const (
+	upgradeListenersEnv = "REROUTER_UPGRADE_LISTENERS"
+	upgradeReadyFD      = 3
+	parentExitPoll      = 500 * time.Millisecond
+	// handoverGrace lets connections accepted just before the handover send
+	// their request: http.Server.Shutdown drops connections it has not read a
+	// request from yet.
+	handoverGrace = time.Second
+)
+
+var errUpgradeInProgress = errors.New("upgrade already in progress")
+
+// inheritedListeners returns the listeners handed over by the process that
+// started this one, keyed by listenerSpec string, and the pipe to report
+// readiness on. Both are nil when this process was not started by an upgrade.
+// It consumes the handover: later calls return nothing.
+func inheritedListeners() (map[string]net.Listener, *os.File, error) {
+	v, ok := os.LookupEnv(upgradeListenersEnv)
+	if !ok {
+		return nil, nil, nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+	ready := os.NewFile(upgradeReadyFD, "upgrade-ready")
+	var specs []string
+	if v != "" {
+		specs = strings.Split(v, "\n")
+	}
+	files := make([]*os.File, len(specs))
+	for i := range specs {
+		files[i] = os.NewFile(uintptr(upgradeReadyFD+1+i), "listener-"+strconv.Itoa(i))
+	}
+	lns, err := listenersFromFiles(specs, files)
+	return lns, ready, err
+}
+
+// listenersFromFiles turns inherited socket files into listeners keyed by
+// spec. The files are closed; the listeners hold their own descriptors.
+func listenersFromFiles(specs []string, files []*os.File) (map[string]net.Listener, error) {
+	out := map[string]net.Listener{}
+	var firstErr error
+	for i, f := range files {
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("inherited listener %s: %w", specs[i], err)
+			}
+			continue
+		}
+		out[specs[i]] = ln
+	}
+	return out, firstErr
+}
+
+// listenerFile returns a duplicate of the socket descriptor behind ln.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	fl, ok := ln.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("listener %T cannot be handed over", ln)
+	}
+	return fl.File()
+}
+
+// Upgrade starts the current executable (usually just replaced on disk) with
+// the same arguments and environment, hands it the bound listeners and waits
+// until it serves on them. On success the caller shuts this Server down:
+// connections queued on the shared sockets go to whichever process accepts
+// them, so none are refused in between. When the new process fails to start
+// serving before ctx ends it is killed and this one carries on.
+func (s *Server) Upgrade(ctx context.Context) error {
+	if !s.upgrading.TryLock() {
+		return errUpgradeInProgress
+	}
+	defer s.upgrading.Unlock()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files := []*os.File{w}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	specs := make([]string, 0, len(s.listeners))
+	for _, ls := range s.listeners {
+		f, err := listenerFile(ls.raw)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		specs = append(specs, ls.spec.String())
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeListenersEnv+"="+strings.Join(specs, "\n"))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start %s: %w", exe, err)
+	}
+	// Our copy of the write end must go, so a child that dies reads as EOF.
+	w.Close()
+	logger.Infow("upgrade_started", map[string]interface{}{"pid": cmd.Process.Pid, "exe": exe})
+
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, err := r.Read(b)
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+		if err != nil {
+			err = fmt.Errorf("new process exited before serving: %w", err)
+		}
+	case <-ctx.Done():
+		err = fmt.Errorf("new process not serving in time: %w", ctx.Err())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	logger.Infow("upgrade_ready", map[string]interface{}{"pid": cmd.Process.Pid})
+	cmd.Process.Release()
+	// Stop accepting: new connections now all go to the new process
+	s.handedOver.Store(true)
+	s.keepSocketFiles()
+	for _, ls := range s.listeners {
+		ls.ln.Close()
+	}
+	return nil
+}
+
+// notifyUpgradeReady tells the process that started this one in an upgrade
+// that it can drain and exit.
+func (s *Server) notifyUpgradeReady() {
+	if s.upgradeReady == nil {
+		return
+	}
+	if _, err := s.upgradeReady.Write([]byte{1}); err != nil {
+		logger.Warnw("upgrade_notify_error", map[string]interface{}{"err": err.Error()})
+	}
+	s.upgradeReady.Close()
+	s.upgradeReady = nil
+}
+
+// waitForParentExit returns once the process ppid, which started this one,
+// has exited and this process was reparented.
+func waitForParentExit(ppid int) {
+	for os.Getppid() == ppid {
+		time.Sleep(parentExitPoll)
+	}
+}
+
+// writePIDFile records this process in cfg.PidFile.
+func writePIDFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// removePIDFile removes cfg.PidFile unless a newer process has taken it over.
+func removePIDFile(path string) {
+	if path == "" {
+		return
+	}
+	if b, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(b)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
+
+// upgradeState is the binary upgrade bookkeeping of a Server.
+type upgradeState struct {
+	// Listeners handed over by the previous process, consumed by Start.
+	inherited map[string]net.Listener
+	// Pipe to report readiness to the previous process on.
+	upgradeReady *os.File
+	upgrading    sync.Mutex
+	// Set once a new process took over the listeners.
+	handedOver atomic.Bool
+}
+
+// keepSocketFiles stops closing the listeners from removing unix socket files
+// the new process now serves on.
+func (s *Server) keepSocketFiles() {
+	for _, ls := range s.listeners {
+		if ul, ok := ls.raw.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package rerouter
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpstreamMapping routes requests for an A host (and optional path prefix) to a B site.
+// The path prefix only selects the upstream; the request path is forwarded unchanged.
+type UpstreamMapping struct {
+	// A-site host to match, e.g. a.example.com. Empty matches any host.
+	Host string `json:"host"`
+	// Optional path prefix to match, e.g. /shop/.
+	PathPrefix string `json:"path_prefix"`
+	// Base URL for the B site serving this mapping.
+	BBaseURL string `json:"b_base_url"`
+	// Optional A-site base URL used for link rewriting. Derived from the request if empty.
+	ABaseURL string `json:"a_base_url"`
+	// Optional Host header and TLS server name sent to this B site instead of
+	// the ones in BBaseURL (see Config.UpstreamHostHeader).
+	HostHeader    string `json:"host_header,omitempty"`
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// Optional credentials for this B site (Config.UpstreamAuth only covers B_BASE_URL).
+	Auth *UpstreamAuth `json:"auth,omitempty"`
+}
+
+// parseUpstreamMappings parses "host[/prefix]=b_base_url" entries separated by commas.
+func parseUpstreamMappings(v string) ([]UpstreamMapping, error) {
+	out := []UpstreamMapping{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid upstream mapping %q", p)
+		}
+		m := UpstreamMapping{BBaseURL: strings.TrimSpace(kv[1])}
+		sel := strings.TrimSpace(kv[0])
+		if i := strings.Index(sel, "/"); i != -1 {
+			m.Host, m.PathPrefix = sel[:i], sel[i:]
+		} else {
+			m.Host = sel
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// matchUpstream returns the first mapping matching the request host and path.
+func matchUpstream(cfg *Config, host, reqPath string) (UpstreamMapping, bool) {
+	for _, m := range cfg.Upstreams {
+		if m.Host != "" && !strings.EqualFold(stripPort(m.Host), stripPort(host)) {
+			continue
+		}
+		if m.PathPrefix != "" && !strings.HasPrefix(reqPath, m.PathPrefix) {
+			continue
+		}
+		return m, true
+	}
+	return UpstreamMapping{}, false
+}
+
+// upstreamConfigForRequest returns cfg with BBaseURL/ABaseURL replaced by the
+// upstream mapping matching r. cfg is returned unchanged when nothing matches.
+func upstreamConfigForRequest(cfg *Config, r *http.Request) *Config {
+	if len(cfg.Upstreams) == 0 {
+		return cfg
+	}
+	m, ok := matchUpstream(cfg, r.Host, r.URL.Path)
+	if !ok {
+		return cfg
+	}
+	return withUpstreamMapping(cfg, m)
+}
+
+// upstreamForBHost returns cfg scoped to the mapping whose B site host is bHost.
+func upstreamForBHost(cfg *Config, bHost string) (*Config, bool) {
+	if u, err := url.Parse(cfg.BBaseURL); err == nil && strings.EqualFold(u.Host, bHost) {
+		return cfg, true
+	}
+	for _, m := range cfg.Upstreams {
+		u, err := url.Parse(m.BBaseURL)
+		if err != nil || !strings.EqualFold(u.Host, bHost) {
+			continue
+		}
+		return withUpstreamMapping(cfg, m), true
+	}
+	return cfg, false
+}
+
+// withUpstreamMapping returns a copy of cfg scoped to the B site of m.
+func withUpstreamMapping(cfg *Config, m UpstreamMapping) *Config {
+	c := *cfg
+	c.BBaseURL = m.BBaseURL
+	if m.ABaseURL != "" {
+		c.ABaseURL = m.ABaseURL
+	}
+	c.UpstreamHostHeader, c.UpstreamTLSServerName = m.HostHeader, m.TLSServerName
+	c.UpstreamAuth = m.Auth
+	return &c
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
@@ -0,0 +1,129 @@
+package rerouter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamLimiter caps concurrent outbound fetches and their request rate.
+// One limiter is shared by every client that talks to the B sites.
+type upstreamLimiter struct {
+	sem chan struct{} // nil means unlimited concurrency
+
+	mu       sync.Mutex
+	interval time.Duration // 0 means unlimited rate
+	burst    float64
+	tokens   float64
+	last     time.Time
+}
+
+func newUpstreamLimiter(maxConcurrent int, maxRPS float64) *upstreamLimiter {
+	l := &upstreamLimiter{}
+	if maxConcurrent > 0 {
+		l.sem = make(chan struct{}, maxConcurrent)
+	}
+	if maxRPS > 0 {
+		l.interval = time.Duration(float64(time.Second) / maxRPS)
+		l.burst = maxRPS
+		if l.burst < 1 {
+			l.burst = 1
+		}
+		l.tokens = l.burst
+		l.last = time.Now()
+	}
+	return l
+}
+
+// acquire blocks until a concurrency slot and a rate token are available.
+// The returned release func must be called once the fetch is finished.
+func (l *upstreamLimiter) acquire(ctx context.Context) (release func(), err error) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	release = func() {
+		if l.sem != nil {
+			<-l.sem
+		}
+	}
+	if err := l.waitToken(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+func (l *upstreamLimiter) waitToken(ctx context.Context) error {
+	if l.interval == 0 {
+		return nil
+	}
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - l.tokens) * float64(l.interval))
+		l.mu.Unlock()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// limitedTransport applies an upstreamLimiter to every round trip. The
+// concurrency slot is held until the response body is closed.
+type limitedTransport struct {
+	lim  *upstreamLimiter
+	base http.RoundTripper
+}
+
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if t.lim == nil {
+		return base.RoundTrip(req)
+	}
+	release, err := t.lim.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &releaseOnClose{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type releaseOnClose struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
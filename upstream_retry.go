@@ -0,0 +1,206 @@
+package rerouter
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rerouter/logger"
+)
+
+const (
+	defaultUpstreamBreakerCooldownSeconds = 30
+	// maxUpstreamRetryBackoff caps the exponential backoff between attempts.
+	maxUpstreamRetryBackoff = 5 * time.Second
+)
+
+// errCircuitOpen is returned for fetches to a B host whose circuit breaker is
+// open; they fail at once instead of waiting on an origin known to be down.
+var errCircuitOpen = errors.New("upstream circuit open")
+
+// Circuit breaker states.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// hostBreaker tracks consecutive failures of one B host. After threshold
+// failures it opens for the cooldown, then lets a single probe through
+// (half-open): success closes it, failure opens it again.
+type hostBreaker struct {
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// allow reports whether a fetch may go out now.
+func (b *hostBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = false
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// record notes the outcome of a fetch and reports whether it tripped the
+// breaker.
+func (b *hostBreaker) record(ok bool, threshold int, cooldown time.Duration, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if ok {
+		b.state, b.failures = breakerClosed, 0
+		return false
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (threshold > 0 && b.failures >= threshold) {
+		b.state, b.openUntil = breakerOpen, now.Add(cooldown)
+		return true
+	}
+	return false
+}
+
+func (b *hostBreaker) snapshot() (string, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return breakerClosed, b.failures
+	}
+	return b.state, b.failures
+}
+
+// resilientTransport retries idempotent fetches that fail transiently, with
+// exponential backoff, and keeps a circuit breaker per B host. Settings are
+// read from the live config on every request so reloads apply.
+type resilientTransport struct {
+	base http.RoundTripper
+	cfg  func() *Config
+
+	breakers sync.Map // host -> *hostBreaker
+	retries  atomic.Int64
+	trips    atomic.Int64
+}
+
+func (t *resilientTransport) breaker(host string) *hostBreaker {
+	b, _ := t.breakers.LoadOrStore(strings.ToLower(host), &hostBreaker{})
+	return b.(*hostBreaker)
+}
+
+// transientUpstreamStatus reports whether status suggests the origin or a
+// proxy in front of it is briefly unavailable.
+func transientUpstreamStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func idempotentMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := t.cfg()
+	attempts := 1
+	if idempotentMethod(req.Method) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil) {
+		attempts += max(cfg.UpstreamRetries, 0)
+	}
+	cooldown := time.Duration(cfg.UpstreamBreakerCooldownSeconds) * time.Second
+	if cooldown <= 0 {
+		cooldown = defaultUpstreamBreakerCooldownSeconds * time.Second
+	}
+	br := t.breaker(req.URL.Host)
+	for i := 0; ; i++ {
+		if cfg.UpstreamBreakerThreshold > 0 && !br.allow(time.Now()) {
+			return nil, errCircuitOpen
+		}
+		resp, err := t.base.RoundTrip(req)
+		failed := err != nil || transientUpstreamStatus(resp.StatusCode)
+		if cfg.UpstreamBreakerThreshold > 0 && br.record(!failed, cfg.UpstreamBreakerThreshold, cooldown, time.Now()) {
+			t.trips.Add(1)
+			logger.Warnw("upstream_circuit_open", map[string]interface{}{"host": req.URL.Host, "cooldown_seconds": int(cooldown / time.Second)})
+		}
+		if !failed || i+1 >= attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		t.retries.Add(1)
+		fields := map[string]interface{}{"url": req.URL.String(), "attempt": i + 2}
+		if err != nil {
+			fields["err"] = err.Error()
+		} else {
+			fields["status"] = resp.StatusCode
+		}
+		logger.Debugw("upstream_retry", fields)
+		timer := time.NewTimer(upstreamRetryBackoff(cfg, i))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// upstreamRetryBackoff is the wait before retry n+1: the base delay doubled per
+// retry, capped, with up to half of it randomized so clients do not retry in
+// lockstep.
+func upstreamRetryBackoff(cfg *Config, n int) time.Duration {
+	if cfg.UpstreamRetryBackoffMs <= 0 {
+		return 0
+	}
+	d := time.Duration(cfg.UpstreamRetryBackoffMs) * time.Millisecond << min(n, 16)
+	if d <= 0 || d > maxUpstreamRetryBackoff {
+		d = maxUpstreamRetryBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// metrics reports breaker states and retry counters for the periodic
+// system_metrics log line.
+func (t *resilientTransport) metrics() map[string]interface{} {
+	hosts := map[string]interface{}{}
+	open := 0
+	t.breakers.Range(func(k, v interface{}) bool {
+		state, failures := v.(*hostBreaker).snapshot()
+		if state != breakerClosed {
+			open++
+		}
+		hosts[k.(string)] = map[string]interface{}{"state": state, "failures": failures}
+		return true
+	})
+	return map[string]interface{}{
+		"upstream_retries":         t.retries.Load(),
+		"upstream_circuit_trips":   t.trips.Load(),
+		"upstream_circuits_open":   open,
+		"upstream_circuit_breaker": hosts,
+	}
+}
@@ -0,0 +1,155 @@
+package rerouter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for the upstream client settings left at 0.
+const (
+	defaultUpstreamTimeoutSeconds     = 15
+	defaultSitemapFetchTimeoutSeconds = 30
+	defaultUpstreamConnectTimeout     = 30 * time.Second
+	defaultUpstreamTLSTimeout         = 10 * time.Second
+)
+
+// upstreamTimeout is the total time allowed for a bot or prefetch fetch.
+func upstreamTimeout(cfg *Config) time.Duration {
+	return secondsOr(cfg.UpstreamTimeoutSeconds, defaultUpstreamTimeoutSeconds*time.Second)
+}
+
+// sitemapFetchTimeout is the total time allowed for a sitemap or crawl fetch.
+func sitemapFetchTimeout(cfg *Config) time.Duration {
+	return secondsOr(cfg.SitemapFetchTimeoutSeconds, defaultSitemapFetchTimeoutSeconds*time.Second)
+}
+
+func secondsOr(n int, def time.Duration) time.Duration {
+	if n <= 0 {
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// newUpstreamTransport builds the transport every B-site client sits on, from
+// the UPSTREAM_* connection, pool, proxy and TLS settings. Unset values keep
+// http.DefaultTransport's behaviour, including proxies from the environment.
+func newUpstreamTransport(cfg *Config) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   secondsOr(cfg.UpstreamConnectTimeoutSeconds, defaultUpstreamConnectTimeout),
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.TLSHandshakeTimeout = secondsOr(cfg.UpstreamTLSTimeoutSeconds, defaultUpstreamTLSTimeout)
+	t.ResponseHeaderTimeout = time.Duration(cfg.UpstreamHeaderTimeoutSeconds) * time.Second
+	if cfg.UpstreamMaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = cfg.UpstreamMaxIdleConnsPerHost
+		t.MaxIdleConns = max(t.MaxIdleConns, cfg.UpstreamMaxIdleConnsPerHost)
+	}
+	if cfg.UpstreamProxyURL != "" {
+		u, err := url.Parse(cfg.UpstreamProxyURL)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return nil, fmt.Errorf("upstream proxy URL %q must be http(s):// or socks5:// with a host", cfg.UpstreamProxyURL)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if cfg.UpstreamCAFile != "" || cfg.UpstreamInsecureSkipVerify {
+		tc := &tls.Config{InsecureSkipVerify: cfg.UpstreamInsecureSkipVerify}
+		if cfg.UpstreamCAFile != "" {
+			pem, err := os.ReadFile(cfg.UpstreamCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("upstream CA file: %w", err)
+			}
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("upstream CA file %q holds no PEM certificates", cfg.UpstreamCAFile)
+			}
+			tc.RootCAs = pool
+		}
+		t.TLSClientConfig = tc
+	}
+	return t, nil
+}
+
+// upstreamHostOverride is the Host header and TLS server name presented to
+// one B site in place of those of its URL.
+type upstreamHostOverride struct {
+	host       string
+	serverName string
+}
+
+// upstreamHostOverrides maps the URL host of each B site (BBaseURL and the
+// UPSTREAMS mappings) to its configured overrides.
+func upstreamHostOverrides(cfg *Config) map[string]upstreamHostOverride {
+	out := map[string]upstreamHostOverride{}
+	add := func(base, host, serverName string) {
+		if host == "" && serverName == "" {
+			return
+		}
+		if u, err := url.Parse(base); err == nil && u.Host != "" {
+			out[strings.ToLower(u.Host)] = upstreamHostOverride{host: host, serverName: serverName}
+		}
+	}
+	for _, m := range cfg.Upstreams {
+		add(m.BBaseURL, m.HostHeader, m.TLSServerName)
+	}
+	add(cfg.BBaseURL, cfg.UpstreamHostHeader, cfg.UpstreamTLSServerName)
+	return out
+}
+
+func validateUpstreamHostOverride(v string) error {
+	if v != "" && (strings.ContainsAny(v, "/ \t@") || strings.Contains(v, "://")) {
+		return fmt.Errorf("upstream host override %q must be a bare host name", v)
+	}
+	return nil
+}
+
+// hostOverrideTransport sends requests for B sites with their configured
+// Host header and TLS server name, e.g. to fetch an origin by IP while
+// presenting the production hostname. Other hosts pass through unchanged.
+type hostOverrideTransport struct {
+	base *http.Transport
+	cfg  func() *Config
+
+	bySNI sync.Map // server name -> *http.Transport
+}
+
+func (t *hostOverrideTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	o, ok := upstreamHostOverrides(t.cfg())[strings.ToLower(req.URL.Host)]
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if o.host != "" {
+		req = req.Clone(req.Context())
+		req.Host = o.host
+	}
+	if o.serverName == "" || req.URL.Scheme != "https" {
+		return t.base.RoundTrip(req)
+	}
+	return t.sniTransport(o.serverName).RoundTrip(req)
+}
+
+// sniTransport returns a copy of the base transport, with its own connection
+// pool, that verifies and presents serverName.
+func (t *hostOverrideTransport) sniTransport(serverName string) *http.Transport {
+	if tr, ok := t.bySNI.Load(serverName); ok {
+		return tr.(*http.Transport)
+	}
+	tr := t.base.Clone()
+	if tr.TLSClientConfig == nil {
+		tr.TLSClientConfig = &tls.Config{}
+	}
+	tr.TLSClientConfig.ServerName = serverName
+	v, _ := t.bySNI.LoadOrStore(serverName, tr)
+	return v.(*http.Transport)
+}
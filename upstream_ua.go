@@ -0,0 +1,98 @@
+package rerouter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Upstream User-Agent modes: send UpstreamUserAgent for everything, pass the
+// client's own UA through, or pick one per bot family.
+const (
+	upstreamUAFixed       = "fixed"
+	upstreamUAPassthrough = "passthrough"
+	upstreamUAFamily      = "family"
+)
+
+// Pseudo families for UpstreamUAFamilies: clients not in verifiableCrawlers,
+// and fetches no client is waiting on (prefetch, sitemap warming, crawls).
+const (
+	uaFamilyOther      = "other"
+	uaFamilyBackground = "background"
+)
+
+func validUpstreamUAMode(m string) bool {
+	switch m {
+	case "", upstreamUAFixed, upstreamUAPassthrough, upstreamUAFamily:
+		return true
+	}
+	return false
+}
+
+// parseUAFamilies parses "family=User-Agent" entries separated by "|", since
+// User-Agent strings contain commas and semicolons.
+func parseUAFamilies(v string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, p := range strings.Split(v, "|") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		fam, ua, ok := strings.Cut(p, "=")
+		if !ok || strings.TrimSpace(ua) == "" {
+			return nil, fmt.Errorf("invalid upstream UA family %q (want family=User-Agent)", p)
+		}
+		out[strings.ToLower(strings.TrimSpace(fam))] = strings.TrimSpace(ua)
+	}
+	return out, nil
+}
+
+func validateUAFamilies(m map[string]string) error {
+	for fam := range m {
+		if fam == uaFamilyOther || fam == uaFamilyBackground {
+			continue
+		}
+		known := false
+		for _, c := range verifiableCrawlers {
+			known = known || c.family == fam
+		}
+		if !known {
+			return fmt.Errorf("unknown upstream UA family %q", fam)
+		}
+	}
+	return nil
+}
+
+// uaFamily names the bot family of a client User-Agent.
+func uaFamily(ua string) string {
+	if c, ok := claimedCrawler(strings.ToLower(ua)); ok {
+		return c.family
+	}
+	return uaFamilyOther
+}
+
+// upstreamUserAgent is the User-Agent sent to B for a fetch made on behalf of
+// r, or nil for background fetches, under cfg.UpstreamUAMode.
+func upstreamUserAgent(cfg *Config, r *http.Request) string {
+	switch cfg.UpstreamUAMode {
+	case upstreamUAPassthrough:
+		if r != nil && r.Header.Get("User-Agent") != "" {
+			return r.Header.Get("User-Agent")
+		}
+		if ua := cfg.UpstreamUAFamilies[uaFamilyBackground]; ua != "" {
+			return ua
+		}
+	case upstreamUAFamily:
+		fam := uaFamilyBackground
+		if r != nil {
+			fam = uaFamily(r.Header.Get("User-Agent"))
+		}
+		if ua := cfg.UpstreamUAFamilies[fam]; ua != "" {
+			return ua
+		}
+	}
+	if cfg.UpstreamUserAgent == "" {
+		return defaultUpstreamUserAgent
+	}
+	return cfg.UpstreamUserAgent
+}
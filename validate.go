@@ -0,0 +1,166 @@
+package rerouter
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const validateUpstreamTimeout = 5 * time.Second
+
+// validateReport collects the results of rerouter -validate.
+type validateReport struct {
+	w            io.Writer
+	fails, warns int
+}
+
+func (r *validateReport) add(level, check, detail string) {
+	switch level {
+	case "FAIL":
+		r.fails++
+	case "WARN":
+		r.warns++
+	}
+	fmt.Fprintf(r.w, "%-4s  %-22s %s\n", level, check, detail)
+}
+
+// checkURL reports whether v is an absolute http(s) URL.
+func (r *validateReport) checkURL(check, v string) {
+	u, err := url.Parse(v)
+	switch {
+	case err != nil:
+		r.add("FAIL", check, err.Error())
+	case u.Scheme != "http" && u.Scheme != "https" || u.Host == "":
+		r.add("FAIL", check, fmt.Sprintf("%q is not an absolute http(s) URL", v))
+	default:
+		r.add("OK", check, v)
+	}
+}
+
+// checkFile reports whether path is a readable file.
+func (r *validateReport) checkFile(check, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		r.add("FAIL", check, err.Error())
+		return
+	}
+	f.Close()
+	r.add("OK", check, path)
+}
+
+// checkDir creates dir when missing and reports whether it is writable.
+func (r *validateReport) checkDir(check, dir string) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		r.add("FAIL", check, err.Error())
+		return
+	}
+	if c := checkCacheDirWritable(dir); !c.OK {
+		r.add("FAIL", check, c.Error)
+		return
+	}
+	r.add("OK", check, dir)
+}
+
+// Validate writes a report on cfg, or on loadErr when loading it failed,
+// and returns the process exit code: 0 when the config is usable, 1 otherwise.
+// Failing to reach the B site is only a warning, so images can be checked at
+// build time without network access.
+func Validate(w io.Writer, cfg *Config, loadErr error) int {
+	r := &validateReport{w: w}
+	if loadErr != nil {
+		r.add("FAIL", "config", loadErr.Error())
+		fmt.Fprintln(w, "config invalid")
+		return 1
+	}
+	src := "environment only"
+	if _, err := os.Stat(cfg.configPath); err == nil {
+		src = "environment and " + cfg.configPath
+	}
+	r.add("OK", "config", "loaded from "+src+", hash "+configHash(cfg))
+
+	r.checkURL("b_base_url", cfg.BBaseURL)
+	for i, m := range cfg.Upstreams {
+		r.checkURL(fmt.Sprintf("upstreams[%d]", i), m.BBaseURL)
+	}
+	for _, u := range []struct{ check, v string }{
+		{"a_base_url", cfg.ABaseURL},
+		{"static_redirect_url", cfg.StaticRedirectURL},
+		{"render_service_url", cfg.RenderServiceURL},
+	} {
+		if u.v != "" {
+			r.checkURL(u.check, strings.ReplaceAll(u.v, "{url}", ""))
+		}
+	}
+
+	r.checkDir("cache_dir", cfg.CacheDir)
+	if cfg.LogFile != "" {
+		r.checkDir("log_file", filepath.Dir(cfg.LogFile))
+	}
+	if cfg.AccessLogFile != "" {
+		r.checkDir("access_log_file", filepath.Dir(cfg.AccessLogFile))
+	}
+	if cfg.AuditLogFile != "" {
+		r.checkDir("audit_log_file", filepath.Dir(cfg.AuditLogFile))
+	}
+	for _, f := range []struct{ check, path string }{
+		{"tls_cert_file", cfg.TLSCertFile},
+		{"tls_key_file", cfg.TLSKeyFile},
+		{"upstream_ca_file", cfg.UpstreamCAFile},
+		{"bot_ua_file", cfg.BotUAFile},
+		{"bot_allow_cidr_file", cfg.BotAllowCIDRFile},
+		{"robots_txt_file", cfg.RobotsTxtFile},
+	} {
+		if f.path != "" {
+			r.checkFile(f.check, f.path)
+		}
+	}
+	for key, path := range cfg.ErrorPages {
+		r.checkFile("error_pages["+key+"]", path)
+	}
+
+	if !cfg.adminEnabled() {
+		r.add("WARN", "admin_token", "not set; admin endpoints are disabled")
+	}
+	r.checkUpstream(cfg)
+
+	if r.fails > 0 {
+		fmt.Fprintf(w, "config invalid: %d failed, %d warnings\n", r.fails, r.warns)
+		return 1
+	}
+	fmt.Fprintf(w, "config ok: %d warnings\n", r.warns)
+	return 0
+}
+
+// checkUpstream sends a HEAD to the B site through the configured transport
+// (proxy, CA, auth and host overrides).
+func (r *validateReport) checkUpstream(cfg *Config) {
+	base, err := newUpstreamTransport(cfg)
+	if err != nil {
+		r.add("FAIL", "upstream", err.Error())
+		return
+	}
+	liveConfig := func() *Config { return cfg }
+	client := &http.Client{Timeout: validateUpstreamTimeout, Transport: &authTransport{base: &hostOverrideTransport{base: base, cfg: liveConfig}, cfg: liveConfig}}
+	req, err := http.NewRequest(http.MethodHead, cfg.BBaseURL, nil)
+	if err != nil {
+		r.add("FAIL", "upstream", err.Error())
+		return
+	}
+	req.Header.Set("User-Agent", cfg.UpstreamUserAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		r.add("WARN", "upstream", "B site unreachable: "+err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		r.add("WARN", "upstream", fmt.Sprintf("B site returned %d", resp.StatusCode))
+		return
+	}
+	r.add("OK", "upstream", fmt.Sprintf("%s returned %d", cfg.BBaseURL, resp.StatusCode))
+}
@@ -0,0 +1,221 @@
+package rerouter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rerouter/logger"
+)
+
+// maxWebhookBodyBytes caps the payload read by /webhooks/purge.
+const maxWebhookBodyBytes = 1 << 20
+
+// ghostSignatureMaxSkew bounds the age of a Ghost signature's t= timestamp,
+// so a captured request cannot be replayed later.
+const ghostSignatureMaxSkew = 5 * time.Minute
+
+// webhookURLKeys are payload fields holding page URLs in WordPress (link,
+// permalink), Ghost (url, under post.current/previous) and generic payloads.
+var webhookURLKeys = map[string]bool{
+	"url":           true,
+	"urls":          true,
+	"link":          true,
+	"permalink":     true,
+	"canonical_url": true,
+	"post_url":      true,
+}
+
+// shopifyTopicPaths maps X-Shopify-Topic resources to the storefront path of a handle.
+var shopifyTopicPaths = map[string]string{
+	"products":    "/products/",
+	"collections": "/collections/",
+	"pages":       "/pages/",
+}
+
+// verifyWebhookSignature checks the HMAC-SHA256 of body with secret, as sent by
+// Shopify (X-Shopify-Hmac-Sha256, base64), Ghost (X-Ghost-Signature
+// "sha256=<hex>, t=<ts>" over body+ts, ts in Unix milliseconds and within
+// ghostSignatureMaxSkew of now) or generic senders (X-Rerouter-Signature or
+// X-Hub-Signature-256, "sha256=<hex>").
+func verifyWebhookSignature(secret string, h http.Header, body []byte) bool {
+	mac := func(parts ...[]byte) []byte {
+		m := hmac.New(sha256.New, []byte(secret))
+		for _, p := range parts {
+			m.Write(p)
+		}
+		return m.Sum(nil)
+	}
+	hexEqual := func(sig string, sum []byte) bool {
+		got, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(sig), "sha256="))
+		return err == nil && hmac.Equal(got, sum)
+	}
+	if v := h.Get("X-Shopify-Hmac-Sha256"); v != "" {
+		got, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		return err == nil && hmac.Equal(got, mac(body))
+	}
+	if v := h.Get("X-Ghost-Signature"); v != "" {
+		var sig, ts string
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "t=") {
+				ts = f[2:]
+			} else if strings.HasPrefix(f, "sha256=") {
+				sig = f
+			}
+		}
+		ms, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return false
+		}
+		if skew := time.Since(time.UnixMilli(ms)); skew > ghostSignatureMaxSkew || skew < -ghostSignatureMaxSkew {
+			return false
+		}
+		return sig != "" && hexEqual(sig, mac(body, []byte(ts)))
+	}
+	for _, k := range []string{"X-Rerouter-Signature", "X-Hub-Signature-256"} {
+		if v := h.Get(k); v != "" {
+			return hexEqual(v, mac(body))
+		}
+	}
+	return false
+}
+
+// webhookPurgeTargets extracts the B-site URLs affected by a content webhook.
+// URLs found under webhookURLKeys anywhere in the payload are mapped onto the
+// B base by path; Shopify payloads contribute their storefront handle path.
+func webhookPurgeTargets(cfg *Config, h http.Header, body []byte) []string {
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	var paths []string
+	var walk func(v interface{}, key string, depth int)
+	walk = func(v interface{}, key string, depth int) {
+		if depth > 8 {
+			return
+		}
+		switch t := v.(type) {
+		case map[string]interface{}:
+			keys := make([]string, 0, len(t))
+			for k := range t {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				walk(t[k], strings.ToLower(k), depth+1)
+			}
+		case []interface{}:
+			for _, c := range t {
+				walk(c, key, depth+1)
+			}
+		case string:
+			if webhookURLKeys[key] {
+				if p := webhookURLPath(t); p != "" {
+					paths = append(paths, p)
+				}
+			}
+		}
+	}
+	walk(payload, "", 0)
+	if topic := h.Get("X-Shopify-Topic"); topic != "" {
+		resource, _, _ := strings.Cut(topic, "/")
+		if prefix, ok := shopifyTopicPaths[resource]; ok {
+			if m, ok := payload.(map[string]interface{}); ok {
+				if handle, _ := m["handle"].(string); handle != "" {
+					paths = append(paths, prefix+url.PathEscape(handle))
+				}
+			}
+		}
+	}
+	paths = append(paths, cfg.WebhookPurgePaths...)
+	base := strings.TrimRight(cfg.BBaseURL, "/")
+	seen := map[string]bool{}
+	out := []string{}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		if t := base + p; !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// webhookURLPath returns the request URI of an absolute URL or root-relative
+// path, or "" for anything else.
+func webhookURLPath(v string) string {
+	v = strings.TrimSpace(v)
+	u, err := url.Parse(v)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.RequestURI()
+	}
+	if u.Scheme == "" && u.Host == "" && strings.HasPrefix(v, "/") {
+		return u.RequestURI()
+	}
+	return ""
+}
+
+// handleWebhookPurge serves POST /webhooks/purge: it verifies the signature,
+// purges every URL the payload refers to (plus cfg.WebhookPurgePaths) and
+// queues them for rewarming.
+func handleWebhookPurge(cfg *Config, pf *Prefetcher, purges *purgeLog, w http.ResponseWriter, r *http.Request) {
+	if cfg.WebhookSecret == "" {
+		http.Error(w, "webhooks disabled: set WEBHOOK_SECRET", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		http.Error(w, "read error", http.StatusBadRequest)
+		return
+	}
+	if !verifyWebhookSignature(cfg.WebhookSecret, r.Header, body) {
+		logger.Warnw("webhook_signature_invalid", map[string]interface{}{"req_id": getRequestID(r.Context()), "remote": r.RemoteAddr})
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	targets := webhookPurgeTargets(cfg, r.Header, body)
+	res := purgeResult{Files: []string{}}
+	for _, t := range targets {
+		pr, err := doPurge(cfg, t, false, "", nil)
+		if err != nil {
+			continue
+		}
+		res.Deleted += pr.Deleted
+		res.Files = append(res.Files, pr.Files...)
+	}
+	// Rewarm every affected URL, cached or not, so new content is served right away
+	res.RewarmQueued = rewarmPurged(cfg, pf, r, targets)
+	purges.record("webhook", strings.Join(targets, " "), res)
+	logger.Infow("webhook_purge", map[string]interface{}{
+		"req_id":  getRequestID(r.Context()),
+		"urls":    targets,
+		"deleted": res.Deleted,
+		"rewarm":  res.RewarmQueued,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"urls":          targets,
+		"deleted":       res.Deleted,
+		"files":         res.Files,
+		"rewarm_queued": res.RewarmQueued,
+	})
+}